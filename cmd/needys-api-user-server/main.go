@@ -1,13 +1,22 @@
 package main
 
 import (
-  cli      "github.com/urfave/cli/v2"
-  context  "context"
-  internal "github.com/gpenaud/needys-api-user/internal"
-  log      "github.com/sirupsen/logrus"
-  os       "os"
-  signal   "os/signal"
-  syscall  "syscall"
+  cli       "github.com/urfave/cli/v2"
+  context   "context"
+  fmt       "fmt"
+  internal  "github.com/gpenaud/needys-api-user/internal"
+  log       "github.com/sirupsen/logrus"
+  os        "os"
+  filepath  "path/filepath"
+  signal    "os/signal"
+  sort      "sort"
+  strconv   "strconv"
+  syscall   "syscall"
+  strings   "strings"
+  tabwriter "text/tabwriter"
+  time      "time"
+  transfer  "github.com/gpenaud/needys-api-user/internal/transfer"
+  user      "github.com/gpenaud/needys-api-user/internal/user"
 )
 
 // -------------------------------------------------------------------------- //
@@ -16,6 +25,7 @@ import (
 
 var mainLog *log.Entry
 var a        internal.Application
+var app      *cli.App
 
 func init() {
   mainLog = log.WithFields(log.Fields{
@@ -23,10 +33,8 @@ func init() {
     "_type": "system",
   })
 
-  registerConfiguration(&a)
+  app = registerConfiguration(&a)
   registerVersion(&a)
-
-  a.Initialize()
 }
 
 // -------------------------------------------------------------------------- //
@@ -37,6 +45,8 @@ var PossibleOptionValues = map[string][]string{
   "environment": {"development", "integration", "production"},
   "verbosity": {"error", "warning", "info", "debug"},
   "log-format": {"unset", "text", "json"},
+  "database-driver": {"mysql", "postgres", "sqlite", "memory"},
+  "notifier": {"log", "file", "smtp"},
 }
 
 func contains(s []string, str string) bool {
@@ -47,34 +57,78 @@ func contains(s []string, str string) bool {
 	return false
 }
 
-func registerConfiguration(a *internal.Application) {
+// OfflineCommands need neither the storage nor the keyring: "keys generate"
+// creates the keyring file which --encryption.keyring may already point at
+var OfflineCommands = [][]string{
+  {"keys", "generate"},
+}
+
+func isOffline(args []string) bool {
+  for _, command := range OfflineCommands {
+    if len(args) >= len(command) && strings.Join(args[:len(command)], " ") == strings.Join(command, " ") {
+      return true
+    }
+  }
+
+  return false
+}
+
+func registerConfiguration(a *internal.Application) *cli.App {
   a.Config = &internal.Configuration{}
 
-  app := &cli.App{
+  return &cli.App{
+    Name:  "needys-api-user",
+    Usage: "An API micro-service for needys application to manage \"user\" objects",
+    Before: func(c *cli.Context) error {
+      validateConfiguration(a)
+      if !isOffline(c.Args().Slice()) {
+        a.Initialize()
+      }
+      return nil
+    },
     Action: func(c *cli.Context) error {
+      serve(a)
       return nil
     },
+    Commands: registerCommands(a),
     Flags: []cli.Flag{
       &cli.StringFlag{Name: "environment", Aliases: []string{"e"}, Value: "development", Usage: "The current environment `ENV`", Destination: &a.Config.Environment, EnvVars: []string{"NEEDYS_API_USER_ENVIRONMENT"}},
       &cli.StringFlag{Name: "verbosity", Aliases: []string{"v"}, Value: "info", Usage: "Verbosity `LEVEL` for log-level", Destination: &a.Config.Verbosity, EnvVars: []string{"NEEDYS_API_USER_VERBOSITY"}},
       &cli.StringFlag{Name: "log-format", Aliases: []string{"l"}, Value: "unset", Usage: "Log formatter to use `FORMAT`", Destination: &a.Config.LogFormat, EnvVars: []string{"NEEDYS_API_USER_LOG_FORMAT"}},
       &cli.BoolFlag  {Name: "log-healthcheck", Value: false, Usage: "Log healthcheck queries", Destination: &a.Config.LogHealthcheck, EnvVars: []string{"NEEDYS_API_USER_LOG_HEALTHCHECK"}},
+      &cli.StringFlag{Name: "default-region", Value: "FR", Usage: "ISO 3166 `REGION` of the national phone numbers and of the addresses without country", Destination: &a.Config.DefaultRegion, EnvVars: []string{"NEEDYS_API_USER_DEFAULT_REGION"}},
       &cli.StringFlag{Name: "server.host", Value: "127.0.0.1", Usage: "API server host `HOST`", Destination: &a.Config.Server.Host, EnvVars: []string{"NEEDYS_API_USER_SERVER_HOST"}},
       &cli.StringFlag{Name: "server.port", Value: "8010", Usage: "API server port `PORT`", Destination: &a.Config.Server.Port, EnvVars: []string{"NEEDYS_API_USER_SERVER_PORT"}},
+      &cli.BoolFlag  {Name: "server.require-if-match", Value: false, Usage: "Answer 428 to the writes of a user without an If-Match header", Destination: &a.Config.Server.RequireIfMatch, EnvVars: []string{"NEEDYS_API_USER_SERVER_REQUIRE_IF_MATCH"}},
+      &cli.BoolFlag  {Name: "server.integer-ids", Value: true, Usage: "Resolve the integer ids of the users in the routes besides their public ids, during the transition", Destination: &a.Config.Server.IntegerIds, EnvVars: []string{"NEEDYS_API_USER_SERVER_INTEGER_IDS"}},
+      &cli.StringFlag{Name: "notifier", Value: "log", Usage: "Email delivery `KIND`, log and file being meant for development", Destination: &a.Config.Notifier.Kind, EnvVars: []string{"NEEDYS_API_USER_NOTIFIER"}},
+      &cli.StringFlag{Name: "notifier.file", Value: "needys-api-user.mbox", Usage: "Mailbox file `PATH` of the file notifier", Destination: &a.Config.Notifier.File, EnvVars: []string{"NEEDYS_API_USER_NOTIFIER_FILE"}},
+      &cli.StringFlag{Name: "smtp.host", Value: "127.0.0.1", Usage: "SMTP relay host `HOST`", Destination: &a.Config.SMTP.Host, EnvVars: []string{"NEEDYS_API_USER_SMTP_HOST"}},
+      &cli.StringFlag{Name: "smtp.port", Value: "587", Usage: "SMTP relay port `PORT`", Destination: &a.Config.SMTP.Port, EnvVars: []string{"NEEDYS_API_USER_SMTP_PORT"}},
+      &cli.StringFlag{Name: "smtp.username", Value: "", Usage: "SMTP user name `USERNAME`, no authentication when empty", Destination: &a.Config.SMTP.Username, EnvVars: []string{"NEEDYS_API_USER_SMTP_USERNAME"}},
+      &cli.StringFlag{Name: "smtp.password", Value: "", Usage: "SMTP user password `PASSWORD`", Destination: &a.Config.SMTP.Password, EnvVars: []string{"NEEDYS_API_USER_SMTP_PASSWORD"}},
+      &cli.StringFlag{Name: "smtp.from", Value: "needys <no-reply@needys.local>", Usage: "Sender `ADDRESS` of the emails", Destination: &a.Config.SMTP.From, EnvVars: []string{"NEEDYS_API_USER_SMTP_FROM"}},
+      &cli.StringFlag{Name: "email.token-secret", Value: "", Usage: "`SECRET` signing the email verification tokens, random when empty", Destination: &a.Config.Email.TokenSecret, EnvVars: []string{"NEEDYS_API_USER_EMAIL_TOKEN_SECRET"}},
+      &cli.DurationFlag{Name: "email.token-ttl", Value: 24 * time.Hour, Usage: "`DURATION` an email verification token stays valid", Destination: &a.Config.Email.TokenTTL, EnvVars: []string{"NEEDYS_API_USER_EMAIL_TOKEN_TTL"}},
+      &cli.StringFlag{Name: "encryption.keyring", Value: "", Usage: "Keyring file `PATH` encrypting addresses and phones at rest, see \"keys generate\"", Destination: &a.Config.Encryption.Keyring, EnvVars: []string{"NEEDYS_API_USER_ENCRYPTION_KEYRING"}},
+      &cli.DurationFlag{Name: "deletion.retention", Value: 30 * 24 * time.Hour, Usage: "`DURATION` a deleted user can be restored before it is purged", Destination: &a.Config.Deletion.Retention, EnvVars: []string{"NEEDYS_API_USER_DELETION_RETENTION"}},
+      &cli.DurationFlag{Name: "deletion.purge-interval", Value: time.Hour, Usage: "`DURATION` between two purges of the deleted users, 0 disabling them", Destination: &a.Config.Deletion.PurgeInterval, EnvVars: []string{"NEEDYS_API_USER_DELETION_PURGE_INTERVAL"}},
+      &cli.DurationFlag{Name: "idempotency.window", Value: 24 * time.Hour, Usage: "`DURATION` the creations sent with an Idempotency-Key are remembered", Destination: &a.Config.Idempotency.Window, EnvVars: []string{"NEEDYS_API_USER_IDEMPOTENCY_WINDOW"}},
+      &cli.DurationFlag{Name: "search.rebuild-interval", Value: 0, Usage: "`DURATION` between two rebuilds of the search index from the storage, needed when several instances share it, 0 disabling them", Destination: &a.Config.Search.RebuildInterval, EnvVars: []string{"NEEDYS_API_USER_SEARCH_REBUILD_INTERVAL"}},
+      &cli.StringFlag{Name: "database.driver", Value: "mysql", Usage: "Database storage `DRIVER`", Destination: &a.Config.Database.Driver, EnvVars: []string{"NEEDYS_API_USER_DATABASE_DRIVER"}},
       &cli.StringFlag{Name: "database.host", Value: "127.0.0.1", Usage: "Database host `HOST`", Destination: &a.Config.Database.Host, EnvVars: []string{"NEEDYS_API_USER_DATABASE_HOST"}},
       &cli.StringFlag{Name: "database.port", Value: "3306", Usage: "Database port `PORT`", Destination: &a.Config.Database.Port, EnvVars: []string{"NEEDYS_API_USER_DATABASE_PORT"}},
       &cli.StringFlag{Name: "database.username", Value: "needys", Usage: "Database user name `USERNAME`", Destination: &a.Config.Database.Username, EnvVars: []string{"NEEDYS_API_USER_DATABASE_USERNAME"}},
       &cli.StringFlag{Name: "database.password", Value: "needys", Usage: "Database user password `PASSWORD`", Destination: &a.Config.Database.Password, EnvVars: []string{"NEEDYS_API_USER_DATABASE_PASSWORD"}},
       &cli.StringFlag{Name: "database.name", Value: "needys", Usage: "Database name `NAME`", Destination: &a.Config.Database.Name, EnvVars: []string{"NEEDYS_API_USER_DATABASE_NAME"}},
+      &cli.StringFlag{Name: "database.sslmode", Value: "disable", Usage: "PostgreSQL ssl `MODE`", Destination: &a.Config.Database.SSLMode, EnvVars: []string{"NEEDYS_API_USER_DATABASE_SSLMODE"}},
+      &cli.StringFlag{Name: "database.path", Value: "needys-api-user.db", Usage: "SQLite database file `PATH`", Destination: &a.Config.Database.Path, EnvVars: []string{"NEEDYS_API_USER_DATABASE_PATH"}},
       &cli.BoolFlag  {Name: "database.initialize", Value: false, Usage: "Initialize database", Destination: &a.Config.Database.Initialize, EnvVars: []string{"NEEDYS_API_USER_DATABASE_INITIALIZE"}},
     },
   }
+}
 
-  err := app.Run(os.Args)
-  if err != nil {
-    log.Fatal(err)
-  }
-
+func validateConfiguration(a *internal.Application) {
   // application general configuration
   if (! contains(PossibleOptionValues["environment"], a.Config.Environment)) {
     mainLog.WithFields(log.Fields{
@@ -93,6 +147,54 @@ func registerConfiguration(a *internal.Application) {
       "log-format": a.Config.LogFormat,
     }).Fatal("Wrong value for option log-format (should be \"unset\", \"text\" or \"json\")")
   }
+
+  if (! user.IsSupportedRegion(a.Config.DefaultRegion)) {
+    mainLog.WithFields(log.Fields{
+      "default-region": a.Config.DefaultRegion,
+    }).Fatal("Wrong value for option default-region (should be an ISO 3166 country code, such as \"FR\")")
+  }
+
+  if (! contains(PossibleOptionValues["notifier"], a.Config.Notifier.Kind)) {
+    mainLog.WithFields(log.Fields{
+      "notifier": a.Config.Notifier.Kind,
+    }).Fatal("Wrong value for option notifier (should be \"log\", \"file\" or \"smtp\")")
+  }
+
+  if (a.Config.Email.TokenTTL <= 0) {
+    mainLog.WithFields(log.Fields{
+      "email.token-ttl": a.Config.Email.TokenTTL,
+    }).Fatal("Wrong value for option email.token-ttl (should be a positive duration, such as \"24h\")")
+  }
+
+  if (a.Config.Deletion.Retention <= 0) {
+    mainLog.WithFields(log.Fields{
+      "deletion.retention": a.Config.Deletion.Retention,
+    }).Fatal("Wrong value for option deletion.retention (should be a positive duration, such as \"720h\")")
+  }
+
+  if (a.Config.Deletion.PurgeInterval < 0) {
+    mainLog.WithFields(log.Fields{
+      "deletion.purge-interval": a.Config.Deletion.PurgeInterval,
+    }).Fatal("Wrong value for option deletion.purge-interval (should be a duration, such as \"1h\", or 0)")
+  }
+
+  if (a.Config.Idempotency.Window <= 0) {
+    mainLog.WithFields(log.Fields{
+      "idempotency.window": a.Config.Idempotency.Window,
+    }).Fatal("Wrong value for option idempotency.window (should be a positive duration, such as \"24h\")")
+  }
+
+  if (a.Config.Search.RebuildInterval < 0) {
+    mainLog.WithFields(log.Fields{
+      "search.rebuild-interval": a.Config.Search.RebuildInterval,
+    }).Fatal("Wrong value for option search.rebuild-interval (should be a duration, such as \"5m\", or 0)")
+  }
+
+  if (! contains(PossibleOptionValues["database-driver"], a.Config.Database.Driver)) {
+    mainLog.WithFields(log.Fields{
+      "database-driver": a.Config.Database.Driver,
+    }).Fatal("Wrong value for option database.driver (should be \"mysql\", \"postgres\", \"sqlite\" or \"memory\")")
+  }
 }
 
 // -------------------------------------------------------------------------- //
@@ -104,14 +206,292 @@ var Commit 		= "unset"
 var Release 	= "unset"
 
 func registerVersion(a *internal.Application) {
-  a.Version = &internal.Version{BuildTime, Commit, Release}
+  a.Version = &internal.Version{BuildTime: BuildTime, Commit: Commit, Release: Release}
 }
 
 // -------------------------------------------------------------------------- //
-// 4. Main function
+// 4. Application Commands
+// -------------------------------------------------------------------------- //
+
+func registerCommands(a *internal.Application) []*cli.Command {
+  return []*cli.Command{
+    {
+      Name:  "migrate",
+      Usage: "Manage the database schema migrations",
+      Subcommands: []*cli.Command{
+        {
+          Name:  "up",
+          Usage: "Apply every pending migration",
+          Action: func(c *cli.Context) error {
+            migrator, err := a.Migrator()
+            if err != nil {
+              return err
+            }
+
+            count, err := migrator.MigrateUp()
+            fmt.Printf("%d migration(s) applied\n", count)
+
+            return err
+          },
+        },
+        {
+          Name:      "down",
+          Usage:     "Roll back the last N applied migrations",
+          ArgsUsage: "N",
+          Action: func(c *cli.Context) error {
+            steps, err := strconv.Atoi(c.Args().First())
+            if err != nil || steps < 1 {
+              return fmt.Errorf("migrate down expects a positive number of migrations, got %q", c.Args().First())
+            }
+
+            migrator, err := a.Migrator()
+            if err != nil {
+              return err
+            }
+
+            count, err := migrator.MigrateDown(steps)
+            fmt.Printf("%d migration(s) rolled back\n", count)
+
+            return err
+          },
+        },
+        {
+          Name:  "status",
+          Usage: "Show applied and pending migrations",
+          Action: func(c *cli.Context) error {
+            migrator, err := a.Migrator()
+            if err != nil {
+              return err
+            }
+
+            migrations, err := migrator.MigrationStatus()
+            if err != nil {
+              return err
+            }
+
+            writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+            fmt.Fprintln(writer, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+
+            for _, migration := range migrations {
+              if migration.Applied {
+                fmt.Fprintf(writer, "%04d\t%s\tapplied\t%s\n", migration.Version, migration.Name, migration.AppliedAt.Format("2006-01-02 15:04:05"))
+              } else {
+                fmt.Fprintf(writer, "%04d\t%s\tpending\t-\n", migration.Version, migration.Name)
+              }
+            }
+
+            return writer.Flush()
+          },
+        },
+      },
+    },
+    {
+      Name:  "normalize-phones",
+      Usage: "Rewrite the stored phone numbers in E.164, listing the invalid ones",
+      Flags: []cli.Flag{
+        &cli.BoolFlag{Name: "dry-run", Usage: "Report what would change without writing anything"},
+      },
+      Action: func(c *cli.Context) error {
+        if err := a.CheckSchema(); err != nil {
+          return err
+        }
+
+        report, err := a.NormalizePhones(c.Bool("dry-run"))
+
+        verb := "normalized"
+        if report.DryRun {
+          verb = "to normalize (dry run)"
+        }
+
+        fmt.Printf("%d user(s) read, %d phone(s) %s, %d invalid\n", report.Users, report.Normalized, verb, len(report.Invalid))
+
+        if len(report.Invalid) > 0 {
+          ids := make([]int, 0, len(report.Invalid))
+          for id := range report.Invalid {
+            ids = append(ids, id)
+          }
+          sort.Ints(ids)
+
+          writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+          fmt.Fprintln(writer, "ID\tINVALID PHONE")
+
+          for _, id := range ids {
+            fmt.Fprintf(writer, "%d\t%s\n", id, report.Invalid[id])
+          }
+
+          writer.Flush()
+        }
+
+        return err
+      },
+    },
+    {
+      Name:  "purge",
+      Usage: "Remove for good the users deleted for longer than --deletion.retention, and the expired idempotency keys",
+      Action: func(c *cli.Context) error {
+        if err := a.CheckSchema(); err != nil {
+          return err
+        }
+
+        purged, err := a.PurgeDeletedUsers()
+        fmt.Printf("%d deleted user(s) purged\n", purged)
+        if err != nil {
+          return err
+        }
+
+        forgotten, err := a.ForgetExpiredRequests()
+        fmt.Printf("%d expired idempotency key(s) forgotten\n", forgotten)
+
+        return err
+      },
+    },
+    {
+      Name:  "keys",
+      Usage: "Manage the keys encrypting addresses and phones at rest",
+      Subcommands: []*cli.Command{
+        {
+          Name:      "generate",
+          Usage:     "Add a new primary key to a keyring file, creating the file when missing",
+          ArgsUsage: "FILE",
+          Action: func(c *cli.Context) error {
+            path := c.Args().First()
+            if path == "" {
+              path = a.Config.Encryption.Keyring
+            }
+
+            if path == "" {
+              return fmt.Errorf("keys generate expects a keyring file to write")
+            }
+
+            id, err := user.GenerateKey(path)
+            if err != nil {
+              return err
+            }
+
+            fmt.Printf("key %s added to %s as the primary key, restart the servers then run \"keys rotate\"\n", id, path)
+            return nil
+          },
+        },
+        {
+          Name:  "rotate",
+          Usage: "Re-encrypt with the primary key the users, their history and the remembered creations encrypted with another key, or not encrypted yet",
+          Flags: []cli.Flag{
+            &cli.IntFlag{Name: "batch-size", Value: 100, Usage: "Number of users re-encrypted per transaction"},
+          },
+          Action: func(c *cli.Context) error {
+            if c.Int("batch-size") < 1 {
+              return fmt.Errorf("keys rotate expects a positive batch size, got %d", c.Int("batch-size"))
+            }
+
+            if err := a.CheckSchema(); err != nil {
+              return err
+            }
+
+            rotator, err := a.KeyRotator()
+            if err != nil {
+              return err
+            }
+
+            rotated, err := rotator.RotateKeys(c.Int("batch-size"), func(rotated int) {
+              fmt.Printf("%d row(s) re-encrypted...\n", rotated)
+            })
+
+            fmt.Printf("%d row(s) re-encrypted\n", rotated)
+            return err
+          },
+        },
+      },
+    },
+    {
+      Name:      "import",
+      Usage:     "Import users from a CSV or NDJSON file, - reading the standard input",
+      ArgsUsage: "FILE",
+      Flags: []cli.Flag{
+        &cli.StringFlag{Name: "format", Usage: "File `FORMAT` (csv or ndjson), guessed from the file extension by default"},
+        &cli.BoolFlag  {Name: "dry-run", Usage: "Validate every row without importing anything"},
+        &cli.StringFlag{Name: "map", Usage: "CSV column `MAPPING` to user fields, e.g. \"Prénom:firstname,Nom:lastname\""},
+      },
+      Action: func(c *cli.Context) error {
+        path := c.Args().First()
+        if path == "" {
+          return fmt.Errorf("import expects a file to read")
+        }
+
+        if err := a.CheckSchema(); err != nil {
+          return err
+        }
+
+        columns, err := transfer.ParseColumns(c.String("map"))
+        if err != nil {
+          return err
+        }
+
+        importer := transfer.Importer{Users: a.Users, Format: c.String("format"), DryRun: c.Bool("dry-run"), Columns: columns}
+        if importer.Format == "" {
+          importer.Format = strings.TrimPrefix(filepath.Ext(path), ".")
+          if importer.Format == "jsonl" {
+            importer.Format = transfer.FormatNDJSON
+          }
+        }
+
+        file := os.Stdin
+        if path != "-" {
+          if file, err = os.Open(path); err != nil {
+            return err
+          }
+          defer file.Close()
+        }
+
+        report, err := importer.Import(file)
+        printImportReport(report)
+
+        return err
+      },
+    },
+  }
+}
+
+func printImportReport(report transfer.Report) {
+  if report.DryRun {
+    fmt.Printf("%d row(s) read, %d valid, %d rejected (dry run, nothing imported)\n", report.Rows, report.Rows - report.Failed, report.Failed)
+  } else {
+    fmt.Printf("%d row(s) read, %d imported, %d rejected\n", report.Rows, report.Imported, report.Failed)
+  }
+
+  if len(report.IgnoredColumns) > 0 {
+    fmt.Printf("ignored columns: %s\n", strings.Join(report.IgnoredColumns, ", "))
+  }
+
+  if len(report.Errors) == 0 {
+    return
+  }
+
+  writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(writer, "LINE\tCODE\tMESSAGE")
+
+  for _, rowErr := range report.Errors {
+    message := rowErr.Message
+    for _, violation := range rowErr.Errors {
+      message += fmt.Sprintf("; %s: %s", violation.Field, violation.Message)
+    }
+
+    fmt.Fprintf(writer, "%d\t%s\t%s\n", rowErr.Line, rowErr.Code, message)
+  }
+
+  writer.Flush()
+}
+
+// -------------------------------------------------------------------------- //
+// 5. Main function
 // -------------------------------------------------------------------------- //
 
 func main() {
+  if err := app.Run(os.Args); err != nil {
+    mainLog.Fatal(err)
+  }
+}
+
+func serve(a *internal.Application) {
   c := make(chan os.Signal, 1) // creation of a channel of type os.Signal
 	signal.Notify(c, os.Interrupt, syscall.SIGKILL, syscall.SIGTERM) // add 2 signals to the channel
 	ctx, cancel := context.WithCancel(context.Background())
@@ -6,11 +6,18 @@ import (
   healthcheck   "github.com/hellofresh/health-go/v4"
   http          "net/http"
   log           "github.com/sirupsen/logrus"
-  _             "github.com/lib/pq"
   mux           "github.com/gorilla/mux"
+  rand          "crypto/rand"
   databasecheck "github.com/hellofresh/health-go/v4/checks/mysql"
+  postgrescheck "github.com/hellofresh/health-go/v4/checks/postgres"
   sql           "database/sql"
+  strings       "strings"
   time          "time"
+  url           "net/url"
+  job           "github.com/gpenaud/needys-api-user/internal/job"
+  notify        "github.com/gpenaud/needys-api-user/internal/notify"
+  search        "github.com/gpenaud/needys-api-user/internal/search"
+  user          "github.com/gpenaud/needys-api-user/internal/user"
 )
 
 // -------------------------------------------------------------------------- //
@@ -67,19 +74,53 @@ type Configuration struct {
   Verbosity      string
   LogFormat      string
   LogHealthcheck bool
+  DefaultRegion  string
   Healthcheck struct {
     Timeout  int
   }
   Server struct {
-    Port string
-    Host string
+    Port           string
+    Host           string
+    RequireIfMatch bool
+    IntegerIds     bool
+  }
+  Notifier struct {
+    Kind string
+    File string
+  }
+  SMTP struct {
+    Host     string
+    Port     string
+    Username string
+    Password string
+    From     string
+  }
+  Email struct {
+    TokenSecret string
+    TokenTTL    time.Duration
+  }
+  Encryption struct {
+    Keyring string
+  }
+  Deletion struct {
+    Retention     time.Duration
+    PurgeInterval time.Duration
+  }
+  Idempotency struct {
+    Window time.Duration
+  }
+  Search struct {
+    RebuildInterval time.Duration
   }
   Database struct {
+    Driver string
     Port string
     Host string
     Username string
     Password string
     Name string
+    SSLMode string
+    Path string
     Initialize bool
   }
 }
@@ -91,56 +132,264 @@ type Version struct {
 }
 
 type Application struct {
-  DB      *sql.DB
-  Config  *Configuration
-  Router  *mux.Router
-  Version *Version
+  Users       user.UserRepository
+  Search      *search.Index
+  Jobs        *job.Registry
+  Notifier    notify.Notifier
+  EmailTokens user.EmailTokens
+  Config      *Configuration
+  Router      *mux.Router
+  Version     *Version
 }
 
 // -------------------------------------------------------------------------- //
-// 3. Backends Initialization (MariaDB)
+// 3. Backends Initialization (MariaDB, PostgreSQL, SQLite, in-memory)
 // -------------------------------------------------------------------------- //
 
 func (a* Application) initializeDatabaseConnection() {
-  dbDriver          := "mysql"
-  dbCharset         := "charset=utf8mb4&collation=utf8mb4_unicode_ci"
-  dbConnectionQuery := a.Config.Database.Username + ":" + a.Config.Database.Password + "@tcp(" + a.Config.Database.Host + ":" + a.Config.Database.Port + ")/" + a.Config.Database.Name + "?" + dbCharset
+  var storage user.UserRepository
+
+  switch a.Config.Database.Driver {
+  case "memory":
+    storage = user.NewMemoryRepository()
+  case "postgres":
+    storage = user.NewPostgresRepository(a.openPostgresConnection())
+  case "sqlite":
+    storage = user.NewSQLiteRepository(a.openSQLiteConnection())
+  default:
+    storage = user.NewMySQLRepository(a.openMySQLConnection())
+  }
 
-  var err error
+  if a.Config.Encryption.Keyring != "" {
+    a.initializeKeyring(storage)
+  }
+
+  // every write goes through the search index to keep it in sync, and into
+  // the history of its user. The index only sees the writes of this instance,
+  // the others reach it through the rebuilds (see --search.rebuild-interval).
+  a.Search = search.NewIndex()
+  a.Users  = search.NewRepository(user.NewHistoryRepository(storage, user.SystemActor), a.Search)
+
+  applicationLog.WithFields(log.Fields{
+    "driver": a.Config.Database.Driver,
+  }).Info("user storage is initialized")
+}
+
+// initializeKeyring encrypts at rest the personal data of the SQL storages
+func (a *Application) initializeKeyring(storage user.UserRepository) {
+  repository, ok := storage.(*user.SQLRepository)
+  if !ok {
+    applicationLog.WithFields(log.Fields{
+      "driver": a.Config.Database.Driver,
+    }).Warning("the storage keeps nothing at rest, the keyring is ignored")
+    return
+  }
+
+  keyring, err := user.LoadKeyring(a.Config.Encryption.Keyring)
+  if err != nil {
+    applicationLog.Fatal(fmt.Sprintf("Keyring is not available: %s", err))
+  }
+
+  repository.Keyring = keyring
+
+  applicationLog.WithFields(log.Fields{
+    "primary_key": keyring.Primary,
+  }).Info("personal data is encrypted at rest")
+}
+
+// usersFor returns a.Users recording the changes on behalf of the actor of
+// the request (see requestActor)
+func (a *Application) usersFor(r *http.Request) user.UserRepository {
+  return search.NewRepository(user.NewHistoryRepository(a.storage(), requestActor(r)), a.Search)
+}
+
+// storage returns the user storage hidden behind the decorators of a.Users
+func (a *Application) storage() user.UserRepository {
+  users := a.Users
 
-  a.DB, err = sql.Open(dbDriver, dbConnectionQuery)
+  for {
+    wrapper, ok := users.(interface{ Unwrap() user.UserRepository })
+    if !ok {
+      return users
+    }
+
+    users = wrapper.Unwrap()
+  }
+}
+
+func (a* Application) openMySQLConnection() *sql.DB {
+  dbDriver          := "mysql"
+  // clientFoundRows makes RowsAffected count matched rows, even when unchanged,
+  // and the session works in UTC like the driver, so that TIMESTAMP columns
+  // hold the times they are given whatever the time zone of the server
+  dbOptions         := "charset=utf8mb4&collation=utf8mb4_unicode_ci&parseTime=true&clientFoundRows=true&loc=UTC&time_zone=%27%2B00%3A00%27"
+  dbConnectionQuery := a.Config.Database.Username + ":" + a.Config.Database.Password + "@tcp(" + a.Config.Database.Host + ":" + a.Config.Database.Port + ")/" + a.Config.Database.Name + "?" + dbOptions
+
+  db, err := sql.Open(dbDriver, dbConnectionQuery)
   if err != nil {
     applicationLog.Fatal(fmt.Sprintf("Database server is not available: %s", dbConnectionQuery))
   }
 
-  a.DB.SetMaxIdleConns(3)
-  a.DB.SetMaxOpenConns(10)
-  a.DB.SetConnMaxLifetime(3600 * time.Second)
+  db.SetMaxIdleConns(3)
+  db.SetMaxOpenConns(10)
+  db.SetConnMaxLifetime(3600 * time.Second)
+
+  return db
+}
+
+func (a *Application) postgresDSN() string {
+  return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s", url.QueryEscape(a.Config.Database.Username), url.QueryEscape(a.Config.Database.Password), a.Config.Database.Host, a.Config.Database.Port, a.Config.Database.Name, a.Config.Database.SSLMode)
+}
+
+func (a* Application) openPostgresConnection() *sql.DB {
+  db, err := sql.Open("postgres", a.postgresDSN())
+  if err != nil {
+    applicationLog.Fatal(fmt.Sprintf("Database server is not available: %s:%s", a.Config.Database.Host, a.Config.Database.Port))
+  }
+
+  db.SetMaxIdleConns(3)
+  db.SetMaxOpenConns(10)
+  db.SetConnMaxLifetime(3600 * time.Second)
+
+  return db
+}
+
+func (a* Application) openSQLiteConnection() *sql.DB {
+  // busy_timeout lets concurrent writers wait for the file lock instead of
+  // failing, and the times are written in UTC in a form SQLite understands
+  dbConnectionQuery := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_timezone=UTC", a.Config.Database.Path)
+
+  db, err := sql.Open("sqlite", dbConnectionQuery)
+  if err != nil {
+    applicationLog.Fatal(fmt.Sprintf("Database file is not available: %s", a.Config.Database.Path))
+  }
+
+  // sqlite allows a single writer at a time
+  db.SetMaxOpenConns(1)
+
+  return db
+}
+
+// databaseCheck returns the live check matching the configured storage driver
+func (a *Application) databaseCheck() healthcheck.Config {
+  if a.Config.Database.Driver == "memory" {
+    return healthcheck.Config{
+      Name:  "memory-check",
+      Check: func(context.Context) error { return nil },
+    }
+  }
+
+  if a.Config.Database.Driver == "sqlite" {
+    db := a.storage().(*user.SQLRepository).DB
+
+    return healthcheck.Config{
+      Name:      "sqlite-check",
+      Timeout:   time.Second * 5,
+      SkipOnErr: false,
+      Check:     func(ctx context.Context) error { return db.PingContext(ctx) },
+    }
+  }
+
+  if a.Config.Database.Driver == "postgres" {
+    return healthcheck.Config{
+      Name:      "postgres-check",
+      Timeout:   time.Second * 5,
+      SkipOnErr: false,
+      Check: postgrescheck.New(postgrescheck.Config{
+        DSN: a.postgresDSN(),
+      }),
+    }
+  }
+
+  return healthcheck.Config{
+    Name:      "mysql-check",
+    Timeout:   time.Second * 5,
+    SkipOnErr: false,
+    Check: databasecheck.New(databasecheck.Config{
+      DSN: fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8", a.Config.Database.Username, a.Config.Database.Password, a.Config.Database.Host, a.Config.Database.Port, a.Config.Database.Name),
+    }),
+  }
+}
+
+// -------------------------------------------------------------------------- //
+// 4. Notifications
+// -------------------------------------------------------------------------- //
+
+func (a *Application) initializeNotifier() {
+  switch a.Config.Notifier.Kind {
+  case "smtp":
+    a.Notifier = &notify.SMTPNotifier{
+      Host:     a.Config.SMTP.Host,
+      Port:     a.Config.SMTP.Port,
+      Username: a.Config.SMTP.Username,
+      Password: a.Config.SMTP.Password,
+      From:     a.Config.SMTP.From,
+    }
+  case "file":
+    a.Notifier = &notify.FileNotifier{Path: a.Config.Notifier.File}
+  default:
+    a.Notifier = notify.LogNotifier{}
+  }
+
+  secret := []byte(a.Config.Email.TokenSecret)
+  if len(secret) == 0 {
+    secret = make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+      applicationLog.Fatal(fmt.Sprintf("No email token secret can be generated: %s", err))
+    }
+
+    applicationLog.Warning("no email token secret is configured, verification tokens will not survive a restart")
+  }
+
+  a.EmailTokens = user.EmailTokens{Secret: secret, TTL: a.Config.Email.TokenTTL}
+
+  applicationLog.WithFields(log.Fields{
+    "notifier": a.Config.Notifier.Kind,
+  }).Info("notifier is initialized")
 }
 
 // -------------------------------------------------------------------------- //
-// 4. Router setup
+// 5. Router setup
 // -------------------------------------------------------------------------- //
 
 func (a *Application) initializeRoutes() {
+  a.Router.Use(withRequestId)
+
   // application user-related routes
   a.Router.HandleFunc("/users", a.getUsers).Methods("GET")
-  a.Router.HandleFunc("/user/{id:[0-9]+}", a.getUser).Methods("GET")
+  a.Router.HandleFunc("/users/search", a.searchUsers).Methods("GET")
+  a.Router.HandleFunc("/users/batch", a.batchUsers).Methods("POST")
+  a.Router.HandleFunc("/users/import", a.importUsers).Methods("POST")
+  a.Router.HandleFunc("/users/duplicates", a.getDuplicates).Methods("GET")
+  a.Router.HandleFunc("/users/merge", a.mergeUsers).Methods("POST")
+  a.Router.HandleFunc("/users/changes", a.getChanges).Methods("GET")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}", a.getUser).Methods("GET")
   a.Router.HandleFunc("/user", a.createUser).Methods("POST")
-  a.Router.HandleFunc("/user/{id:[0-9]+}", a.updateUser).Methods("PUT")
-  a.Router.HandleFunc("/user/{firstname:[a-zA-Z]+}/{lastname:[a-zA-Z]+}", a.deleteUser).Methods("DELETE")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}", a.updateUser).Methods("PUT")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}", a.patchUser).Methods("PATCH")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}", a.deleteUser).Methods("DELETE")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}/email/verification", a.requestEmailVerification).Methods("POST")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}/email/verify", a.verifyEmail).Methods("POST")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}/export", a.exportUser).Methods("GET")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}/erase", a.eraseUser).Methods("POST")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}/restore", a.restoreUser).Methods("POST")
+  a.Router.HandleFunc("/user/{id:[0-9A-Za-z]+}/history", a.getHistory).Methods("GET")
   // application maintenance routes
-  a.Router.HandleFunc("/initialize_db", a.InitializeDB).Methods("GET")
+  a.Router.HandleFunc("/jobs/{id:[0-9a-f]+}", a.getJob).Methods("GET")
 }
 
 // -------------------------------------------------------------------------- //
-// 5. Application Setup
+// 6. Application Setup
 // -------------------------------------------------------------------------- //
 
 func (a *Application) Initialize() {
   a.Router = mux.NewRouter()
+  a.Jobs   = job.NewRegistry()
+
+  user.DefaultRegion = strings.ToUpper(a.Config.DefaultRegion)
 
   a.initializeDatabaseConnection()
+  a.initializeNotifier()
   a.initializeLogger()
   a.initializeRoutes()
 
@@ -174,7 +423,43 @@ commit: %s
     )
 
   // ---------------------------------------------------------------------------
-  // 5.1. manage healthchecks and healthchecks server
+  // 6.1. initialize database if specified in configuration, else make sure
+  // its schema is up to date, then build the search index and schedule the
+  // purge of the deleted users
+  // ---------------------------------------------------------------------------
+
+  if (a.Config.Database.Initialize) {
+    initialized, err := a.InitializeDatabase()
+
+    if (initialized) {
+      applicationLog.Info("database initialisation succeeded")
+    } else {
+      applicationLog.WithFields(log.Fields{
+        "error": err,
+      }).Fatal("database initialisation failed")
+    }
+  } else if err := a.CheckSchema(); err != nil {
+    applicationLog.WithFields(log.Fields{
+      "error": err,
+    }).Fatal("database schema is not up to date")
+  }
+
+  if err := a.Search.Rebuild(a.Users); err != nil {
+    applicationLog.WithFields(log.Fields{
+      "error": err,
+    }).Error("search index cannot be built, searches will miss existing users")
+  }
+
+  if a.Config.Deletion.PurgeInterval > 0 {
+    go a.purgeDeletedUsersEvery(ctx, a.Config.Deletion.PurgeInterval)
+  }
+
+  if a.Config.Search.RebuildInterval > 0 {
+    go a.rebuildSearchIndexEvery(ctx, a.Config.Search.RebuildInterval)
+  }
+
+  // ---------------------------------------------------------------------------
+  // 6.2. manage healthchecks and healthchecks server
   // ---------------------------------------------------------------------------
 
   // health checks
@@ -188,14 +473,7 @@ commit: %s
   // live checks
   live, _ := healthcheck.New()
 
-  live.Register(healthcheck.Config{
-		Name:      "mysql-check",
-		Timeout:   time.Second * 5,
-		SkipOnErr: false,
-		Check: databasecheck.New(databasecheck.Config{
-			DSN: fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8", a.Config.Database.Username, a.Config.Database.Password, a.Config.Database.Host, a.Config.Database.Port, a.Config.Database.Name),
-		}),
-	})
+  live.Register(a.databaseCheck())
 
   http.Handle("/health", health.Handler())
   http.Handle("/live", live.Handler())
@@ -211,7 +489,7 @@ commit: %s
   }()
 
   // ---------------------------------------------------------------------------
-  // 5.2. manage healthchecks and healthchecks server
+  // 6.3. manage application server
   // ---------------------------------------------------------------------------
 
   httpServer := &http.Server{
@@ -225,24 +503,8 @@ commit: %s
     httpServer.ListenAndServe()
   }()
 
-  // -------------------------------------------------
-  // 5.3. initialize database if specified in configuration
-  // -------------------------------------------------
-
-  if (a.Config.Database.Initialize) {
-    initialized, err := a.InitializeDatabase()
-
-    if (initialized) {
-      applicationLog.Info("database initialisation succeeded")
-    } else {
-      applicationLog.WithFields(log.Fields{
-        "error": err,
-      }).Fatal("database initialisation failed")
-    }
-  }
-
   // ---------------------------------------------------------------------------
-  // 5.4. manage server shutdown
+  // 6.4. manage server shutdown
   // ---------------------------------------------------------------------------
 
   <-ctx.Done()
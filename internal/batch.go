@@ -0,0 +1,358 @@
+package internal
+
+import (
+  errors  "errors"
+  fmt     "fmt"
+  http    "net/http"
+  json    "encoding/json"
+  strings "strings"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Batch payload
+// -------------------------------------------------------------------------- //
+
+const maxBatchSize = 1000
+
+const (
+  OperationCreate = "create"
+  OperationUpdate = "update"
+  OperationDelete = "delete"
+)
+
+// Batch is the body of POST /users/batch. An atomic batch commits every
+// operation or none, otherwise each operation commits on its own.
+type Batch struct {
+  Atomic     bool        `json:"atomic"`
+  Operations []Operation `json:"operations"`
+}
+
+// Operation creates User, or updates or deletes the user Id, referenced as in
+// the routes (see userIdOf). An update may leave Id out when User carries its
+// PublicId. IfMatch holds the ETags an update or a delete expects, as the
+// If-Match header of a single write does.
+type Operation struct {
+  Op            string     `json:"op"`
+  Id            UserRef    `json:"id,omitempty"`
+  IfMatch       string     `json:"if_match,omitempty"`
+  User          *user.User `json:"user,omitempty"`
+  userId        int
+  previousEmail string
+}
+
+// OperationResult reports the outcome of one operation with an HTTP status:
+// 201 or 200 when it is committed, 424 when an atomic batch is rolled back
+// because of another operation, and the status of Error otherwise
+type OperationResult struct {
+  Index  int        `json:"index"`
+  Op     string     `json:"op"`
+  Status int        `json:"status"`
+  User   *user.User `json:"user,omitempty"`
+  Error  *Problem   `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+  Atomic    bool              `json:"atomic"`
+  Committed bool              `json:"committed"`
+  Results   []OperationResult `json:"results"`
+}
+
+// validate checks an operation before any write, resolving its id with
+// userIdOf, from the user payload when needed. requireIfMatch refuses the
+// updates and deletes without IfMatch.
+func (o *Operation) validate(userIdOf func(reference string) (int, error), requireIfMatch bool) error {
+  switch o.Op {
+  case OperationCreate:
+    if o.User == nil {
+      return user.ValidationError("invalid_operation", "create needs a user")
+    }
+    if o.Id != "" || o.IfMatch != "" {
+      return user.ValidationError("invalid_operation", "create does not accept an id nor if_match")
+    }
+    return o.User.Validate()
+  case OperationUpdate:
+    if o.User == nil {
+      return user.ValidationError("invalid_operation", "update needs a user")
+    }
+    if requireIfMatch && strings.TrimSpace(o.IfMatch) == "" {
+      return user.ErrVersionRequired
+    }
+    if o.Id == "" {
+      o.Id = UserRef(o.User.PublicId)
+    }
+    if err := o.resolve(userIdOf, "update"); err != nil {
+      return err
+    }
+    if o.User.PublicId != "" {
+      if id, err := userIdOf(o.User.PublicId); err != nil || id != o.userId {
+        return user.ValidationError("invalid_operation", "the public id of the user does not match the id of the update")
+      }
+    }
+    return o.User.Validate()
+  case OperationDelete:
+    if requireIfMatch && strings.TrimSpace(o.IfMatch) == "" {
+      return user.ErrVersionRequired
+    }
+    return o.resolve(userIdOf, "delete")
+  }
+
+  return user.ValidationError("invalid_operation", "%q is not an operation (create, update, delete)", o.Op)
+}
+
+// resolve sets the id of the user the operation targets
+func (o *Operation) resolve(userIdOf func(reference string) (int, error), op string) error {
+  if o.Id == "" {
+    return user.ValidationError("invalid_operation", "%s needs the id of an existing user", op)
+  }
+
+  id, err := userIdOf(string(o.Id))
+  if err != nil {
+    return err
+  }
+
+  o.userId = id
+  return nil
+}
+
+// apply runs a validated operation against the repository, the updates and
+// deletes expecting the version IfMatch names
+func (o *Operation) apply(users user.UserRepository) (OperationResult, error) {
+  result := OperationResult{Op: o.Op, Status: http.StatusOK}
+
+  switch o.Op {
+  case OperationCreate:
+    n := *o.User
+    if err := users.CreateUser(&n); err != nil {
+      return result, err
+    }
+    result.Status, result.User = http.StatusCreated, &n
+  case OperationUpdate:
+    current := user.User{Id: o.userId}
+    if err := users.GetUser(&current); err != nil {
+      return result, err
+    }
+    version, err := matchVersion(o.IfMatch, &current)
+    if err != nil {
+      return result, err
+    }
+    n := *o.User
+    n.Id, n.Version = o.userId, version
+    if err := users.UpdateUser(&n); err != nil {
+      return result, err
+    }
+    result.User, o.previousEmail = &n, current.Email
+  case OperationDelete:
+    n := user.User{Id: o.userId}
+    if err := users.GetUser(&n); err != nil {
+      return result, err
+    }
+    version, err := matchVersion(o.IfMatch, &n)
+    if err != nil {
+      return result, err
+    }
+    n.Version = version
+    if err := users.DeleteUser(&n); err != nil {
+      return result, err
+    }
+    result.User = &n
+  }
+
+  return result, nil
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Batch execution
+// -------------------------------------------------------------------------- //
+
+func operationFailure(r *http.Request, index int, op string, err error) OperationResult {
+  instance := fmt.Sprintf("%s#/operations/%d", r.URL.RequestURI(), index)
+
+  var problem    Problem
+  var duplicates *PossibleDuplicate
+
+  if errors.As(err, &duplicates) {
+    problem = duplicateProblem(instance, duplicates)
+  } else {
+    problem = problemFor(r, err)
+    problem.Instance = instance
+  }
+
+  return OperationResult{Index: index, Op: op, Status: problem.Status, Error: &problem}
+}
+
+func rolledBack(index int, op string) OperationResult {
+  return OperationResult{Index: index, Op: op, Status: http.StatusFailedDependency}
+}
+
+// runAtomicBatch applies every operation in one transaction, retried on
+// conflicts. The transaction is not even started when an operation is
+// invalid. A nil result means the failure is not tied to an operation.
+func (a *Application) runAtomicBatch(r *http.Request, operations []Operation, invalid map[int]error) ([]OperationResult, bool, error) {
+  results := make([]OperationResult, len(operations))
+
+  if len(invalid) > 0 {
+    for i, o := range operations {
+      if err, found := invalid[i]; found {
+        results[i] = operationFailure(r, i, o.Op, err)
+      } else {
+        results[i] = rolledBack(i, o.Op)
+      }
+    }
+
+    return results, false, nil
+  }
+
+  failed := -1
+
+  err := user.RunTransaction(a.usersFor(r), func(tx user.UserRepository) error {
+    failed = -1
+
+    for i := range operations {
+      result, err := operations[i].apply(tx)
+      if err != nil {
+        failed = i
+        return err
+      }
+
+      result.Index = i
+      results[i] = result
+    }
+
+    return nil
+  })
+
+  if err == nil {
+    return results, true, nil
+  }
+
+  if failed < 0 {
+    return nil, false, err
+  }
+
+  for i, o := range operations {
+    if i == failed {
+      results[i] = operationFailure(r, i, o.Op, err)
+    } else {
+      results[i] = rolledBack(i, o.Op)
+    }
+  }
+
+  return results, false, nil
+}
+
+// runBestEffortBatch applies each operation in its own transaction, so that a
+// failing operation leaves the others committed
+func (a *Application) runBestEffortBatch(r *http.Request, operations []Operation, invalid map[int]error) ([]OperationResult, bool) {
+  results   := make([]OperationResult, len(operations))
+  committed := true
+
+  for i := range operations {
+    if err, found := invalid[i]; found {
+      results[i], committed = operationFailure(r, i, operations[i].Op, err), false
+      continue
+    }
+
+    err := user.RunTransaction(a.usersFor(r), func(tx user.UserRepository) error {
+      result, err := operations[i].apply(tx)
+      results[i] = result
+      return err
+    })
+
+    if err != nil {
+      results[i], committed = operationFailure(r, i, operations[i].Op, err), false
+    } else {
+      results[i].Index = i
+    }
+  }
+
+  return results, committed
+}
+
+// emailsChanged sends the verifications of the emails the committed creates
+// and updates set, see emailChanged
+func (a *Application) emailsChanged(operations []Operation, results []OperationResult) {
+  for i, o := range operations {
+    // the failed and rolled back operations hold no user
+    if o.Op == OperationDelete || results[i].User == nil {
+      continue
+    }
+
+    a.emailChanged(o.previousEmail, results[i].User)
+  }
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Handler
+// -------------------------------------------------------------------------- //
+
+// batchUsers answers 200 when every operation is committed and 207 with the
+// per-operation statuses otherwise. The creates are checked for duplicates as
+// POST /user does, unless ?force=true.
+func (a *Application) batchUsers(w http.ResponseWriter, r *http.Request) {
+  if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+    respondWithProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "The payload must be sent as application/json")
+    return
+  }
+
+  if _, err := parseBoolParameter(r, "force"); err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  defer r.Body.Close()
+
+  batch   := Batch{}
+  decoder := json.NewDecoder(r.Body)
+  decoder.DisallowUnknownFields()
+
+  if err := decoder.Decode(&batch); err != nil {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload is invalid")
+    return
+  }
+
+  if len(batch.Operations) == 0 {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The batch holds no operation")
+    return
+  }
+
+  if len(batch.Operations) > maxBatchSize {
+    respondWithProblem(w, r, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("A batch holds at most %d operations", maxBatchSize))
+    return
+  }
+
+  invalid := map[int]error{}
+  for i := range batch.Operations {
+    o := &batch.Operations[i]
+
+    if err := o.validate(a.userIdOf, a.Config.Server.RequireIfMatch); err != nil {
+      invalid[i] = err
+    } else if o.Op == OperationCreate {
+      if err := a.duplicatesOf(r, o.User); err != nil {
+        invalid[i] = err
+      }
+    }
+  }
+
+  result := BatchResult{Atomic: batch.Atomic}
+
+  if batch.Atomic {
+    results, committed, err := a.runAtomicBatch(r, batch.Operations, invalid)
+    if err != nil {
+      respondWithUserError(w, r, err)
+      return
+    }
+
+    result.Results, result.Committed = results, committed
+  } else {
+    result.Results, result.Committed = a.runBestEffortBatch(r, batch.Operations, invalid)
+  }
+
+  a.emailsChanged(batch.Operations, result.Results)
+
+  if result.Committed {
+    respondWithJSON(w, http.StatusOK, result)
+  } else {
+    respondWithJSON(w, http.StatusMultiStatus, result)
+  }
+}
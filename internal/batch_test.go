@@ -0,0 +1,298 @@
+package internal
+
+import (
+  json    "encoding/json"
+  http    "net/http"
+  notify  "github.com/gpenaud/needys-api-user/internal/notify"
+  strings "strings"
+  testing "testing"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestUserRef(t *testing.T) {
+  tests := map[string]UserRef{
+    `7`:                            "7",
+    `"7"`:                          "7",
+    `"01HV3K8Z4X6N7Q2R5T9W0YBCDE"`: "01HV3K8Z4X6N7Q2R5T9W0YBCDE",
+  }
+
+  for document, want := range tests {
+    var ref UserRef
+    if err := json.Unmarshal([]byte(document), &ref); err != nil || ref != want {
+      t.Errorf("UserRef(%s) = %q, %v, want %q", document, ref, err, want)
+    }
+  }
+
+  var ref UserRef
+  if err := json.Unmarshal([]byte(`true`), &ref); err == nil {
+    t.Errorf("UserRef(true) = %q", ref)
+  }
+}
+
+func TestOperationValidate(t *testing.T) {
+  publicIds := map[string]int{"01HV3K8Z4X6N7Q2R5T9W0YBCDE": 7, "01HV3KA2M8P0S3V6X9Z1C4F7HJ": 8}
+  userIdOf  := func(reference string) (int, error) {
+    if id, found := publicIds[reference]; found {
+      return id, nil
+    }
+    if reference == "7" {
+      return 7, nil
+    }
+    return 0, user.ErrUserNotFound
+  }
+
+  valid := &user.User{Firstname: "Guillaume", Lastname: "Penaud"}
+
+  tests := []struct {
+    operation Operation
+    userId    int
+    code      string // of the error, if any
+  }{
+    {Operation{Op: "create", User: valid}, 0, ""},
+    {Operation{Op: "create"}, 0, "invalid_operation"},
+    {Operation{Op: "create", Id: "7", User: valid}, 0, "invalid_operation"},
+    {Operation{Op: "create", IfMatch: `"1"`, User: valid}, 0, "invalid_operation"},
+    {Operation{Op: "create", User: &user.User{Firstname: "Guillaume"}}, 0, "invalid_user"},
+    {Operation{Op: "update", Id: "01HV3K8Z4X6N7Q2R5T9W0YBCDE", User: valid}, 7, ""},
+    {Operation{Op: "update", Id: "7", User: valid}, 7, ""},
+    {Operation{Op: "update", User: &user.User{PublicId: "01HV3KA2M8P0S3V6X9Z1C4F7HJ", Firstname: "Guillaume", Lastname: "Penaud"}}, 8, ""},
+    {Operation{Op: "update", Id: "7", User: &user.User{PublicId: "01HV3KA2M8P0S3V6X9Z1C4F7HJ", Firstname: "Guillaume", Lastname: "Penaud"}}, 0, "invalid_operation"},
+    {Operation{Op: "update", User: valid}, 0, "invalid_operation"},
+    {Operation{Op: "update", Id: "9", User: valid}, 0, "user_not_found"},
+    {Operation{Op: "delete", Id: "01HV3KA2M8P0S3V6X9Z1C4F7HJ"}, 8, ""},
+    {Operation{Op: "delete"}, 0, "invalid_operation"},
+    {Operation{Op: "upsert", User: valid}, 0, "invalid_operation"},
+  }
+
+  for _, test := range tests {
+    operation := test.operation
+    err := operation.validate(userIdOf, false)
+
+    code := ""
+    if userErr, ok := err.(*user.Error); ok {
+      code = userErr.Code
+    } else if err != nil {
+      code = err.Error()
+    }
+
+    if code != test.code || code == "" && operation.userId != test.userId {
+      t.Errorf("validate(%s %q) = %q for user %d, want %q for user %d", test.operation.Op, test.operation.Id, code, operation.userId, test.code, test.userId)
+    }
+  }
+
+  required := []struct {
+    operation Operation
+    err       error
+  }{
+    {Operation{Op: "create", User: valid}, nil},
+    {Operation{Op: "update", Id: "7", User: valid}, user.ErrVersionRequired},
+    {Operation{Op: "update", Id: "7", IfMatch: `"3"`, User: valid}, nil},
+    {Operation{Op: "delete", Id: "7"}, user.ErrVersionRequired},
+    {Operation{Op: "delete", Id: "7", IfMatch: "*"}, nil},
+  }
+
+  for _, test := range required {
+    operation := test.operation
+    if err := operation.validate(userIdOf, true); err != test.err {
+      t.Errorf("validate(%s %q) requiring If-Match = %v, want %v", test.operation.Op, test.operation.IfMatch, err, test.err)
+    }
+  }
+}
+
+func TestAtomicBatch(t *testing.T) {
+  a := newTestApplication(t)
+
+  kept := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  result := BatchResult{}
+  decode(t, serve(t, a, "POST", "/users/batch", `{"atomic": true, "operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin"}},
+    {"op": "update", "id": "`+kept.PublicId+`", "user": {"firstname": "Guillaume", "lastname": "Martin"}},
+    {"op": "delete", "id": 42}
+  ]}`), http.StatusMultiStatus, &result)
+
+  statuses := []int{}
+  for _, operation := range result.Results {
+    statuses = append(statuses, operation.Status)
+  }
+
+  if result.Committed || len(statuses) != 3 || statuses[0] != http.StatusFailedDependency || statuses[1] != http.StatusFailedDependency || statuses[2] != http.StatusNotFound {
+    t.Errorf("the atomic batch answers committed %t with %v", result.Committed, statuses)
+  }
+  if result.Results[2].Error == nil || !strings.HasSuffix(result.Results[2].Error.Instance, "#/operations/2") {
+    t.Errorf("the failed operation reports %+v", result.Results[2].Error)
+  }
+
+  list := UserList{}
+  decode(t, serve(t, a, "GET", "/users", ""), http.StatusOK, &list)
+
+  if len(list.Data) != 1 || list.Data[0].Lastname != "Penaud" {
+    t.Errorf("the atomic batch left %+v", list.Data)
+  }
+
+  decode(t, serve(t, a, "POST", "/users/batch", `{"atomic": true, "operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin"}},
+    {"op": "update", "id": "`+kept.PublicId+`", "user": {"firstname": "Guillaume", "lastname": "Martin"}}
+  ]}`), http.StatusOK, &result)
+
+  if !result.Committed || result.Results[0].Status != http.StatusCreated || result.Results[1].User.Lastname != "Martin" {
+    t.Errorf("the atomic batch answers %+v", result)
+  }
+}
+
+func TestBestEffortBatch(t *testing.T) {
+  a := newTestApplication(t)
+
+  result := BatchResult{}
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin"}},
+    {"op": "create", "user": {"firstname": "Océane"}},
+    {"op": "delete", "id": 1}
+  ]}`), http.StatusMultiStatus, &result)
+
+  statuses := []int{}
+  for _, operation := range result.Results {
+    statuses = append(statuses, operation.Status)
+  }
+
+  if result.Committed || len(statuses) != 3 || statuses[0] != http.StatusCreated || statuses[1] != http.StatusUnprocessableEntity || statuses[2] != http.StatusOK {
+    t.Errorf("the batch answers committed %t with %v", result.Committed, statuses)
+  }
+}
+
+func TestBatchPayload(t *testing.T) {
+  a := newTestApplication(t)
+
+  tooLarge := `{"operations": [` + strings.TrimSuffix(strings.Repeat(`{"op": "delete", "id": 1},`, maxBatchSize + 1), ",") + `]}`
+
+  tests := []struct {
+    body string
+    code int
+  }{
+    {`{"operations": []}`, http.StatusBadRequest},
+    {`{"operations": [{"op": "delete", "id": 1, "force": true}]}`, http.StatusBadRequest},
+    {`[]`, http.StatusBadRequest},
+    {tooLarge, http.StatusRequestEntityTooLarge},
+  }
+
+  for _, test := range tests {
+    if w := serve(t, a, "POST", "/users/batch", test.body); w.Code != test.code {
+      t.Errorf("POST /users/batch %.60s: status %d, want %d", test.body, w.Code, test.code)
+    }
+  }
+}
+
+func TestBatchPreconditions(t *testing.T) {
+  a := newTestApplication(t)
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  result := BatchResult{}
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "update", "id": "`+n.PublicId+`", "if_match": "\"2\"", "user": {"firstname": "Guillaume", "lastname": "Martin"}}
+  ]}`), http.StatusMultiStatus, &result)
+
+  if problem := result.Results[0].Error; problem == nil || problem.Code != "version_mismatch" || result.Results[0].Status != http.StatusPreconditionFailed {
+    t.Errorf("the stale update answers %+v", result.Results[0])
+  }
+
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "update", "id": "`+n.PublicId+`", "if_match": "\"1\"", "user": {"firstname": "Guillaume", "lastname": "Martin"}}
+  ]}`), http.StatusOK, &result)
+
+  if result.Results[0].User.Version != 2 {
+    t.Errorf("the update answers %+v", result.Results[0].User)
+  }
+
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "delete", "id": "`+n.PublicId+`", "if_match": "\"1\""}
+  ]}`), http.StatusMultiStatus, &result)
+
+  if result.Results[0].Status != http.StatusPreconditionFailed {
+    t.Errorf("the stale delete answers %+v", result.Results[0])
+  }
+
+  a.Config.Server.RequireIfMatch = true
+
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin"}},
+    {"op": "delete", "id": "`+n.PublicId+`"}
+  ]}`), http.StatusMultiStatus, &result)
+
+  if result.Results[0].Status != http.StatusCreated || result.Results[1].Status != http.StatusPreconditionRequired || result.Results[1].Error.Code != "precondition_required" {
+    t.Errorf("the unconditional delete answers %+v", result.Results)
+  }
+
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "delete", "id": "`+n.PublicId+`", "if_match": "\"2\""}
+  ]}`), http.StatusOK, &result)
+}
+
+func TestBatchDuplicates(t *testing.T) {
+  a := newTestApplication(t)
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "phone": "06 45 12 43 65"}`)
+
+  result := BatchResult{}
+  decode(t, serve(t, a, "POST", "/users/batch", `{"atomic": true, "operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin"}},
+    {"op": "create", "user": {"firstname": "Guillaume", "lastname": "Penot", "phone": "+33645124365"}}
+  ]}`), http.StatusMultiStatus, &result)
+
+  problem := result.Results[1].Error
+  if result.Results[0].Status != http.StatusFailedDependency || problem == nil || problem.Code != "possible_duplicate" || len(problem.Candidates) != 1 || problem.Candidates[0].PublicId != n.PublicId {
+    t.Errorf("the duplicate answers %+v", result.Results)
+  }
+
+  decode(t, serve(t, a, "POST", "/users/batch?force=true", `{"atomic": true, "operations": [
+    {"op": "create", "user": {"firstname": "Guillaume", "lastname": "Penot", "phone": "+33645124365"}}
+  ]}`), http.StatusOK, &result)
+  decode(t, serve(t, a, "POST", "/users/batch?force=maybe", `{"operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin"}}
+  ]}`), http.StatusBadRequest, nil)
+}
+
+// sentMessages records the messages sent by the application
+type sentMessages chan notify.Message
+
+func (s sentMessages) Send(m notify.Message) error {
+  s <- m
+  return nil
+}
+
+func TestBatchEmails(t *testing.T) {
+  a    := newTestApplication(t)
+  sent := make(sentMessages, 10)
+
+  a.Notifier = sent
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.com"}`)
+  <-sent
+
+  decode(t, serve(t, a, "POST", "/users/batch", `{"operations": [
+    {"op": "create", "user": {"firstname": "Océane", "lastname": "Martin", "email": "oceane@example.com"}},
+    {"op": "update", "id": "`+n.PublicId+`", "user": {"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.com"}},
+    {"op": "update", "id": "`+n.PublicId+`", "user": {"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.org"}}
+  ]}`), http.StatusOK, nil)
+
+  recipients := map[string]bool{}
+  for len(recipients) < 2 {
+    select {
+    case m := <-sent:
+      recipients[m.To] = true
+    case <-time.After(time.Second):
+      t.Fatalf("the batch sent verifications to %v", recipients)
+    }
+  }
+
+  if !recipients["oceane@example.com"] || !recipients["guillaume@example.org"] {
+    t.Errorf("the batch sent verifications to %v", recipients)
+  }
+
+  select {
+  case m := <-sent:
+    t.Errorf("the unchanged email received %+v", m)
+  case <-time.After(50 * time.Millisecond):
+  }
+}
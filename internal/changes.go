@@ -0,0 +1,85 @@
+package internal
+
+import (
+  fmt     "fmt"
+  http    "net/http"
+  strconv "strconv"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Delta synchronisation
+// -------------------------------------------------------------------------- //
+
+// ChangesResult is the body of GET /users/changes. Next is the sync token of
+// the following call, HasMore telling whether it returns changes right away.
+type ChangesResult struct {
+  Data    []user.Delta `json:"data"`
+  Next    string       `json:"next"`
+  HasMore bool         `json:"has_more"`
+}
+
+func (a *Application) getChanges(w http.ResponseWriter, r *http.Request) {
+  token, limit, err := parseChangesQuery(r)
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  now := time.Now().UTC()
+
+  // the users deleted since an older token may have been purged without a
+  // trace
+  if !token.At.IsZero() && token.At.Before(now.Add(-a.Config.Deletion.Retention)) {
+    respondWithProblem(w, r, http.StatusGone, "sync_token_expired", fmt.Sprintf("The sync token is older than the retention of the deleted users (%s), synchronise again without since", a.Config.Deletion.Retention))
+    return
+  }
+
+  deltas, err := a.Users.Deltas(token, limit + 1)
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  result := ChangesResult{Data: deltas, HasMore: len(deltas) > limit}
+
+  if result.HasMore {
+    result.Data = deltas[:limit]
+    result.Next = user.SyncToken{Since: token.Since, At: token.At, Position: deltas[limit - 1].Position()}.Encode()
+  } else {
+    // every change committed so far was returned, the next call starts over
+    // from the last one
+    position := token.Position
+    if len(deltas) > 0 {
+      position = deltas[len(deltas) - 1].Position()
+    }
+
+    result.Next = user.SyncToken{Since: position, At: now, Position: position}.Encode()
+  }
+
+  respondWithJSON(w, http.StatusOK, result)
+}
+
+// parseChangesQuery reads ?since= and ?limit=, no token standing for the start
+// of the stream
+func parseChangesQuery(r *http.Request) (user.SyncToken, int, error) {
+  values := r.URL.Query()
+  limit  := user.DefaultPageSize
+
+  if value := values.Get("limit"); value != "" {
+    size, err := strconv.Atoi(value)
+    if err != nil || size < 1 || size > user.MaxPageSize {
+      return user.SyncToken{}, 0, user.ValidationError("invalid_parameter", "limit must be a number between 1 and %d", user.MaxPageSize)
+    }
+
+    limit = size
+  }
+
+  if encoded := values.Get("since"); encoded != "" {
+    token, err := user.DecodeSyncToken(encoded)
+    return token, limit, err
+  }
+
+  return user.SyncToken{}, limit, nil
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+  http    "net/http"
+  testing "testing"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestGetChanges(t *testing.T) {
+  a := newTestApplication(t)
+
+  for _, name := range []string{"Anna", "Bruno", "Carla"} {
+    createTestUser(t, a, `{"firstname": "`+name+`", "lastname": "Roux"}`)
+  }
+
+  names  := []string{}
+  target := "/users/changes?limit=2"
+  result := ChangesResult{}
+
+  for {
+    decode(t, serve(t, a, "GET", target, ""), http.StatusOK, &result)
+
+    for _, delta := range result.Data {
+      if delta.Change != user.DeltaCreated {
+        t.Errorf("the first synchronisation reports %s %s", delta.Change, delta.PublicId)
+      }
+      names = append(names, delta.User.Firstname)
+    }
+
+    target = "/users/changes?limit=2&since=" + result.Next
+    if !result.HasMore {
+      break
+    }
+  }
+
+  if len(names) != 3 || names[0] != "Anna" || names[2] != "Carla" {
+    t.Errorf("the first synchronisation lists %v", names)
+  }
+
+  decode(t, serve(t, a, "GET", target, ""), http.StatusOK, &result)
+
+  if len(result.Data) != 0 || result.HasMore || result.Next == "" {
+    t.Errorf("the synchronisation without changes answers %+v", result)
+  }
+
+  n := createTestUser(t, a, `{"firstname": "David", "lastname": "Roux"}`)
+  decode(t, serve(t, a, "GET", "/users/changes?since=" + result.Next, ""), http.StatusOK, &result)
+
+  if len(result.Data) != 1 || result.Data[0].PublicId != n.PublicId || result.Data[0].Change != user.DeltaCreated {
+    t.Errorf("the next synchronisation answers %+v", result.Data)
+  }
+
+  expired := user.SyncToken{At: time.Now().Add(-a.Config.Deletion.Retention - time.Hour), Position: 1}.Encode()
+
+  decode(t, serve(t, a, "GET", "/users/changes?since=" + expired, ""), http.StatusGone, nil)
+  decode(t, serve(t, a, "GET", "/users/changes?since=%25%25", ""), http.StatusBadRequest, nil)
+  decode(t, serve(t, a, "GET", "/users/changes?limit=0", ""), http.StatusBadRequest, nil)
+}
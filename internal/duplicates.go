@@ -0,0 +1,266 @@
+package internal
+
+import (
+  errors  "errors"
+  http    "net/http"
+  json    "encoding/json"
+  search  "github.com/gpenaud/needys-api-user/internal/search"
+  strconv "strconv"
+  strings "strings"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Duplicates listing
+// -------------------------------------------------------------------------- //
+
+const defaultDuplicatesSize = 50
+const maxDuplicatesSize     = 500
+
+// DuplicatesResult is the body of GET /users/duplicates, the most likely
+// duplicates first
+type DuplicatesResult struct {
+  Data  []search.DuplicatePair `json:"data"`
+  Total int                    `json:"total"`
+}
+
+// parseDuplicatesQuery reads ?min_score= and ?limit= from the request
+func parseDuplicatesQuery(r *http.Request) (float64, int, error) {
+  values   := r.URL.Query()
+  minScore := search.DuplicateThreshold
+  limit    := defaultDuplicatesSize
+
+  if value := values.Get("min_score"); value != "" {
+    score, err := strconv.ParseFloat(value, 64)
+    if err != nil || score <= 0 || score > 1 {
+      return 0, 0, user.ValidationError("invalid_parameter", "min_score must be a number above 0, up to 1")
+    }
+
+    minScore = score
+  }
+
+  if value := values.Get("limit"); value != "" {
+    size, err := strconv.Atoi(value)
+    if err != nil || size < 1 || size > maxDuplicatesSize {
+      return 0, 0, user.ValidationError("invalid_parameter", "limit must be a number between 1 and %d", maxDuplicatesSize)
+    }
+
+    limit = size
+  }
+
+  return minScore, limit, nil
+}
+
+func (a *Application) getDuplicates(w http.ResponseWriter, r *http.Request) {
+  minScore, limit, err := parseDuplicatesQuery(r)
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  pairs  := a.Search.DuplicatePairs(minScore)
+  result := DuplicatesResult{Data: pairs, Total: len(pairs)}
+
+  if len(pairs) > limit {
+    result.Data = pairs[:limit]
+  }
+
+  respondWithJSON(w, http.StatusOK, result)
+}
+
+// PossibleDuplicate reports a new user which likely exists already, along
+// with the users it resembles
+type PossibleDuplicate struct {
+  Candidates []search.Duplicate
+}
+
+func (e *PossibleDuplicate) Error() string {
+  return "the user likely exists already"
+}
+
+// duplicatesOf returns the error refusing n when it resembles existing users,
+// unless the request forces its creation with ?force=true
+func (a *Application) duplicatesOf(r *http.Request, n *user.User) error {
+  force, err := parseBoolParameter(r, "force")
+  if err != nil {
+    return err
+  }
+
+  if force {
+    return nil
+  }
+
+  if duplicates := a.Search.Duplicates(*n); len(duplicates) > 0 {
+    return &PossibleDuplicate{Candidates: duplicates}
+  }
+
+  return nil
+}
+
+func duplicateProblem(instance string, duplicates *PossibleDuplicate) Problem {
+  return Problem{
+    Type:       problemType("possible_duplicate"),
+    Title:      http.StatusText(http.StatusConflict),
+    Status:     http.StatusConflict,
+    Detail:     "The user likely exists already, send it again with ?force=true to create it anyway",
+    Instance:   instance,
+    Code:       "possible_duplicate",
+    Candidates: duplicates.Candidates,
+  }
+}
+
+// respondWithDuplicates answers 409 when a new user likely exists already,
+// see duplicatesOf
+func (a *Application) respondWithDuplicates(w http.ResponseWriter, r *http.Request, n *user.User) bool {
+  err := a.duplicatesOf(r, n)
+
+  var duplicates *PossibleDuplicate
+  switch {
+  case err == nil:
+    return false
+  case errors.As(err, &duplicates):
+    writeProblem(w, duplicateProblem(r.URL.RequestURI(), duplicates))
+  default:
+    respondWithBadRequest(w, r, err)
+  }
+
+  return true
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Merge
+// -------------------------------------------------------------------------- //
+
+// Merge is the body of POST /users/merge. The user Merge is merged into the
+// user Keep, which takes the fields listed in Take from it, along with the
+// fields it lacks. Both are referenced as in the routes, see userIdOf.
+type Merge struct {
+  Keep  UserRef  `json:"keep"`
+  Merge UserRef  `json:"merge"`
+  Take  []string `json:"take,omitempty"`
+}
+
+// mergeUsers answers the kept user once merged. Its If-Match header applies to
+// the kept user, whose version the merge increments.
+func (a *Application) mergeUsers(w http.ResponseWriter, r *http.Request) {
+  if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+    respondWithProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "The payload must be sent as application/json")
+    return
+  }
+
+  merge := Merge{}
+
+  defer r.Body.Close()
+
+  decoder := json.NewDecoder(r.Body)
+  decoder.DisallowUnknownFields()
+
+  if err := decoder.Decode(&merge); err != nil {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload must be a JSON object with keep, merge and take")
+    return
+  }
+
+  keepId, ok := a.userIdFromRequest(w, r, string(merge.Keep))
+  if !ok {
+    return
+  }
+
+  mergeId, ok := a.userIdFromRequest(w, r, string(merge.Merge))
+  if !ok {
+    return
+  }
+
+  if keepId == mergeId {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "keep and merge must be the ids of two distinct users")
+    return
+  }
+
+  current := user.User{Id: keepId}
+  if err := a.Users.GetUser(&current); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  version, ok := a.expectedVersion(w, r, &current)
+  if !ok {
+    return
+  }
+
+  kept := user.User{Id: keepId}
+
+  err := user.RunTransaction(a.usersFor(r), func(tx user.UserRepository) error {
+    kept    = user.User{Id: keepId}
+    merged := user.User{Id: mergeId}
+
+    if err := tx.GetUser(&kept); err != nil {
+      return err
+    }
+
+    if version != 0 && kept.Version != version {
+      return user.ErrVersionMismatch
+    }
+
+    if err := tx.GetUser(&merged); err != nil {
+      return err
+    }
+
+    if err := kept.Merge(&merged, merge.Take); err != nil {
+      return err
+    }
+
+    // UpdateUser resets the verification of a new email, which stays verified
+    // when it comes verified from the merged user
+    verified := kept.EmailVerified && kept.Email == merged.Email
+
+    // merged goes first to release its email
+    if err := tx.MergeUser(&merged, &kept); err != nil {
+      return err
+    }
+
+    if err := tx.UpdateUser(&kept); err != nil {
+      return err
+    }
+
+    if verified && !kept.EmailVerified {
+      return tx.VerifyEmail(&kept)
+    }
+
+    return nil
+  })
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+  } else {
+    respondWithUser(w, http.StatusOK, &kept)
+  }
+}
+
+// respondWithMergedUser redirects the requests for a user which is not found
+// because it was merged to the user which absorbed it
+func (a *Application) respondWithMergedUser(w http.ResponseWriter, r *http.Request, id int, err error) bool {
+  if !errors.Is(err, user.ErrUserNotFound) {
+    return false
+  }
+
+  into, err := a.Users.MergedInto(id)
+  if err != nil {
+    return false
+  }
+
+  // the user which absorbed it may be deleted or erased since, its route
+  // answering so
+  target := user.User{Id: into}
+  if a.findUser(&target, true) != nil {
+    receipt, err := a.Users.ErasedUser(into)
+    if err != nil || receipt.PublicId == "" {
+      return false
+    }
+
+    target.PublicId = receipt.PublicId
+  }
+
+  w.Header().Set("Location", "/user/" + target.PublicId)
+  respondHTTPCodeOnly(w, http.StatusMovedPermanently)
+
+  return true
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+  http    "net/http"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestPossibleDuplicate(t *testing.T) {
+  a := newTestApplication(t)
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "phone": "06 45 12 43 65"}`)
+
+  problem := Problem{}
+  decode(t, serve(t, a, "POST", "/user", `{"firstname": "Guillaume", "lastname": "Penot", "phone": "+33645124365"}`), http.StatusConflict, &problem)
+
+  if problem.Code != "possible_duplicate" || len(problem.Candidates) != 1 || problem.Candidates[0].PublicId != n.PublicId {
+    t.Errorf("the duplicate is answered with %+v", problem)
+  }
+
+  createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penot"}`)
+  decode(t, serve(t, a, "POST", "/user?force=true", `{"firstname": "Guillaume", "lastname": "Penot", "phone": "+33645124365"}`), http.StatusOK, nil)
+  decode(t, serve(t, a, "POST", "/user?force=maybe", `{"firstname": "Guillaume", "lastname": "Penot"}`), http.StatusBadRequest, nil)
+
+  result := DuplicatesResult{}
+  decode(t, serve(t, a, "GET", "/users/duplicates", ""), http.StatusOK, &result)
+
+  if result.Total != 2 || result.Data[0].Score < result.Data[1].Score {
+    t.Errorf("the duplicates are %+v", result)
+  }
+
+  decode(t, serve(t, a, "GET", "/users/duplicates?min_score=0.1&limit=1", ""), http.StatusOK, &result)
+
+  if result.Total != 3 || len(result.Data) != 1 {
+    t.Errorf("the duplicates limited to 1 are %d of %d", len(result.Data), result.Total)
+  }
+
+  decode(t, serve(t, a, "GET", "/users/duplicates?min_score=2", ""), http.StatusBadRequest, nil)
+}
+
+func TestMergeUsers(t *testing.T) {
+  a := newTestApplication(t)
+
+  kept   := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+  merged := createTestUser(t, a, `{"firstname": "Guy", "lastname": "Penaud", "phone": "06 45 12 43 65", "email": "guy@example.com"}`)
+  other  := createTestUser(t, a, `{"firstname": "Océane", "lastname": "Martin", "email": "oceane@example.com"}`)
+
+  result := user.User{}
+  decode(t, serve(t, a, "POST", "/users/merge", `{"keep": "`+kept.PublicId+`", "merge": "`+merged.PublicId+`", "take": ["firstname"]}`), http.StatusOK, &result)
+
+  if result.PublicId != kept.PublicId || result.Firstname != "Guy" || result.Phone != "+33645124365" || result.Email != "guy@example.com" {
+    t.Errorf("the merge kept %+v", result)
+  }
+
+  w := serve(t, a, "GET", "/user/" + merged.PublicId, "")
+  if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/user/" + kept.PublicId {
+    t.Errorf("GET of the merged user: status %d, Location %q", w.Code, w.Header().Get("Location"))
+  }
+
+  tests := []struct {
+    body string
+    code int
+  }{
+    {`{"keep": "` + kept.PublicId + `", "merge": "` + kept.PublicId + `"}`, http.StatusBadRequest},
+    {`{"keep": "` + kept.PublicId + `", "merge": "someone"}`, http.StatusBadRequest},
+    {`{"keep": "0", "merge": "` + other.PublicId + `"}`, http.StatusBadRequest},
+    {`{"keep": "` + kept.PublicId + `", "merge": "01HV3KA2M8P0S3V6X9Z1C4F7HJ"}`, http.StatusNotFound},
+    {`{"keep": "` + kept.PublicId + `", "merge": "` + merged.PublicId + `"}`, http.StatusNotFound},
+    {`{"keep": "` + kept.PublicId + `", "merge": "` + other.PublicId + `", "take": ["id"]}`, http.StatusUnprocessableEntity},
+    {`{"keep": "` + kept.PublicId + `", "merge": "` + other.PublicId + `", "force": true}`, http.StatusBadRequest},
+  }
+
+  for _, test := range tests {
+    if w := serve(t, a, "POST", "/users/merge", test.body); w.Code != test.code {
+      t.Errorf("POST /users/merge %s: status %d, want %d", test.body, w.Code, test.code)
+    }
+  }
+
+  body := `{"keep": "` + kept.PublicId + `", "merge": "` + other.PublicId + `"}`
+
+  decode(t, serve(t, a, "POST", "/users/merge", body, "Content-Type", "text/plain"), http.StatusUnsupportedMediaType, nil)
+  decode(t, serve(t, a, "POST", "/users/merge", body, "If-Match", userETag(&kept)), http.StatusPreconditionFailed, nil)
+
+  a.Config.Server.RequireIfMatch = true
+  decode(t, serve(t, a, "POST", "/users/merge", body), http.StatusPreconditionRequired, nil)
+
+  decode(t, serve(t, a, "POST", "/users/merge", body, "If-Match", userETag(&result)), http.StatusOK, &result)
+
+  if result.Version != 3 || result.Email != "guy@example.com" {
+    t.Errorf("the conditional merge kept %+v", result)
+  }
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+  fmt     "fmt"
+  http    "net/http"
+  json    "encoding/json"
+  log     "github.com/sirupsen/logrus"
+  notify  "github.com/gpenaud/needys-api-user/internal/notify"
+  strings "strings"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+var emailLog *log.Entry
+
+func init() {
+  emailLog = log.WithFields(log.Fields{
+    "_file": "internal/email.go",
+    "_type": "router",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Email verification
+// -------------------------------------------------------------------------- //
+
+// verificationMessage builds the email carrying a fresh verification token
+func (a *Application) verificationMessage(n *user.User) notify.Message {
+  token, expiresAt := a.EmailTokens.Issue(n, time.Now())
+
+  return notify.Message{
+    To:      n.Email,
+    Subject: "Confirm your email address",
+    Body: fmt.Sprintf(
+      "Hello %s,\n\nplease confirm your email address with the following code, valid until %s:\n\n%s\n",
+      n.Firstname, expiresAt.Format("2006-01-02 15:04 MST"), token,
+    ),
+  }
+}
+
+// emailChanged sends the verification of a new email in the background: the
+// write already succeeded and a client can ask for another message anyway
+func (a *Application) emailChanged(previous string, n *user.User) {
+  if n.Email == "" || n.EmailVerified || strings.EqualFold(previous, n.Email) {
+    return
+  }
+
+  message := a.verificationMessage(n)
+  id      := n.Id
+
+  go func() {
+    if err := a.Notifier.Send(message); err != nil {
+      emailLog.WithFields(log.Fields{
+        "error":   err,
+        "user_id": id,
+      }).Error("email verification cannot be sent")
+    }
+  }()
+}
+
+// requestEmailVerification sends a new verification token to the user email
+func (a *Application) requestEmailVerification(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  n := user.User{Id: id}
+
+  if err := a.Users.GetUser(&n); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  if n.Email == "" {
+    respondWithUserError(w, r, user.ValidationError("email_missing", "the user has no email to verify"))
+    return
+  }
+
+  if n.EmailVerified {
+    respondWithUserError(w, r, user.ConflictError("email_verified", "the email is already verified"))
+    return
+  }
+
+  if err := a.Notifier.Send(a.verificationMessage(&n)); err != nil {
+    emailLog.WithFields(log.Fields{
+      "error":   err,
+      "user_id": id,
+    }).Error("email verification cannot be sent")
+
+    respondWithProblem(w, r, http.StatusServiceUnavailable, "notification_failed", "The verification email cannot be sent, try again later")
+    return
+  }
+
+  respondHTTPCodeOnly(w, http.StatusAccepted)
+}
+
+type EmailVerification struct {
+  Token string
+}
+
+// verifyEmail checks the token received by email and marks the email verified
+func (a *Application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  verification := EmailVerification{}
+
+  defer r.Body.Close()
+
+  if err := json.NewDecoder(r.Body).Decode(&verification); err != nil || verification.Token == "" {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload must be a JSON object holding the token")
+    return
+  }
+
+  n := user.User{Id: id}
+
+  if err := a.Users.GetUser(&n); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  if err := a.EmailTokens.Check(&n, verification.Token, time.Now()); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  if !n.EmailVerified {
+    if err := a.usersFor(r).VerifyEmail(&n); err != nil {
+      respondWithUserError(w, r, err)
+      return
+    }
+  }
+
+  respondWithUser(w, http.StatusOK, &n)
+}
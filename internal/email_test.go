@@ -0,0 +1,56 @@
+package internal
+
+import (
+  http    "net/http"
+  testing "testing"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestEmailVerification(t *testing.T) {
+  a := newTestApplication(t)
+
+  n    := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.com"}`)
+  path := "/user/" + n.PublicId + "/email/"
+
+  if n.EmailVerified {
+    t.Fatal("a created user has a verified email")
+  }
+
+  if w := serve(t, a, "POST", path + "verification", ""); w.Code != http.StatusAccepted {
+    t.Errorf("POST %sverification: status %d", path, w.Code)
+  }
+
+  token, _ := a.EmailTokens.Issue(&n, time.Now())
+
+  decode(t, serve(t, a, "POST", path + "verify", `{"token": "forged"}`), http.StatusUnprocessableEntity, nil)
+  decode(t, serve(t, a, "POST", path + "verify", `{}`), http.StatusBadRequest, nil)
+
+  verified := user.User{}
+  decode(t, serve(t, a, "POST", path + "verify", `{"token": "`+token+`"}`), http.StatusOK, &verified)
+
+  if !verified.EmailVerified {
+    t.Errorf("the verified user is %+v", verified)
+  }
+
+  decode(t, serve(t, a, "POST", path + "verification", ""), http.StatusConflict, nil)
+
+  // a token stops working once the email changes
+  decode(t, serve(t, a, "PUT", "/user/" + n.PublicId, `{"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.org"}`), http.StatusOK, &verified)
+  decode(t, serve(t, a, "POST", path + "verify", `{"token": "`+token+`"}`), http.StatusUnprocessableEntity, nil)
+
+  if verified.EmailVerified {
+    t.Error("the changed email is still verified")
+  }
+}
+
+func TestEmailTaken(t *testing.T) {
+  a := newTestApplication(t)
+
+  createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.com"}`)
+  decode(t, serve(t, a, "POST", "/user", `{"firstname": "Océane", "lastname": "Martin", "email": "Guillaume@EXAMPLE.com"}`), http.StatusConflict, nil)
+  decode(t, serve(t, a, "POST", "/user", `{"firstname": "Océane", "lastname": "Martin", "email": "oceane"}`), http.StatusUnprocessableEntity, nil)
+
+  n := createTestUser(t, a, `{"firstname": "Océane", "lastname": "Martin"}`)
+  decode(t, serve(t, a, "POST", "/user/" + n.PublicId + "/email/verification", ""), http.StatusUnprocessableEntity, nil)
+}
@@ -1,8 +1,10 @@
 package internal
 
 import (
+  errors  "errors"
   fmt     "fmt"
   http    "net/http"
+  io      "io"
   json    "encoding/json"
   log     "github.com/sirupsen/logrus"
   mux     "github.com/gorilla/mux"
@@ -33,11 +35,6 @@ func respondHTTPCodeOnly(w http.ResponseWriter, code int) {
   w.WriteHeader(code)
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-  handlerLog.Error(message)
-  respondWithJSON(w, code, map[string]string{"error": message})
-}
-
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
   response, _ := json.Marshal(payload)
   handlerLog.Debug(fmt.Sprintf("JSON response: %s", response))
@@ -47,19 +44,36 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
   w.Write(response)
 }
 
-// -------------------------------------------------------------------------- //
-// Maintenance handlers
+// decodeUserPayload reads a JSON user from the request body, answering 415 on
+// a wrong Content-Type, 400 on malformed JSON and 422 on unknown fields or
+// rule violations (see user.UserRules)
+func decodeUserPayload(w http.ResponseWriter, r *http.Request, n *user.User) bool {
+  if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+    respondWithProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "The payload must be sent as application/json")
+    return false
+  }
+
+  defer r.Body.Close()
 
-func (a *Application) InitializeDB(w http.ResponseWriter, _ *http.Request) {
-  initialized, err := a.InitializeDatabase()
+  decoder := json.NewDecoder(r.Body)
+  decoder.DisallowUnknownFields()
 
-  if (initialized) {
-    payload := map[string]bool{"initialized": initialized}
-    respondWithJSON(w, http.StatusOK, payload)
-  } else {
-    handlerLog.Info(err)
-    respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Database is not initializable - Error: %s", err.Error()))
+  if err := decoder.Decode(n); err != nil {
+    if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+      respondWithUserError(w, r, user.InvalidUserError(user.UnknownFieldViolation(strings.Trim(field, `"`))))
+    } else {
+      respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload is invalid")
+    }
+
+    return false
   }
+
+  if err := n.Validate(); err != nil {
+    respondWithUserError(w, r, err)
+    return false
+  }
+
+  return true
 }
 
 // -------------------------------------------------------------------------- //
@@ -67,85 +81,334 @@ func (a *Application) InitializeDB(w http.ResponseWriter, _ *http.Request) {
 func (a *Application) createUser(w http.ResponseWriter, r *http.Request) {
   user := user.User{}
 
-  decoder := json.NewDecoder(r.Body)
-  err := decoder.Decode(&user)
+  if !decodeUserPayload(w, r, &user) {
+    return
+  }
 
-  handlerLog.Debug(r.Body)
+  idempotent, ok := a.idempotentRequest(w, r, &user)
+  if !ok {
+    return
+  }
 
-  if err != nil {
-    respondWithError(w, http.StatusBadRequest, "The payload is invalid")
+  if a.respondWithDuplicates(w, r, &user) {
     return
   }
-  defer r.Body.Close()
 
-  err = user.CreateUser(a.DB)
+  var err error
+  if idempotent != nil {
+    var replayed bool
+    if replayed, err = a.createUserOnce(w, r, &user, idempotent); replayed {
+      return
+    }
+  } else {
+    err = a.usersFor(r).CreateUser(&user)
+  }
 
   if err != nil {
-    respondWithError(w, http.StatusInternalServerError, err.Error())
+    respondWithUserError(w, r, err)
   } else {
-    respondWithJSON(w, http.StatusOK, user)
+    a.emailChanged("", &user)
+    respondWithUser(w, http.StatusOK, &user)
   }
 }
 
+// userIdFromPath reads the {id} route variable, see userIdOf. It answers 400
+// when the variable is not a user id and 404 when no user has it.
+func (a *Application) userIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+  return a.userIdFromRequest(w, r, mux.Vars(r)["id"])
+}
+
+// userIdFromRequest resolves a reference read from the request as
+// userIdFromPath does
+func (a *Application) userIdFromRequest(w http.ResponseWriter, r *http.Request, reference string) (int, bool) {
+  id, err := a.userIdOf(reference)
+
+  var userErr *user.Error
+  if errors.As(err, &userErr) && userErr.Kind == user.KindValidation {
+    respondWithBadRequest(w, r, err)
+    return 0, false
+  }
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return 0, false
+  }
+
+  return id, true
+}
+
+// userIdOf resolves the reference of a user, its public id or, during the
+// transition to public ids, its integer id. It fails with a validation error
+// when the reference is neither and ErrUserNotFound when no user, even merged
+// or erased, has it.
+func (a *Application) userIdOf(reference string) (int, error) {
+  if publicId, ok := user.ParseULID(reference); ok {
+    return a.Users.UserIdOf(publicId)
+  }
+
+  id, err := strconv.Atoi(reference)
+  if err != nil || id < 1 {
+    return 0, user.ValidationError("invalid_parameter", "the user id %s is invalid", reference)
+  }
+
+  // the integer ids can be enumerated, they stop resolving once the clients
+  // moved to the public ids
+  if !a.Config.Server.IntegerIds {
+    return 0, user.ErrUserNotFound
+  }
+
+  return id, nil
+}
+
+// UserRef is the reference of a user in a payload, given as a string or, for
+// an integer id, as a number too
+type UserRef string
+
+func (ref *UserRef) UnmarshalJSON(data []byte) error {
+  id := 0
+  if err := json.Unmarshal(data, &id); err == nil {
+    *ref = UserRef(strconv.Itoa(id))
+    return nil
+  }
+
+  return json.Unmarshal(data, (*string)(ref))
+}
+
+// findUser reads the user n.Id, even when it is deleted if includeDeleted is
+// set
+func (a *Application) findUser(n *user.User, includeDeleted bool) error {
+  err := a.Users.GetUser(n)
+  if includeDeleted && errors.Is(err, user.ErrUserNotFound) && a.Users.GetDeletedUser(n) == nil {
+    return nil
+  }
+
+  return err
+}
+
 func (a *Application) getUser(w http.ResponseWriter, r *http.Request) {
-  vars := mux.Vars(r)
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
 
-  id, err := strconv.Atoi(vars["id"])
+  includeDeleted, err := parseBoolParameter(r, "include_deleted")
   if err != nil {
-    respondWithError(w, http.StatusBadRequest, fmt.Sprintf("The user with Id %d is invalid", id))
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  asOf, err := parseTimeParameter(r, "as_of")
+  if err != nil {
+    respondWithBadRequest(w, r, err)
     return
   }
 
   user := user.User{Id: id}
-  err = user.GetUser(a.DB)
 
-  if err != nil {
-    respondWithError(w, http.StatusInternalServerError, err.Error())
+  if asOf != nil {
+    err = a.findUserAsOf(&user, *asOf, includeDeleted)
   } else {
-    respondWithJSON(w, http.StatusOK, user)
+    err = a.findUser(&user, includeDeleted)
+  }
+
+  if a.respondWithMergedUser(w, r, id, err) || a.respondWithErasedUser(w, r, id, err) {
+    return
+  }
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+  } else if !respondNotModified(w, r, &user) {
+    respondWithUser(w, http.StatusOK, &user)
   }
 }
 
 func (a *Application) getUsers(w http.ResponseWriter, r *http.Request) {
-  user       := user.User{}
-  users, err := user.GetUsers(a.DB)
+  w.Header().Set("Vary", "Accept")
+
+  format, err := listingFormat(r)
+  if err == errNotAcceptable {
+    respondWithProblem(w, r, http.StatusNotAcceptable, "not_acceptable", errNotAcceptable.Message)
+    return
+  }
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  query, err := parsePageQuery(r)
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  if format != "json" {
+    a.exportUsers(w, r, query, format)
+    return
+  }
+
+  page, err := a.Users.ListUsers(query)
 
   if err != nil {
-    respondWithError(w, http.StatusInternalServerError, err.Error())
+    respondWithUserError(w, r, err)
   } else {
-    respondWithJSON(w, http.StatusOK, users)
+    respondWithJSON(w, http.StatusOK, newUserList(w, r, page))
   }
 }
 
+func (a *Application) searchUsers(w http.ResponseWriter, r *http.Request) {
+  query, limit, err := parseSearchQuery(r)
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  hits   := a.Search.Search(query)
+  result := SearchResult{Data: hits, Total: len(hits)}
+
+  if len(hits) > limit {
+    result.Data = hits[:limit]
+  }
+
+  respondWithJSON(w, http.StatusOK, result)
+}
+
 func (a *Application) updateUser(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
   user := user.User{}
 
-  decoder := json.NewDecoder(r.Body)
-  err := decoder.Decode(&user)
+  if !decodeUserPayload(w, r, &user) {
+    return
+  }
+
+  previous := user
+  previous.Id = id
+  if err := a.Users.GetUser(&previous); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  if user.PublicId != "" && user.PublicId != previous.PublicId {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload public id does not match the user of the path")
+    return
+  }
+
+  user.Id = id
+
+  version, ok := a.expectedVersion(w, r, &previous)
+  if !ok {
+    return
+  }
+
+  user.Version = version
+
+  err := a.usersFor(r).UpdateUser(&user)
+
   if err != nil {
-    respondWithError(w, http.StatusBadRequest, "The payload is invalid")
+    respondWithUserError(w, r, err)
+  } else {
+    a.emailChanged(previous.Email, &user)
+    respondWithUser(w, http.StatusOK, &user)
+  }
+}
+
+func (a *Application) patchUser(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  if contentType := r.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, user.MergePatchContentType) {
+    respondWithProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("PATCH expects an %s document", user.MergePatchContentType))
+    return
+  }
+
+  patch, err := io.ReadAll(r.Body)
+  if err != nil {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload is invalid")
     return
   }
   defer r.Body.Close()
 
-  err = user.UpdateUser(a.DB)
+  user := user.User{Id: id}
+
+  if err = a.Users.GetUser(&user); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  version, ok := a.expectedVersion(w, r, &user)
+  if !ok {
+    return
+  }
+
+  previous := user.Email
+
+  if err = user.MergePatch(patch); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  user.Version = version
+
+  if err = user.Validate(); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  err = a.usersFor(r).UpdateUser(&user)
 
   if err != nil {
-    respondWithError(w, http.StatusInternalServerError, err.Error())
+    respondWithUserError(w, r, err)
   } else {
-    respondWithJSON(w, http.StatusOK, user)
+    a.emailChanged(previous, &user)
+    respondWithUser(w, http.StatusOK, &user)
   }
 }
 
 func (a *Application) deleteUser(w http.ResponseWriter, r *http.Request) {
-  vars := mux.Vars(r)
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
 
-  user := user.User{Firstname: vars["firstname"], Lastname: vars["lastname"]}
-  err  := user.DeleteUser(a.DB)
+  user := user.User{Id: id}
+
+  if err := a.Users.GetUser(&user); err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  version, ok := a.expectedVersion(w, r, &user)
+  if !ok {
+    return
+  }
+
+  user.Version = version
+  err := a.usersFor(r).DeleteUser(&user)
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+  } else {
+    respondWithUser(w, http.StatusOK, &user)
+  }
+}
+
+func (a *Application) restoreUser(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  user := user.User{Id: id}
+  err  := a.usersFor(r).RestoreUser(&user)
 
   if err != nil {
-    respondWithError(w, http.StatusInternalServerError, err.Error())
+    respondWithUserError(w, r, err)
   } else {
-    respondWithJSON(w, http.StatusOK, user)
+    respondWithUser(w, http.StatusOK, &user)
   }
 }
@@ -0,0 +1,305 @@
+package internal
+
+import (
+  httptest "net/http/httptest"
+  http     "net/http"
+  json     "encoding/json"
+  strings  "strings"
+  testing  "testing"
+  time     "time"
+  user     "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Test application
+// -------------------------------------------------------------------------- //
+
+// newTestApplication serves the routes over a MemoryRepository, configured as
+// the defaults of the command line
+func newTestApplication(t *testing.T) *Application {
+  t.Helper()
+
+  a := &Application{Config: &Configuration{}, Version: &Version{}}
+
+  a.Config.Verbosity              = "fatal"
+  a.Config.LogFormat              = "text"
+  a.Config.DefaultRegion          = "FR"
+  a.Config.Server.IntegerIds      = true
+  a.Config.Notifier.Kind          = "log"
+  a.Config.Email.TokenSecret      = "test secret"
+  a.Config.Email.TokenTTL         = 24 * time.Hour
+  a.Config.Deletion.Retention     = 30 * 24 * time.Hour
+  a.Config.Idempotency.Window     = 24 * time.Hour
+  a.Config.Database.Driver        = "memory"
+
+  a.Initialize()
+
+  return a
+}
+
+// serve runs one request through the router, the body being sent as JSON
+// unless a Content-Type is given in headers
+func serve(t *testing.T, a *Application, method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+  t.Helper()
+
+  r := httptest.NewRequest(method, target, strings.NewReader(body))
+  if body != "" {
+    r.Header.Set("Content-Type", "application/json")
+  }
+  for i := 0; i+1 < len(headers); i += 2 {
+    r.Header.Set(headers[i], headers[i+1])
+  }
+
+  w := httptest.NewRecorder()
+  a.Router.ServeHTTP(w, r)
+
+  return w
+}
+
+// decode reads the JSON body of a response into v, failing on another status
+// than code
+func decode(t *testing.T, w *httptest.ResponseRecorder, code int, v interface{}) {
+  t.Helper()
+
+  if w.Code != code {
+    t.Fatalf("status %d, want %d: %s", w.Code, code, w.Body.String())
+  }
+
+  if v != nil {
+    if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+      t.Fatalf("invalid JSON response %q: %s", w.Body.String(), err)
+    }
+  }
+}
+
+// createTestUser creates a user through POST /user
+func createTestUser(t *testing.T, a *Application, body string) user.User {
+  t.Helper()
+
+  n := user.User{}
+  decode(t, serve(t, a, "POST", "/user", body), http.StatusOK, &n)
+
+  return n
+}
+
+// -------------------------------------------------------------------------- //
+// 2. CRUD handlers
+// -------------------------------------------------------------------------- //
+
+func TestCreateAndGetUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.com"}`)
+  if created.PublicId == "" || created.Firstname != "Guillaume" || created.Version != 1 {
+    t.Fatalf("unexpected created user %+v", created)
+  }
+
+  for _, id := range []string{created.PublicId, "1"} {
+    w := serve(t, a, "GET", "/user/"+id, "")
+
+    found := user.User{}
+    decode(t, w, http.StatusOK, &found)
+
+    if found.PublicId != created.PublicId || found.Email != "guillaume@example.com" {
+      t.Errorf("GET /user/%s = %+v, want %+v", id, found, created)
+    }
+    if strings.Contains(w.Body.String(), `"Id"`) {
+      t.Errorf("GET /user/%s exposes the integer id: %s", id, w.Body.String())
+    }
+  }
+}
+
+func TestUpdateUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  updated := user.User{}
+  decode(t, serve(t, a, "PUT", "/user/"+created.PublicId, `{"firstname": "Guillaume", "lastname": "Martin"}`), http.StatusOK, &updated)
+
+  if updated.Lastname != "Martin" || updated.Version != 2 {
+    t.Errorf("unexpected updated user %+v", updated)
+  }
+
+  found := user.User{}
+  decode(t, serve(t, a, "GET", "/user/"+created.PublicId, ""), http.StatusOK, &found)
+
+  if found.Lastname != "Martin" {
+    t.Errorf("the update is not stored: %+v", found)
+  }
+}
+
+func TestDeleteUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  decode(t, serve(t, a, "DELETE", "/user/"+created.PublicId, ""), http.StatusOK, nil)
+  decode(t, serve(t, a, "GET", "/user/"+created.PublicId, ""), http.StatusNotFound, nil)
+  decode(t, serve(t, a, "DELETE", "/user/"+created.PublicId, ""), http.StatusNotFound, nil)
+}
+
+func TestRestoreUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  decode(t, serve(t, a, "POST", "/user/"+created.PublicId+"/restore", ""), http.StatusConflict, nil)
+  decode(t, serve(t, a, "DELETE", "/user/"+created.PublicId, ""), http.StatusOK, nil)
+
+  deleted := user.User{}
+  decode(t, serve(t, a, "GET", "/user/"+created.PublicId+"?include_deleted=true", ""), http.StatusOK, &deleted)
+
+  if deleted.DeletedAt == nil {
+    t.Errorf("the deleted user is %+v", deleted)
+  }
+
+  list := UserList{}
+  decode(t, serve(t, a, "GET", "/users?include_deleted=true", ""), http.StatusOK, &list)
+
+  if len(list.Data) != 1 {
+    t.Errorf("the listing of the deleted users holds %d users", len(list.Data))
+  }
+
+  decode(t, serve(t, a, "POST", "/user/"+created.PublicId+"/restore", ""), http.StatusOK, nil)
+  decode(t, serve(t, a, "GET", "/user/"+created.PublicId, ""), http.StatusOK, nil)
+}
+
+func TestPurgeDeletedUsers(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+  decode(t, serve(t, a, "DELETE", "/user/"+created.PublicId, ""), http.StatusOK, nil)
+
+  if purged, err := a.PurgeDeletedUsers(); err != nil || purged != 0 {
+    t.Errorf("PurgeDeletedUsers within the retention = %d, %v", purged, err)
+  }
+
+  a.Config.Deletion.Retention = -time.Minute
+
+  if purged, err := a.PurgeDeletedUsers(); err != nil || purged != 1 {
+    t.Errorf("PurgeDeletedUsers past the retention = %d, %v", purged, err)
+  }
+
+  decode(t, serve(t, a, "POST", "/user/"+created.PublicId+"/restore", ""), http.StatusNotFound, nil)
+}
+
+func TestGetUsers(t *testing.T) {
+  a := newTestApplication(t)
+
+  for _, name := range []string{"Anna", "Bruno", "Carla"} {
+    createTestUser(t, a, `{"firstname": "`+name+`", "lastname": "Roux"}`)
+  }
+
+  list := UserList{}
+  decode(t, serve(t, a, "GET", "/users", ""), http.StatusOK, &list)
+
+  if len(list.Data) != 3 {
+    t.Fatalf("GET /users lists %d users, want 3", len(list.Data))
+  }
+}
+
+func TestUserIdFromPath(t *testing.T) {
+  tests := []struct {
+    integerIds bool
+    id         string
+    code       int
+  }{
+    {true, "1", http.StatusOK},
+    {true, "2", http.StatusNotFound},
+    {true, "0", http.StatusBadRequest},
+    {true, "abc", http.StatusBadRequest},
+    {true, "01HV3K8Z4X6N7Q2R5T9W0YBCDE", http.StatusNotFound},
+    {false, "1", http.StatusNotFound},
+    {false, "abc", http.StatusBadRequest},
+  }
+
+  for _, test := range tests {
+    a := newTestApplication(t)
+    a.Config.Server.IntegerIds = test.integerIds
+
+    createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+    if w := serve(t, a, "GET", "/user/"+test.id, ""); w.Code != test.code {
+      t.Errorf("GET /user/%s with integer ids %t: status %d, want %d", test.id, test.integerIds, w.Code, test.code)
+    }
+  }
+}
+
+func TestPublicIds(t *testing.T) {
+  a := newTestApplication(t)
+  a.Config.Server.IntegerIds = false
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  if _, ok := user.ParseULID(created.PublicId); !ok {
+    t.Fatalf("the created user has the public id %q", created.PublicId)
+  }
+
+  decode(t, serve(t, a, "GET", "/user/"+strings.ToLower(created.PublicId), ""), http.StatusOK, nil)
+
+  for _, target := range []string{"/users", "/users/changes", "/users?format=ndjson"} {
+    if body := serve(t, a, "GET", target, "").Body.String(); !strings.Contains(body, created.PublicId) || strings.Contains(body, `"id"`) || strings.Contains(body, `"Id"`) {
+      t.Errorf("GET %s exposes the integer id: %s", target, body)
+    }
+  }
+}
+
+func TestDecodeUserPayload(t *testing.T) {
+  tests := []struct {
+    contentType string
+    body        string
+    code        int
+  }{
+    {"application/json", `{"firstname": "Guillaume", "lastname": "Penaud"}`, http.StatusOK},
+    {"text/plain", `{"firstname": "Guillaume", "lastname": "Penaud"}`, http.StatusUnsupportedMediaType},
+    {"application/json", `{"firstname": "Guillaume",`, http.StatusBadRequest},
+    {"application/json", `{"firstname": "Guillaume", "lastname": "Penaud", "age": 40}`, http.StatusUnprocessableEntity},
+    {"application/json", `{"firstname": "Guillaume"}`, http.StatusUnprocessableEntity},
+  }
+
+  for _, test := range tests {
+    a := newTestApplication(t)
+
+    if w := serve(t, a, "POST", "/user", test.body, "Content-Type", test.contentType); w.Code != test.code {
+      t.Errorf("POST /user %s %s: status %d, want %d", test.contentType, test.body, w.Code, test.code)
+    }
+  }
+}
+
+func TestPatchUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud", "phone": "+33645124365"}`)
+
+  patched := user.User{}
+  decode(t, serve(t, a, "PATCH", "/user/"+created.PublicId, `{"lastname": "Martin"}`, "Content-Type", user.MergePatchContentType), http.StatusOK, &patched)
+
+  if patched.Lastname != "Martin" || patched.Firstname != "Guillaume" || patched.Phone != "+33645124365" {
+    t.Errorf("unexpected patched user %+v", patched)
+  }
+
+  decode(t, serve(t, a, "PATCH", "/user/"+created.PublicId, `{"lastname": "Martin"}`, "Content-Type", "text/plain"), http.StatusUnsupportedMediaType, nil)
+  decode(t, serve(t, a, "PATCH", "/user/"+created.PublicId, `{"lastname": null}`, "Content-Type", user.MergePatchContentType), http.StatusUnprocessableEntity, nil)
+}
+
+// the writes target a single user by id, and answer 404 when it is missing
+func TestWritesOfUnknownUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  homonym := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+  decode(t, serve(t, a, "POST", "/user?force=true", `{"firstname": "Guillaume", "lastname": "Penaud", "email": "guillaume@example.com"}`), http.StatusOK, nil)
+
+  decode(t, serve(t, a, "PUT", "/user/3", `{"firstname": "Guillaume", "lastname": "Martin"}`), http.StatusNotFound, nil)
+  decode(t, serve(t, a, "PATCH", "/user/3", `{"lastname": "Martin"}`, "Content-Type", user.MergePatchContentType), http.StatusNotFound, nil)
+  decode(t, serve(t, a, "DELETE", "/user/3", ""), http.StatusNotFound, nil)
+
+  decode(t, serve(t, a, "DELETE", "/user/"+homonym.PublicId, ""), http.StatusOK, nil)
+
+  list := UserList{}
+  decode(t, serve(t, a, "GET", "/users", ""), http.StatusOK, &list)
+
+  if len(list.Data) != 1 || list.Data[0].Email != "guillaume@example.com" {
+    t.Errorf("the deletion of one homonym left %+v", list.Data)
+  }
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+  rand    "crypto/rand"
+  hex     "encoding/hex"
+  http    "net/http"
+  strings "strings"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Actors and request ids
+// -------------------------------------------------------------------------- //
+
+// the actor is whoever the caller says it is, this service authenticating
+// nobody: the gateway in front of it is expected to set the header
+const actorHeader     = "X-Actor"
+const requestIdHeader = "X-Request-Id"
+
+const anonymousActor = "anonymous"
+
+// withRequestId gives every request an id, unless the caller sent a usable
+// one, and echoes it in the response
+func withRequestId(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    id := r.Header.Get(requestIdHeader)
+
+    if id == "" || len(id) > 64 {
+      random := make([]byte, 16)
+      rand.Read(random)
+
+      id = hex.EncodeToString(random)
+      r.Header.Set(requestIdHeader, id)
+    }
+
+    w.Header().Set(requestIdHeader, id)
+    next.ServeHTTP(w, r)
+  })
+}
+
+// requestActor names who makes the changes of the request
+func requestActor(r *http.Request) user.Actor {
+  name := strings.TrimSpace(r.Header.Get(actorHeader))
+  if name == "" || len(name) > 254 {
+    name = anonymousActor
+  }
+
+  return user.Actor{Name: name, RequestId: r.Header.Get(requestIdHeader)}
+}
+
+// -------------------------------------------------------------------------- //
+// 2. History
+// -------------------------------------------------------------------------- //
+
+// HistoryResult is the body of GET /user/{id}/history, oldest change first
+type HistoryResult struct {
+  Data []user.Change `json:"data"`
+}
+
+func (a *Application) getHistory(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  history, err := a.Users.History(id)
+
+  if err == nil && len(history) == 0 {
+    // tell a user with no recorded change from a missing one
+    err = a.findUser(&user.User{Id: id}, true)
+  }
+
+  if a.respondWithMergedUser(w, r, id, err) || a.respondWithErasedUser(w, r, id, err) {
+    return
+  }
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+  } else {
+    respondWithJSON(w, http.StatusOK, HistoryResult{Data: history})
+  }
+}
+
+// findUserAsOf reads the user n.Id as it was at the given time, even when it
+// was deleted then if includeDeleted is set
+func (a *Application) findUserAsOf(n *user.User, at time.Time, includeDeleted bool) error {
+  if err := user.UserAsOf(a.Users, n, at); err != nil {
+    return err
+  }
+
+  if n.DeletedAt != nil && !includeDeleted {
+    return user.ErrUserNotFound
+  }
+
+  return nil
+}
+
+// parseTimeParameter reads an RFC 3339 time from the query, nil when it is
+// missing
+func parseTimeParameter(r *http.Request, name string) (*time.Time, error) {
+  value := r.URL.Query().Get(name)
+  if value == "" {
+    return nil, nil
+  }
+
+  parsed, err := time.Parse(time.RFC3339Nano, value)
+  if err != nil {
+    return nil, user.ValidationError("invalid_parameter", "%s must be an RFC 3339 time, such as 2024-01-31T12:00:00Z", name)
+  }
+
+  return &parsed, nil
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+  http     "net/http"
+  httptest "net/http/httptest"
+  strings  "strings"
+  testing  "testing"
+  time     "time"
+  user     "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestRequestActor(t *testing.T) {
+  tests := map[string]string{
+    "guillaume":              "guillaume",
+    "  guillaume ":           "guillaume",
+    "":                       anonymousActor,
+    strings.Repeat("a", 255): anonymousActor,
+  }
+
+  for header, want := range tests {
+    r := httptest.NewRequest("GET", "/users", nil)
+    r.Header.Set(actorHeader, header)
+
+    if actor := requestActor(r); actor.Name != want {
+      t.Errorf("requestActor(%.20q) = %q, want %q", header, actor.Name, want)
+    }
+  }
+}
+
+func TestGetHistory(t *testing.T) {
+  a := newTestApplication(t)
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+  before := time.Now()
+
+  w := serve(t, a, "PUT", "/user/" + n.PublicId, `{"firstname": "Guy", "lastname": "Penaud"}`, actorHeader, "dpo", requestIdHeader, "update-1")
+  if w.Code != http.StatusOK || w.Header().Get(requestIdHeader) != "update-1" {
+    t.Fatalf("the update answers %d with the request id %q", w.Code, w.Header().Get(requestIdHeader))
+  }
+  if w = serve(t, a, "GET", "/user/" + n.PublicId, ""); w.Header().Get(requestIdHeader) == "" {
+    t.Error("a request without id is not given one")
+  }
+
+  result := HistoryResult{}
+  decode(t, serve(t, a, "GET", "/user/" + n.PublicId + "/history", ""), http.StatusOK, &result)
+
+  if len(result.Data) != 2 || result.Data[0].Actor != anonymousActor || result.Data[1].Actor != "dpo" || result.Data[1].RequestId != "update-1" || result.Data[1].After.Firstname != "Guy" {
+    t.Errorf("the history is %+v", result.Data)
+  }
+
+  past := user.User{}
+  decode(t, serve(t, a, "GET", "/user/" + n.PublicId + "?as_of=" + before.UTC().Format(time.RFC3339Nano), ""), http.StatusOK, &past)
+
+  if past.Firstname != "Guillaume" {
+    t.Errorf("the user as of its creation is %+v", past)
+  }
+
+  decode(t, serve(t, a, "GET", "/user/" + n.PublicId + "?as_of=yesterday", ""), http.StatusBadRequest, nil)
+  decode(t, serve(t, a, "GET", "/user/" + n.PublicId + "?as_of=2000-01-01T00:00:00Z", ""), http.StatusNotFound, nil)
+  decode(t, serve(t, a, "GET", "/user/01HV3K8Z4X6N7Q2R5T9W0YBCDE/history", ""), http.StatusNotFound, nil)
+}
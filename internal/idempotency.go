@@ -0,0 +1,103 @@
+package internal
+
+import (
+  errors "errors"
+  fmt    "fmt"
+  http   "net/http"
+  json   "encoding/json"
+  sha256 "crypto/sha256"
+  hex    "encoding/hex"
+  time   "time"
+  user   "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Idempotent creations
+// -------------------------------------------------------------------------- //
+
+// clients retrying a creation send the same key, e.g. a UUID, so that the
+// user is created once whatever the number of attempts
+const idempotencyKeyHeader = "Idempotency-Key"
+const replayedHeader       = "Idempotent-Replayed"
+
+// idempotentRequest reads the Idempotency-Key of the creation of n. It answers
+// the remembered user when the request is a retry, and a problem when the key
+// is invalid or was used by another request. The request is nil when the
+// client sent no key.
+func (a *Application) idempotentRequest(w http.ResponseWriter, r *http.Request, n *user.User) (*user.IdempotentRequest, bool) {
+  key := r.Header.Get(idempotencyKeyHeader)
+  if key == "" {
+    return nil, true
+  }
+
+  if len(key) > user.MaxIdempotencyKeyLength {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_idempotency_key", fmt.Sprintf("The %s header exceeds %d characters", idempotencyKeyHeader, user.MaxIdempotencyKeyLength))
+    return nil, false
+  }
+
+  req := &user.IdempotentRequest{Key: key, Fingerprint: requestFingerprint(r, n)}
+  if a.replayRequest(w, r, req) {
+    return nil, false
+  }
+
+  return req, true
+}
+
+// requestFingerprint sums up what a creation asks for, the decoded user
+// rather than the body so that the spacing or the order of the members of a
+// retry do not matter
+func requestFingerprint(r *http.Request, n *user.User) string {
+  payload, _ := json.Marshal(n)
+
+  sum := sha256.New()
+  sum.Write([]byte(r.URL.RawQuery))
+  sum.Write([]byte{0})
+  sum.Write(payload)
+
+  return hex.EncodeToString(sum.Sum(nil))
+}
+
+// replayRequest answers the user remembered under the key of req, or 422 when
+// the key was used by another request. It returns false when nothing is
+// remembered under the key.
+func (a *Application) replayRequest(w http.ResponseWriter, r *http.Request, req *user.IdempotentRequest) bool {
+  remembered, err := a.Users.RememberedRequest(req.Key)
+  if errors.Is(err, user.ErrIdempotencyKeyNotFound) {
+    return false
+  }
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return true
+  }
+
+  if remembered.Fingerprint != req.Fingerprint {
+    respondWithProblem(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", fmt.Sprintf("The %s was already used by another request", idempotencyKeyHeader))
+    return true
+  }
+
+  w.Header().Set(replayedHeader, "true")
+  respondWithUser(w, http.StatusOK, remembered.User)
+  return true
+}
+
+// createUserOnce creates n and remembers it under the key of req, in the same
+// transaction so that concurrent retries cannot both create it. It returns
+// true when a concurrent retry won the race, the request being answered the
+// user it created.
+func (a *Application) createUserOnce(w http.ResponseWriter, r *http.Request, n *user.User, req *user.IdempotentRequest) (bool, error) {
+  err := a.usersFor(r).Transaction(func(tx user.UserRepository) error {
+    if err := tx.CreateUser(n); err != nil {
+      return err
+    }
+
+    req.User, req.ExpiresAt = n, time.Now().Add(a.Config.Idempotency.Window)
+    return tx.RememberRequest(req)
+  })
+
+  if errors.Is(err, user.ErrIdempotencyKeyTaken) && a.replayRequest(w, r, req) {
+    return true, nil
+  }
+
+  return false, err
+}
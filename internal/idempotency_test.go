@@ -0,0 +1,46 @@
+package internal
+
+import (
+  http    "net/http"
+  strings "strings"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestIdempotentCreation(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := user.User{}
+  w       := serve(t, a, "POST", "/user", `{"firstname": "Guillaume", "lastname": "Penaud"}`, idempotencyKeyHeader, "key-1")
+  decode(t, w, http.StatusOK, &created)
+
+  if w.Header().Get(replayedHeader) != "" {
+    t.Error("the creation is answered as a replay")
+  }
+
+  // a retry, however spaced, is answered the same user
+  replayed := user.User{}
+  w         = serve(t, a, "POST", "/user", `{"lastname":"Penaud","firstname":"Guillaume"}`, idempotencyKeyHeader, "key-1")
+  decode(t, w, http.StatusOK, &replayed)
+
+  if w.Header().Get(replayedHeader) != "true" || replayed.PublicId != created.PublicId || w.Header().Get("ETag") != `"1"` {
+    t.Errorf("the retry answers %+v with the headers %v", replayed, w.Header())
+  }
+
+  problem := Problem{}
+  decode(t, serve(t, a, "POST", "/user", `{"firstname": "Océane", "lastname": "Martin"}`, idempotencyKeyHeader, "key-1"), http.StatusUnprocessableEntity, &problem)
+
+  if problem.Code != "idempotency_key_reused" {
+    t.Errorf("another request under the key answers %+v", problem)
+  }
+
+  decode(t, serve(t, a, "POST", "/user?force=true", `{"firstname": "Guillaume", "lastname": "Penaud"}`, idempotencyKeyHeader, "key-1"), http.StatusUnprocessableEntity, nil)
+  decode(t, serve(t, a, "POST", "/user", `{"firstname": "Océane", "lastname": "Martin"}`, idempotencyKeyHeader, strings.Repeat("k", user.MaxIdempotencyKeyLength + 1)), http.StatusBadRequest, nil)
+
+  list := UserList{}
+  decode(t, serve(t, a, "GET", "/users", ""), http.StatusOK, &list)
+
+  if len(list.Data) != 1 {
+    t.Errorf("the retries created %d users", len(list.Data))
+  }
+}
@@ -0,0 +1,137 @@
+package job
+
+import (
+  rand  "crypto/rand"
+  hex   "encoding/hex"
+  log   "github.com/sirupsen/logrus"
+  sync  "sync"
+  time  "time"
+)
+
+var jobLog *log.Entry
+
+func init() {
+  jobLog = log.WithFields(log.Fields{
+    "_file": "internal/job/job.go",
+    "_type": "system",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Jobs
+// -------------------------------------------------------------------------- //
+
+type Status string
+
+const (
+  StatusRunning   Status = "running"
+  StatusSucceeded Status = "succeeded"
+  StatusFailed    Status = "failed"
+)
+
+// Job is a snapshot of a background task. Result holds the latest progress
+// while the job runs, then its outcome. Err is the reason of a failure.
+type Job struct {
+  Id         string      `json:"id"`
+  Kind       string      `json:"kind"`
+  Status     Status      `json:"status"`
+  StartedAt  time.Time   `json:"started_at"`
+  FinishedAt *time.Time  `json:"finished_at,omitempty"`
+  Result     interface{} `json:"result,omitempty"`
+  Err        error       `json:"-"`
+}
+
+// Task is the work of a job. It may report its progress as often as it likes,
+// and returns its result.
+type Task func(progress func(result interface{})) (interface{}, error)
+
+// -------------------------------------------------------------------------- //
+// 2. Registry
+// -------------------------------------------------------------------------- //
+
+const DefaultRetention = 24 * time.Hour
+
+// Registry runs jobs in the background and keeps them in memory, finished
+// jobs being forgotten after Retention. Jobs do not survive a restart.
+type Registry struct {
+  mutex     sync.RWMutex
+  jobs      map[string]*Job
+  Retention time.Duration
+}
+
+func NewRegistry() *Registry {
+  return &Registry{jobs: map[string]*Job{}, Retention: DefaultRetention}
+}
+
+func newId() string {
+  id := make([]byte, 16)
+  rand.Read(id)
+
+  return hex.EncodeToString(id)
+}
+
+// Start runs the task in a goroutine and returns the job tracking it
+func (r *Registry) Start(kind string, task Task) Job {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  r.prune()
+
+  job := &Job{Id: newId(), Kind: kind, Status: StatusRunning, StartedAt: time.Now().UTC()}
+  r.jobs[job.Id] = job
+
+  go r.run(job, task)
+
+  return *job
+}
+
+func (r *Registry) run(job *Job, task Task) {
+  result, err := task(func(progress interface{}) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    job.Result = progress
+  })
+
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+
+  finishedAt := time.Now().UTC()
+  job.FinishedAt, job.Result, job.Err = &finishedAt, result, err
+
+  entry := jobLog.WithFields(log.Fields{
+    "id": job.Id,
+    "kind": job.Kind,
+    "duration": finishedAt.Sub(job.StartedAt),
+  })
+
+  if err != nil {
+    job.Status = StatusFailed
+    entry.WithField("error", err).Error("job failed")
+  } else {
+    job.Status = StatusSucceeded
+    entry.Info("job succeeded")
+  }
+}
+
+// Get returns a snapshot of the job
+func (r *Registry) Get(id string) (Job, bool) {
+  r.mutex.RLock()
+  defer r.mutex.RUnlock()
+
+  job, found := r.jobs[id]
+  if !found {
+    return Job{}, false
+  }
+
+  return *job, true
+}
+
+// prune forgets the jobs finished for longer than the retention
+func (r *Registry) prune() {
+  for id, job := range r.jobs {
+    if job.FinishedAt != nil && time.Since(*job.FinishedAt) > r.Retention {
+      delete(r.jobs, id)
+    }
+  }
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+  fmt  "fmt"
+  http "net/http"
+  job  "github.com/gpenaud/needys-api-user/internal/job"
+  mux  "github.com/gorilla/mux"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Job resource
+// -------------------------------------------------------------------------- //
+
+// JobView is the body of GET /jobs/{id}, a failed job explaining its failure
+// with a problem
+type JobView struct {
+  job.Job
+  Error *Problem `json:"error,omitempty"`
+}
+
+func newJobView(j job.Job) JobView {
+  view := JobView{Job: j}
+
+  if j.Err != nil {
+    problem := userProblem(j.Err, fmt.Sprintf("/jobs/%s", j.Id))
+    view.Error = &problem
+  }
+
+  return view
+}
+
+func (a *Application) getJob(w http.ResponseWriter, r *http.Request) {
+  id := mux.Vars(r)["id"]
+
+  j, found := a.Jobs.Get(id)
+  if !found {
+    respondWithProblem(w, r, http.StatusNotFound, "job_not_found", fmt.Sprintf("No job %s, finished jobs are kept %s", id, a.Jobs.Retention))
+    return
+  }
+
+  respondWithJSON(w, http.StatusOK, newJobView(j))
+}
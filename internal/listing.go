@@ -0,0 +1,213 @@
+package internal
+
+import (
+  fmt      "fmt"
+  http     "net/http"
+  search   "github.com/gpenaud/needys-api-user/internal/search"
+  strconv  "strconv"
+  strings  "strings"
+  transfer "github.com/gpenaud/needys-api-user/internal/transfer"
+  user     "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. User listing envelope
+// -------------------------------------------------------------------------- //
+
+// UserList is the body of GET /users. Next and Prev are opaque cursors to pass
+// back as ?cursor=, Total is only present with ?total=true.
+type UserList struct {
+  Data  []user.User `json:"data"`
+  Next  string      `json:"next,omitempty"`
+  Prev  string      `json:"prev,omitempty"`
+  Total *int        `json:"total,omitempty"`
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Query parameters
+// -------------------------------------------------------------------------- //
+
+var listingParameters = map[string]bool{"limit": true, "cursor": true, "total": true, "sort": true, "format": true, "include_deleted": true}
+
+// parsePageQuery reads ?limit=, ?cursor=, ?total=, ?sort= and ?include_deleted=
+// from the request.
+// Any other parameter is a filter on a user field, written field=value (or
+// field=v1,v2,v3 for a list) and field[operator]=value where operator is one
+// of eq, in, prefix or contains.
+func parsePageQuery(r *http.Request) (user.PageQuery, error) {
+  values := r.URL.Query()
+  query  := user.PageQuery{Limit: user.DefaultPageSize}
+
+  for parameter, filters := range values {
+    if listingParameters[parameter] {
+      continue
+    }
+
+    name, operator := parameter, ""
+    if open := strings.Index(parameter, "["); open > 0 && strings.HasSuffix(parameter, "]") {
+      name, operator = parameter[:open], parameter[open + 1:len(parameter) - 1]
+    }
+
+    for _, value := range filters {
+      filter, err := user.NewFilter(name, operator, value)
+      if err != nil {
+        return query, err
+      }
+
+      query.Filters = append(query.Filters, filter)
+    }
+  }
+
+  if sort := values.Get("sort"); sort != "" {
+    keys, err := user.ParseSort(sort)
+    if err != nil {
+      return query, err
+    }
+
+    query.Sort = keys
+  }
+
+  if limit := values.Get("limit"); limit != "" {
+    size, err := strconv.Atoi(limit)
+    if err != nil || size < 1 || size > user.MaxPageSize {
+      return query, user.ValidationError("invalid_parameter", "limit must be a number between 1 and %d", user.MaxPageSize)
+    }
+
+    query.Limit = size
+  }
+
+  if token := values.Get("cursor"); token != "" {
+    cursor, err := user.DecodeCursor(token)
+    if err != nil {
+      return query, err
+    }
+
+    query.Cursor = cursor
+  }
+
+  if total := values.Get("total"); total != "" {
+    withTotal, err := strconv.ParseBool(total)
+    if err != nil {
+      return query, user.ValidationError("invalid_parameter", "total must be true or false")
+    }
+
+    query.WithTotal = withTotal
+  }
+
+  includeDeleted, err := parseBoolParameter(r, "include_deleted")
+  if err != nil {
+    return query, err
+  }
+
+  query.IncludeDeleted = includeDeleted
+
+  return query, query.Validate()
+}
+
+// listingFormat negotiates the representation of the listing from ?format=,
+// then from the Accept header, JSON pages being the default. Other formats
+// are exports of every matching user (see transfer.go).
+func listingFormat(r *http.Request) (string, error) {
+  if format := r.URL.Query().Get("format"); format != "" {
+    if format == "json" {
+      return format, nil
+    }
+
+    if _, found := transfer.FormatOf(format); !found {
+      return "", user.ValidationError("invalid_parameter", "%q is not a listing format (json, csv, ndjson, xlsx)", format)
+    }
+
+    return format, nil
+  }
+
+  accept := r.Header.Get("Accept")
+  if accept == "" {
+    return "json", nil
+  }
+
+  for _, mediaRange := range strings.Split(accept, ",") {
+    mediaType := strings.ToLower(strings.TrimSpace(strings.Split(mediaRange, ";")[0]))
+
+    switch mediaType {
+    case "application/json", "application/*", "*/*":
+      return "json", nil
+    }
+
+    if format, found := transfer.FormatOf(mediaType); found && mediaType != format {
+      return format, nil
+    }
+  }
+
+  return "", errNotAcceptable
+}
+
+var errNotAcceptable = user.ValidationError("not_acceptable", "The users can be listed as application/json, text/csv, application/x-ndjson or %s", transfer.ContentTypes[transfer.FormatXLSX])
+
+// -------------------------------------------------------------------------- //
+// 3. Link headers
+// -------------------------------------------------------------------------- //
+
+// pageLink rewrites the request URL with another cursor, keeping every other
+// query parameter
+func pageLink(r *http.Request, cursor *user.Cursor) string {
+  values := r.URL.Query()
+  values.Set("cursor", cursor.Encode())
+
+  return fmt.Sprintf("%s?%s", r.URL.Path, values.Encode())
+}
+
+func newUserList(w http.ResponseWriter, r *http.Request, page user.Page) UserList {
+  list  := UserList{Data: page.Users, Total: page.Total}
+  links := []string{}
+
+  if page.Next != nil {
+    list.Next = page.Next.Encode()
+    links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageLink(r, page.Next)))
+  }
+
+  if page.Prev != nil {
+    list.Prev = page.Prev.Encode()
+    links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageLink(r, page.Prev)))
+  }
+
+  if len(links) > 0 {
+    w.Header().Set("Link", strings.Join(links, ", "))
+  }
+
+  return list
+}
+
+// -------------------------------------------------------------------------- //
+// 4. Search results
+// -------------------------------------------------------------------------- //
+
+const defaultSearchSize = 20
+const maxSearchSize     = 100
+
+// SearchResult is the body of GET /users/search, hits being ranked by score
+type SearchResult struct {
+  Data  []search.Hit `json:"data"`
+  Total int          `json:"total"`
+}
+
+// parseSearchQuery reads ?q= and ?limit= from the request
+func parseSearchQuery(r *http.Request) (string, int, error) {
+  values := r.URL.Query()
+  limit  := defaultSearchSize
+
+  query := strings.TrimSpace(values.Get("q"))
+  if query == "" {
+    return "", 0, user.ValidationError("invalid_parameter", "q is required")
+  }
+
+  if value := values.Get("limit"); value != "" {
+    size, err := strconv.Atoi(value)
+    if err != nil || size < 1 || size > maxSearchSize {
+      return "", 0, user.ValidationError("invalid_parameter", "limit must be a number between 1 and %d", maxSearchSize)
+    }
+
+    limit = size
+  }
+
+  return query, limit, nil
+}
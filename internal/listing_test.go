@@ -0,0 +1,178 @@
+package internal
+
+import (
+  http     "net/http"
+  httptest "net/http/httptest"
+  url      "net/url"
+  strconv  "strconv"
+  strings  "strings"
+  testing  "testing"
+  user     "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestParsePageQuery(t *testing.T) {
+  tests := []struct {
+    target string
+    valid  bool
+  }{
+    {"/users", true},
+    {"/users?limit=1", true},
+    {"/users?limit=500", true},
+    {"/users?limit=0", false},
+    {"/users?limit=501", false},
+    {"/users?limit=ten", false},
+    {"/users?total=true", true},
+    {"/users?total=maybe", false},
+    {"/users?cursor=" + user.Cursor{Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE"}}.Encode(), true},
+    {"/users?cursor=" + user.Cursor{Values: []string{"7"}}.Encode(), false},
+    {"/users?cursor=%25%25", false},
+    {"/users?include_deleted=true", true},
+  }
+
+  for _, test := range tests {
+    if _, err := parsePageQuery(httptest.NewRequest("GET", test.target, nil)); (err == nil) != test.valid {
+      t.Errorf("parsePageQuery(%s) = %v, want valid %t", test.target, err, test.valid)
+    }
+  }
+}
+
+func TestGetUsersPages(t *testing.T) {
+  a := newTestApplication(t)
+
+  for _, name := range []string{"Anna", "Bruno", "Carla", "David", "Emma"} {
+    createTestUser(t, a, `{"firstname": "`+name+`", "lastname": "Roux"}`)
+  }
+
+  names  := []string{}
+  target := "/users?limit=2"
+
+  for i := 0; target != ""; i++ {
+    list := UserList{}
+    decode(t, serve(t, a, "GET", target, ""), http.StatusOK, &list)
+
+    if i > 0 && list.Prev == "" {
+      t.Errorf("the page %d has no previous page", i)
+    }
+    for _, n := range list.Data {
+      names = append(names, n.Firstname)
+    }
+
+    target = ""
+    if list.Next != "" {
+      target = "/users?limit=2&cursor=" + list.Next
+    }
+  }
+
+  if len(names) != 5 || names[0] != "Anna" || names[4] != "Emma" {
+    t.Errorf("the pages list %v", names)
+  }
+
+  decode(t, serve(t, a, "GET", "/users?limit=0", ""), http.StatusBadRequest, nil)
+}
+
+// the cursors end on the public id, the integer ids never leaving the
+// service, whichever way they are given to the client
+func TestCursorsHideIds(t *testing.T) {
+  a := newTestApplication(t)
+
+  created := []user.User{}
+  for _, name := range []string{"Anna", "Bruno", "Carla"} {
+    created = append(created, createTestUser(t, a, `{"firstname": "`+name+`", "lastname": "Roux"}`))
+  }
+
+  for _, target := range []string{"/users?limit=1&cursor=", "/users?limit=1&sort=lastname&cursor="} {
+    first := UserList{}
+    decode(t, serve(t, a, "GET", target, ""), http.StatusOK, &first)
+
+    w    := serve(t, a, "GET", target + first.Next, "")
+    list := UserList{}
+    decode(t, w, http.StatusOK, &list)
+
+    tokens := []string{list.Next, list.Prev}
+    for _, link := range strings.Split(w.Header().Get("Link"), ", ") {
+      address, err := url.Parse(strings.Trim(strings.SplitN(link, ";", 2)[0], "<>"))
+      if err != nil {
+        t.Fatal(err)
+      }
+      tokens = append(tokens, address.Query().Get("cursor"))
+    }
+
+    if len(tokens) != 4 {
+      t.Fatalf("GET %s gives the cursors %v", target, tokens)
+    }
+
+    for _, token := range tokens {
+      cursor, err := user.DecodeCursor(token)
+      if err != nil || len(cursor.Values) == 0 {
+        t.Fatalf("the cursor %q decodes to %+v, %v", token, cursor, err)
+      }
+
+      for _, value := range cursor.Values {
+        if _, err := strconv.Atoi(value); err == nil {
+          t.Errorf("the cursor %q holds the integer %s", token, value)
+        }
+      }
+
+      if last := cursor.Values[len(cursor.Values) - 1]; last != created[1].PublicId {
+        t.Errorf("the cursor %q ends on %s, want the public id %s", token, last, created[1].PublicId)
+      }
+    }
+  }
+}
+
+func TestParsePageQueryFilters(t *testing.T) {
+  tests := []struct {
+    target  string
+    filters int
+    keys    int // sort keys
+    valid   bool
+  }{
+    {"/users?lastname=Penaud", 1, 0, true},
+    {"/users?lastname[prefix]=Pen&city[contains]=lyon", 2, 0, true},
+    {"/users?lastname=Penaud&lastname=Martin", 2, 0, true},
+    {"/users?sort=-lastname,firstname", 0, 2, true},
+    {"/users?age=40", 0, 0, false},
+    {"/users?lastname[like]=Pen", 0, 0, false},
+    {"/users?sort=age", 0, 0, false},
+    {"/users?sort=lastname&cursor=" + user.Cursor{Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE"}}.Encode(), 0, 0, false},
+  }
+
+  for _, test := range tests {
+    query, err := parsePageQuery(httptest.NewRequest("GET", test.target, nil))
+    if (err == nil) != test.valid {
+      t.Errorf("parsePageQuery(%s) = %v, want valid %t", test.target, err, test.valid)
+      continue
+    }
+    if !test.valid {
+      continue
+    }
+
+    if len(query.Filters) != test.filters || len(query.Sort) != test.keys {
+      t.Errorf("parsePageQuery(%s) = %d filters, sort %+v", test.target, len(query.Filters), query.Sort)
+    }
+  }
+}
+
+func TestSearchUsers(t *testing.T) {
+  a := newTestApplication(t)
+
+  for _, name := range []string{"Océane", "Oscar", "Anna"} {
+    createTestUser(t, a, `{"firstname": "`+name+`", "lastname": "Roux"}`)
+  }
+
+  result := SearchResult{}
+  decode(t, serve(t, a, "GET", "/users/search?q=oceane+roux", ""), http.StatusOK, &result)
+
+  if result.Total != 1 || result.Data[0].Firstname != "Océane" {
+    t.Errorf("the search found %+v", result)
+  }
+
+  decode(t, serve(t, a, "GET", "/users/search?q=roux&limit=2", ""), http.StatusOK, &result)
+
+  if result.Total != 3 || len(result.Data) != 2 {
+    t.Errorf("the search limited to 2 hits found %d of %d", len(result.Data), result.Total)
+  }
+
+  decode(t, serve(t, a, "GET", "/users/search?q=+", ""), http.StatusBadRequest, nil)
+  decode(t, serve(t, a, "GET", "/users/search?q=roux&limit=0", ""), http.StatusBadRequest, nil)
+}
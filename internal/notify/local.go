@@ -0,0 +1,65 @@
+package notify
+
+import (
+  log  "github.com/sirupsen/logrus"
+  os   "os"
+  sync "sync"
+  time "time"
+)
+
+var notifyLog *log.Entry
+
+func init() {
+  notifyLog = log.WithFields(log.Fields{
+    "_file": "internal/notify/local.go",
+    "_type": "system",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Local notifiers, for development
+// -------------------------------------------------------------------------- //
+
+// LogNotifier writes the messages to the application log instead of sending
+// them
+type LogNotifier struct{}
+
+func (LogNotifier) Send(m Message) error {
+  notifyLog.WithFields(log.Fields{
+    "to":      m.To,
+    "subject": m.Subject,
+  }).Info(m.Body)
+
+  return nil
+}
+
+// FileNotifier appends the messages to a file in the mbox format, which most
+// mail clients can open
+type FileNotifier struct {
+  Path  string
+  mutex sync.Mutex
+}
+
+func (f *FileNotifier) Send(m Message) error {
+  f.mutex.Lock()
+  defer f.mutex.Unlock()
+
+  file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+
+  now := time.Now()
+
+  if _, err = file.WriteString("From needys " + now.Format(time.ANSIC) + "\n"); err != nil {
+    return err
+  }
+
+  if _, err = file.Write(m.rfc5322("needys <no-reply@localhost>", now)); err != nil {
+    return err
+  }
+
+  _, err = file.WriteString("\n\n")
+  return err
+}
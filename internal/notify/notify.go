@@ -0,0 +1,42 @@
+package notify
+
+import (
+  bytes "bytes"
+  fmt   "fmt"
+  mime  "mime"
+  time  "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Notifiers
+// -------------------------------------------------------------------------- //
+
+// Message is a plain text email
+type Message struct {
+  To      string
+  Subject string
+  Body    string
+}
+
+// Notifier delivers messages to users. SMTPNotifier sends real emails, while
+// LogNotifier and FileNotifier keep them local for development.
+type Notifier interface {
+  Send(m Message) error
+}
+
+// rfc5322 renders the message as an email, its subject being encoded when it
+// is not plain ASCII
+func (m Message) rfc5322(from string, date time.Time) []byte {
+  var buffer bytes.Buffer
+
+  fmt.Fprintf(&buffer, "From: %s\r\n", from)
+  fmt.Fprintf(&buffer, "To: %s\r\n", m.To)
+  fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+  fmt.Fprintf(&buffer, "Date: %s\r\n", date.Format(time.RFC1123Z))
+  fmt.Fprintf(&buffer, "MIME-Version: 1.0\r\n")
+  fmt.Fprintf(&buffer, "Content-Type: text/plain; charset=utf-8\r\n")
+  fmt.Fprintf(&buffer, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+  buffer.WriteString(m.Body)
+
+  return buffer.Bytes()
+}
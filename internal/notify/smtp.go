@@ -0,0 +1,37 @@
+package notify
+
+import (
+  mail "net/mail"
+  net  "net"
+  smtp "net/smtp"
+  time "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. SMTP
+// -------------------------------------------------------------------------- //
+
+// SMTPNotifier sends the messages through an SMTP relay, authenticating only
+// when a username is set. net/smtp upgrades the connection with STARTTLS
+// whenever the server offers it.
+type SMTPNotifier struct {
+  Host     string
+  Port     string
+  Username string
+  Password string
+  From     string // e.g. "needys <no-reply@needys.org>"
+}
+
+func (s *SMTPNotifier) Send(m Message) error {
+  from, err := mail.ParseAddress(s.From)
+  if err != nil {
+    return err
+  }
+
+  var auth smtp.Auth
+  if s.Username != "" {
+    auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+  }
+
+  return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, from.Address, []string{m.To}, m.rfc5322(s.From, time.Now()))
+}
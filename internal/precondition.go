@@ -0,0 +1,122 @@
+package internal
+
+import (
+  fmt     "fmt"
+  http    "net/http"
+  strings "strings"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Entity tags
+// -------------------------------------------------------------------------- //
+
+// userETag is the entity tag of a user, whose version changes on every write
+func userETag(n *user.User) string {
+  return fmt.Sprintf(`"%d"`, n.Version)
+}
+
+// userHeaders describes the representation of a user, with its entity tag
+// and, unless it predates them, its last modification date
+func userHeaders(w http.ResponseWriter, n *user.User) {
+  w.Header().Set("ETag", userETag(n))
+
+  if !n.UpdatedAt.IsZero() {
+    w.Header().Set("Last-Modified", n.UpdatedAt.UTC().Format(http.TimeFormat))
+  }
+}
+
+// respondWithUser answers a user along with its entity tag
+func respondWithUser(w http.ResponseWriter, code int, n *user.User) {
+  userHeaders(w, n)
+  respondWithJSON(w, code, n)
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Preconditions
+// -------------------------------------------------------------------------- //
+
+// expectedVersion checks the If-Match header of a write against the current
+// state of the user, and returns the version the storage must still find when
+// it applies the write, 0 for any. It answers 428 when the header is missing
+// but required, and 412 when none of its tags matches.
+func (a *Application) expectedVersion(w http.ResponseWriter, r *http.Request, current *user.User) (int, bool) {
+  header := strings.TrimSpace(r.Header.Get("If-Match"))
+
+  if header == "" && a.Config.Server.RequireIfMatch {
+    respondWithProblem(w, r, http.StatusPreconditionRequired, "precondition_required", "The request must carry an If-Match header with the ETag of the user")
+    return 0, false
+  }
+
+  version, err := matchVersion(header, current)
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return 0, false
+  }
+
+  return version, true
+}
+
+// matchVersion compares the tags of an If-Match value with the current state
+// of the user, an empty value expecting any version
+func matchVersion(tags string, current *user.User) (int, error) {
+  if strings.TrimSpace(tags) == "" {
+    return 0, nil
+  }
+
+  for _, tag := range strings.Split(tags, ",") {
+    tag = strings.TrimSpace(tag)
+
+    if tag == "*" {
+      return 0, nil
+    }
+
+    // If-Match uses the strong comparison, weak tags never match
+    if tag == userETag(current) {
+      return current.Version, nil
+    }
+  }
+
+  return 0, user.ErrVersionMismatch
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Conditional reads
+// -------------------------------------------------------------------------- //
+
+// respondNotModified answers 304 when the client already holds the current
+// representation of n, as told by If-None-Match or, without it, by
+// If-Modified-Since
+func respondNotModified(w http.ResponseWriter, r *http.Request, n *user.User) bool {
+  if !clientHasUser(r, n) {
+    return false
+  }
+
+  userHeaders(w, n)
+  respondHTTPCodeOnly(w, http.StatusNotModified)
+  return true
+}
+
+func clientHasUser(r *http.Request, n *user.User) bool {
+  if header := strings.TrimSpace(r.Header.Get("If-None-Match")); header != "" {
+    for _, tag := range strings.Split(header, ",") {
+      // If-None-Match uses the weak comparison
+      tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+
+      if tag == "*" || tag == userETag(n) {
+        return true
+      }
+    }
+
+    return false
+  }
+
+  since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+  if err != nil || n.UpdatedAt.IsZero() {
+    return false
+  }
+
+  // Last-Modified is only precise to the second
+  return !n.UpdatedAt.Truncate(time.Second).After(since)
+}
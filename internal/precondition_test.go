@@ -0,0 +1,107 @@
+package internal
+
+import (
+  http     "net/http"
+  httptest "net/http/httptest"
+  testing  "testing"
+  time     "time"
+  user     "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestClientHasUser(t *testing.T) {
+  n := user.User{Version: 3, UpdatedAt: time.Date(2024, 4, 2, 10, 0, 0, 500, time.UTC)}
+
+  tests := []struct {
+    header string
+    value  string
+    has    bool
+  }{
+    {"If-None-Match", `"3"`, true},
+    {"If-None-Match", `W/"3"`, true},
+    {"If-None-Match", `"2", "3"`, true},
+    {"If-None-Match", `*`, true},
+    {"If-None-Match", `"2"`, false},
+    {"If-Modified-Since", "Tue, 02 Apr 2024 10:00:00 GMT", true},
+    {"If-Modified-Since", "Tue, 02 Apr 2024 09:59:59 GMT", false},
+    {"If-Modified-Since", "yesterday", false},
+    {"", "", false},
+  }
+
+  for _, test := range tests {
+    r := httptest.NewRequest("GET", "/user/1", nil)
+    if test.header != "" {
+      r.Header.Set(test.header, test.value)
+    }
+
+    if has := clientHasUser(r, &n); has != test.has {
+      t.Errorf("clientHasUser(%s: %s) = %t, want %t", test.header, test.value, has, test.has)
+    }
+  }
+
+  // If-None-Match prevails
+  r := httptest.NewRequest("GET", "/user/1", nil)
+  r.Header.Set("If-None-Match", `"2"`)
+  r.Header.Set("If-Modified-Since", "Tue, 02 Apr 2024 10:00:00 GMT")
+
+  if clientHasUser(r, &n) {
+    t.Error("clientHasUser ignores a stale If-None-Match")
+  }
+}
+
+func TestIfMatch(t *testing.T) {
+  a := newTestApplication(t)
+
+  n    := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+  path := "/user/" + n.PublicId
+
+  w := serve(t, a, "GET", path, "")
+  if w.Header().Get("ETag") != `"1"` || w.Header().Get("Last-Modified") == "" {
+    t.Fatalf("GET %s has the headers %v", path, w.Header())
+  }
+
+  if w = serve(t, a, "GET", path, "", "If-None-Match", `"1"`); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+    t.Errorf("GET %s with its ETag: status %d", path, w.Code)
+  }
+
+  tests := []struct {
+    method  string
+    ifMatch string
+    code    int
+    etag    string
+  }{
+    {"PUT", `"1"`, http.StatusOK, `"2"`},
+    {"PUT", `"1"`, http.StatusPreconditionFailed, ""},
+    {"PUT", `W/"2"`, http.StatusPreconditionFailed, ""},
+    {"PUT", `"1", "2"`, http.StatusOK, `"3"`},
+    {"PATCH", `"2"`, http.StatusPreconditionFailed, ""},
+    {"PATCH", `"3"`, http.StatusOK, `"4"`},
+    {"PUT", `*`, http.StatusOK, `"5"`},
+    {"DELETE", `"4"`, http.StatusPreconditionFailed, ""},
+    {"DELETE", `"5"`, http.StatusOK, `"6"`},
+  }
+
+  for _, test := range tests {
+    body, contentType := `{"firstname": "Guy", "lastname": "Penaud"}`, "application/json"
+    if test.method == "PATCH" {
+      body, contentType = `{"firstname": "Guillaume"}`, user.MergePatchContentType
+    } else if test.method == "DELETE" {
+      body = ""
+    }
+
+    w := serve(t, a, test.method, path, body, "If-Match", test.ifMatch, "Content-Type", contentType)
+    if w.Code != test.code || w.Header().Get("ETag") != test.etag {
+      t.Errorf("%s %s with If-Match %s: status %d, ETag %s, want %d %s", test.method, path, test.ifMatch, w.Code, w.Header().Get("ETag"), test.code, test.etag)
+    }
+  }
+}
+
+func TestRequireIfMatch(t *testing.T) {
+  a := newTestApplication(t)
+  a.Config.Server.RequireIfMatch = true
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  decode(t, serve(t, a, "PUT", "/user/"+n.PublicId, `{"firstname": "Guy", "lastname": "Penaud"}`), http.StatusPreconditionRequired, nil)
+  decode(t, serve(t, a, "DELETE", "/user/"+n.PublicId, ""), http.StatusPreconditionRequired, nil)
+  decode(t, serve(t, a, "PUT", "/user/"+n.PublicId, `{"firstname": "Guy", "lastname": "Penaud"}`, "If-Match", `"1"`), http.StatusOK, nil)
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+  zip     "archive/zip"
+  errors  "errors"
+  fmt     "fmt"
+  http    "net/http"
+  json    "encoding/json"
+  log     "github.com/sirupsen/logrus"
+  strings "strings"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+var privacyLog *log.Entry
+
+func init() {
+  privacyLog = log.WithFields(log.Fields{
+    "_file": "internal/privacy.go",
+    "_type": "router",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Access requests
+// -------------------------------------------------------------------------- //
+
+// exportFiles are the files of an export archive, each one holding a part of
+// the export as JSON
+func exportFiles(export *user.Export) []struct{ Name string; Content interface{} } {
+  return []struct{ Name string; Content interface{} }{
+    {"user.json", export.User},
+    {"history.json", export.History},
+    {"merged_users.json", export.MergedUsers},
+    {"merged_history.json", export.MergedHistory},
+    {"remembered_creations.json", export.Requests},
+    {"export.json", map[string]interface{}{"public_id": export.User.PublicId, "exported_at": export.ExportedAt}},
+  }
+}
+
+// exportUser answers an access request with a zip archive of everything held
+// about the user
+func (a *Application) exportUser(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  export, err := user.ExportUser(a.Users, &user.User{Id: id})
+
+  if a.respondWithMergedUser(w, r, id, err) || a.respondWithErasedUser(w, r, id, err) {
+    return
+  }
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/zip")
+  w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s-export.zip"`, export.User.PublicId))
+  w.WriteHeader(http.StatusOK)
+
+  archive := zip.NewWriter(w)
+
+  for _, file := range exportFiles(&export) {
+    entry, err := archive.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: export.ExportedAt})
+    if err == nil {
+      encoder := json.NewEncoder(entry)
+      encoder.SetIndent("", "  ")
+      err = encoder.Encode(file.Content)
+    }
+
+    if err != nil {
+      // the status is sent already, the client gets a truncated archive
+      privacyLog.WithFields(log.Fields{"id": id, "error": err}).Error("export archive cannot be written")
+      return
+    }
+  }
+
+  if err := archive.Close(); err != nil {
+    privacyLog.WithFields(log.Fields{"id": id, "error": err}).Error("export archive cannot be written")
+  }
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Erasure requests
+// -------------------------------------------------------------------------- //
+
+// ErasureRequest is the body of POST /user/{id}/erase
+type ErasureRequest struct {
+  Requester string `json:"requester"`
+  Reason    string `json:"reason,omitempty"`
+}
+
+// eraseUser deletes every personal data of the user, irreversibly, and
+// answers with the receipt kept in its place
+func (a *Application) eraseUser(w http.ResponseWriter, r *http.Request) {
+  id, ok := a.userIdFromPath(w, r)
+  if !ok {
+    return
+  }
+
+  request := ErasureRequest{}
+
+  defer r.Body.Close()
+
+  decoder := json.NewDecoder(r.Body)
+  decoder.DisallowUnknownFields()
+
+  if err := decoder.Decode(&request); err != nil {
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The payload must be a JSON object with requester and reason")
+    return
+  }
+
+  request.Requester = strings.TrimSpace(request.Requester)
+
+  if request.Requester == "" || len(request.Requester) > 254 || len(request.Reason) > 1000 {
+    respondWithUserError(w, r, user.ValidationError("invalid_payload", "requester is required, up to 254 characters, and reason cannot exceed 1000 characters"))
+    return
+  }
+
+  receipt := user.Erasure{Requester: request.Requester, Reason: request.Reason}
+  err     := a.Users.EraseUser(&user.User{Id: id}, &receipt)
+
+  if a.respondWithMergedUser(w, r, id, err) || a.respondWithErasedUser(w, r, id, err) {
+    return
+  }
+
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  privacyLog.WithFields(log.Fields{
+    "id": id,
+    "requester": receipt.Requester,
+  }).Info("user erased")
+
+  respondWithJSON(w, http.StatusOK, receipt)
+}
+
+// respondWithErasedUser answers 410 to the requests for a user which is not
+// found because it was erased
+func (a *Application) respondWithErasedUser(w http.ResponseWriter, r *http.Request, id int, err error) bool {
+  if !errors.Is(err, user.ErrUserNotFound) {
+    return false
+  }
+
+  receipt, err := a.Users.ErasedUser(id)
+  if err != nil {
+    return false
+  }
+
+  // the users erased before the public ids have none
+  if receipt.PublicId == "" {
+    respondWithUserError(w, r, user.GoneError("user_erased", "the user was erased on %s", receipt.ErasedAt.Format("2006-01-02")))
+  } else {
+    respondWithUserError(w, r, user.GoneError("user_erased", "user %s was erased on %s", receipt.PublicId, receipt.ErasedAt.Format("2006-01-02")))
+  }
+
+  return true
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+  zip     "archive/zip"
+  bytes   "bytes"
+  http    "net/http"
+  strings "strings"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestExportUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  w := serve(t, a, "GET", "/user/" + n.PublicId + "/export", "")
+  if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" || !strings.Contains(w.Header().Get("Content-Disposition"), n.PublicId) {
+    t.Fatalf("the export answers %d with %v", w.Code, w.Header())
+  }
+
+  archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  names := []string{}
+  for _, file := range archive.File {
+    names = append(names, file.Name)
+  }
+
+  if want := "user.json history.json merged_users.json merged_history.json remembered_creations.json export.json"; strings.Join(names, " ") != want {
+    t.Errorf("the export archive holds %v", names)
+  }
+
+  decode(t, serve(t, a, "GET", "/user/01HV3K8Z4X6N7Q2R5T9W0YBCDE/export", ""), http.StatusNotFound, nil)
+}
+
+func TestEraseUser(t *testing.T) {
+  a := newTestApplication(t)
+
+  n := createTestUser(t, a, `{"firstname": "Guillaume", "lastname": "Penaud"}`)
+
+  decode(t, serve(t, a, "POST", "/user/" + n.PublicId + "/erase", `{"requester": " "}`), http.StatusUnprocessableEntity, nil)
+  decode(t, serve(t, a, "POST", "/user/" + n.PublicId + "/erase", `{"requester": "dpo@example.com", "id": 1}`), http.StatusBadRequest, nil)
+
+  receipt := user.Erasure{}
+  decode(t, serve(t, a, "POST", "/user/" + n.PublicId + "/erase", `{"requester": "dpo@example.com", "reason": "article 17"}`), http.StatusOK, &receipt)
+
+  if receipt.PublicId != n.PublicId || receipt.Requester != "dpo@example.com" {
+    t.Errorf("the erasure answers %+v", receipt)
+  }
+
+  for _, target := range []string{"", "/export", "/history"} {
+    problem := Problem{}
+    decode(t, serve(t, a, "GET", "/user/" + n.PublicId + target, ""), http.StatusGone, &problem)
+
+    if problem.Code != "user_erased" || !strings.Contains(problem.Detail, n.PublicId) {
+      t.Errorf("GET /user/%s%s answers %+v", n.PublicId, target, problem)
+    }
+  }
+
+  decode(t, serve(t, a, "POST", "/user/" + n.PublicId + "/erase", `{"requester": "dpo@example.com"}`), http.StatusGone, nil)
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+  errors "errors"
+  http   "net/http"
+  json   "encoding/json"
+  log    "github.com/sirupsen/logrus"
+  search "github.com/gpenaud/needys-api-user/internal/search"
+  user   "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+var problemLog *log.Entry
+
+func init() {
+  problemLog = log.WithFields(log.Fields{
+    "_file": "internal/problem.go",
+    "_type": "router",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. RFC 7807 problem details
+// -------------------------------------------------------------------------- //
+
+const problemContentType = "application/problem+json"
+
+// Problem is the body of every error response. Code is stable across
+// releases, clients should branch on it rather than on Title or Detail.
+type Problem struct {
+  Type       string             `json:"type"`
+  Title      string             `json:"title"`
+  Status     int                `json:"status"`
+  Detail     string             `json:"detail,omitempty"`
+  Instance   string             `json:"instance,omitempty"`
+  Code       string             `json:"code"`
+  Errors     []user.Violation   `json:"errors,omitempty"`
+  Candidates []search.Duplicate `json:"candidates,omitempty"` // possible_duplicate only
+}
+
+func problemType(code string) string {
+  return "urn:needys:problem:" + code
+}
+
+func respondWithProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+  writeProblem(w, Problem{
+    Type:     problemType(code),
+    Title:    http.StatusText(status),
+    Status:   status,
+    Detail:   detail,
+    Instance: r.URL.RequestURI(),
+    Code:     code,
+  })
+}
+
+func writeProblem(w http.ResponseWriter, problem Problem) {
+  response, _ := json.Marshal(problem)
+
+  w.Header().Set("Content-Type", problemContentType)
+  w.WriteHeader(problem.Status)
+  w.Write(response)
+}
+
+// -------------------------------------------------------------------------- //
+// 2. User errors mapping
+// -------------------------------------------------------------------------- //
+
+var problemStatuses = map[user.Kind]int{
+  user.KindInternal:             http.StatusInternalServerError,
+  user.KindNotFound:             http.StatusNotFound,
+  user.KindConflict:             http.StatusConflict,
+  user.KindValidation:           http.StatusUnprocessableEntity,
+  user.KindUnavailable:          http.StatusServiceUnavailable,
+  user.KindGone:                 http.StatusGone,
+  user.KindPrecondition:         http.StatusPreconditionFailed,
+  user.KindPreconditionRequired: http.StatusPreconditionRequired,
+}
+
+// userProblem turns an error of the user package into a problem. Causes never
+// reach the client.
+func userProblem(err error, instance string) Problem {
+  var userErr *user.Error
+  if !errors.As(err, &userErr) {
+    userErr = user.InternalError(err)
+  }
+
+  status := problemStatuses[userErr.Kind]
+
+  return Problem{
+    Type:     problemType(userErr.Code),
+    Title:    http.StatusText(status),
+    Status:   status,
+    Detail:   userErr.Message,
+    Instance: instance,
+    Code:     userErr.Code,
+    Errors:   userErr.Violations,
+  }
+}
+
+// problemFor builds the problem answering a request, logging its cause
+func problemFor(r *http.Request, err error) Problem {
+  problem := userProblem(err, r.URL.RequestURI())
+
+  entry := problemLog.WithFields(log.Fields{
+    "code": problem.Code,
+    "status": problem.Status,
+    "error": err,
+  })
+
+  if problem.Status >= http.StatusInternalServerError {
+    entry.Error("storage request failed")
+  } else {
+    entry.Debug("storage request rejected")
+  }
+
+  return problem
+}
+
+func respondWithUserError(w http.ResponseWriter, r *http.Request, err error) {
+  writeProblem(w, problemFor(r, err))
+}
+
+// respondWithBadRequest answers 400 for malformed query parameters, which the
+// user package reports as validation errors
+func respondWithBadRequest(w http.ResponseWriter, r *http.Request, err error) {
+  var userErr *user.Error
+  if !errors.As(err, &userErr) {
+    userErr = user.ValidationError("invalid_parameter", "%s", err)
+  }
+
+  respondWithProblem(w, r, http.StatusBadRequest, userErr.Code, userErr.Message)
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+  errors  "errors"
+  fmt     "fmt"
+  http    "net/http"
+  strings "strings"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestUserProblem(t *testing.T) {
+  cause := errors.New("dial tcp 10.0.0.1:3306: connection refused")
+
+  tests := []struct {
+    err    error
+    status int
+    code   string
+  }{
+    {user.ErrUserNotFound, http.StatusNotFound, "user_not_found"},
+    {fmt.Errorf("reading user 7: %w", user.ErrUserNotFound), http.StatusNotFound, "user_not_found"},
+    {user.ValidationError("invalid_payload", "the payload is invalid"), http.StatusUnprocessableEntity, "invalid_payload"},
+    {user.ErrUserNotDeleted, http.StatusConflict, "user_not_deleted"},
+    {user.ErrVersionMismatch, http.StatusPreconditionFailed, "version_mismatch"},
+    {user.GoneError("user_erased", "the user was erased"), http.StatusGone, "user_erased"},
+    {user.UnavailableError(cause), http.StatusServiceUnavailable, "storage_unavailable"},
+    {user.InternalError(cause), http.StatusInternalServerError, "storage_error"},
+    {cause, http.StatusInternalServerError, "storage_error"},
+  }
+
+  for _, test := range tests {
+    problem := userProblem(test.err, "/user/7")
+
+    if problem.Status != test.status || problem.Code != test.code || problem.Type != "urn:needys:problem:"+test.code {
+      t.Errorf("userProblem(%v) = %d %s, want %d %s", test.err, problem.Status, problem.Code, test.status, test.code)
+    }
+    if problem.Title != http.StatusText(test.status) || problem.Instance != "/user/7" {
+      t.Errorf("userProblem(%v) = %+v", test.err, problem)
+    }
+    if strings.Contains(problem.Detail, "10.0.0.1") {
+      t.Errorf("userProblem(%v) gives the cause to the client: %q", test.err, problem.Detail)
+    }
+  }
+}
+
+func TestProblemResponse(t *testing.T) {
+  a := newTestApplication(t)
+
+  w := serve(t, a, "GET", "/user/7", "")
+
+  problem := Problem{}
+  decode(t, w, http.StatusNotFound, &problem)
+
+  if contentType := w.Header().Get("Content-Type"); contentType != problemContentType {
+    t.Errorf("Content-Type = %q, want %q", contentType, problemContentType)
+  }
+  if problem.Code != "user_not_found" || problem.Status != http.StatusNotFound || problem.Instance != "/user/7" {
+    t.Errorf("unexpected problem %+v", problem)
+  }
+}
@@ -0,0 +1,256 @@
+package search
+
+import (
+  math    "math"
+  sort    "sort"
+  strings "strings"
+  unicode "unicode"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Name keys
+// -------------------------------------------------------------------------- //
+
+var soundexCodes = map[rune]byte{
+  'b': '1', 'f': '1', 'p': '1', 'v': '1',
+  'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+  'd': '3', 't': '3',
+  'l': '4',
+  'm': '5', 'n': '5',
+  'r': '6',
+}
+
+// soundex encodes a folded term by its sound, so that "penaud" and "penot"
+// share the same code
+func soundex(term string) string {
+  code := []byte{}
+  last := byte(0)
+
+  for _, r := range term {
+    if !unicode.IsLetter(r) || r > unicode.MaxASCII {
+      continue
+    }
+
+    digit := soundexCodes[r]
+
+    if len(code) == 0 {
+      code = append(code, byte(r))
+    } else if digit != 0 && digit != last {
+      code = append(code, digit)
+    }
+
+    // h and w do not separate two letters of the same code, vowels do
+    if r != 'h' && r != 'w' {
+      last = digit
+    }
+  }
+
+  if len(code) == 0 {
+    return ""
+  }
+
+  return string(append(code, "000"...)[:4])
+}
+
+// nameKey is the normalised full name of a user
+func nameKey(n *user.User) string {
+  return strings.Join(Tokenize(n.Firstname + " " + n.Lastname), " ")
+}
+
+// phoneticKey is the sound of the full name of a user
+func phoneticKey(n *user.User) string {
+  codes := []string{}
+  for _, term := range Tokenize(n.Firstname + " " + n.Lastname) {
+    codes = append(codes, soundex(term))
+  }
+
+  return strings.Join(codes, " ")
+}
+
+// addressKey is the normalised address of a user, which may come straight
+// from a client with its postal address alone
+func addressKey(n *user.User) string {
+  if !n.PostalAddress.IsZero() {
+    return strings.Join(Tokenize(n.PostalAddress.String()), " ")
+  }
+
+  return strings.Join(Tokenize(n.Address), " ")
+}
+
+// phoneKey is the E.164 form of the phone of a user, which may come straight
+// from a client in its national format
+func phoneKey(n *user.User) string {
+  if e164, err := user.ParsePhone(n.Phone); err == nil {
+    return e164
+  }
+
+  return n.Phone
+}
+
+// duplicateKeys are the keys under which the index looks two users resembling
+// each other up: the sound of their name, their phone and their address
+func duplicateKeys(n *user.User) []string {
+  keys := []string{"name:" + phoneticKey(n)}
+
+  if phone := phoneKey(n); phone != "" {
+    keys = append(keys, "phone:" + phone)
+  }
+
+  if address := addressKey(n); address != "" {
+    keys = append(keys, "address:" + address)
+  }
+
+  return keys
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Duplicates detection
+// -------------------------------------------------------------------------- //
+
+const (
+  ReasonSameName    = "same_name"
+  ReasonSimilarName = "similar_name"
+  ReasonSamePhone   = "same_phone"
+  ReasonSameAddress = "same_address"
+)
+
+// DuplicateThreshold is the score from which two users are likely the same
+// person: the same name, or a similar name sharing a phone or an address.
+// A similar name alone scores below, and so do a shared phone and address
+// without a resembling name, which are common among relatives.
+const DuplicateThreshold = 0.6
+
+// the weight of each thing two users have in common, see resemblance
+const (
+  sameNameWeight    = 0.6
+  similarNameWeight = 0.4
+  samePhoneWeight   = 0.3
+  sameAddressWeight = 0.2
+)
+
+// Duplicate is an indexed user resembling another one
+type Duplicate struct {
+  Id       int      `json:"-"`
+  PublicId string   `json:"public_id"`
+  Score    float64  `json:"score"`
+  Reasons  []string `json:"reasons"`
+}
+
+// DuplicatePair is two indexed users resembling each other
+type DuplicatePair struct {
+  Users   [2]user.User `json:"users"`
+  Score   float64      `json:"score"`
+  Reasons []string     `json:"reasons"`
+}
+
+// resemblance scores how likely two users are the same person, summing the
+// weights of what they have in common. Users whose names do not even sound
+// alike stay below DuplicateThreshold however many things they share: they
+// are likely relatives or flatmates.
+func resemblance(a *user.User, b *user.User) (float64, []string) {
+  score   := 0.0
+  reasons := []string{}
+
+  switch {
+  case nameKey(a) == nameKey(b):
+    score, reasons = sameNameWeight, append(reasons, ReasonSameName)
+  case phoneticKey(a) == phoneticKey(b):
+    score, reasons = similarNameWeight, append(reasons, ReasonSimilarName)
+  }
+
+  if phone := phoneKey(a); phone != "" && phone == phoneKey(b) {
+    score, reasons = score + samePhoneWeight, append(reasons, ReasonSamePhone)
+  }
+
+  if address := addressKey(a); address != "" && address == addressKey(b) {
+    score, reasons = score + sameAddressWeight, append(reasons, ReasonSameAddress)
+  }
+
+  if score == 0 {
+    return 0, nil
+  }
+
+  return math.Min(1, math.Round(score * 100) / 100), reasons
+}
+
+// Duplicates returns the indexed users likely to be the same person as n,
+// most likely first, n itself left aside
+func (i *Index) Duplicates(n user.User) []Duplicate {
+  i.mutex.RLock()
+  defer i.mutex.RUnlock()
+
+  candidates := map[int]bool{}
+  for _, key := range duplicateKeys(&n) {
+    for id := range i.lookalike[key] {
+      if id != n.Id {
+        candidates[id] = true
+      }
+    }
+  }
+
+  duplicates := []Duplicate{}
+
+  for id := range candidates {
+    indexed := i.documents[id]
+    if score, reasons := resemblance(&n, &indexed); score >= DuplicateThreshold {
+      duplicates = append(duplicates, Duplicate{Id: id, PublicId: indexed.PublicId, Score: score, Reasons: reasons})
+    }
+  }
+
+  sort.Slice(duplicates, func(a, b int) bool {
+    if duplicates[a].Score != duplicates[b].Score {
+      return duplicates[a].Score > duplicates[b].Score
+    }
+    return duplicates[a].Id < duplicates[b].Id
+  })
+
+  return duplicates
+}
+
+// DuplicatePairs lists every pair of indexed users scoring at least minScore,
+// most likely first. Only users sharing one of their duplicateKeys are
+// compared.
+func (i *Index) DuplicatePairs(minScore float64) []DuplicatePair {
+  i.mutex.RLock()
+  defer i.mutex.RUnlock()
+
+  pairs    := []DuplicatePair{}
+  compared := map[[2]int]bool{}
+
+  for _, ids := range i.lookalike {
+    if len(ids) < 2 {
+      continue
+    }
+
+    sorted := make([]int, 0, len(ids))
+    for id := range ids {
+      sorted = append(sorted, id)
+    }
+    sort.Ints(sorted)
+
+    for x := range sorted {
+      for y := x + 1; y < len(sorted); y++ {
+        if compared[[2]int{sorted[x], sorted[y]}] {
+          continue
+        }
+        compared[[2]int{sorted[x], sorted[y]}] = true
+
+        a, b := i.documents[sorted[x]], i.documents[sorted[y]]
+
+        if score, reasons := resemblance(&a, &b); score > 0 && score >= minScore {
+          pairs = append(pairs, DuplicatePair{Users: [2]user.User{a, b}, Score: score, Reasons: reasons})
+        }
+      }
+    }
+  }
+
+  sort.Slice(pairs, func(a, b int) bool {
+    if pairs[a].Score != pairs[b].Score {
+      return pairs[a].Score > pairs[b].Score
+    }
+    return pairs[a].Users[0].Id < pairs[b].Users[0].Id || pairs[a].Users[0].Id == pairs[b].Users[0].Id && pairs[a].Users[1].Id < pairs[b].Users[1].Id
+  })
+
+  return pairs
+}
@@ -0,0 +1,92 @@
+package search
+
+import (
+  reflect "reflect"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestSoundex(t *testing.T) {
+  tests := map[string]string{
+    "robert":   "r163",
+    "rupert":   "r163",
+    "ashcraft": "a261",
+    "tymczak":  "t522",
+    "pfister":  "p236",
+    "penaud":   "p530",
+    "penot":    "p530",
+    "a":        "a000",
+    "42":       "",
+  }
+
+  for term, want := range tests {
+    if code := soundex(term); code != want {
+      t.Errorf("soundex(%q) = %q, want %q", term, code, want)
+    }
+  }
+}
+
+func TestResemblance(t *testing.T) {
+  guillaume := user.User{Firstname: "Guillaume", Lastname: "Penaud", Phone: "+33645124365", Address: "10 route de Rhye 74210 Mouthier-En-Bresse"}
+
+  tests := []struct {
+    other   user.User
+    score   float64
+    reasons []string
+  }{
+    {user.User{Firstname: "guillaume", Lastname: "PENAUD"}, 0.6, []string{ReasonSameName}},
+    {user.User{Firstname: "Guillaume", Lastname: "Penot"}, 0.4, []string{ReasonSimilarName}},
+    {user.User{Firstname: "Guillaume", Lastname: "Penot", Phone: "06 45 12 43 65"}, 0.7, []string{ReasonSimilarName, ReasonSamePhone}},
+    {user.User{Firstname: "Guillaume", Lastname: "Penaud", Phone: "+33645124365", PostalAddress: user.PostalAddress{Line1: "10 route de Rhye", PostalCode: "74210", City: "Mouthier-En-Bresse"}}, 1, []string{ReasonSameName, ReasonSamePhone, ReasonSameAddress}},
+    {user.User{Firstname: "Océane", Lastname: "Penaud", Phone: "+33645124365", Address: guillaume.Address}, 0.5, []string{ReasonSamePhone, ReasonSameAddress}},
+    {user.User{Firstname: "Océane", Lastname: "Penaud", Address: guillaume.Address}, 0.2, []string{ReasonSameAddress}},
+    {user.User{Firstname: "Océane", Lastname: "Penaud"}, 0, nil},
+  }
+
+  for _, test := range tests {
+    score, reasons := resemblance(&guillaume, &test.other)
+    if score != test.score || !reflect.DeepEqual(reasons, test.reasons) {
+      t.Errorf("resemblance(%s %s) = %v %v, want %v %v", test.other.Firstname, test.other.Lastname, score, reasons, test.score, test.reasons)
+    }
+  }
+}
+
+func TestDuplicates(t *testing.T) {
+  index := NewIndex()
+
+  for i, n := range []user.User{
+    {Firstname: "Guillaume", Lastname: "Penaud", Phone: "+33645124365"},
+    {Firstname: "Guillaume", Lastname: "Penot", Phone: "+33645124365"},
+    {Firstname: "Guillaume", Lastname: "Penot"},
+    {Firstname: "Océane", Lastname: "Martin"},
+    {Firstname: "Gaëlle", Lastname: "Penaud", Phone: "+33645124365"},
+  } {
+    n.Id, n.PublicId = i + 1, string(rune('A' + i))
+    index.Add(n)
+  }
+
+  ids := []int{}
+  for _, duplicate := range index.Duplicates(user.User{Firstname: "Guillaume", Lastname: "Penaud", Phone: "06 45 12 43 65"}) {
+    ids = append(ids, duplicate.Id)
+  }
+  if !reflect.DeepEqual(ids, []int{1, 2}) {
+    t.Errorf("Duplicates = %v, want [1 2]", ids)
+  }
+
+  if duplicates := index.Duplicates(user.User{Id: 1, Firstname: "Guillaume", Lastname: "Penaud"}); len(duplicates) != 0 {
+    t.Errorf("Duplicates of the user 1 = %+v", duplicates)
+  }
+
+  pairs := [][2]int{}
+  for _, pair := range index.DuplicatePairs(0.5) {
+    pairs = append(pairs, [2]int{pair.Users[0].Id, pair.Users[1].Id})
+  }
+  if !reflect.DeepEqual(pairs, [][2]int{{1, 2}, {2, 3}}) {
+    t.Errorf("DuplicatePairs(0.5) = %v", pairs)
+  }
+
+  // the relative sharing a phone is compared, but scores low
+  if pairs := index.DuplicatePairs(0.1); len(pairs) != 5 || pairs[4].Users[1].Id != 5 || pairs[4].Score != 0.3 {
+    t.Errorf("DuplicatePairs(0.1) = %+v, want 5 pairs", pairs)
+  }
+}
@@ -0,0 +1,359 @@
+package search
+
+import (
+  log       "github.com/sirupsen/logrus"
+  math      "math"
+  runes     "golang.org/x/text/runes"
+  norm      "golang.org/x/text/unicode/norm"
+  sort      "sort"
+  strings   "strings"
+  sync      "sync"
+  transform "golang.org/x/text/transform"
+  unicode   "unicode"
+  user      "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+var indexLog *log.Entry
+
+func init() {
+  indexLog = log.WithFields(log.Fields{
+    "_file": "internal/search/index.go",
+    "_type": "data",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Text normalisation
+// -------------------------------------------------------------------------- //
+
+var ligatures = strings.NewReplacer("œ", "oe", "æ", "ae", "ß", "ss")
+
+// Fold lowers the text and strips its accents, so that "Océane" and "oceane"
+// share the same terms
+func Fold(text string) string {
+  folder := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+  folded, _, err := transform.String(folder, ligatures.Replace(strings.ToLower(text)))
+  if err != nil {
+    return strings.ToLower(text)
+  }
+
+  return folded
+}
+
+// Tokenize folds the text and cuts it on anything but letters and digits
+func Tokenize(text string) []string {
+  return strings.FieldsFunc(Fold(text), func(r rune) bool {
+    return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+  })
+}
+
+func digits(text string) string {
+  return strings.Map(func(r rune) rune {
+    if unicode.IsDigit(r) {
+      return r
+    }
+    return -1
+  }, text)
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Inverted index
+// -------------------------------------------------------------------------- //
+
+// fieldWeights ranks a match on a name above a match on an address or a phone
+var fieldWeights = []struct {
+  Weight float64
+  Value  func(n *user.User) string
+}{
+  {3, func(n *user.User) string { return n.Firstname }},
+  {3, func(n *user.User) string { return n.Lastname }},
+  {1, func(n *user.User) string { return n.Address }},
+  // the E.164 and the national digits, so that both ways of typing it match
+  {1, func(n *user.User) string { return n.Phone + " " + digits(n.PhoneNational) }},
+}
+
+// Index is an in-memory inverted index over the users: each term points to
+// the users holding it, with a weight summing the fields it appears in
+type Index struct {
+  mutex     sync.RWMutex
+  postings  map[string]map[int]float64
+  documents map[int]user.User
+  terms     []string // sorted vocabulary, for prefix lookups
+  lookalike map[string]map[int]bool // users by their duplicateKeys, see duplicates.go
+}
+
+func NewIndex() *Index {
+  return &Index{
+    postings:  map[string]map[int]float64{},
+    documents: map[int]user.User{},
+    lookalike: map[string]map[int]bool{},
+  }
+}
+
+func documentTerms(n *user.User) map[string]float64 {
+  terms := map[string]float64{}
+
+  for _, field := range fieldWeights {
+    for _, term := range Tokenize(field.Value(n)) {
+      terms[term] += field.Weight
+    }
+  }
+
+  return terms
+}
+
+// Add indexes the user, replacing any previous version of it
+func (i *Index) Add(n user.User) {
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+
+  i.remove(n.Id)
+
+  for term, weight := range documentTerms(&n) {
+    postings, found := i.postings[term]
+    if !found {
+      postings = map[int]float64{}
+      i.postings[term] = postings
+
+      position := sort.SearchStrings(i.terms, term)
+      i.terms = append(i.terms, "")
+      copy(i.terms[position + 1:], i.terms[position:])
+      i.terms[position] = term
+    }
+
+    postings[n.Id] = weight
+  }
+
+  for _, key := range duplicateKeys(&n) {
+    if i.lookalike[key] == nil {
+      i.lookalike[key] = map[int]bool{}
+    }
+
+    i.lookalike[key][n.Id] = true
+  }
+  i.documents[n.Id] = n
+}
+
+func (i *Index) Remove(id int) {
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+
+  i.remove(id)
+}
+
+func (i *Index) remove(id int) {
+  previous, found := i.documents[id]
+  if !found {
+    return
+  }
+
+  for term := range documentTerms(&previous) {
+    delete(i.postings[term], id)
+
+    if len(i.postings[term]) == 0 {
+      delete(i.postings, term)
+
+      position := sort.SearchStrings(i.terms, term)
+      i.terms = append(i.terms[:position], i.terms[position + 1:]...)
+    }
+  }
+
+  for _, key := range duplicateKeys(&previous) {
+    delete(i.lookalike[key], id)
+
+    if len(i.lookalike[key]) == 0 {
+      delete(i.lookalike, key)
+    }
+  }
+
+  delete(i.documents, id)
+}
+
+// Rebuild replaces the whole index content with every user of the storage
+func (i *Index) Rebuild(users user.UserRepository) error {
+  rebuilt := NewIndex()
+  query   := user.PageQuery{Limit: user.MaxPageSize}
+
+  for {
+    page, err := users.ListUsers(query)
+    if err != nil {
+      return err
+    }
+
+    for _, n := range page.Users {
+      rebuilt.Add(n)
+    }
+
+    if page.Next == nil {
+      break
+    }
+
+    query.Cursor = *page.Next
+  }
+
+  i.mutex.Lock()
+  defer i.mutex.Unlock()
+
+  i.postings  = rebuilt.postings
+  i.documents = rebuilt.documents
+  i.terms     = rebuilt.terms
+  i.lookalike = rebuilt.lookalike
+
+  indexLog.WithFields(log.Fields{
+    "users": len(i.documents),
+    "terms": len(i.terms),
+  }).Info("search index is built")
+
+  return nil
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Search
+// -------------------------------------------------------------------------- //
+
+type Hit struct {
+  user.User
+  Score float64
+}
+
+// match qualities, an exact term outranking a prefix which outranks a typo
+const (
+  exactMatch  = 1.0
+  prefixMatch = 0.7
+  typoMatch   = 0.5
+)
+
+// maxTypos tolerates one typo from 4 characters on, two from 8 on
+func maxTypos(term string) int {
+  switch length := len([]rune(term)); {
+  case length >= 8:
+    return 2
+  case length >= 4:
+    return 1
+  }
+
+  return 0
+}
+
+// candidates lists the indexed terms matching a query term, with the quality
+// of each match
+func (i *Index) candidates(term string) map[string]float64 {
+  matches := map[string]float64{}
+
+  for position := sort.SearchStrings(i.terms, term); position < len(i.terms) && strings.HasPrefix(i.terms[position], term); position++ {
+    if i.terms[position] == term {
+      matches[term] = exactMatch
+    } else {
+      matches[i.terms[position]] = prefixMatch
+    }
+  }
+
+  if typos := maxTypos(term); typos > 0 {
+    for _, indexed := range i.terms {
+      if _, found := matches[indexed]; !found && levenshtein(term, indexed, typos) <= typos {
+        matches[indexed] = typoMatch
+      }
+    }
+  }
+
+  return matches
+}
+
+// Search returns the users matching every term of the query, best first.
+// Each term scores its best match weighted by the field and the rarity of the
+// matched term.
+func (i *Index) Search(query string) []Hit {
+  i.mutex.RLock()
+  defer i.mutex.RUnlock()
+
+  terms := Tokenize(query)
+  if len(terms) == 0 {
+    return []Hit{}
+  }
+
+  scores := map[int]float64{}
+  total  := float64(len(i.documents))
+
+  for position, term := range terms {
+    best := map[int]float64{}
+
+    for indexed, quality := range i.candidates(term) {
+      postings := i.postings[indexed]
+      rarity   := math.Log(1 + total / float64(len(postings)))
+
+      for id, weight := range postings {
+        if score := quality * weight * rarity; score > best[id] {
+          best[id] = score
+        }
+      }
+    }
+
+    // every term must match: only users kept by the previous terms survive
+    for id := range scores {
+      if _, found := best[id]; !found {
+        delete(scores, id)
+      }
+    }
+
+    for id, score := range best {
+      if _, found := scores[id]; found || position == 0 {
+        scores[id] += score
+      }
+    }
+  }
+
+  hits := make([]Hit, 0, len(scores))
+  for id, score := range scores {
+    hits = append(hits, Hit{User: i.documents[id], Score: math.Round(score * 1000) / 1000})
+  }
+
+  sort.Slice(hits, func(a, b int) bool {
+    if hits[a].Score != hits[b].Score {
+      return hits[a].Score > hits[b].Score
+    }
+    return hits[a].Id < hits[b].Id
+  })
+
+  return hits
+}
+
+// levenshtein computes the edit distance between two terms, giving up with
+// max + 1 as soon as the distance exceeds max
+func levenshtein(a string, b string, max int) int {
+  x, y := []rune(a), []rune(b)
+
+  if diff := len(x) - len(y); diff > max || -diff > max {
+    return max + 1
+  }
+
+  previous := make([]int, len(y) + 1)
+  current  := make([]int, len(y) + 1)
+
+  for j := range previous {
+    previous[j] = j
+  }
+
+  for i := 1; i <= len(x); i++ {
+    current[0] = i
+    lowest := current[0]
+
+    for j := 1; j <= len(y); j++ {
+      cost := 1
+      if x[i - 1] == y[j - 1] {
+        cost = 0
+      }
+
+      current[j] = min(previous[j] + 1, current[j - 1] + 1, previous[j - 1] + cost)
+      lowest     = min(lowest, current[j])
+    }
+
+    if lowest > max {
+      return max + 1
+    }
+
+    previous, current = current, previous
+  }
+
+  return previous[len(y)]
+}
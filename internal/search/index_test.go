@@ -0,0 +1,187 @@
+package search
+
+import (
+  errors  "errors"
+  reflect "reflect"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestFold(t *testing.T) {
+  tests := map[string]string{
+    "Océane":       "oceane",
+    "ÉLODIE":       "elodie",
+    "Gaëlle Noël":  "gaelle noel",
+    "Lætitia Cœur": "laetitia coeur",
+    "Straße":       "strasse",
+    "Ñandú":        "nandu",
+  }
+
+  for text, want := range tests {
+    if folded := Fold(text); folded != want {
+      t.Errorf("Fold(%q) = %q, want %q", text, folded, want)
+    }
+  }
+}
+
+func TestTokenize(t *testing.T) {
+  tests := map[string][]string{
+    "Jean-Loïc d'Arc":          {"jean", "loic", "d", "arc"},
+    "10 route de Rhye, 74210":  {"10", "route", "de", "rhye", "74210"},
+    "  ":                       {},
+  }
+
+  for text, want := range tests {
+    if terms := Tokenize(text); !reflect.DeepEqual(terms, want) {
+      t.Errorf("Tokenize(%q) = %q, want %q", text, terms, want)
+    }
+  }
+}
+
+func TestLevenshtein(t *testing.T) {
+  tests := []struct {
+    a    string
+    b    string
+    max  int
+    want int
+  }{
+    {"penaud", "penaud", 2, 0},
+    {"penaud", "peanud", 2, 2},
+    {"penaud", "penau", 2, 1},
+    {"penaud", "pinaud", 1, 1},
+    {"guillaume", "guilaume", 2, 1},
+    {"martin", "robert", 2, 3},
+    {"anna", "annabelle", 2, 3},
+    {"élodie", "elodie", 1, 1},
+  }
+
+  for _, test := range tests {
+    if distance := levenshtein(test.a, test.b, test.max); distance != test.want {
+      t.Errorf("levenshtein(%q, %q, %d) = %d, want %d", test.a, test.b, test.max, distance, test.want)
+    }
+  }
+}
+
+func newTestIndex() *Index {
+  index := NewIndex()
+
+  for i, n := range []user.User{
+    {Firstname: "Guillaume", Lastname: "Penaud", Address: "10 route de Rhye 74210 Mouthier-En-Bresse", Phone: "+33645124365", PhoneNational: "06 45 12 43 65"},
+    {Firstname: "Océane", Lastname: "Martin", Address: "3 rue Neuve 69001 Lyon"},
+    {Firstname: "Martin", Lastname: "Rousseau", Address: "8 avenue Guillaume 75008 Paris"},
+    {Firstname: "Gaëlle", Lastname: "Penot"},
+  } {
+    n.Id = i + 1
+    index.Add(n)
+  }
+
+  return index
+}
+
+func hitIds(hits []Hit) []int {
+  ids := []int{}
+  for _, hit := range hits {
+    ids = append(ids, hit.Id)
+  }
+
+  return ids
+}
+
+func TestSearch(t *testing.T) {
+  index := newTestIndex()
+
+  tests := []struct {
+    query string
+    want  []int
+  }{
+    {"oceane", []int{2}},
+    {"OCÉANE martin", []int{2}},
+    {"martin", []int{2, 3}},
+    {"guillaume", []int{1, 3}},
+    {"guil", []int{1, 3}},
+    {"guilaume", []int{1, 3}},
+    {"penaud", []int{1}},
+    {"pen", []int{1, 4}},
+    {"0645124365", []int{1}},
+    {"+33645124365", []int{1}},
+    {"lyon rousseau", []int{}},
+    {"", []int{}},
+    {"- ,", []int{}},
+  }
+
+  for _, test := range tests {
+    if ids := hitIds(index.Search(test.query)); !reflect.DeepEqual(ids, test.want) {
+      t.Errorf("Search(%q) = %v, want %v", test.query, ids, test.want)
+    }
+  }
+}
+
+func TestIndexUpdates(t *testing.T) {
+  index := newTestIndex()
+
+  index.Add(user.User{Id: 2, Firstname: "Océane", Lastname: "Dupont"})
+  if ids := hitIds(index.Search("martin")); !reflect.DeepEqual(ids, []int{3}) {
+    t.Errorf("Search(martin) after an update = %v, want [3]", ids)
+  }
+  if ids := hitIds(index.Search("dupont")); !reflect.DeepEqual(ids, []int{2}) {
+    t.Errorf("Search(dupont) after an update = %v, want [2]", ids)
+  }
+
+  index.Remove(1)
+  if ids := hitIds(index.Search("penaud")); len(ids) != 0 {
+    t.Errorf("Search(penaud) after a removal = %v", ids)
+  }
+  for _, term := range index.terms {
+    if term == "penaud" || term == "rhye" {
+      t.Errorf("the removed user left the term %q", term)
+    }
+  }
+}
+
+// the index follows the committed writes only
+func TestRepository(t *testing.T) {
+  index := NewIndex()
+  users := NewRepository(user.NewMemoryRepository(), index)
+
+  if err := users.CreateUser(&user.User{Firstname: "Guillaume", Lastname: "Penaud"}); err != nil {
+    t.Fatal(err)
+  }
+
+  failure := errors.New("failure")
+  err := users.Transaction(func(tx user.UserRepository) error {
+    if err := tx.CreateUser(&user.User{Firstname: "Océane", Lastname: "Martin"}); err != nil {
+      return err
+    }
+
+    if len(index.Search("oceane")) != 0 {
+      t.Error("the index holds a user before the commit")
+    }
+
+    return failure
+  })
+  if err != failure {
+    t.Fatalf("Transaction = %v, want %v", err, failure)
+  }
+
+  if hits := index.Search("oceane"); len(hits) != 0 {
+    t.Errorf("the index holds a rolled back user: %v", hitIds(hits))
+  }
+
+  n := user.User{Id: 1}
+  if err = users.GetUser(&n); err != nil {
+    t.Fatal(err)
+  }
+  if err = users.DeleteUser(&n); err != nil {
+    t.Fatal(err)
+  }
+  if hits := index.Search("penaud"); len(hits) != 0 {
+    t.Errorf("the index holds a deleted user: %v", hitIds(hits))
+  }
+
+  if err = index.Rebuild(users); err != nil {
+    t.Fatal(err)
+  }
+  if len(index.documents) != 0 {
+    t.Errorf("the rebuilt index holds %d users", len(index.documents))
+  }
+}
@@ -0,0 +1,129 @@
+package search
+
+import (
+  user "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Indexed repository
+// -------------------------------------------------------------------------- //
+
+// Repository wraps a user storage and mirrors every successful write into the
+// search index, so that the index never lags behind this instance's writes.
+// Inside a transaction, index updates wait in pending until the commit.
+type Repository struct {
+  user.UserRepository
+  Index   *Index
+  pending *[]func()
+}
+
+func NewRepository(users user.UserRepository, index *Index) *Repository {
+  return &Repository{UserRepository: users, Index: index}
+}
+
+// Unwrap gives access to the wrapped storage, e.g. to reach its Migrator
+func (r *Repository) Unwrap() user.UserRepository {
+  return r.UserRepository
+}
+
+func (r *Repository) index(update func()) {
+  if r.pending != nil {
+    *r.pending = append(*r.pending, update)
+  } else {
+    update()
+  }
+}
+
+func (r *Repository) CreateUser(n *user.User) error {
+  if err := r.UserRepository.CreateUser(n); err != nil {
+    return err
+  }
+
+  indexed := *n
+  r.index(func() { r.Index.Add(indexed) })
+  return nil
+}
+
+func (r *Repository) UpdateUser(n *user.User) error {
+  if err := r.UserRepository.UpdateUser(n); err != nil {
+    return err
+  }
+
+  indexed := *n
+  r.index(func() { r.Index.Add(indexed) })
+  return nil
+}
+
+func (r *Repository) VerifyEmail(n *user.User) error {
+  if err := r.UserRepository.VerifyEmail(n); err != nil {
+    return err
+  }
+
+  indexed := *n
+  r.index(func() { r.Index.Add(indexed) })
+  return nil
+}
+
+func (r *Repository) DeleteUser(n *user.User) error {
+  if err := r.UserRepository.DeleteUser(n); err != nil {
+    return err
+  }
+
+  id := n.Id
+  r.index(func() { r.Index.Remove(id) })
+  return nil
+}
+
+func (r *Repository) RestoreUser(n *user.User) error {
+  if err := r.UserRepository.RestoreUser(n); err != nil {
+    return err
+  }
+
+  indexed := *n
+  r.index(func() { r.Index.Add(indexed) })
+  return nil
+}
+
+func (r *Repository) MergeUser(from *user.User, into *user.User) error {
+  if err := r.UserRepository.MergeUser(from, into); err != nil {
+    return err
+  }
+
+  id := from.Id
+  r.index(func() { r.Index.Remove(id) })
+  return nil
+}
+
+func (r *Repository) EraseUser(n *user.User, receipt *user.Erasure) error {
+  if err := r.UserRepository.EraseUser(n, receipt); err != nil {
+    return err
+  }
+
+  id := n.Id
+  r.index(func() { r.Index.Remove(id) })
+  return nil
+}
+
+func (r *Repository) Transaction(fn func(tx user.UserRepository) error) error {
+  if r.pending != nil {
+    return fn(r)
+  }
+
+  pending := []func(){}
+
+  err := r.UserRepository.Transaction(func(tx user.UserRepository) error {
+    // a retried transaction starts over with no pending update
+    pending = pending[:0]
+    return fn(&Repository{UserRepository: tx, Index: r.Index, pending: &pending})
+  })
+
+  if err != nil {
+    return err
+  }
+
+  for _, update := range pending {
+    update()
+  }
+
+  return nil
+}
@@ -1,40 +1,225 @@
 package internal
 
+import (
+  context "context"
+  errors  "errors"
+  fmt     "fmt"
+  log     "github.com/sirupsen/logrus"
+  time    "time"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
 // -----------------------------------------------------------------------------
-// 1. Database initialization (if specified in configuration)
+// 1. Database schema migrations
 // -----------------------------------------------------------------------------
 
-const dbReset = `DROP TABLE IF EXISTS user`
-const dbInit = `
-  CREATE TABLE user (
-    id INTEGER PRIMARY KEY NOT NULL AUTO_INCREMENT,
-    firstname VARCHAR(100),
-    lastname VARCHAR(100),
-    address VARCHAR(100),
-    phone VARCHAR(100)
-  ) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
-  `
-const dbInsertFirst  = `INSERT INTO user (firstname, lastname, address, phone) VALUES ('Guillaume', 'Penaud', '16 sentier de la côte 94370 Sucy-En-Brie', '0666222475');`
-const dbInsertSecond = `INSERT INTO user (firstname, lastname, address, phone) VALUES ('Pauline', 'Breniaux', '10 route de Rhye 74210 Mouthier-En-Bresse', '0645124365');`
+var ErrNoSchema = errors.New("the configured storage driver has no schema to migrate")
 
-func (a *Application) InitializeDatabase() (bool, error) {
-  var err error
+func (a *Application) Migrator() (user.Migrator, error) {
+  migrator, ok := a.storage().(user.Migrator)
+  if !ok {
+    return nil, ErrNoSchema
+  }
 
-  if _, err = a.DB.Exec(dbReset); err != nil {
-    return false, err
+  return migrator, nil
+}
+
+// KeyRotator returns the storage re-encrypting the personal data, when it
+// encrypts it at rest
+func (a *Application) KeyRotator() (user.KeyRotator, error) {
+  rotator, ok := a.storage().(user.KeyRotator)
+  if !ok {
+    return nil, fmt.Errorf("the %s storage driver keeps nothing at rest to encrypt", a.Config.Database.Driver)
   }
 
-  if _, err = a.DB.Exec(dbInit); err != nil {
-    return false, err
+  return rotator, nil
+}
+
+// CheckSchema refuses to go further when migrations are waiting to be applied
+func (a *Application) CheckSchema() error {
+  migrator, err := a.Migrator()
+  if errors.Is(err, ErrNoSchema) {
+    return nil
   }
 
-  if _, err = a.DB.Exec(dbInsertFirst); err != nil {
-    return false, err
+  pending, err := user.PendingMigrations(migrator)
+  if err != nil {
+    return err
+  }
+
+  if pending > 0 {
+    return fmt.Errorf("database schema is behind by %d migration(s), run \"migrate up\" first", pending)
   }
 
-  if _, err = a.DB.Exec(dbInsertSecond); err != nil {
+  return nil
+}
+
+// -----------------------------------------------------------------------------
+// 2. Database initialization (if specified in configuration)
+// -----------------------------------------------------------------------------
+
+var dbSeed = []user.User{
+  {Firstname: "Guillaume", Lastname: "Penaud", Address: "16 sentier de la côte 94370 Sucy-En-Brie", Phone: "0666222475"},
+  {Firstname: "Pauline", Lastname: "Breniaux", Address: "10 route de Rhye 74210 Mouthier-En-Bresse", Phone: "0645124365"},
+}
+
+// InitializeDatabase applies pending migrations, then inserts the seed users
+// when the user storage is empty. Existing data is never dropped.
+func (a *Application) InitializeDatabase() (bool, error) {
+  if migrator, err := a.Migrator(); err == nil {
+    if _, err = migrator.MigrateUp(); err != nil {
+      return false, err
+    }
+  }
+
+  page, err := a.Users.ListUsers(user.PageQuery{Limit: 1})
+  if err != nil {
     return false, err
   }
 
+  if len(page.Users) > 0 {
+    return true, nil
+  }
+
+  for _, seed := range dbSeed {
+    if err = a.Users.CreateUser(&seed); err != nil {
+      return false, err
+    }
+  }
+
   return true, err
 }
+
+// -----------------------------------------------------------------------------
+// 3. Phone numbers normalisation
+// -----------------------------------------------------------------------------
+
+// PhoneReport is the outcome of NormalizePhones. Invalid phones are listed by
+// user id and left as they are.
+type PhoneReport struct {
+  DryRun     bool
+  Users      int
+  Normalized int
+  Invalid    map[int]string
+}
+
+// NormalizePhones rewrites in E.164 the phones stored before numbers were
+// normalised on every write
+func (a *Application) NormalizePhones(dryRun bool) (PhoneReport, error) {
+  report := PhoneReport{DryRun: dryRun, Invalid: map[int]string{}}
+  query  := user.PageQuery{Limit: user.MaxPageSize}
+
+  for {
+    page, err := a.Users.ListUsers(query)
+    if err != nil {
+      return report, err
+    }
+
+    for _, n := range page.Users {
+      report.Users++
+
+      if n.Phone == "" {
+        continue
+      }
+
+      e164, err := user.ParsePhone(n.Phone)
+      if err != nil {
+        report.Invalid[n.Id] = n.Phone
+        continue
+      }
+
+      if e164 == n.Phone {
+        continue
+      }
+
+      if !dryRun {
+        n.Phone = e164
+        if err = a.Users.UpdateUser(&n); err != nil {
+          return report, fmt.Errorf("user %d: %w", n.Id, err)
+        }
+      }
+
+      report.Normalized++
+    }
+
+    if page.Next == nil {
+      return report, nil
+    }
+
+    query.Cursor = *page.Next
+  }
+}
+
+// -----------------------------------------------------------------------------
+// 4. Deleted users and expired requests purge
+// -----------------------------------------------------------------------------
+
+// PurgeDeletedUsers removes for good the users deleted for longer than the
+// retention
+func (a *Application) PurgeDeletedUsers() (int, error) {
+  return a.Users.PurgeUsers(time.Now().Add(-a.Config.Deletion.Retention))
+}
+
+// ForgetExpiredRequests removes the creations remembered under an
+// Idempotency-Key for longer than the idempotency window
+func (a *Application) ForgetExpiredRequests() (int, error) {
+  return a.Users.ForgetRequests(time.Now())
+}
+
+// purgeDeletedUsersEvery runs PurgeDeletedUsers and ForgetExpiredRequests at
+// every interval until ctx is done
+func (a *Application) purgeDeletedUsersEvery(ctx context.Context, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    purged, err := a.PurgeDeletedUsers()
+
+    entry := applicationLog.WithFields(log.Fields{
+      "purged": purged,
+      "retention": a.Config.Deletion.Retention,
+    })
+
+    if err != nil {
+      entry.WithField("error", err).Error("deleted users purge failed")
+    } else if purged > 0 {
+      entry.Info("deleted users purged")
+    }
+
+    if forgotten, err := a.ForgetExpiredRequests(); err != nil {
+      applicationLog.WithField("error", err).Error("expired requests purge failed")
+    } else if forgotten > 0 {
+      applicationLog.WithField("forgotten", forgotten).Debug("expired requests forgotten")
+    }
+
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+  }
+}
+
+// -----------------------------------------------------------------------------
+// 5. Search index rebuild
+// -----------------------------------------------------------------------------
+
+// rebuildSearchIndexEvery rebuilds the search index from the storage at every
+// interval until ctx is done, so that it catches up with the writes made
+// through the other instances
+func (a *Application) rebuildSearchIndexEvery(ctx context.Context, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+
+    if err := a.Search.Rebuild(a.Users); err != nil {
+      applicationLog.WithField("error", err).Error("search index rebuild failed")
+    }
+  }
+}
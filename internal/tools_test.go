@@ -0,0 +1,44 @@
+package internal
+
+import (
+  http    "net/http"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestInitializeDatabase(t *testing.T) {
+  a := newTestApplication(t)
+
+  for i := 0; i < 2; i++ {
+    if initialized, err := a.InitializeDatabase(); !initialized || err != nil {
+      t.Fatalf("InitializeDatabase() = %t, %v", initialized, err)
+    }
+  }
+
+  page, err := a.Users.ListUsers(user.PageQuery{Limit: 10})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(page.Users) != len(dbSeed) {
+    t.Errorf("the seed users are inserted %d times", len(page.Users) / len(dbSeed))
+  }
+}
+
+// the schema is only changed from the command line, never over HTTP
+func TestNoInitializeRoute(t *testing.T) {
+  a := newTestApplication(t)
+
+  for _, method := range []string{"GET", "POST"} {
+    if w := serve(t, a, method, "/initialize_db", ""); w.Code != http.StatusNotFound && w.Code != http.StatusMethodNotAllowed {
+      t.Errorf("%s /initialize_db: status %d", method, w.Code)
+    }
+  }
+}
+
+func TestCheckSchema(t *testing.T) {
+  a := newTestApplication(t)
+
+  if err := a.CheckSchema(); err != nil {
+    t.Errorf("CheckSchema() = %v on a storage without schema", err)
+  }
+}
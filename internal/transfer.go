@@ -0,0 +1,188 @@
+package internal
+
+import (
+  fmt      "fmt"
+  http     "net/http"
+  io       "io"
+  log      "github.com/sirupsen/logrus"
+  os       "os"
+  strconv  "strconv"
+  transfer "github.com/gpenaud/needys-api-user/internal/transfer"
+  user     "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Import parameters
+// -------------------------------------------------------------------------- //
+
+func parseBoolParameter(r *http.Request, name string) (bool, error) {
+  value := r.URL.Query().Get(name)
+  if value == "" {
+    return false, nil
+  }
+
+  parsed, err := strconv.ParseBool(value)
+  if err != nil {
+    return false, user.ValidationError("invalid_parameter", "%s must be true or false", name)
+  }
+
+  return parsed, nil
+}
+
+// parseImport reads the format from ?format= or from the Content-Type, and
+// ?dry_run=, ?async= and ?map=
+func parseImport(r *http.Request) (importer transfer.Importer, async bool, err error) {
+  importer.Format = r.URL.Query().Get("format")
+  if importer.Format == "" {
+    importer.Format, _ = transfer.FormatOf(r.Header.Get("Content-Type"))
+  }
+
+  if importer.DryRun, err = parseBoolParameter(r, "dry_run"); err != nil {
+    return
+  }
+
+  if async, err = parseBoolParameter(r, "async"); err != nil {
+    return
+  }
+
+  importer.Columns, err = transfer.ParseColumns(r.URL.Query().Get("map"))
+  return
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Import handler
+// -------------------------------------------------------------------------- //
+
+// importUsers streams a CSV or NDJSON file into the storage. The report comes
+// back as soon as the import is over, or an async import answers 202 right
+// away with the job to follow at /jobs/{id}.
+func (a *Application) importUsers(w http.ResponseWriter, r *http.Request) {
+  importer, async, err := parseImport(r)
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  if !transfer.Importable(importer.Format) {
+    respondWithProblem(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "The file must be sent as text/csv or application/x-ndjson")
+    return
+  }
+
+  defer r.Body.Close()
+
+  importer.Users = a.usersFor(r)
+
+  if async {
+    a.startImport(w, r, importer)
+    return
+  }
+
+  report, err := importer.Import(r.Body)
+
+  switch {
+  case err != nil:
+    respondWithUserError(w, r, err)
+  case report.Failed > 0:
+    respondWithJSON(w, http.StatusMultiStatus, report)
+  default:
+    respondWithJSON(w, http.StatusOK, report)
+  }
+}
+
+// startImport spools the body to a temporary file, the request being over
+// long before the job, then imports the file in the background
+func (a *Application) startImport(w http.ResponseWriter, r *http.Request, importer transfer.Importer) {
+  spool, err := os.CreateTemp("", "needys-import-*")
+  if err != nil {
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  if _, err = io.Copy(spool, r.Body); err != nil {
+    spool.Close()
+    os.Remove(spool.Name())
+    respondWithProblem(w, r, http.StatusBadRequest, "invalid_payload", "The file cannot be read")
+    return
+  }
+
+  job := a.Jobs.Start("import", func(progress func(interface{})) (interface{}, error) {
+    defer os.Remove(spool.Name())
+    defer spool.Close()
+
+    if _, err := spool.Seek(0, io.SeekStart); err != nil {
+      return nil, err
+    }
+
+    importer.Progress = func(report transfer.Report) { progress(report) }
+
+    report, err := importer.Import(spool)
+    return report, err
+  })
+
+  w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.Id))
+  respondWithJSON(w, http.StatusAccepted, newJobView(job))
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Export handler
+// -------------------------------------------------------------------------- //
+
+// exportFlushSize is the number of users sent to the client at once
+const exportFlushSize = 500
+
+// exportUsers streams every user matching the listing filters, in the listing
+// order, as the rows come from the storage. A failure after the first row
+// aborts the response, so that a truncated file never looks complete.
+func (a *Application) exportUsers(w http.ResponseWriter, r *http.Request, query user.PageQuery, format string) {
+  writer, err := transfer.NewWriter(format, w)
+  if err != nil {
+    respondWithBadRequest(w, r, err)
+    return
+  }
+
+  w.Header().Set("Content-Type", transfer.ContentTypes[format])
+  w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+  flusher, _ := w.(http.Flusher)
+  count      := 0
+
+  err = a.Users.ScanUsers(query, func(n *user.User) error {
+    if err := writer.Write(n); err != nil {
+      return err
+    }
+
+    if count++; count % exportFlushSize == 0 {
+      if err := writer.Flush(); err != nil {
+        return err
+      }
+
+      if flusher != nil {
+        flusher.Flush()
+      }
+    }
+
+    return nil
+  })
+
+  if err == nil {
+    err = writer.Close()
+  }
+
+  if err == nil {
+    return
+  }
+
+  if count == 0 {
+    w.Header().Del("Content-Disposition")
+    respondWithUserError(w, r, err)
+    return
+  }
+
+  handlerLog.WithFields(log.Fields{
+    "format": format,
+    "exported": count,
+    "error": err,
+  }).Error("export aborted")
+
+  panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,255 @@
+package transfer
+
+import (
+  zip     "archive/zip"
+  bufio   "bufio"
+  csv     "encoding/csv"
+  io      "io"
+  json    "encoding/json"
+  regexp  "regexp"
+  strings "strings"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+  xml     "encoding/xml"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Export writers
+// -------------------------------------------------------------------------- //
+
+// Writer encodes users one at a time. Nothing reaches the underlying writer
+// before the first user or Close, so that an early failure can still be
+// answered with an error.
+type Writer interface {
+  Write(n *user.User) error
+  // Flush pushes the buffered users to the underlying writer
+  Flush() error
+  // Close completes the document, Close of an empty export included
+  Close() error
+}
+
+func NewWriter(format string, w io.Writer) (Writer, error) {
+  switch format {
+  case FormatCSV:
+    return &csvWriter{writer: csv.NewWriter(w)}, nil
+  case FormatNDJSON:
+    buffered := bufio.NewWriter(w)
+    return &ndjsonWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+  case FormatXLSX:
+    return &xlsxWriter{archive: zip.NewWriter(w)}, nil
+  }
+
+  return nil, user.ValidationError("invalid_parameter", "%q is not an export format (csv, ndjson, xlsx)", format)
+}
+
+// exportedFields are the columns of the exports, the internal id left out
+var exportedFields = user.PublicFields()
+
+func header() []string {
+  names := make([]string, len(exportedFields))
+  for i, field := range exportedFields {
+    names[i] = field.Name
+  }
+
+  return names
+}
+
+func record(n *user.User) []string {
+  values := make([]string, len(exportedFields))
+  for i, field := range exportedFields {
+    values[i] = field.Value(n)
+  }
+
+  return values
+}
+
+// -------------------------------------------------------------------------- //
+// 2. CSV
+// -------------------------------------------------------------------------- //
+
+// phoneLike matches the values which look like formulas to a spreadsheet
+// but cannot run anything, e.g. "+33 6 12 34 56 78"
+var phoneLike = regexp.MustCompile(`^\+?[0-9 ().-]*$`)
+
+// neutralise quotes the values a spreadsheet would run as a formula
+func neutralise(value string) string {
+  if value == "" || !strings.ContainsAny(value[:1], "=+-@\t\r") || phoneLike.MatchString(value) {
+    return value
+  }
+
+  return "'" + value
+}
+
+type csvWriter struct {
+  writer  *csv.Writer
+  started bool
+}
+
+func (c *csvWriter) start() error {
+  if c.started {
+    return nil
+  }
+
+  c.started = true
+
+  return c.writer.Write(header())
+}
+
+func (c *csvWriter) Write(n *user.User) error {
+  if err := c.start(); err != nil {
+    return err
+  }
+
+  values := record(n)
+  for i := range values {
+    values[i] = neutralise(values[i])
+  }
+
+  return c.writer.Write(values)
+}
+
+func (c *csvWriter) Flush() error {
+  c.writer.Flush()
+  return c.writer.Error()
+}
+
+func (c *csvWriter) Close() error {
+  if err := c.start(); err != nil {
+    return err
+  }
+
+  return c.Flush()
+}
+
+// -------------------------------------------------------------------------- //
+// 3. NDJSON
+// -------------------------------------------------------------------------- //
+
+type ndjsonWriter struct {
+  buffered *bufio.Writer
+  encoder  *json.Encoder
+}
+
+func (j *ndjsonWriter) Write(n *user.User) error {
+  return j.encoder.Encode(n)
+}
+
+func (j *ndjsonWriter) Flush() error {
+  return j.buffered.Flush()
+}
+
+func (j *ndjsonWriter) Close() error {
+  return j.Flush()
+}
+
+// -------------------------------------------------------------------------- //
+// 4. XLSX
+// -------------------------------------------------------------------------- //
+
+// xlsxParts are the fixed parts of a workbook holding a single "users" sheet,
+// whose content is streamed afterwards
+var xlsxParts = []struct {
+  Name    string
+  Content string
+}{
+  {"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+  {"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+  {"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="users" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+  {"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+const xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+
+const xlsxSheetEnd = `</sheetData></worksheet>`
+
+// xlsxWriter writes the sheet as inline strings, numbers aside, so that no
+// shared string table has to be held in memory
+type xlsxWriter struct {
+  archive *zip.Writer
+  sheet   *bufio.Writer
+}
+
+func (x *xlsxWriter) start() error {
+  if x.sheet != nil {
+    return nil
+  }
+
+  for _, part := range xlsxParts {
+    entry, err := x.archive.Create(part.Name)
+    if err != nil {
+      return err
+    }
+
+    if _, err = io.WriteString(entry, part.Content); err != nil {
+      return err
+    }
+  }
+
+  entry, err := x.archive.Create("xl/worksheets/sheet1.xml")
+  if err != nil {
+    return err
+  }
+
+  x.sheet = bufio.NewWriter(entry)
+  x.sheet.WriteString(xlsxSheetStart)
+
+  return x.row(header(), nil)
+}
+
+func (x *xlsxWriter) row(values []string, fields []user.Field) error {
+  x.sheet.WriteString("<row>")
+
+  for i, value := range values {
+    if fields != nil && fields[i].Numeric {
+      x.sheet.WriteString("<c><v>")
+      xml.EscapeText(x.sheet, []byte(value))
+      x.sheet.WriteString("</v></c>")
+      continue
+    }
+
+    x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+    xml.EscapeText(x.sheet, []byte(value))
+    x.sheet.WriteString("</t></is></c>")
+  }
+
+  _, err := x.sheet.WriteString("</row>")
+  return err
+}
+
+func (x *xlsxWriter) Write(n *user.User) error {
+  if err := x.start(); err != nil {
+    return err
+  }
+
+  return x.row(record(n), exportedFields)
+}
+
+func (x *xlsxWriter) Flush() error {
+  if x.sheet == nil {
+    return nil
+  }
+
+  if err := x.sheet.Flush(); err != nil {
+    return err
+  }
+
+  return x.archive.Flush()
+}
+
+func (x *xlsxWriter) Close() error {
+  if err := x.start(); err != nil {
+    return err
+  }
+
+  x.sheet.WriteString(xlsxSheetEnd)
+
+  if err := x.sheet.Flush(); err != nil {
+    return err
+  }
+
+  return x.archive.Close()
+}
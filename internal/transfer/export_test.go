@@ -0,0 +1,152 @@
+package transfer
+
+import (
+  zip     "archive/zip"
+  bytes   "bytes"
+  csv     "encoding/csv"
+  io      "io"
+  json    "encoding/json"
+  reflect "reflect"
+  strings "strings"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestNeutralise(t *testing.T) {
+  tests := map[string]string{
+    "Penaud":            "Penaud",
+    "":                  "",
+    "=SUM(A1:A2)":       "'=SUM(A1:A2)",
+    "@cmd":              "'@cmd",
+    "-2+3":              "'-2+3",
+    "\tTab":             "'\tTab",
+    "+33645124365":      "+33645124365",
+    "+33 (0)6 45 12 43": "+33 (0)6 45 12 43",
+    "+ville":            "'+ville",
+  }
+
+  for value, want := range tests {
+    if neutralised := neutralise(value); neutralised != want {
+      t.Errorf("neutralise(%q) = %q, want %q", value, neutralised, want)
+    }
+  }
+}
+
+// export writes users through a new writer of format
+func export(t *testing.T, format string, users ...user.User) []byte {
+  t.Helper()
+
+  buffer := bytes.Buffer{}
+  writer, err := NewWriter(format, &buffer)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for i := range users {
+    if err = writer.Write(&users[i]); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err = writer.Close(); err != nil {
+    t.Fatal(err)
+  }
+
+  return buffer.Bytes()
+}
+
+var exportedUser = user.User{Id: 7, PublicId: "01HV3K8Z4X6N7Q2R5T9W0YBCDE", Firstname: "=Guillaume", Lastname: "Penaud", Phone: "+33645124365"}
+
+func TestCSVWriter(t *testing.T) {
+  records, err := csv.NewReader(bytes.NewReader(export(t, FormatCSV, exportedUser))).ReadAll()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if len(records) != 2 || !reflect.DeepEqual(records[0], header()) {
+    t.Fatalf("the CSV export holds %q", records)
+  }
+
+  row := map[string]string{}
+  for i, name := range records[0] {
+    row[name] = records[1][i]
+  }
+
+  if row["publicid"] != exportedUser.PublicId || row["firstname"] != "'=Guillaume" || row["phone"] != "+33645124365" {
+    t.Errorf("the CSV export writes the row %v", row)
+  }
+
+  if records, _ = csv.NewReader(bytes.NewReader(export(t, FormatCSV))).ReadAll(); len(records) != 1 {
+    t.Errorf("the empty CSV export holds %q", records)
+  }
+}
+
+func TestExportHidesIds(t *testing.T) {
+  for _, name := range header() {
+    if name == "id" {
+      t.Error("the exports have an id column")
+    }
+  }
+
+  for _, format := range []string{FormatCSV, FormatNDJSON} {
+    if content := string(export(t, format, exportedUser)); strings.Contains(content, `"id"`) || strings.Contains(content, ",7,") {
+      t.Errorf("the %s export shows the integer id: %s", format, content)
+    }
+  }
+}
+
+func TestNDJSONWriter(t *testing.T) {
+  lines := strings.Split(strings.TrimSuffix(string(export(t, FormatNDJSON, exportedUser, exportedUser)), "\n"), "\n")
+  if len(lines) != 2 {
+    t.Fatalf("the NDJSON export holds %d lines", len(lines))
+  }
+
+  n := user.User{}
+  if err := json.Unmarshal([]byte(lines[0]), &n); err != nil || n.PublicId != exportedUser.PublicId || n.Firstname != "=Guillaume" {
+    t.Errorf("the NDJSON export writes %s: %v", lines[0], err)
+  }
+
+  if content := export(t, FormatNDJSON); len(content) != 0 {
+    t.Errorf("the empty NDJSON export holds %q", content)
+  }
+}
+
+func TestXLSXWriter(t *testing.T) {
+  content := export(t, FormatXLSX, user.User{Firstname: "Guillaume", Lastname: "Penaud & <Fils>"})
+
+  archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  parts := map[string]string{}
+  for _, file := range archive.File {
+    entry, err := file.Open()
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    data, _ := io.ReadAll(entry)
+    parts[file.Name] = string(data)
+    entry.Close()
+  }
+
+  for _, part := range xlsxParts {
+    if parts[part.Name] != part.Content {
+      t.Errorf("the workbook misses the part %s", part.Name)
+    }
+  }
+
+  sheet := parts["xl/worksheets/sheet1.xml"]
+  if !strings.HasPrefix(sheet, xlsxSheetStart) || !strings.HasSuffix(sheet, xlsxSheetEnd) || strings.Count(sheet, "<row>") != 2 {
+    t.Errorf("the sheet is %s", sheet)
+  }
+  if !strings.Contains(sheet, "Penaud &amp; &lt;Fils&gt;") {
+    t.Errorf("the sheet does not escape the values: %s", sheet)
+  }
+}
+
+func TestNewWriter(t *testing.T) {
+  if _, err := NewWriter("pdf", io.Discard); user.KindOf(err) != user.KindValidation {
+    t.Errorf("NewWriter(pdf) = %v, want a validation error", err)
+  }
+}
@@ -0,0 +1,40 @@
+package transfer
+
+import (
+  strings "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Formats
+// -------------------------------------------------------------------------- //
+
+const (
+  FormatCSV    = "csv"
+  FormatNDJSON = "ndjson"
+  FormatXLSX   = "xlsx"
+)
+
+var ContentTypes = map[string]string{
+  FormatCSV:    "text/csv",
+  FormatNDJSON: "application/x-ndjson",
+  FormatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// FormatOf finds the format of a media type or of a format name
+func FormatOf(value string) (string, bool) {
+  value = strings.ToLower(strings.TrimSpace(strings.Split(value, ";")[0]))
+
+  for format, contentType := range ContentTypes {
+    if value == format || value == contentType {
+      return format, true
+    }
+  }
+
+  return "", false
+}
+
+// Importable tells the formats the Importer reads, spreadsheets having to be
+// saved as CSV first
+func Importable(format string) bool {
+  return format == FormatCSV || format == FormatNDJSON
+}
@@ -0,0 +1,407 @@
+package transfer
+
+import (
+  bufio   "bufio"
+  bytes   "bytes"
+  csv     "encoding/csv"
+  errors  "errors"
+  fmt     "fmt"
+  io      "io"
+  json    "encoding/json"
+  log     "github.com/sirupsen/logrus"
+  strings "strings"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+var importLog *log.Entry
+
+func init() {
+  importLog = log.WithFields(log.Fields{
+    "_file": "internal/transfer/import.go",
+    "_type": "data",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Column mapping
+// -------------------------------------------------------------------------- //
+
+// ParseColumns reads a column mapping like "Prénom:firstname,Nom:lastname"
+func ParseColumns(specification string) (map[string]string, error) {
+  columns := map[string]string{}
+
+  if specification == "" {
+    return columns, nil
+  }
+
+  for _, pair := range strings.Split(specification, ",") {
+    column, field, found := strings.Cut(pair, ":")
+    if !found || strings.TrimSpace(column) == "" {
+      return nil, user.ValidationError("invalid_parameter", "%q is not a column:field mapping", pair)
+    }
+
+    columns[column] = field
+  }
+
+  return columns, nil
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Import report
+// -------------------------------------------------------------------------- //
+
+// maxReportedErrors bounds the report of a broken file, Failed still counts
+// every rejected row
+const maxReportedErrors = 1000
+
+// RowError explains why the row at Line was not imported
+type RowError struct {
+  Line    int              `json:"line"`
+  Code    string           `json:"code"`
+  Message string           `json:"message"`
+  Errors  []user.Violation `json:"errors,omitempty"`
+}
+
+type Report struct {
+  DryRun         bool       `json:"dry_run"`
+  Rows           int        `json:"rows"`
+  Imported       int        `json:"imported"`
+  Failed         int        `json:"failed"`
+  IgnoredColumns []string   `json:"ignored_columns,omitempty"`
+  Errors         []RowError `json:"errors"`
+}
+
+func (r *Report) reject(line int, err error) {
+  r.Failed++
+
+  if len(r.Errors) >= maxReportedErrors {
+    return
+  }
+
+  rowErr := RowError{Line: line, Code: "invalid_row", Message: err.Error()}
+
+  var userErr *user.Error
+  if errors.As(err, &userErr) {
+    rowErr.Code, rowErr.Message, rowErr.Errors = userErr.Code, userErr.Message, userErr.Violations
+  }
+
+  r.Errors = append(r.Errors, rowErr)
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Row readers
+// -------------------------------------------------------------------------- //
+
+// row is one user read from the file, or the reason it could not be read
+type row struct {
+  Line int
+  User user.User
+  Err  error
+}
+
+type rowReader interface {
+  // Next returns io.EOF once every row is read
+  Next() (row, error)
+}
+
+// csvReader maps the columns of the header line to user fields, by name or
+// through the Columns mapping of the importer
+type csvReader struct {
+  reader  *csv.Reader
+  fields  []*user.Field
+}
+
+// sniffDelimiter picks the most frequent of the usual separators on the header
+// line, spreadsheets using ";" wherever "," is the decimal separator
+func sniffDelimiter(buffered *bufio.Reader) rune {
+  head, _ := buffered.Peek(4096)
+  if end := bytes.IndexByte(head, '\n'); end >= 0 {
+    head = head[:end]
+  }
+
+  delimiter, best := ',', bytes.Count(head, []byte(","))
+  for _, candidate := range []rune{';', '\t'} {
+    if count := bytes.Count(head, []byte(string(candidate))); count > best {
+      delimiter, best = candidate, count
+    }
+  }
+
+  return delimiter
+}
+
+func newCSVReader(r io.Reader, columns map[string]string, report *Report) (*csvReader, error) {
+  buffered := bufio.NewReader(r)
+
+  reader := csv.NewReader(buffered)
+  reader.Comma            = sniffDelimiter(buffered)
+  reader.FieldsPerRecord  = -1
+  reader.TrimLeadingSpace = true
+
+  header, err := reader.Read()
+  if err == io.EOF {
+    return nil, user.ValidationError("invalid_file", "the file is empty")
+  }
+  if err != nil {
+    return nil, user.ValidationError("invalid_file", "the header line cannot be read: %s", err)
+  }
+
+  mapping := map[string]string{}
+  for column, name := range columns {
+    mapping[strings.ToLower(strings.TrimSpace(column))] = strings.ToLower(strings.TrimSpace(name))
+  }
+
+  fields := make([]*user.Field, len(header))
+  mapped := map[string]bool{}
+
+  for i, column := range header {
+    column = strings.TrimSpace(strings.TrimPrefix(column, "\uFEFF"))
+    header[i] = column
+    column = strings.ToLower(column)
+
+    name := column
+    if target, found := mapping[column]; found {
+      name = target
+    }
+
+    field, found := user.LookupField(name)
+    if !found || field.Set == nil {
+      report.IgnoredColumns = append(report.IgnoredColumns, header[i])
+      continue
+    }
+
+    if mapped[field.Name] {
+      return nil, user.ValidationError("invalid_file", "several columns map to %s", field.Name)
+    }
+
+    mapped[field.Name] = true
+    fields[i] = &field
+  }
+
+  if len(mapped) == 0 {
+    return nil, user.ValidationError("invalid_file", "no column maps to a user field")
+  }
+
+  return &csvReader{reader: reader, fields: fields}, nil
+}
+
+func (c *csvReader) Next() (row, error) {
+  record, err := c.reader.Read()
+  if err == io.EOF {
+    return row{}, err
+  }
+
+  var parseErr *csv.ParseError
+  if errors.As(err, &parseErr) {
+    return row{Line: parseErr.Line, Err: user.ValidationError("invalid_row", "%s", parseErr.Err)}, nil
+  }
+  if err != nil {
+    return row{}, err
+  }
+
+  line, _ := c.reader.FieldPos(0)
+
+  n := user.User{}
+  for i, value := range record {
+    if i < len(c.fields) && c.fields[i] != nil {
+      c.fields[i].Set(&n, strings.TrimSpace(value))
+    }
+  }
+
+  return row{Line: line, User: n}, nil
+}
+
+// ndjsonReader reads one JSON user per line, blank lines being skipped
+type ndjsonReader struct {
+  scanner *bufio.Scanner
+  line    int
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+
+  return &ndjsonReader{scanner: scanner}
+}
+
+func (j *ndjsonReader) Next() (row, error) {
+  for j.scanner.Scan() {
+    j.line++
+
+    document := bytes.TrimSpace(j.scanner.Bytes())
+    if len(document) == 0 {
+      continue
+    }
+
+    n := user.User{}
+
+    decoder := json.NewDecoder(bytes.NewReader(document))
+    decoder.DisallowUnknownFields()
+
+    if err := decoder.Decode(&n); err != nil {
+      if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+        return row{Line: j.line, Err: user.InvalidUserError(user.UnknownFieldViolation(strings.Trim(field, `"`)))}, nil
+      }
+
+      return row{Line: j.line, Err: user.ValidationError("invalid_row", "the line is not a JSON user")}, nil
+    }
+
+    return row{Line: j.line, User: n}, nil
+  }
+
+  if err := j.scanner.Err(); err != nil {
+    return row{}, user.ValidationError("invalid_file", "the file cannot be read: %s", err)
+  }
+
+  return row{}, io.EOF
+}
+
+// -------------------------------------------------------------------------- //
+// 4. Importer
+// -------------------------------------------------------------------------- //
+
+const DefaultChunkSize = 100
+
+// Importer streams users from a file into the storage. Valid rows are created
+// ChunkSize at a time, each chunk in its own transaction. A dry run validates
+// the rows without writing anything.
+type Importer struct {
+  Users     user.UserRepository
+  Format    string
+  DryRun    bool
+  ChunkSize int
+  // Columns maps CSV header names to user fields, e.g. "Prénom": "firstname"
+  Columns   map[string]string
+  // Progress, when set, receives a copy of the report after every chunk
+  Progress  func(Report)
+}
+
+// Import reads the whole file and reports the fate of every row. An error
+// means the import stopped early: the file cannot be read or the storage
+// failed, rows already reported as imported stay imported.
+func (i *Importer) Import(r io.Reader) (Report, error) {
+  report := Report{DryRun: i.DryRun, Errors: []RowError{}}
+
+  var rows rowReader
+
+  switch i.Format {
+  case FormatCSV:
+    reader, err := newCSVReader(r, i.Columns, &report)
+    if err != nil {
+      return report, err
+    }
+    rows = reader
+  case FormatNDJSON:
+    rows = newNDJSONReader(r)
+  default:
+    return report, user.ValidationError("invalid_parameter", "%q is not an import format (csv, ndjson)", i.Format)
+  }
+
+  size := i.ChunkSize
+  if size < 1 {
+    size = DefaultChunkSize
+  }
+
+  chunk := make([]row, 0, size)
+
+  for {
+    next, err := rows.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return report, err
+    }
+
+    if report.Rows++; report.Rows % size == 0 {
+      i.notify(&report)
+    }
+
+    if next.Err == nil {
+      next.Err = next.User.Validate()
+    }
+
+    if next.Err != nil {
+      report.reject(next.Line, next.Err)
+      continue
+    }
+
+    if i.DryRun {
+      continue
+    }
+
+    if chunk = append(chunk, next); len(chunk) == size {
+      if err = i.flush(chunk, &report); err != nil {
+        return report, err
+      }
+      chunk = chunk[:0]
+    }
+  }
+
+  if err := i.flush(chunk, &report); err != nil {
+    return report, err
+  }
+
+  importLog.WithFields(log.Fields{
+    "format": i.Format,
+    "dry_run": i.DryRun,
+    "rows": report.Rows,
+    "imported": report.Imported,
+    "failed": report.Failed,
+  }).Info("import is over")
+
+  return report, nil
+}
+
+// fatal tells the storage failures which make any further row fail as well
+func fatal(err error) bool {
+  kind := user.KindOf(err)
+  return kind == user.KindInternal || kind == user.KindUnavailable
+}
+
+// flush creates a chunk of rows in one transaction. When a row breaks the
+// transaction, the chunk is replayed row by row to single the culprits out.
+func (i *Importer) flush(chunk []row, report *Report) error {
+  if len(chunk) == 0 {
+    return nil
+  }
+
+  err := user.RunTransaction(i.Users, func(tx user.UserRepository) error {
+    for _, next := range chunk {
+      n := next.User
+      if err := tx.CreateUser(&n); err != nil {
+        return fmt.Errorf("line %d: %w", next.Line, err)
+      }
+    }
+
+    return nil
+  })
+
+  switch {
+  case err == nil:
+    report.Imported += len(chunk)
+  case fatal(err):
+    return err
+  default:
+    for _, next := range chunk {
+      n := next.User
+
+      if err = i.Users.CreateUser(&n); err == nil {
+        report.Imported++
+      } else if fatal(err) {
+        return err
+      } else {
+        report.reject(next.Line, err)
+      }
+    }
+  }
+
+  return nil
+}
+
+func (i *Importer) notify(report *Report) {
+  if i.Progress != nil {
+    progress := *report
+    progress.Errors = append([]RowError{}, report.Errors...)
+    i.Progress(progress)
+  }
+}
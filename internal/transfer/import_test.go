@@ -0,0 +1,130 @@
+package transfer
+
+import (
+  bufio   "bufio"
+  reflect "reflect"
+  strings "strings"
+  testing "testing"
+  user    "github.com/gpenaud/needys-api-user/internal/user"
+)
+
+func TestParseColumns(t *testing.T) {
+  columns, err := ParseColumns("Prénom:firstname,Nom:lastname")
+  if err != nil || !reflect.DeepEqual(columns, map[string]string{"Prénom": "firstname", "Nom": "lastname"}) {
+    t.Errorf("ParseColumns = %v, %v", columns, err)
+  }
+
+  for _, specification := range []string{"Prénom", ":firstname", "Prénom:firstname,"} {
+    if _, err := ParseColumns(specification); err == nil {
+      t.Errorf("ParseColumns(%q) accepts an invalid mapping", specification)
+    }
+  }
+}
+
+func TestSniffDelimiter(t *testing.T) {
+  tests := map[string]rune{
+    "firstname,lastname\nGuillaume;Penaud\n": ',',
+    "firstname;lastname;city\nGuillaume,Penaud\n": ';',
+    "firstname\tlastname\n": '\t',
+    "firstname\n": ',',
+  }
+
+  for content, want := range tests {
+    if delimiter := sniffDelimiter(bufio.NewReader(strings.NewReader(content))); delimiter != want {
+      t.Errorf("sniffDelimiter(%q) = %q, want %q", content, delimiter, want)
+    }
+  }
+}
+
+// importRows imports content into an empty storage, returning the report and
+// the stored users
+func importRows(t *testing.T, importer Importer, content string) (Report, []user.User) {
+  t.Helper()
+
+  users := user.NewMemoryRepository()
+  importer.Users = users
+
+  report, err := importer.Import(strings.NewReader(content))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  page, err := users.ListUsers(user.PageQuery{Limit: user.MaxPageSize})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return report, page.Users
+}
+
+func rejectedLines(report Report) map[int]string {
+  lines := map[int]string{}
+  for _, rowErr := range report.Errors {
+    lines[rowErr.Line] = rowErr.Code
+  }
+
+  return lines
+}
+
+func TestImportCSV(t *testing.T) {
+  content := "\uFEFFPrénom;Nom;Email;Notes\n" +
+    "Guillaume;Penaud;guillaume@example.com;first\n" +
+    "Océane;;oceane@example.com;no lastname\n" +
+    "Anna;Roux;GUILLAUME@example.com;same email\n" +
+    "Bruno;Roux;;\n"
+
+  report, users := importRows(t, Importer{Format: FormatCSV, ChunkSize: 2, Columns: map[string]string{"prénom": "firstname", "Nom": "lastname"}}, content)
+
+  if report.Rows != 4 || report.Imported != 2 || report.Failed != 2 || len(users) != 2 {
+    t.Errorf("the import reports %+v and stores %d users", report, len(users))
+  }
+  if lines := rejectedLines(report); !reflect.DeepEqual(lines, map[int]string{3: "invalid_user", 4: "email_taken"}) {
+    t.Errorf("the import rejects the lines %v", lines)
+  }
+  if !reflect.DeepEqual(report.IgnoredColumns, []string{"Notes"}) {
+    t.Errorf("the import ignores the columns %v", report.IgnoredColumns)
+  }
+}
+
+func TestImportCSVHeader(t *testing.T) {
+  tests := []string{
+    "",
+    "age,notes\n40,none\n",
+    "firstname,prenom\nGuillaume,Guillaume\n",
+  }
+
+  for _, content := range tests {
+    importer := Importer{Users: user.NewMemoryRepository(), Format: FormatCSV, Columns: map[string]string{"prenom": "firstname"}}
+
+    if _, err := importer.Import(strings.NewReader(content)); user.KindOf(err) != user.KindValidation {
+      t.Errorf("Import(%q) = %v, want a validation error", content, err)
+    }
+  }
+}
+
+func TestImportNDJSON(t *testing.T) {
+  content := `{"firstname": "Guillaume", "lastname": "Penaud"}` + "\n" +
+    "\n" +
+    `{"firstname": "Océane", "lastname": "Martin", "age": 40}` + "\n" +
+    `{"firstname": "Anna",` + "\n" +
+    `{"firstname": "Bruno", "lastname": "Roux", "phone": "06 45 12 43 65"}` + "\n"
+
+  report, users := importRows(t, Importer{Format: FormatNDJSON}, content)
+
+  if report.Rows != 4 || report.Imported != 2 || len(users) != 2 || users[1].Phone != "+33645124365" {
+    t.Errorf("the import reports %+v and stores %+v", report, users)
+  }
+  if lines := rejectedLines(report); !reflect.DeepEqual(lines, map[int]string{3: "invalid_user", 4: "invalid_row"}) {
+    t.Errorf("the import rejects the lines %v", lines)
+  }
+}
+
+func TestImportDryRun(t *testing.T) {
+  content := "firstname,lastname\nGuillaume,Penaud\nOcéane,\n"
+
+  report, users := importRows(t, Importer{Format: FormatCSV, DryRun: true}, content)
+
+  if !report.DryRun || report.Rows != 2 || report.Imported != 0 || report.Failed != 1 || len(users) != 0 {
+    t.Errorf("the dry run reports %+v and stores %d users", report, len(users))
+  }
+}
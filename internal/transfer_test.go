@@ -0,0 +1,107 @@
+package internal
+
+import (
+  httptest "net/http/httptest"
+  http     "net/http"
+  strings  "strings"
+  testing  "testing"
+  time     "time"
+  job      "github.com/gpenaud/needys-api-user/internal/job"
+  transfer "github.com/gpenaud/needys-api-user/internal/transfer"
+)
+
+func TestImportUsers(t *testing.T) {
+  a := newTestApplication(t)
+
+  content := "firstname,lastname\nGuillaume,Penaud\nOcéane,\n"
+
+  report := transfer.Report{}
+  decode(t, serve(t, a, "POST", "/users/import", content, "Content-Type", "text/csv"), http.StatusMultiStatus, &report)
+
+  if report.Rows != 2 || report.Imported != 1 || report.Failed != 1 {
+    t.Errorf("the import reports %+v", report)
+  }
+
+  decode(t, serve(t, a, "POST", "/users/import?dry_run=maybe", content, "Content-Type", "text/csv"), http.StatusBadRequest, nil)
+  decode(t, serve(t, a, "POST", "/users/import", content, "Content-Type", "text/plain"), http.StatusUnsupportedMediaType, nil)
+}
+
+func TestImportUsersInBackground(t *testing.T) {
+  a := newTestApplication(t)
+
+  w := serve(t, a, "POST", "/users/import?async=true&format=ndjson", `{"firstname": "Guillaume", "lastname": "Penaud"}`+"\n")
+
+  view := JobView{}
+  decode(t, w, http.StatusAccepted, &view)
+
+  location := w.Header().Get("Location")
+  if location != "/jobs/"+view.Id {
+    t.Fatalf("the import job is at %q, want /jobs/%s", location, view.Id)
+  }
+
+  for deadline := time.Now().Add(5 * time.Second); view.Status == job.StatusRunning; {
+    if time.Now().After(deadline) {
+      t.Fatal("the import job never ends")
+    }
+
+    time.Sleep(10 * time.Millisecond)
+    decode(t, serve(t, a, "GET", location, ""), http.StatusOK, &view)
+  }
+
+  if view.Status != job.StatusSucceeded || view.Error != nil {
+    t.Errorf("the import job ends with %+v", view)
+  }
+
+  decode(t, serve(t, a, "GET", "/jobs/0123456789abcdef", ""), http.StatusNotFound, nil)
+}
+
+func TestListingFormat(t *testing.T) {
+  tests := []struct {
+    target string
+    accept string
+    format string // empty if not acceptable
+  }{
+    {"/users", "", "json"},
+    {"/users?format=csv", "application/json", "csv"},
+    {"/users?format=json", "text/csv", "json"},
+    {"/users?format=pdf", "", ""},
+    {"/users", "text/csv;q=0.9, application/json", "csv"},
+    {"/users", "application/x-ndjson", "ndjson"},
+    {"/users", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx"},
+    {"/users", "text/html, */*;q=0.1", "json"},
+    {"/users", "text/html", ""},
+    {"/users", "xlsx", ""},
+  }
+
+  for _, test := range tests {
+    r := httptest.NewRequest("GET", test.target, nil)
+    if test.accept != "" {
+      r.Header.Set("Accept", test.accept)
+    }
+
+    if format, err := listingFormat(r); format != test.format || (err == nil) != (test.format != "") {
+      t.Errorf("listingFormat(%s, %q) = %q, %v, want %q", test.target, test.accept, format, err, test.format)
+    }
+  }
+}
+
+func TestExportUsers(t *testing.T) {
+  a := newTestApplication(t)
+
+  for _, name := range []string{"Anna", "Bruno", "Carla"} {
+    createTestUser(t, a, `{"firstname": "`+name+`", "lastname": "Roux"}`)
+  }
+
+  w := serve(t, a, "GET", "/users?format=csv&sort=-firstname&firstname[in]=Anna,Carla", "")
+  if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" || !strings.Contains(w.Header().Get("Content-Disposition"), `filename="users.csv"`) {
+    t.Fatalf("the CSV export answers %d with %v", w.Code, w.Header())
+  }
+
+  lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+  if len(lines) != 3 || !strings.HasPrefix(lines[0], "publicid,") || !strings.Contains(lines[1], "Carla") || !strings.Contains(lines[2], "Anna") {
+    t.Errorf("the CSV export holds %q", lines)
+  }
+
+  decode(t, serve(t, a, "GET", "/users", "", "Accept", "text/html"), http.StatusNotAcceptable, nil)
+  decode(t, serve(t, a, "GET", "/users?format=pdf", ""), http.StatusBadRequest, nil)
+}
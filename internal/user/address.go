@@ -0,0 +1,131 @@
+package user
+
+import (
+  log     "github.com/sirupsen/logrus"
+  regexp  "regexp"
+  sql     "database/sql"
+  strings "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Free-text addresses
+// -------------------------------------------------------------------------- //
+
+// addressPattern splits "16 sentier de la côte 94370 Sucy-En-Brie" on the
+// last postal code followed by the city
+var addressPattern = regexp.MustCompile(`^(.*)[\s,]+(\d{5})\s+(\D.*)$`)
+
+// ParseAddress reads a one-line address. When no postal code can be found, the
+// whole text is kept as the first line.
+func ParseAddress(text string) PostalAddress {
+  text = strings.Join(strings.Fields(text), " ")
+  if text == "" {
+    return PostalAddress{}
+  }
+
+  parts := addressPattern.FindStringSubmatch(text)
+  if parts == nil {
+    return PostalAddress{Line1: text}
+  }
+
+  return PostalAddress{
+    Line1:       strings.TrimRight(parts[1], " ,"),
+    PostalCode:  parts[2],
+    City:        strings.TrimSpace(parts[3]),
+    CountryCode: DefaultRegion,
+  }
+}
+
+func (a PostalAddress) IsZero() bool {
+  return a == PostalAddress{}
+}
+
+// String renders the address on one line, the way Address used to be typed.
+// The country only appears when it is not the default one.
+func (a PostalAddress) String() string {
+  parts := []string{}
+
+  for _, part := range []string{a.Line1, a.Line2, strings.TrimSpace(a.PostalCode + " " + a.City)} {
+    if part != "" {
+      parts = append(parts, part)
+    }
+  }
+
+  if a.CountryCode != "" && a.CountryCode != DefaultRegion {
+    parts = append(parts, a.CountryCode)
+  }
+
+  return strings.Join(parts, " ")
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Address synchronisation
+// -------------------------------------------------------------------------- //
+
+// syncAddress fills PostalAddress from Address for the clients sending only
+// the latter, then derives Address from PostalAddress, which always wins
+func (n *User) syncAddress() {
+  n.PostalAddress.CountryCode = strings.ToUpper(n.PostalAddress.CountryCode)
+
+  if n.PostalAddress.IsZero() {
+    n.PostalAddress = ParseAddress(n.Address)
+  } else if n.PostalAddress.CountryCode == "" {
+    n.PostalAddress.CountryCode = DefaultRegion
+  }
+
+  n.Address = n.PostalAddress.String()
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Data migration
+// -------------------------------------------------------------------------- //
+
+// parseAddresses fills the PostalAddress columns of migration 0002 from the
+// free-text addresses, which stay as they were typed
+func parseAddresses(tx *sql.Tx, d dialect) error {
+  rows, err := tx.Query(d.rebind("SELECT id, address FROM {table} WHERE address IS NOT NULL AND address <> ''"))
+  if err != nil {
+    return err
+  }
+
+  addresses := map[int]string{}
+
+  for rows.Next() {
+    var id int
+    var address string
+
+    if err = rows.Scan(&id, &address); err != nil {
+      rows.Close()
+      return err
+    }
+
+    addresses[id] = address
+  }
+
+  rows.Close()
+
+  if err = rows.Err(); err != nil {
+    return err
+  }
+
+  update   := d.rebind("UPDATE {table} SET address_line1 = ?, address_line2 = ?, postal_code = ?, city = ?, country_code = ? WHERE id = ?")
+  unparsed := 0
+
+  for id, address := range addresses {
+    parsed := ParseAddress(address)
+    if parsed.PostalCode == "" {
+      unparsed++
+    }
+
+    if _, err = tx.Exec(update, parsed.Line1, parsed.Line2, parsed.PostalCode, parsed.City, parsed.CountryCode, id); err != nil {
+      return err
+    }
+  }
+
+  migrationLog.WithFields(log.Fields{
+    "addresses": len(addresses),
+    "without_postal_code": unparsed,
+  }).Info("free-text addresses are parsed")
+
+  return nil
+}
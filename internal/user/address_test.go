@@ -0,0 +1,95 @@
+package user
+
+import (
+  testing "testing"
+)
+
+func TestParseAddress(t *testing.T) {
+  tests := map[string]PostalAddress{
+    "16 sentier de la côte 94370 Sucy-En-Brie":    {Line1: "16 sentier de la côte", PostalCode: "94370", City: "Sucy-En-Brie", CountryCode: "FR"},
+    " 10 route de Rhye,  74210   Mouthier-En-Bresse": {Line1: "10 route de Rhye", PostalCode: "74210", City: "Mouthier-En-Bresse", CountryCode: "FR"},
+    "Bât. B, 75008 rue 12 75009 Paris":            {Line1: "Bât. B, 75008 rue 12", PostalCode: "75009", City: "Paris", CountryCode: "FR"},
+    "3 rue Neuve Lyon":                            {Line1: "3 rue Neuve Lyon"},
+    "74210":                                       {Line1: "74210"},
+    "   ":                                         {},
+  }
+
+  for text, want := range tests {
+    if address := ParseAddress(text); address != want {
+      t.Errorf("ParseAddress(%q) = %+v, want %+v", text, address, want)
+    }
+  }
+}
+
+func TestPostalAddressString(t *testing.T) {
+  tests := []struct {
+    address PostalAddress
+    want    string
+  }{
+    {PostalAddress{Line1: "10 route de Rhye", PostalCode: "74210", City: "Mouthier-En-Bresse", CountryCode: "FR"}, "10 route de Rhye 74210 Mouthier-En-Bresse"},
+    {PostalAddress{Line1: "Rue du Lac 3", Line2: "Case postale 12", PostalCode: "1003", City: "Lausanne", CountryCode: "CH"}, "Rue du Lac 3 Case postale 12 1003 Lausanne CH"},
+    {PostalAddress{City: "Lyon"}, "Lyon"},
+    {PostalAddress{}, ""},
+  }
+
+  for _, test := range tests {
+    if text := test.address.String(); text != test.want {
+      t.Errorf("%+v.String() = %q, want %q", test.address, text, test.want)
+    }
+  }
+}
+
+func TestSyncAddress(t *testing.T) {
+  tests := []struct {
+    user    User
+    address string
+    country string
+  }{
+    {User{Address: "3 rue Neuve  69001 Lyon"}, "3 rue Neuve 69001 Lyon", "FR"},
+    {User{Address: "3 rue Neuve 69001 Lyon", PostalAddress: PostalAddress{City: "Paris"}}, "Paris", "FR"},
+    {User{PostalAddress: PostalAddress{Line1: "Rue du Lac 3", City: "Lausanne", CountryCode: "ch"}}, "Rue du Lac 3 Lausanne CH", "CH"},
+    {User{}, "", ""},
+  }
+
+  for _, test := range tests {
+    n := test.user
+    n.syncAddress()
+
+    if n.Address != test.address || n.PostalAddress.CountryCode != test.country {
+      t.Errorf("syncAddress(%+v) = %q in %q, want %q in %q", test.user, n.Address, n.PostalAddress.CountryCode, test.address, test.country)
+    }
+  }
+}
+
+// the migration 0002 parses the addresses typed before it
+func TestParseAddressesMigration(t *testing.T) {
+  r := newTestSQLiteRepository(t)
+
+  migrations, err := r.MigrationStatus()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = r.MigrateDown(len(migrations) - 1); err != nil {
+    t.Fatal(err)
+  }
+
+  for _, address := range []string{"10 route de Rhye 74210 Mouthier-En-Bresse", "somewhere"} {
+    if _, err = r.DB.Exec(`INSERT INTO "user" (firstname, lastname, address) VALUES ('Guillaume', 'Penaud', ?)`, address); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  if _, err = r.MigrateUp(); err != nil {
+    t.Fatal(err)
+  }
+
+  parsed := User{Id: 1}
+  if err = r.GetUser(&parsed); err != nil || parsed.PostalAddress.PostalCode != "74210" || parsed.PostalAddress.City != "Mouthier-En-Bresse" {
+    t.Errorf("the migrated user 1 is %+v, %v", parsed.PostalAddress, err)
+  }
+
+  unparsed := User{Id: 2}
+  if err = r.GetUser(&unparsed); err != nil || unparsed.Address != "somewhere" || unparsed.PostalAddress.Line1 != "somewhere" {
+    t.Errorf("the migrated user 2 is %q %+v, %v", unparsed.Address, unparsed.PostalAddress, err)
+  }
+}
@@ -0,0 +1,189 @@
+package user
+
+import (
+  sql    "database/sql"
+  base64 "encoding/base64"
+  json   "encoding/json"
+  fmt    "fmt"
+  log    "github.com/sirupsen/logrus"
+  sort   "sort"
+  time   "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Deltas
+// -------------------------------------------------------------------------- //
+
+const (
+  DeltaCreated = "created"
+  DeltaUpdated = "updated"
+  DeltaDeleted = "deleted"
+)
+
+// Delta tells the services mirroring the users what became of one of them
+// since their last synchronisation. User is its current state, nil once it is
+// merged into the user of public id MergedInto or erased.
+type Delta struct {
+  Change     string    `json:"change"`
+  Id         int       `json:"-"`
+  PublicId   string    `json:"public_id,omitempty"`
+  ChangedAt  time.Time `json:"changed_at"`
+  User       *User     `json:"user,omitempty"`
+  MergedInto string    `json:"merged_into,omitempty"`
+  sequence   int64
+}
+
+// Position is the place of the delta in the stream of the changes
+func (d Delta) Position() int64 {
+  return d.sequence
+}
+
+// userDelta reports the last change of n, a creation when n was created
+// past the position the synchronisation started from
+func userDelta(n User, since int64) Delta {
+  delta := Delta{Change: DeltaUpdated, Id: n.Id, PublicId: n.PublicId, ChangedAt: n.UpdatedAt, User: &n, sequence: n.sequence}
+
+  if n.DeletedAt != nil {
+    delta.Change = DeltaDeleted
+  } else if n.createdSequence > since {
+    delta.Change = DeltaCreated
+  }
+
+  return delta
+}
+
+func mergeDelta(m MergedUser) Delta {
+  return Delta{Change: DeltaDeleted, Id: m.Id, PublicId: m.PublicId, ChangedAt: m.MergedAt, MergedInto: m.IntoPublicId, sequence: m.sequence}
+}
+
+func erasureDelta(e Erasure) Delta {
+  return Delta{Change: DeltaDeleted, Id: e.UserId, PublicId: e.PublicId, ChangedAt: e.ErasedAt, sequence: e.sequence}
+}
+
+// sortDeltas orders the deltas read from the users, the merges and the
+// erasures, and keeps the first limit ones
+func sortDeltas(deltas []Delta, limit int) []Delta {
+  sort.Slice(deltas, func(i, j int) bool { return deltas[i].sequence < deltas[j].sequence })
+
+  if len(deltas) > limit {
+    deltas = deltas[:limit]
+  }
+
+  return deltas
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Sync tokens
+// -------------------------------------------------------------------------- //
+
+// The changes of the users are numbered by the storage in the order they are
+// committed, from 1, every write of a user, merge or erasure giving the row
+// it touched the next number: its position in the stream of the changes.
+// Since a change commits after every change numbered before it, a consumer
+// which read the changes up to some position never misses one by reading
+// past it afterwards.
+
+// SyncToken is where a consumer stands: the changes up to Position were
+// returned to it, by a synchronisation which started from the position Since
+// at the time At, possibly over several pages. The users created past Since
+// are new to the consumer.
+type SyncToken struct {
+  Since    int64     `json:"s"`
+  At       time.Time `json:"t"`
+  Position int64     `json:"p"`
+}
+
+// Encode gives the opaque form of the token
+func (t SyncToken) Encode() string {
+  document, _ := json.Marshal(t)
+  return base64.RawURLEncoding.EncodeToString(document)
+}
+
+func DecodeSyncToken(encoded string) (SyncToken, error) {
+  token := SyncToken{}
+
+  document, err := base64.RawURLEncoding.DecodeString(encoded)
+  if err != nil {
+    return token, ValidationError("invalid_sync_token", "the sync token is invalid")
+  }
+
+  if err = json.Unmarshal(document, &token); err != nil {
+    return token, ValidationError("invalid_sync_token", "the sync token is invalid")
+  }
+
+  return token, nil
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Migration
+// -------------------------------------------------------------------------- //
+
+// numberChanges gives the rows written before the change sequence their
+// positions, in the order of the times of their last changes, the users being
+// created at the position of their last change
+func numberChanges(tx *sql.Tx, d dialect) error {
+  type change struct {
+    table string
+    key   string
+    id    int
+    at    time.Time
+  }
+
+  changes := []change{}
+
+  for _, source := range []struct{ table, key, at string }{
+    {"{table}", "id", "updated_at"},
+    {"user_merge", "merged_id", "merged_at"},
+    {"user_erasure", "user_id", "erased_at"},
+  } {
+    rows, err := tx.Query(d.rebind(fmt.Sprintf("SELECT %s, %s FROM %s", source.key, source.at, source.table)))
+    if err != nil {
+      return err
+    }
+
+    for rows.Next() {
+      c  := change{table: source.table, key: source.key}
+      at := sql.NullTime{}
+
+      if err = rows.Scan(&c.id, &at); err != nil {
+        rows.Close()
+        return err
+      }
+
+      c.at    = at.Time
+      changes = append(changes, c)
+    }
+
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+      return err
+    }
+  }
+
+  sort.SliceStable(changes, func(i, j int) bool { return changes[i].at.Before(changes[j].at) })
+
+  for i, c := range changes {
+    query      := fmt.Sprintf("UPDATE %s SET sequence = ? WHERE %s = ?", c.table, c.key)
+    parameters := []interface{}{i + 1, c.id}
+
+    if c.table == "{table}" {
+      query      = fmt.Sprintf("UPDATE %s SET sequence = ?, created_sequence = ? WHERE %s = ?", c.table, c.key)
+      parameters = []interface{}{i + 1, i + 1, c.id}
+    }
+
+    if _, err := tx.Exec(d.rebind(query), parameters...); err != nil {
+      return err
+    }
+  }
+
+  if _, err := tx.Exec(d.rebind("UPDATE user_change_counter SET value = ?"), len(changes)); err != nil {
+    return err
+  }
+
+  migrationLog.WithFields(log.Fields{
+    "changes": len(changes),
+  }).Info("changes are numbered")
+
+  return nil
+}
@@ -0,0 +1,114 @@
+package user
+
+import (
+  reflect "reflect"
+  testing "testing"
+  time    "time"
+)
+
+func TestSyncToken(t *testing.T) {
+  token := SyncToken{Since: 3, At: time.Date(2024, 4, 2, 10, 0, 0, 0, time.UTC), Position: 7}
+
+  if decoded, err := DecodeSyncToken(token.Encode()); err != nil || decoded != token {
+    t.Errorf("DecodeSyncToken(Encode(%+v)) = %+v, %v", token, decoded, err)
+  }
+
+  for _, encoded := range []string{"%%", "bm90IEpTT04", "W10"} {
+    if _, err := DecodeSyncToken(encoded); KindOf(err) != KindValidation {
+      t.Errorf("DecodeSyncToken(%q) = %v, want a validation error", encoded, err)
+    }
+  }
+}
+
+// deltas lists the changes and public ids of the deltas
+func deltas(t *testing.T, users UserRepository, token SyncToken) ([]string, []Delta) {
+  t.Helper()
+
+  found, err := users.Deltas(token, MaxPageSize)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  changes := []string{}
+  for i, delta := range found {
+    changes = append(changes, delta.Change + " " + delta.PublicId)
+
+    if i > 0 && delta.Position() <= found[i-1].Position() {
+      t.Errorf("%T: the delta %d is at %d, after %d", users, i, delta.Position(), found[i-1].Position())
+    }
+  }
+
+  return changes, found
+}
+
+// the deltas tell what became of every user past a position, in the order of
+// the changes, once each
+func TestDeltas(t *testing.T) {
+  for _, users := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    people := []User{{Firstname: "Anna", Lastname: "Roux"}, {Firstname: "Bruno", Lastname: "Roux"}, {Firstname: "Carla", Lastname: "Roux"}}
+    for i := range people {
+      if err := users.CreateUser(&people[i]); err != nil {
+        t.Fatal(err)
+      }
+    }
+    anna, bruno, carla := &people[0], &people[1], &people[2]
+
+    changes, found := deltas(t, users, SyncToken{})
+    if want := []string{"created " + anna.PublicId, "created " + bruno.PublicId, "created " + carla.PublicId}; !reflect.DeepEqual(changes, want) {
+      t.Fatalf("%T: the first synchronisation finds %v, want %v", users, changes, want)
+    }
+
+    if limited, err := users.Deltas(SyncToken{}, 2); err != nil || len(limited) != 2 {
+      t.Errorf("%T: Deltas limited to 2 = %d deltas, %v", users, len(limited), err)
+    }
+
+    last  := found[len(found)-1].Position()
+    token := SyncToken{Since: last, Position: last}
+
+    anna.Firstname = "Annie"
+    if err := users.UpdateUser(anna); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.DeleteUser(&User{Id: bruno.Id}); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.MergeUser(carla, anna); err != nil {
+      t.Fatal(err)
+    }
+
+    david := User{Firstname: "David", Lastname: "Roux"}
+    if err := users.CreateUser(&david); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.EraseUser(&User{Id: david.Id}, &Erasure{Requester: "dpo@example.com"}); err != nil {
+      t.Fatal(err)
+    }
+
+    changes, found = deltas(t, users, token)
+    if want := []string{"updated " + anna.PublicId, "deleted " + bruno.PublicId, "deleted " + carla.PublicId, "deleted " + david.PublicId}; !reflect.DeepEqual(changes, want) {
+      t.Fatalf("%T: the next synchronisation finds %v, want %v", users, changes, want)
+    }
+
+    if found[0].User == nil || found[0].User.Firstname != "Annie" || found[1].User == nil || found[1].User.DeletedAt == nil {
+      t.Errorf("%T: the update and the deletion report %+v and %+v", users, found[0].User, found[1].User)
+    }
+    if found[2].User != nil || found[2].MergedInto != anna.PublicId || found[3].User != nil || found[3].MergedInto != "" {
+      t.Errorf("%T: the merge and the erasure report %+v and %+v", users, found[2], found[3])
+    }
+
+    // a user created past the start of the synchronisation is new, whatever
+    // page it is found on
+    david = User{Firstname: "David", Lastname: "Roux"}
+    if err := users.CreateUser(&david); err != nil {
+      t.Fatal(err)
+    }
+    david.Lastname = "Rouxel"
+    if err := users.UpdateUser(&david); err != nil {
+      t.Fatal(err)
+    }
+
+    if changes, _ = deltas(t, users, SyncToken{Since: token.Since, Position: found[len(found)-1].Position()}); !reflect.DeepEqual(changes, []string{"created " + david.PublicId}) {
+      t.Errorf("%T: the last page finds %v", users, changes)
+    }
+  }
+}
@@ -1,108 +1,145 @@
 package user
 
 import (
-  _   "github.com/go-sql-driver/mysql"
-  log "github.com/sirupsen/logrus"
-  sql "database/sql"
+  time "time"
 )
 
-var userLog *log.Entry
+// -------------------------------------------------------------------------- //
+// 1. User model
+// -------------------------------------------------------------------------- //
 
-func init() {
-  userLog = log.WithFields(log.Fields{
-    "_file": "internal/user/crud.go",
-    "_type": "data",
-  })
-}
+// DefaultRegion is the ISO 3166 country assumed for the phone numbers and the
+// addresses which do not name one
+var DefaultRegion = "FR"
 
+// User is a person known to needys. Address is the one-line form of
+// PostalAddress, kept for the clients which predate it (see address.go).
 type User struct {
-  Id        int
-  Firstname string
-  Lastname  string
-  Address   string
-  Phone     string
-}
-
-func (n *User) CreateUser(db *sql.DB) (err error) {
-  userLog.WithFields(log.Fields{
-    "type": "database query",
-    "parameter_firstname": n.Firstname,
-    "parameter_lastname": n.Lastname,
-    "parameter_address": n.Address,
-    "parameter_phone": n.Phone,
-  }).Debug("INSERT INTO user (name, priority) VALUES ({name}, {priority})")
-
-  r, err := db.Query("INSERT INTO user (firstname, lastname, address, phone) VALUES (?, ?, ?, ?)", n.Firstname, n.Lastname, n.Address, n.Phone)
-  r.Close()
-
-  return err
-}
-
-func (n *User) GetUser(db *sql.DB) (error) {
-  userLog.WithFields(log.Fields{
-    "type": "database query",
-    "parameter_id": n.Id,
-  }).Debug("SELECT * FROM user WHERE id={id}")
-
-  err := db.QueryRow("SELECT * FROM user WHERE id=?", n.Id).Scan(&n.Id, &n.Firstname, &n.Lastname, &n.Address, &n.Phone)
-  return err
-}
-
-func (n *User) UpdateUser(db *sql.DB) (err error) {
-  userLog.WithFields(log.Fields{
-    "type": "database query",
-    "parameter_firstname": n.Firstname,
-    "parameter_lastname": n.Lastname,
-    "parameter_address": n.Address,
-    "parameter_phone": n.Phone,
-  }).Debug("UPDATE user SET address = '{address}', phone = '{phone}' WHERE firstname = '{firstname}' AND lastname = '{lastname}'")
-
-  r, err := db.Query("UPDATE user SET address = ?, phone = ? WHERE firstname = ? AND lastname = ?", n.Address, n.Phone, n.Firstname, n.Lastname)
-  r.Close()
-
-  return err
+  Id            int    `json:"-"` // internal, never given to the clients, see PublicId
+  PublicId      string // ULID given to the clients, set on creation, ignored on writes
+  Firstname     string
+  Lastname      string
+  Address       string
+  PostalAddress PostalAddress
+  Phone         string // E.164, e.g. +33666222475
+  PhoneNational string // national format of Phone, e.g. 06 66 22 24 75, ignored on writes
+  Email         string // unique regardless of case
+  EmailVerified bool   // set by the verification flow only, reset when Email changes, ignored on writes
+  DeletedAt     *time.Time `json:",omitempty"` // set by DeleteUser, ignored on writes
+  Version       int    // incremented by the storage on every change, see UpdateUser
+  CreatedAt     time.Time // set by the storage, ignored on writes
+  UpdatedAt     time.Time // set by the storage on every change, ignored on writes
+
+  // positions of the last change and of the creation in the stream of the
+  // changes, see SyncToken
+  sequence        int64
+  createdSequence int64
 }
 
-func (n *User) DeleteUser(db *sql.DB) error {
-  userLog.WithFields(log.Fields{
-    "type": "database query",
-    "parameter_firstname": n.Firstname,
-    "parameter_lastname": n.Lastname,
-  }).Debug("DELETE FROM user WHERE name='{name}'")
-
-  r, err := db.Query("DELETE FROM user WHERE firstname = ? AND lastname = ?", n.Firstname, n.Lastname)
-  r.Close()
-
-  return err
+// PostalAddress is the structured address used for postal mailings
+type PostalAddress struct {
+  Line1       string
+  Line2       string
+  PostalCode  string
+  City        string
+  CountryCode string // ISO 3166-1 alpha-2
 }
 
-func (n *User) GetUsers(db *sql.DB) ([]User, error) {
-  user  := User{}
-  users := []User{}
-
-  selDB, err := db.Query("SELECT * FROM user ORDER BY id ASC")
-
-  if err != nil {
-    return users, err
-  }
+// normalize derives the stored form of a user from what a client sent. The
+// backends call it on every write.
+func (n *User) normalize() error {
+  n.syncAddress()
 
-  for selDB.Next() {
-    var id int
-    var firstname, lastname, address, phone string
-
-    err = selDB.Scan(&id, &firstname, &lastname, &address, &phone)
-    if err != nil {
-      return users, err
+  violations := []Violation{}
+  for _, violation := range []*Violation{n.normalizePhone(), n.normalizeEmail()} {
+    if violation != nil {
+      violations = append(violations, *violation)
     }
+  }
 
-    user.Id        = id
-    user.Firstname = firstname
-    user.Lastname  = lastname
-    user.Address   = address
-    user.Phone     = phone
-
-    users = append(users, user)
+  if len(violations) > 0 {
+    return InvalidUserError(violations...)
   }
 
-  return users, err
+  return nil
+}
+
+// -------------------------------------------------------------------------- //
+// 2. User storage
+// -------------------------------------------------------------------------- //
+
+// UserRepository is the storage contract the handlers rely on. Each backend
+// (see sql.go, memory.go) provides its own implementation, and every error it
+// returns is a *Error (see errors.go).
+type UserRepository interface {
+  CreateUser(u *User) error
+  // GetUser, UpdateUser and DeleteUser target the user by its Id and return
+  // ErrUserNotFound when it does not exist or is deleted. DeleteUser only
+  // marks the user deleted, PurgeUsers removes it later. When u.Version is
+  // set, UpdateUser and DeleteUser only apply to that version of the user and
+  // return ErrVersionMismatch otherwise. Every write sets u.Version to the new
+  // version.
+  GetUser(u *User) error
+  UpdateUser(u *User) error
+  DeleteUser(u *User) error
+  // GetDeletedUser and RestoreUser target a deleted user by its Id and return
+  // ErrUserNotFound when it does not exist, ErrUserNotDeleted when it is not
+  // deleted
+  GetDeletedUser(u *User) error
+  RestoreUser(u *User) error
+  // PurgeUsers removes for good the users deleted before the given time, with
+  // their history and remembered requests, and returns how many
+  PurgeUsers(before time.Time) (int, error)
+  // ListUsers returns one page of users ordered by id (see pagination.go)
+  ListUsers(q PageQuery) (Page, error)
+  // ScanUsers calls fn on every user matching the filters of q, in the sort
+  // order of q, ignoring its limit and cursor. It stops at the first error.
+  ScanUsers(q PageQuery, fn func(n *User) error) error
+  // VerifyEmail marks the email of the user as verified. It returns
+  // ErrEmailChanged when the stored email is no longer n.Email.
+  VerifyEmail(u *User) error
+  // MergeUser deletes from, recording that it now leads to into along with
+  // the users merged into from before. It returns ErrUserNotFound when from
+  // does not exist.
+  MergeUser(from *User, into *User) error
+  // MergedInto returns the id of the user which absorbed id, or
+  // ErrUserNotFound when id was never merged
+  MergedInto(id int) (int, error)
+  // MergedUsers lists the users merged into id, directly or not
+  MergedUsers(id int) ([]MergedUser, error)
+  // EraseUser deletes the user along with its history and the history of the
+  // users merged into it, as well as their remembered requests, and records
+  // the receipt, setting its ErasedAt. It returns ErrUserNotFound when the
+  // user does not exist.
+  EraseUser(u *User, receipt *Erasure) error
+  // ErasedUser returns the receipt of the erasure of id, or ErrUserNotFound
+  // when id was never erased
+  ErasedUser(id int) (Erasure, error)
+  // RecordChange appends a change to the history of its user, setting its Id
+  // and ChangedAt
+  RecordChange(c *Change) error
+  // History returns the changes of the user id, oldest first
+  History(id int) ([]Change, error)
+  // UserIdOf returns the id of the user with the given public id, even when it
+  // is deleted, merged or erased, or ErrUserNotFound
+  UserIdOf(publicId string) (int, error)
+  // Deltas returns the users created, changed, deleted, merged or erased
+  // past the position of the token, in the order of their positions, at most
+  // limit of them
+  Deltas(token SyncToken, limit int) ([]Delta, error)
+  // RememberRequest records a request under its key, replacing an expired
+  // one. It returns ErrIdempotencyKeyTaken when the key is in use.
+  RememberRequest(req *IdempotentRequest) error
+  // RememberedRequest returns the request remembered under key, or
+  // ErrIdempotencyKeyNotFound when there is none or it expired
+  RememberedRequest(key string) (IdempotentRequest, error)
+  // RememberedRequestsOf returns the requests, expired or not, remembered
+  // with the user id or the users merged into it
+  RememberedRequestsOf(id int) ([]IdempotentRequest, error)
+  // ForgetRequests removes the requests expired before the given time and
+  // returns how many
+  ForgetRequests(before time.Time) (int, error)
+  // Transaction runs fn against a repository whose writes are committed
+  // together when fn returns nil, and discarded otherwise
+  Transaction(fn func(tx UserRepository) error) error
 }
@@ -0,0 +1,99 @@
+package user
+
+import (
+  testing "testing"
+  time    "time"
+)
+
+// a deleted user is held until its purge and can be restored until then
+func TestSoftDelete(t *testing.T) {
+  for _, users := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    n := User{Firstname: "Guillaume", Lastname: "Penaud"}
+    if err := users.CreateUser(&n); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.CreateUser(&User{Firstname: "Océane", Lastname: "Martin"}); err != nil {
+      t.Fatal(err)
+    }
+
+    if err := users.RestoreUser(&User{Id: n.Id}); err != ErrUserNotDeleted {
+      t.Errorf("%T: RestoreUser of a user not deleted = %v", users, err)
+    }
+
+    deleted := User{Id: n.Id}
+    if err := users.DeleteUser(&deleted); err != nil || deleted.DeletedAt == nil || deleted.Version != 2 {
+      t.Fatalf("%T: DeleteUser = %v, %+v", users, err, deleted)
+    }
+
+    if err := users.GetUser(&User{Id: n.Id}); err != ErrUserNotFound {
+      t.Errorf("%T: GetUser of a deleted user = %v", users, err)
+    }
+    if err := users.DeleteUser(&User{Id: n.Id}); err != ErrUserNotFound {
+      t.Errorf("%T: DeleteUser of a deleted user = %v", users, err)
+    }
+    if err := users.GetDeletedUser(&User{Id: n.Id}); err != nil {
+      t.Errorf("%T: GetDeletedUser = %v", users, err)
+    }
+
+    for includeDeleted, want := range map[bool]int{false: 1, true: 2} {
+      if page, err := users.ListUsers(PageQuery{Limit: 10, IncludeDeleted: includeDeleted}); err != nil || len(page.Users) != want {
+        t.Errorf("%T: ListUsers including the deleted users %t lists %d users, %v", users, includeDeleted, len(page.Users), err)
+      }
+    }
+
+    restored := User{Id: n.Id}
+    if err := users.RestoreUser(&restored); err != nil || restored.DeletedAt != nil || restored.Lastname != "Penaud" {
+      t.Errorf("%T: RestoreUser = %v, %+v", users, err, restored)
+    }
+
+    if err := users.DeleteUser(&User{Id: n.Id}); err != nil {
+      t.Fatal(err)
+    }
+
+    if purged, err := users.PurgeUsers(time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+      t.Errorf("%T: PurgeUsers of an hour ago = %d, %v", users, purged, err)
+    }
+    if purged, err := users.PurgeUsers(time.Now().Add(time.Second)); err != nil || purged != 1 {
+      t.Errorf("%T: PurgeUsers = %d, %v", users, purged, err)
+    }
+
+    if err := users.GetDeletedUser(&User{Id: n.Id}); err != ErrUserNotFound {
+      t.Errorf("%T: GetDeletedUser of a purged user = %v", users, err)
+    }
+    if err := users.RestoreUser(&User{Id: n.Id}); err != ErrUserNotFound {
+      t.Errorf("%T: RestoreUser of a purged user = %v", users, err)
+    }
+  }
+}
+
+// the writes only apply to the expected version of the user, when one is
+func TestVersions(t *testing.T) {
+  for _, users := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    n := User{Firstname: "Guillaume", Lastname: "Penaud"}
+    if err := users.CreateUser(&n); err != nil {
+      t.Fatal(err)
+    }
+
+    stale := n
+    n.Firstname = "Guy"
+    if err := users.UpdateUser(&n); err != nil || n.Version != 2 {
+      t.Fatalf("%T: UpdateUser = %v, version %d", users, err, n.Version)
+    }
+
+    stale.Firstname = "Gui"
+    if err := users.UpdateUser(&stale); err != ErrVersionMismatch {
+      t.Errorf("%T: UpdateUser of version 1 = %v", users, err)
+    }
+    if err := users.DeleteUser(&User{Id: n.Id, Version: 1}); err != ErrVersionMismatch {
+      t.Errorf("%T: DeleteUser of version 1 = %v", users, err)
+    }
+
+    // no version applies to any
+    if err := users.UpdateUser(&User{Id: n.Id, Firstname: "Gui", Lastname: "Penaud"}); err != nil {
+      t.Errorf("%T: UpdateUser of any version = %v", users, err)
+    }
+    if err := users.DeleteUser(&User{Id: n.Id, Version: 3}); err != nil {
+      t.Errorf("%T: DeleteUser of version 3 = %v", users, err)
+    }
+  }
+}
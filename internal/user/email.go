@@ -0,0 +1,123 @@
+package user
+
+import (
+  base64  "encoding/base64"
+  hmac    "crypto/hmac"
+  mail    "net/mail"
+  sha256  "crypto/sha256"
+  strconv "strconv"
+  strings "strings"
+  time    "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Email addresses
+// -------------------------------------------------------------------------- //
+
+// ErrEmailChanged is returned by VerifyEmail when the email of the user is no
+// longer the one the verification was requested for
+var ErrEmailChanged = &Error{Kind: KindConflict, Code: "email_changed", Message: "the email changed since its verification was requested"}
+
+// EmailTakenError reports a write colliding with the email of another user,
+// emails being unique regardless of case
+func EmailTakenError(err error) *Error {
+  return &Error{Kind: KindConflict, Code: "email_taken", Message: "the email is already used by another user", Err: err}
+}
+
+// ParseEmail accepts a bare address, without display name, and returns it
+// with its domain in lower case
+func ParseEmail(text string) (string, bool) {
+  address, err := mail.ParseAddress(text)
+  if err != nil || address.Name != "" || address.Address != text {
+    return "", false
+  }
+
+  at := strings.LastIndex(text, "@")
+  return text[:at] + strings.ToLower(text[at:]), true
+}
+
+// canonicalEmail turns a filter value into the stored form of an email
+func canonicalEmail(value string) string {
+  if email, ok := ParseEmail(value); ok {
+    return email
+  }
+
+  return value
+}
+
+// normalizeEmail rejects the emails which are not bare addresses
+func (n *User) normalizeEmail() *Violation {
+  n.Email = strings.TrimSpace(n.Email)
+
+  if n.Email == "" {
+    return nil
+  }
+
+  email, ok := ParseEmail(n.Email)
+  if !ok {
+    return &Violation{Field: "email", Code: "invalid_email", Message: "email is not a valid address, such as jane@example.org"}
+  }
+
+  n.Email = email
+  return nil
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Verification tokens
+// -------------------------------------------------------------------------- //
+
+// EmailTokens issues and checks the email verification tokens. A token signs
+// the public id of the user, its email and an expiry, so that nothing has to
+// be stored and a token stops working as soon as the email changes.
+type EmailTokens struct {
+  Secret []byte
+  TTL    time.Duration
+}
+
+var ErrInvalidToken = &Error{Kind: KindValidation, Code: "invalid_token", Message: "the verification token is invalid"}
+var ErrExpiredToken = &Error{Kind: KindValidation, Code: "expired_token", Message: "the verification token has expired, request a new one"}
+
+func (t EmailTokens) sign(payload string) string {
+  mac := hmac.New(sha256.New, t.Secret)
+  mac.Write([]byte(payload))
+
+  return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a token for the current email of the user, and its expiry
+func (t EmailTokens) Issue(n *User, now time.Time) (string, time.Time) {
+  expiresAt := now.Add(t.TTL).Truncate(time.Second)
+  payload   := strings.Join([]string{n.PublicId, strconv.FormatInt(expiresAt.Unix(), 10), strings.ToLower(n.Email)}, ":")
+
+  return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + t.sign(payload), expiresAt
+}
+
+// Check tells whether the token was issued for the current email of the user
+// and has not expired yet
+func (t EmailTokens) Check(n *User, token string, now time.Time) error {
+  encoded, signature, found := strings.Cut(token, ".")
+  if !found {
+    return ErrInvalidToken
+  }
+
+  decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+  if err != nil || !hmac.Equal([]byte(signature), []byte(t.sign(string(decoded)))) {
+    return ErrInvalidToken
+  }
+
+  parts := strings.SplitN(string(decoded), ":", 3)
+  if len(parts) != 3 || parts[0] != n.PublicId || parts[2] != strings.ToLower(n.Email) {
+    return ErrInvalidToken
+  }
+
+  expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+  if err != nil {
+    return ErrInvalidToken
+  }
+
+  if now.Unix() > expiresAt {
+    return ErrExpiredToken
+  }
+
+  return nil
+}
@@ -0,0 +1,115 @@
+package user
+
+import (
+  testing "testing"
+  time    "time"
+)
+
+func TestParseEmail(t *testing.T) {
+  tests := map[string]string{
+    "guillaume@example.com":     "guillaume@example.com",
+    "Guillaume@Example.COM":     "Guillaume@example.com",
+    "guillaume+needys@mail.fr":  "guillaume+needys@mail.fr",
+    "Guillaume <g@example.com>": "",
+    " guillaume@example.com":    "",
+    "guillaume":                 "",
+    "guillaume@":                "",
+    "":                          "",
+  }
+
+  for text, want := range tests {
+    email, ok := ParseEmail(text)
+    if email != want || ok != (want != "") {
+      t.Errorf("ParseEmail(%q) = %q, %t, want %q", text, email, ok, want)
+    }
+  }
+}
+
+func TestNormalizeEmail(t *testing.T) {
+  n := User{Email: " Guillaume@EXAMPLE.com "}
+  if violation := n.normalizeEmail(); violation != nil || n.Email != "Guillaume@example.com" {
+    t.Errorf("normalizeEmail = %v, %q", violation, n.Email)
+  }
+
+  n = User{Email: "guillaume at example.com"}
+  if violation := n.normalizeEmail(); violation == nil || violation.Code != "invalid_email" {
+    t.Errorf("normalizeEmail(%q) = %v", n.Email, violation)
+  }
+}
+
+func TestEmailTokens(t *testing.T) {
+  tokens := EmailTokens{Secret: []byte("secret"), TTL: time.Hour}
+  now    := time.Date(2024, 4, 2, 10, 0, 0, 0, time.UTC)
+  n      := User{PublicId: "01HV3K8Z4X6N7Q2R5T9W0YBCDE", Email: "guillaume@example.com"}
+
+  token, expiresAt := tokens.Issue(&n, now)
+  if !expiresAt.Equal(now.Add(time.Hour)) {
+    t.Errorf("the token expires at %s", expiresAt)
+  }
+
+  other   := User{PublicId: "01HV3KA2M8P0S3V6X9Z1C4F7HJ", Email: n.Email}
+  changed := User{PublicId: n.PublicId, Email: "guillaume@example.org"}
+  recased := User{PublicId: n.PublicId, Email: "GUILLAUME@example.com"}
+
+  forgery, _ := EmailTokens{Secret: []byte("another secret"), TTL: time.Hour}.Issue(&n, now)
+
+  tests := []struct {
+    user  *User
+    token string
+    now   time.Time
+    want  error
+  }{
+    {&n, token, now, nil},
+    {&recased, token, now, nil},
+    {&n, token, now.Add(time.Hour), nil},
+    {&n, token, now.Add(time.Hour + time.Second), ErrExpiredToken},
+    {&other, token, now, ErrInvalidToken},
+    {&changed, token, now, ErrInvalidToken},
+    {&n, forgery, now, ErrInvalidToken},
+    {&n, token + "x", now, ErrInvalidToken},
+    {&n, "no dot", now, ErrInvalidToken},
+    {&n, "%%.%%", now, ErrInvalidToken},
+  }
+
+  for i, test := range tests {
+    if err := tokens.Check(test.user, test.token, test.now); err != test.want {
+      t.Errorf("Check #%d = %v, want %v", i, err, test.want)
+    }
+  }
+}
+
+// the storages keep the emails unique regardless of case, and forget their
+// verification when they change
+func TestEmailStorage(t *testing.T) {
+  for _, users := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    n := User{Firstname: "Guillaume", Lastname: "Penaud", Email: "guillaume@example.com"}
+    if err := users.CreateUser(&n); err != nil {
+      t.Fatal(err)
+    }
+
+    taken := User{Firstname: "Océane", Lastname: "Martin", Email: "GUILLAUME@example.com"}
+    if err := users.CreateUser(&taken); KindOf(err) != KindConflict {
+      t.Errorf("%T creates a user with a taken email: %v", users, err)
+    }
+
+    if err := users.VerifyEmail(&User{Id: n.Id, Email: "guillaume@example.org"}); err != ErrEmailChanged {
+      t.Errorf("%T verifies a changed email: %v", users, err)
+    }
+    if err := users.VerifyEmail(&n); err != nil || !n.EmailVerified {
+      t.Fatalf("%T VerifyEmail = %v, verified %t", users, err, n.EmailVerified)
+    }
+    if err := users.VerifyEmail(&User{Id: 42, Email: n.Email}); err != ErrUserNotFound {
+      t.Errorf("%T verifies an unknown user: %v", users, err)
+    }
+
+    n.Firstname = "Guy"
+    if err := users.UpdateUser(&n); err != nil || !n.EmailVerified {
+      t.Errorf("%T forgets the verification of an unchanged email: %v, %t", users, err, n.EmailVerified)
+    }
+
+    n.Email = "guy@example.com"
+    if err := users.UpdateUser(&n); err != nil || n.EmailVerified {
+      t.Errorf("%T keeps the verification of a changed email: %v, %t", users, err, n.EmailVerified)
+    }
+  }
+}
@@ -0,0 +1,87 @@
+package user
+
+import (
+  errors "errors"
+  time   "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Data subject requests
+// -------------------------------------------------------------------------- //
+
+// Erasure is the receipt of an erasure, kept once every personal data of the
+// user is gone to show the request was honoured. It names who asked for it,
+// never the person erased.
+type Erasure struct {
+  UserId    int       `json:"-"`
+  PublicId  string    `json:"public_id,omitempty"`
+  Requester string    `json:"requester"`
+  Reason    string    `json:"reason,omitempty"`
+  ErasedAt  time.Time `json:"erased_at"`
+  sequence  int64
+}
+
+// MergedUser is a user which was merged into another one, see MergeUser
+type MergedUser struct {
+  Id           int       `json:"-"`
+  PublicId     string    `json:"public_id,omitempty"`
+  IntoId       int       `json:"-"`
+  IntoPublicId string    `json:"into_public_id,omitempty"`
+  MergedAt     time.Time `json:"merged_at"`
+  sequence     int64
+}
+
+// Export is everything held about a user, as answered to an access request,
+// that is everything its erasure removes: the users merged into it being the
+// same person, their history and remembered creations are exported too
+type Export struct {
+  ExportedAt    time.Time           `json:"exported_at"`
+  User          User                `json:"user"`
+  History       []Change            `json:"history"`
+  MergedUsers   []MergedUser        `json:"merged_users"`
+  MergedHistory []Change            `json:"merged_history"`
+  Requests      []IdempotentRequest `json:"remembered_creations"`
+}
+
+// ExportUser gathers in a single transaction everything held about the user
+// n.Id, so that the parts of the export agree with each other
+func ExportUser(users UserRepository, n *User) (Export, error) {
+  export := Export{}
+
+  err := RunTransaction(users, func(tx UserRepository) error {
+    export = Export{ExportedAt: time.Now().UTC(), User: User{Id: n.Id}}
+
+    err := tx.GetUser(&export.User)
+    if errors.Is(err, ErrUserNotFound) && tx.GetDeletedUser(&export.User) == nil {
+      // a deleted user is held until the purge, and exported as well
+      err = nil
+    }
+
+    if err != nil {
+      return err
+    }
+
+    if export.History, err = tx.History(n.Id); err != nil {
+      return err
+    }
+
+    if export.MergedUsers, err = tx.MergedUsers(n.Id); err != nil {
+      return err
+    }
+
+    export.MergedHistory = []Change{}
+    for _, merged := range export.MergedUsers {
+      history, err := tx.History(merged.Id)
+      if err != nil {
+        return err
+      }
+
+      export.MergedHistory = append(export.MergedHistory, history...)
+    }
+
+    export.Requests, err = tx.RememberedRequestsOf(n.Id)
+    return err
+  })
+
+  return export, err
+}
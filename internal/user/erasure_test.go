@@ -0,0 +1,75 @@
+package user
+
+import (
+  testing "testing"
+)
+
+// an export gathers the users merged into the exported one, whose erasure
+// removes them as well
+func TestExportAndEraseUser(t *testing.T) {
+  for _, storage := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    users := NewHistoryRepository(storage, SystemActor)
+
+    kept   := User{Firstname: "Guillaume", Lastname: "Penaud"}
+    merged := User{Firstname: "Guy", Lastname: "Penaud"}
+    other  := User{Firstname: "Océane", Lastname: "Martin"}
+
+    for _, n := range []*User{&kept, &merged, &other} {
+      if err := users.CreateUser(n); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := users.MergeUser(&merged, &kept); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.DeleteUser(&User{Id: kept.Id}); err != nil {
+      t.Fatal(err)
+    }
+
+    export, err := ExportUser(users, &User{Id: kept.Id})
+    if err != nil {
+      t.Fatalf("%T: ExportUser = %v", storage, err)
+    }
+
+    if export.User.PublicId != kept.PublicId || export.User.DeletedAt == nil || len(export.History) != 2 {
+      t.Errorf("%T: the export holds %+v with %d changes", storage, export.User, len(export.History))
+    }
+    if len(export.MergedUsers) != 1 || export.MergedUsers[0].PublicId != merged.PublicId || len(export.MergedHistory) != 2 {
+      t.Errorf("%T: the export holds the merged users %+v with %d changes", storage, export.MergedUsers, len(export.MergedHistory))
+    }
+
+    receipt := Erasure{Requester: "dpo@example.com"}
+    if err = users.EraseUser(&User{Id: kept.Id}, &receipt); err != nil {
+      t.Fatal(err)
+    }
+
+    if receipt.PublicId != kept.PublicId || receipt.ErasedAt.IsZero() {
+      t.Errorf("%T: the receipt is %+v", storage, receipt)
+    }
+    if found, err := users.ErasedUser(kept.Id); err != nil || found.Requester != "dpo@example.com" {
+      t.Errorf("%T: ErasedUser = %+v, %v", storage, found, err)
+    }
+
+    for _, id := range []int{kept.Id, merged.Id} {
+      if history, err := users.History(id); err != nil || len(history) != 0 {
+        t.Errorf("%T: the erased user %d keeps %d changes, %v", storage, id, len(history), err)
+      }
+    }
+    if err = users.GetDeletedUser(&User{Id: kept.Id}); err != ErrUserNotFound {
+      t.Errorf("%T: the erased user is still found: %v", storage, err)
+    }
+    if _, err = ExportUser(users, &User{Id: kept.Id}); err != ErrUserNotFound {
+      t.Errorf("%T: the erased user is still exported: %v", storage, err)
+    }
+
+    if history, err := users.History(other.Id); err != nil || len(history) != 1 {
+      t.Errorf("%T: the other user keeps %d changes, %v", storage, len(history), err)
+    }
+    if _, err = users.ErasedUser(other.Id); err != ErrUserNotFound {
+      t.Errorf("%T: ErasedUser of a user never erased = %v", storage, err)
+    }
+    if err = users.EraseUser(&User{Id: 42}, &Erasure{Requester: "dpo@example.com"}); err != ErrUserNotFound {
+      t.Errorf("%T: EraseUser of an unknown user = %v", storage, err)
+    }
+  }
+}
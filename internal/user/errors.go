@@ -0,0 +1,137 @@
+package user
+
+import (
+  driver "database/sql/driver"
+  errors "errors"
+  fmt    "fmt"
+  net    "net"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Error taxonomy
+// -------------------------------------------------------------------------- //
+
+type Kind int
+
+const (
+  KindInternal Kind = iota
+  KindNotFound
+  KindConflict
+  KindValidation
+  KindUnavailable
+  KindGone
+  KindPrecondition
+  KindPreconditionRequired
+)
+
+// Error is the only error type the user package hands to its callers. Code is
+// stable and meant for clients, Message is human readable, Violations details
+// validation errors per field and Err keeps the storage error for logs.
+type Error struct {
+  Kind       Kind
+  Code       string
+  Message    string
+  Violations []Violation
+  Err        error
+}
+
+func (e *Error) Error() string {
+  if e.Err != nil {
+    return fmt.Sprintf("%s: %s", e.Message, e.Err)
+  }
+
+  return e.Message
+}
+
+func (e *Error) Unwrap() error {
+  return e.Err
+}
+
+// Is matches two user errors on their code, so errors.Is(err, ErrUserNotFound)
+// holds whatever message or cause was attached.
+func (e *Error) Is(target error) bool {
+  t, ok := target.(*Error)
+  return ok && t.Code == e.Code
+}
+
+var ErrUserNotFound = &Error{Kind: KindNotFound, Code: "user_not_found", Message: "user not found"}
+var ErrUserNotDeleted = &Error{Kind: KindConflict, Code: "user_not_deleted", Message: "user is not deleted"}
+
+// ErrVersionMismatch reports a write expecting a version of the user which is
+// no longer the current one (see User.Version)
+var ErrVersionMismatch = &Error{Kind: KindPrecondition, Code: "version_mismatch", Message: "user was changed since the expected version"}
+
+// ErrVersionRequired reports a write which names no expected version of the
+// user while the server requires one
+var ErrVersionRequired = &Error{Kind: KindPreconditionRequired, Code: "precondition_required", Message: "the write must name the expected version of the user"}
+
+func NotFoundError(code string, format string, args ...interface{}) *Error {
+  return &Error{Kind: KindNotFound, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func GoneError(code string, format string, args ...interface{}) *Error {
+  return &Error{Kind: KindGone, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func ConflictError(code string, format string, args ...interface{}) *Error {
+  return &Error{Kind: KindConflict, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func ValidationError(code string, format string, args ...interface{}) *Error {
+  return &Error{Kind: KindValidation, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func UnavailableError(err error) *Error {
+  return &Error{Kind: KindUnavailable, Code: "storage_unavailable", Message: "user storage is unavailable", Err: err}
+}
+
+// TransactionConflictError reports a deadlock or a serialization failure: the
+// whole transaction can be retried (see RunTransaction)
+func TransactionConflictError(err error) *Error {
+  return &Error{Kind: KindUnavailable, Code: "transaction_conflict", Message: "the transaction collided with another one", Err: err}
+}
+
+func InternalError(err error) *Error {
+  return &Error{Kind: KindInternal, Code: "storage_error", Message: "user storage failed", Err: err}
+}
+
+// KindOf returns the kind of any error, errors outside the taxonomy being
+// internal ones
+func KindOf(err error) Kind {
+  var e *Error
+  if errors.As(err, &e) {
+    return e.Kind
+  }
+
+  return KindInternal
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Storage error classification
+// -------------------------------------------------------------------------- //
+
+// classify wraps a raw storage error into the taxonomy, using the dialect
+// specific classifier first (see mysql.go, postgres.go, sqlite.go)
+func (d dialect) classify(err error) error {
+  if err == nil {
+    return nil
+  }
+
+  var e *Error
+  if errors.As(err, &e) {
+    return err
+  }
+
+  if d.Classify != nil {
+    if classified := d.Classify(err); classified != nil {
+      return classified
+    }
+  }
+
+  var netErr net.Error
+  if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+    return UnavailableError(err)
+  }
+
+  return InternalError(err)
+}
@@ -0,0 +1,188 @@
+package user
+
+import (
+  errors "errors"
+  time   "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Change history
+// -------------------------------------------------------------------------- //
+
+const (
+  ActionCreated       = "created"
+  ActionUpdated       = "updated"
+  ActionDeleted       = "deleted"
+  ActionRestored      = "restored"
+  ActionMerged        = "merged"
+  ActionEmailVerified = "email_verified"
+)
+
+// Actor is who makes the changes, and in which request when it comes through
+// the API
+type Actor struct {
+  Name      string
+  RequestId string
+}
+
+// SystemActor makes the changes of the command line and background tasks
+var SystemActor = Actor{Name: "system"}
+
+// Change is an entry of the history of a user, with the user before and after
+// the change. Before is nil for a creation, After for a merge.
+type Change struct {
+  Id           int       `json:"id"`
+  UserId       int       `json:"-"`
+  UserPublicId string    `json:"user_public_id,omitempty"` // set when read
+  Action       string    `json:"action"`
+  Actor        string    `json:"actor"`
+  RequestId    string    `json:"request_id,omitempty"`
+  ChangedAt    time.Time `json:"changed_at"`
+  Before       *User     `json:"before"`
+  After        *User     `json:"after"`
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Audited repository
+// -------------------------------------------------------------------------- //
+
+// HistoryRepository wraps a user storage and records every change made
+// through it, in the transaction of the change, on behalf of Actor
+type HistoryRepository struct {
+  UserRepository
+  Actor Actor
+}
+
+func NewHistoryRepository(users UserRepository, actor Actor) *HistoryRepository {
+  return &HistoryRepository{UserRepository: users, Actor: actor}
+}
+
+// Unwrap gives access to the wrapped storage, e.g. to reach its Migrator
+func (r *HistoryRepository) Unwrap() UserRepository {
+  return r.UserRepository
+}
+
+func (r *HistoryRepository) Transaction(fn func(tx UserRepository) error) error {
+  return r.UserRepository.Transaction(func(tx UserRepository) error {
+    return fn(&HistoryRepository{UserRepository: tx, Actor: r.Actor})
+  })
+}
+
+// record runs the change on the storage within a transaction, then records
+// it with the user as before reads it and as after leaves it
+func (r *HistoryRepository) record(id int, action string, before func(tx UserRepository, n *User) error, change func(tx UserRepository) error, after *User) error {
+  return r.UserRepository.Transaction(func(tx UserRepository) error {
+    var previous *User
+
+    if before != nil {
+      previous = &User{Id: id}
+      if err := before(tx, previous); err != nil {
+        return err
+      }
+    }
+
+    if err := change(tx); err != nil {
+      return err
+    }
+
+    entry := &Change{Action: action, Actor: r.Actor.Name, RequestId: r.Actor.RequestId, Before: previous}
+    if after != nil {
+      entry.UserId, entry.After = after.Id, snapshot(after)
+    } else {
+      entry.UserId = id
+    }
+
+    return tx.RecordChange(entry)
+  })
+}
+
+func snapshot(n *User) *User {
+  copied := *n
+  return &copied
+}
+
+func getUser(tx UserRepository, n *User) error {
+  return tx.GetUser(n)
+}
+
+func getDeletedUser(tx UserRepository, n *User) error {
+  return tx.GetDeletedUser(n)
+}
+
+func (r *HistoryRepository) CreateUser(n *User) error {
+  return r.record(0, ActionCreated, nil, func(tx UserRepository) error { return tx.CreateUser(n) }, n)
+}
+
+func (r *HistoryRepository) UpdateUser(n *User) error {
+  return r.record(n.Id, ActionUpdated, getUser, func(tx UserRepository) error { return tx.UpdateUser(n) }, n)
+}
+
+func (r *HistoryRepository) DeleteUser(n *User) error {
+  deleted := &User{Id: n.Id}
+
+  return r.record(n.Id, ActionDeleted, getUser, func(tx UserRepository) error {
+    if err := tx.DeleteUser(n); err != nil {
+      return err
+    }
+
+    return tx.GetDeletedUser(deleted)
+  }, deleted)
+}
+
+func (r *HistoryRepository) RestoreUser(n *User) error {
+  return r.record(n.Id, ActionRestored, getDeletedUser, func(tx UserRepository) error { return tx.RestoreUser(n) }, n)
+}
+
+func (r *HistoryRepository) VerifyEmail(n *User) error {
+  return r.record(n.Id, ActionEmailVerified, getUser, func(tx UserRepository) error { return tx.VerifyEmail(n) }, n)
+}
+
+func (r *HistoryRepository) MergeUser(from *User, into *User) error {
+  return r.record(from.Id, ActionMerged, getUser, func(tx UserRepository) error { return tx.MergeUser(from, into) }, nil)
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Point in time reads
+// -------------------------------------------------------------------------- //
+
+// UserAsOf reads the user n.Id as it was at the given time, deleted or not,
+// from its history. The users changed before the history was kept are read
+// as they were before their first recorded change. It returns
+// ErrUserNotFound when the user did not exist yet, or no longer.
+func UserAsOf(users UserRepository, n *User, at time.Time) error {
+  history, err := users.History(n.Id)
+  if err != nil {
+    return err
+  }
+
+  var state *User
+  known := false
+
+  for i := range history {
+    if history[i].ChangedAt.After(at) {
+      if !known {
+        state, known = history[i].Before, true
+      }
+      break
+    }
+
+    state, known = history[i].After, true
+  }
+
+  if !known {
+    // nothing changed since the history is kept
+    err = users.GetUser(n)
+    if errors.Is(err, ErrUserNotFound) && users.GetDeletedUser(n) == nil {
+      err = nil
+    }
+
+    return err
+  }
+
+  if state == nil {
+    return ErrUserNotFound
+  }
+
+  *n = *state
+  return nil
+}
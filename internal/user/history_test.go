@@ -0,0 +1,145 @@
+package user
+
+import (
+  reflect "reflect"
+  testing "testing"
+  time    "time"
+)
+
+// the history holds every committed change, with who made it and the user
+// before and after it
+func TestHistoryRepository(t *testing.T) {
+  for _, storage := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    users := NewHistoryRepository(storage, Actor{Name: "guillaume", RequestId: "42"})
+
+    n := User{Firstname: "Guillaume", Lastname: "Penaud", Email: "guillaume@example.com"}
+    if err := users.CreateUser(&n); err != nil {
+      t.Fatal(err)
+    }
+
+    n.Firstname = "Guy"
+    if err := users.UpdateUser(&n); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.VerifyEmail(&n); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.DeleteUser(&User{Id: n.Id}); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.RestoreUser(&User{Id: n.Id}); err != nil {
+      t.Fatal(err)
+    }
+
+    // a failed change leaves no trace
+    if err := users.UpdateUser(&User{Id: n.Id, Version: 1, Firstname: "Guillaume", Lastname: "Penaud"}); err != ErrVersionMismatch {
+      t.Errorf("%T: UpdateUser of a former version = %v", storage, err)
+    }
+
+    history, err := users.History(n.Id)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    actions := []string{}
+    for _, change := range history {
+      actions = append(actions, change.Action)
+
+      if change.Actor != "guillaume" || change.RequestId != "42" || change.UserPublicId != n.PublicId {
+        t.Errorf("%T: the change %s is made by %q in %q on %q", storage, change.Action, change.Actor, change.RequestId, change.UserPublicId)
+      }
+    }
+
+    if want := []string{ActionCreated, ActionUpdated, ActionEmailVerified, ActionDeleted, ActionRestored}; !reflect.DeepEqual(actions, want) {
+      t.Fatalf("%T: the history holds %v, want %v", storage, actions, want)
+    }
+
+    if history[0].Before != nil || history[0].After.Firstname != "Guillaume" || history[1].Before.Firstname != "Guillaume" || history[1].After.Firstname != "Guy" {
+      t.Errorf("%T: the creation and the update are recorded as %+v and %+v", storage, history[0], history[1])
+    }
+    if history[3].After == nil || history[3].After.DeletedAt == nil || history[4].Before.DeletedAt == nil || history[4].After.DeletedAt != nil {
+      t.Errorf("%T: the deletion and the restoration are recorded as %+v and %+v", storage, history[3], history[4])
+    }
+  }
+}
+
+// the ids of the changes of a forgotten user are not given to later changes
+func TestChangeIdsAreNeverReused(t *testing.T) {
+  for _, storage := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    users := NewHistoryRepository(storage, Actor{Name: "guillaume"})
+
+    kept, erased := User{Firstname: "Guillaume", Lastname: "Penaud"}, User{Firstname: "Océane", Lastname: "Martin"}
+    for _, n := range []*User{&kept, &erased} {
+      if err := users.CreateUser(n); err != nil {
+        t.Fatal(err)
+      }
+    }
+
+    history, err := users.History(erased.Id)
+    if err != nil || len(history) != 1 {
+      t.Fatalf("%T: the history of the created user is %v, %v", storage, history, err)
+    }
+    last := history[0].Id
+
+    if err := users.EraseUser(&User{Id: erased.Id}, &Erasure{Requester: "dpo@example.com"}); err != nil {
+      t.Fatal(err)
+    }
+
+    kept.Firstname = "Guy"
+    if err := users.UpdateUser(&kept); err != nil {
+      t.Fatal(err)
+    }
+
+    history, err = users.History(kept.Id)
+    if err != nil || len(history) != 2 || history[1].Id <= last {
+      t.Errorf("%T: the change after the erasure is %+v, the erased one was %d", storage, history, last)
+    }
+  }
+}
+
+// changedHistory stands for a storage holding a given history
+type changedHistory struct {
+  UserRepository
+  changes []Change
+}
+
+func (c changedHistory) History(id int) ([]Change, error) {
+  return c.changes, nil
+}
+
+func TestUserAsOf(t *testing.T) {
+  created := time.Date(2024, 4, 2, 10, 0, 0, 0, time.UTC)
+  updated := created.Add(time.Hour)
+  deleted := updated.Add(time.Hour)
+
+  guillaume := User{Id: 1, Firstname: "Guillaume"}
+  guy       := User{Id: 1, Firstname: "Guy"}
+
+  current := NewMemoryRepository()
+  if err := current.CreateUser(&User{Firstname: "Gui", Lastname: "Penaud"}); err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    changes []Change
+    at      time.Time
+    want    string // firstname, empty when not found
+  }{
+    {[]Change{{ChangedAt: created, After: &guillaume}, {ChangedAt: updated, Before: &guillaume, After: &guy}}, created.Add(-time.Second), ""},
+    {[]Change{{ChangedAt: created, After: &guillaume}, {ChangedAt: updated, Before: &guillaume, After: &guy}}, created, "Guillaume"},
+    {[]Change{{ChangedAt: created, After: &guillaume}, {ChangedAt: updated, Before: &guillaume, After: &guy}}, deleted, "Guy"},
+    {[]Change{{ChangedAt: created, After: &guillaume}, {ChangedAt: deleted, Before: &guillaume}}, deleted, ""},
+    // changed before the history was kept
+    {[]Change{{ChangedAt: updated, Before: &guillaume, After: &guy}}, created, "Guillaume"},
+    {nil, created, "Gui"},
+  }
+
+  for i, test := range tests {
+    n   := User{Id: 1}
+    err := UserAsOf(changedHistory{UserRepository: current, changes: test.changes}, &n, test.at)
+
+    if test.want == "" && err != ErrUserNotFound || test.want != "" && (err != nil || n.Firstname != test.want) {
+      t.Errorf("UserAsOf #%d = %q, %v, want %q", i, n.Firstname, err, test.want)
+    }
+  }
+}
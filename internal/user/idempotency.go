@@ -0,0 +1,27 @@
+package user
+
+import (
+  time "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Idempotent requests
+// -------------------------------------------------------------------------- //
+
+// IdempotentRequest is a creation remembered under the Idempotency-Key sent by
+// its client, so that its retries are answered the same created user instead
+// of creating another one. Fingerprint tells a retry from another request
+// reusing the key.
+type IdempotentRequest struct {
+  Key         string    `json:"key"`
+  Fingerprint string    `json:"fingerprint"`
+  User        *User     `json:"user"`
+  ExpiresAt   time.Time `json:"expires_at"`
+}
+
+var ErrIdempotencyKeyNotFound = &Error{Kind: KindNotFound, Code: "idempotency_key_not_found", Message: "no request is remembered under this idempotency key"}
+var ErrIdempotencyKeyTaken = &Error{Kind: KindConflict, Code: "idempotency_key_taken", Message: "a request is already remembered under this idempotency key"}
+
+// MaxIdempotencyKeyLength bounds the keys, which clients usually derive from
+// a UUID
+const MaxIdempotencyKeyLength = 255
@@ -0,0 +1,59 @@
+package user
+
+import (
+  testing "testing"
+  time    "time"
+)
+
+// a key holds one request until it expires, then can be reused
+func TestRememberRequest(t *testing.T) {
+  for _, users := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    n := User{Firstname: "Guillaume", Lastname: "Penaud"}
+    if err := users.CreateUser(&n); err != nil {
+      t.Fatal(err)
+    }
+
+    req := IdempotentRequest{Key: "a", Fingerprint: "f", User: &n, ExpiresAt: time.Now().Add(time.Hour)}
+    if err := users.RememberRequest(&req); err != nil {
+      t.Fatal(err)
+    }
+
+    remembered, err := users.RememberedRequest("a")
+    if err != nil || remembered.Fingerprint != "f" || remembered.User.PublicId != n.PublicId {
+      t.Errorf("%T: RememberedRequest = %+v, %v", users, remembered, err)
+    }
+
+    if err = users.RememberRequest(&IdempotentRequest{Key: "a", Fingerprint: "g", User: &n, ExpiresAt: time.Now().Add(time.Hour)}); err != ErrIdempotencyKeyTaken {
+      t.Errorf("%T: RememberRequest under a taken key = %v", users, err)
+    }
+
+    expired := IdempotentRequest{Key: "b", Fingerprint: "f", User: &n, ExpiresAt: time.Now().Add(-time.Hour)}
+    if err = users.RememberRequest(&expired); err != nil {
+      t.Fatal(err)
+    }
+    if _, err = users.RememberedRequest("b"); err != ErrIdempotencyKeyNotFound {
+      t.Errorf("%T: RememberedRequest of an expired key = %v", users, err)
+    }
+
+    if requests, err := users.RememberedRequestsOf(n.Id); err != nil || len(requests) != 2 {
+      t.Errorf("%T: RememberedRequestsOf = %d requests, %v", users, len(requests), err)
+    }
+
+    if forgotten, err := users.ForgetRequests(time.Now()); err != nil || forgotten != 1 {
+      t.Errorf("%T: ForgetRequests = %d, %v", users, forgotten, err)
+    }
+
+    expired.ExpiresAt = time.Now().Add(-time.Minute)
+    if err = users.RememberRequest(&expired); err != nil {
+      t.Fatal(err)
+    }
+
+    expired.Fingerprint, expired.ExpiresAt = "g", time.Now().Add(time.Hour)
+    if err = users.RememberRequest(&expired); err != nil {
+      t.Errorf("%T: RememberRequest under an expired key = %v", users, err)
+    }
+    if remembered, err = users.RememberedRequest("b"); err != nil || remembered.Fingerprint != "g" {
+      t.Errorf("%T: RememberedRequest of a reused key = %+v, %v", users, remembered, err)
+    }
+  }
+}
@@ -0,0 +1,434 @@
+package user
+
+import (
+  aes     "crypto/aes"
+  base64  "encoding/base64"
+  cipher  "crypto/cipher"
+  errors  "errors"
+  fmt     "fmt"
+  hex     "encoding/hex"
+  hmac    "crypto/hmac"
+  json    "encoding/json"
+  log     "github.com/sirupsen/logrus"
+  os      "os"
+  rand    "crypto/rand"
+  sql     "database/sql"
+  sha256  "crypto/sha256"
+  strings "strings"
+  time    "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Keyring
+// -------------------------------------------------------------------------- //
+
+// KeyringFile is the JSON document holding the keys, each one being 32 bytes
+// encoded in base64. New values are encrypted with Primary, the other keys
+// remaining to read the values they encrypted until "keys rotate" re-encrypts
+// them. IndexKey computes the blind indexes and must never change.
+type KeyringFile struct {
+  Primary  string            `json:"primary"`
+  IndexKey string            `json:"index_key"`
+  Keys     map[string]string `json:"keys"`
+}
+
+// Keyring encrypts the personal data columns of the SQL storages with
+// AES-256-GCM, the column and the row being authenticated along with the
+// value so that a ciphertext moved to another column or row cannot be read
+type Keyring struct {
+  Primary  string
+  aeads    map[string]cipher.AEAD
+  indexKey []byte
+}
+
+func decodeKey(name string, encoded string) ([]byte, error) {
+  key, err := base64.StdEncoding.DecodeString(encoded)
+  if err != nil || len(key) != 32 {
+    return nil, fmt.Errorf("key %s must be 32 bytes encoded in base64", name)
+  }
+
+  return key, nil
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  file := KeyringFile{}
+  if err = json.Unmarshal(content, &file); err != nil {
+    return nil, fmt.Errorf("keyring %s: %w", path, err)
+  }
+
+  if _, found := file.Keys[file.Primary]; !found {
+    return nil, fmt.Errorf("keyring %s: primary key %q is not among its keys", path, file.Primary)
+  }
+
+  keyring := &Keyring{Primary: file.Primary, aeads: map[string]cipher.AEAD{}}
+
+  if keyring.indexKey, err = decodeKey("index_key", file.IndexKey); err != nil {
+    return nil, fmt.Errorf("keyring %s: %w", path, err)
+  }
+
+  for id, encoded := range file.Keys {
+    key, err := decodeKey(id, encoded)
+    if err != nil {
+      return nil, fmt.Errorf("keyring %s: %w", path, err)
+    }
+
+    block, err := aes.NewCipher(key)
+    if err != nil {
+      return nil, err
+    }
+
+    if keyring.aeads[id], err = cipher.NewGCM(block); err != nil {
+      return nil, err
+    }
+  }
+
+  return keyring, nil
+}
+
+// GenerateKey adds a new primary key to the keyring file, creating it with
+// its index key when it does not exist, and returns the id of the new key
+func GenerateKey(path string) (string, error) {
+  file := KeyringFile{Keys: map[string]string{}}
+
+  content, err := os.ReadFile(path)
+  switch {
+  case err == nil:
+    if err = json.Unmarshal(content, &file); err != nil {
+      return "", fmt.Errorf("keyring %s: %w", path, err)
+    }
+  case os.IsNotExist(err):
+    if file.IndexKey, err = randomKey(); err != nil {
+      return "", err
+    }
+  default:
+    return "", err
+  }
+
+  id := "k" + time.Now().UTC().Format("20060102150405")
+  if _, found := file.Keys[id]; found {
+    return "", fmt.Errorf("keyring %s already has a key %s, try again in a second", path, id)
+  }
+
+  if file.Keys[id], err = randomKey(); err != nil {
+    return "", err
+  }
+
+  file.Primary = id
+
+  content, err = json.MarshalIndent(file, "", "  ")
+  if err != nil {
+    return "", err
+  }
+
+  return id, os.WriteFile(path, append(content, '\n'), 0600)
+}
+
+func randomKey() (string, error) {
+  key := make([]byte, 32)
+  if _, err := rand.Read(key); err != nil {
+    return "", fmt.Errorf("no random key can be generated: %w", err)
+  }
+
+  return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Encryption
+// -------------------------------------------------------------------------- //
+
+// sealedPrefix marks the values sealed along with their row. Values without
+// it were sealed along with their column only, by former releases, and are
+// sealed again by "keys rotate".
+const sealedPrefix = "v2:"
+
+// additionalData binds a value to its column and to its row, row being what
+// identifies the row for good, e.g. the public id of a user
+func additionalData(column string, row string) []byte {
+  return []byte(column + "\x00" + row)
+}
+
+// Encrypt seals the value of a column of a row with the primary key. Empty
+// values stay empty, so that "no phone" still reads as such.
+func (k *Keyring) Encrypt(column string, row string, plaintext string) (string, error) {
+  if plaintext == "" {
+    return "", nil
+  }
+
+  aead  := k.aeads[k.Primary]
+  nonce := make([]byte, aead.NonceSize())
+
+  if _, err := rand.Read(nonce); err != nil {
+    return "", err
+  }
+
+  return sealedPrefix + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plaintext), additionalData(column, row))), nil
+}
+
+// Decrypt opens the value of a column of a row sealed with the key keyId
+func (k *Keyring) Decrypt(keyId string, column string, row string, ciphertext string) (string, error) {
+  if ciphertext == "" {
+    return "", nil
+  }
+
+  aead, found := k.aeads[keyId]
+  if !found {
+    return "", fmt.Errorf("key %s is missing from the keyring", keyId)
+  }
+
+  data := []byte(column)
+  if strings.HasPrefix(ciphertext, sealedPrefix) {
+    ciphertext, data = strings.TrimPrefix(ciphertext, sealedPrefix), additionalData(column, row)
+  }
+
+  sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+  if err != nil || len(sealed) < aead.NonceSize() {
+    return "", fmt.Errorf("%s is not a ciphertext", column)
+  }
+
+  plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], data)
+  if err != nil {
+    return "", fmt.Errorf("%s cannot be decrypted with key %s: %w", column, keyId, err)
+  }
+
+  return string(plaintext), nil
+}
+
+// BlindIndex is a keyed hash of a value, which equality lookups can match
+// without the value being readable
+func (k *Keyring) BlindIndex(value string) string {
+  if value == "" {
+    return ""
+  }
+
+  mac := hmac.New(sha256.New, k.indexKey)
+  mac.Write([]byte(value))
+
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Key rotation
+// -------------------------------------------------------------------------- //
+
+// KeyRotator is implemented by the storages encrypting data at rest
+type KeyRotator interface {
+  // RotateKeys re-encrypts with the primary key the users, their history and
+  // the creations remembered under an Idempotency-Key encrypted with another
+  // key, not bound to their row, or not encrypted yet, one batch per
+  // transaction so that the storage stays available. progress receives the
+  // running count of rows.
+  RotateKeys(batchSize int, progress func(rotated int)) (int, error)
+}
+
+var ErrNoKeyring = errors.New("no keyring is configured, see --encryption.keyring")
+
+func (r *SQLRepository) RotateKeys(batchSize int, progress func(rotated int)) (int, error) {
+  if r.Keyring == nil {
+    return 0, ErrNoKeyring
+  }
+
+  total := 0
+
+  for _, rotate := range []func(t *SQLRepository, batchSize int) (int, error){(*SQLRepository).rotateUsers, (*SQLRepository).rotateHistory, (*SQLRepository).rotateRequests} {
+    for {
+      rotated := 0
+
+      err := RunTransaction(r, func(tx UserRepository) error {
+        var err error
+        rotated, err = rotate(tx.(*SQLRepository), batchSize)
+        return err
+      })
+
+      if err != nil {
+        return total, err
+      }
+
+      if rotated == 0 {
+        break
+      }
+
+      total += rotated
+      if progress != nil {
+        progress(total)
+      }
+    }
+  }
+
+  return total, nil
+}
+
+// lockingSelect reads a batch of the rows of a table to re-encrypt, locking
+// them when the dialect allows it: the rows sealed with another key, or whose
+// encrypted columns are not sealed along with their row
+func (r *SQLRepository) lockingSelect(columns string, table string, key string, encrypted []string, batchSize int) string {
+  conditions := []string{"key_id <> ?"}
+  for _, column := range encrypted {
+    conditions = append(conditions, fmt.Sprintf("(%s <> '' AND %s NOT LIKE '%s%%')", column, column, sealedPrefix))
+  }
+
+  query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT %d", columns, table, strings.Join(conditions, " OR "), key, batchSize)
+  if r.dialect.ForUpdate {
+    query += " FOR UPDATE"
+  }
+
+  return r.dialect.rebind(query)
+}
+
+// rotateUsers re-encrypts a batch of users
+func (r *SQLRepository) rotateUsers(batchSize int) (int, error) {
+  query := r.lockingSelect(selectColumns, "{table}", "id", encryptedColumns, batchSize)
+
+  r.logQuery(query, log.Fields{
+    "parameter_key_id": r.Keyring.Primary,
+  })
+
+  rows, err := r.conn().Query(query, r.Keyring.Primary)
+  if err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  users := []User{}
+  for rows.Next() {
+    n := User{}
+    if err = r.scanUser(rows, &n); err != nil {
+      rows.Close()
+      return 0, r.dialect.classify(err)
+    }
+
+    users = append(users, n)
+  }
+
+  rows.Close()
+  if err = rows.Err(); err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  update := r.dialect.rebind(fmt.Sprintf("UPDATE {table} SET %s = ?, key_id = ?, phone_index = ? WHERE id = ?", strings.Join(encryptedColumns, " = ?, ")))
+
+  // the values are written back as they were read, without normalisation,
+  // so that rows breaking newer rules are rotated too
+  for i := range users {
+    values := []interface{}{}
+    for j, field := range encryptedFields(&users[i]) {
+      ciphertext, err := r.Keyring.Encrypt(encryptedColumns[j], users[i].PublicId, *field)
+      if err != nil {
+        return 0, InternalError(err)
+      }
+
+      values = append(values, ciphertext)
+    }
+
+    values = append(values, r.Keyring.Primary, r.Keyring.BlindIndex(users[i].Phone), users[i].Id)
+
+    if _, err = r.conn().Exec(update, values...); err != nil {
+      return 0, r.dialect.classify(err)
+    }
+  }
+
+  return len(users), nil
+}
+
+// rotateHistory re-encrypts a batch of changes
+func (r *SQLRepository) rotateHistory(batchSize int) (int, error) {
+  query := r.lockingSelect(historyColumns, "user_history", "id", []string{"before_state", "after_state"}, batchSize)
+
+  r.logQuery(query, log.Fields{
+    "parameter_key_id": r.Keyring.Primary,
+  })
+
+  rows, err := r.conn().Query(query, r.Keyring.Primary)
+  if err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  history := []Change{}
+  for rows.Next() {
+    c := Change{}
+    if err = r.scanChange(rows, &c); err != nil {
+      rows.Close()
+      return 0, r.dialect.classify(err)
+    }
+
+    history = append(history, c)
+  }
+
+  rows.Close()
+  if err = rows.Err(); err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  update := r.dialect.rebind("UPDATE user_history SET key_id = ?, before_state = ?, after_state = ? WHERE id = ?")
+
+  for i := range history {
+    before, err := r.encodeState("before_state", historyRow(history[i].UserId), history[i].Before)
+    if err != nil {
+      return 0, err
+    }
+
+    after, err := r.encodeState("after_state", historyRow(history[i].UserId), history[i].After)
+    if err != nil {
+      return 0, err
+    }
+
+    if _, err = r.conn().Exec(update, r.Keyring.Primary, before, after, history[i].Id); err != nil {
+      return 0, r.dialect.classify(err)
+    }
+  }
+
+  return len(history), nil
+}
+
+// rotateRequests re-encrypts a batch of remembered creations, expired or not
+func (r *SQLRepository) rotateRequests(batchSize int) (int, error) {
+  query := r.lockingSelect("idempotency_key, key_id, user_state", "user_idempotency", "idempotency_key", []string{"user_state"}, batchSize)
+
+  r.logQuery(query, log.Fields{
+    "parameter_key_id": r.Keyring.Primary,
+  })
+
+  rows, err := r.conn().Query(query, r.Keyring.Primary)
+  if err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  requests := []IdempotentRequest{}
+  for rows.Next() {
+    req, keyId, state := IdempotentRequest{}, "", sql.NullString{}
+    if err = rows.Scan(&req.Key, &keyId, &state); err != nil {
+      rows.Close()
+      return 0, r.dialect.classify(err)
+    }
+
+    if req.User, err = r.decodeState(keyId, "user_state", req.Key, 0, state); err != nil {
+      rows.Close()
+      return 0, err
+    }
+
+    requests = append(requests, req)
+  }
+
+  rows.Close()
+  if err = rows.Err(); err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  update := r.dialect.rebind("UPDATE user_idempotency SET key_id = ?, user_state = ? WHERE idempotency_key = ?")
+
+  for i := range requests {
+    state, err := r.encodeState("user_state", requests[i].Key, requests[i].User)
+    if err != nil {
+      return 0, err
+    }
+
+    if _, err = r.conn().Exec(update, r.Keyring.Primary, state, requests[i].Key); err != nil {
+      return 0, r.dialect.classify(err)
+    }
+  }
+
+  return len(requests), nil
+}
@@ -0,0 +1,175 @@
+package user
+
+import (
+  base64  "encoding/base64"
+  json    "encoding/json"
+  os      "os"
+  path    "path/filepath"
+  strings "strings"
+  testing "testing"
+)
+
+// writeKeyring writes a keyring file whose keys are made of the repeated
+// bytes of their ids, primary being the last of them
+func writeKeyring(t *testing.T, file string, ids ...string) *Keyring {
+  t.Helper()
+
+  keyring := KeyringFile{Primary: ids[len(ids)-1], IndexKey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("i", 32))), Keys: map[string]string{}}
+  for _, id := range ids {
+    keyring.Keys[id] = base64.StdEncoding.EncodeToString([]byte(strings.Repeat(id[:1], 32)))
+  }
+
+  content, _ := json.Marshal(keyring)
+  if err := os.WriteFile(file, content, 0600); err != nil {
+    t.Fatal(err)
+  }
+
+  k, err := LoadKeyring(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  return k
+}
+
+func TestLoadKeyring(t *testing.T) {
+  directory := t.TempDir()
+
+  tests := map[string]string{
+    "unknown primary": `{"primary": "b", "index_key": "aWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWk=", "keys": {"a": "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="}}`,
+    "short key":       `{"primary": "a", "index_key": "aWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWlpaWk=", "keys": {"a": "YWFh"}}`,
+    "no index key":    `{"primary": "a", "keys": {"a": "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE="}}`,
+    "not JSON":        `primary = a`,
+  }
+
+  for name, content := range tests {
+    file := path.Join(directory, "keyring.json")
+    os.WriteFile(file, []byte(content), 0600)
+
+    if _, err := LoadKeyring(file); err == nil {
+      t.Errorf("LoadKeyring accepts a keyring with %s", name)
+    }
+  }
+
+  file := path.Join(directory, "generated.json")
+
+  id, err := GenerateKey(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if k, err := LoadKeyring(file); err != nil || k.Primary != id {
+    t.Errorf("LoadKeyring of a generated keyring = %v, %v", k, err)
+  }
+}
+
+func TestEncrypt(t *testing.T) {
+  k := writeKeyring(t, path.Join(t.TempDir(), "keyring.json"), "a")
+
+  ciphertext, err := k.Encrypt("phone", "01HV3K8Z4X6N7Q2R5T9W0YBCDE", "+33645124365")
+  if err != nil || !strings.HasPrefix(ciphertext, sealedPrefix) || strings.Contains(ciphertext, "645124365") {
+    t.Fatalf("Encrypt = %q, %v", ciphertext, err)
+  }
+
+  if plaintext, err := k.Decrypt("a", "phone", "01HV3K8Z4X6N7Q2R5T9W0YBCDE", ciphertext); err != nil || plaintext != "+33645124365" {
+    t.Errorf("Decrypt = %q, %v", plaintext, err)
+  }
+
+  // a ciphertext only opens in its own column of its own row
+  for _, place := range [][3]string{{"a", "address", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}, {"a", "phone", "01HV3KA2M8P0S3V6X9Z1C4F7HJ"}, {"b", "phone", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}} {
+    if plaintext, err := k.Decrypt(place[0], place[1], place[2], ciphertext); err == nil {
+      t.Errorf("Decrypt with key %s in %s of %s = %q", place[0], place[1], place[2], plaintext)
+    }
+  }
+
+  // the values of former releases are sealed along with their column only
+  nonce  := make([]byte, k.aeads["a"].NonceSize())
+  former := base64.StdEncoding.EncodeToString(k.aeads["a"].Seal(nonce, nonce, []byte("+33645124365"), []byte("phone")))
+
+  if plaintext, err := k.Decrypt("a", "phone", "01HV3K8Z4X6N7Q2R5T9W0YBCDE", former); err != nil || plaintext != "+33645124365" {
+    t.Errorf("Decrypt of a former value = %q, %v", plaintext, err)
+  }
+
+  if ciphertext, _ = k.Encrypt("phone", "", ""); ciphertext != "" {
+    t.Errorf("Encrypt of an empty value = %q", ciphertext)
+  }
+  if _, err = k.Decrypt("a", "phone", "", "not base64!"); err == nil {
+    t.Error("Decrypt accepts a value which is not a ciphertext")
+  }
+}
+
+func TestBlindIndex(t *testing.T) {
+  directory := t.TempDir()
+  k         := writeKeyring(t, path.Join(directory, "keyring.json"), "a")
+  rotated   := writeKeyring(t, path.Join(directory, "rotated.json"), "a", "b")
+
+  if index := k.BlindIndex("+33645124365"); index == "" || index != rotated.BlindIndex("+33645124365") || index == k.BlindIndex("+33645124366") {
+    t.Errorf("BlindIndex = %q", index)
+  }
+  if index := k.BlindIndex(""); index != "" {
+    t.Errorf("BlindIndex of an empty value = %q", index)
+  }
+}
+
+// the personal data is encrypted at rest, the phones staying searchable, and
+// survives a rotation of the keys
+func TestSQLiteEncryption(t *testing.T) {
+  directory := t.TempDir()
+  r         := newTestSQLiteRepository(t)
+
+  if _, err := r.RotateKeys(10, nil); err != ErrNoKeyring {
+    t.Errorf("RotateKeys without keyring = %v", err)
+  }
+
+  clear := User{Firstname: "Océane", Lastname: "Martin", Phone: "06 12 34 56 78"}
+  if err := r.CreateUser(&clear); err != nil {
+    t.Fatal(err)
+  }
+
+  r.Keyring = writeKeyring(t, path.Join(directory, "keyring.json"), "a")
+
+  n := User{Firstname: "Guillaume", Lastname: "Penaud", Phone: "06 45 12 43 65", Address: "10 route de Rhye 74210 Mouthier-En-Bresse"}
+  if err := r.CreateUser(&n); err != nil {
+    t.Fatal(err)
+  }
+
+  var phone, city, keyId string
+  if err := r.DB.QueryRow(`SELECT phone, city, key_id FROM "user" WHERE id = ?`, n.Id).Scan(&phone, &city, &keyId); err != nil {
+    t.Fatal(err)
+  }
+  if strings.Contains(phone, "645124365") || city != "Mouthier-En-Bresse" || keyId != "a" {
+    t.Errorf("the stored user has the phone %q, the city %q and the key %q", phone, city, keyId)
+  }
+
+  for _, value := range []string{"+33645124365", "+33612345678"} {
+    filter, _ := NewFilter("phone", "", value)
+    if page, err := r.ListUsers(PageQuery{Limit: 10, Filters: []Filter{filter}}); err != nil || len(page.Users) != 1 {
+      t.Errorf("the phone filter on %s finds %d users: %v", value, len(page.Users), err)
+    }
+  }
+
+  filter, _ := NewFilter("phone", "prefix", "+336")
+  if _, err := r.ListUsers(PageQuery{Limit: 10, Filters: []Filter{filter}}); KindOf(err) != KindValidation {
+    t.Errorf("the phone prefix filter = %v, want a validation error", err)
+  }
+
+  r.Keyring = writeKeyring(t, path.Join(directory, "rotated.json"), "a", "b")
+
+  if rotated, err := r.RotateKeys(1, nil); err != nil || rotated != 2 {
+    t.Errorf("RotateKeys = %d, %v, want 2", rotated, err)
+  }
+  if rotated, err := r.RotateKeys(1, nil); err != nil || rotated != 0 {
+    t.Errorf("RotateKeys once more = %d, %v, want 0", rotated, err)
+  }
+
+  for _, u := range []User{n, clear} {
+    found := User{Id: u.Id}
+    if err := r.GetUser(&found); err != nil || found.Phone != u.Phone || found.Address != u.Address {
+      t.Errorf("the rotated user %d is %+v, %v", u.Id, found, err)
+    }
+  }
+
+  if err := r.DB.QueryRow(`SELECT key_id FROM "user" WHERE id = ?`, clear.Id).Scan(&keyId); err != nil || keyId != "b" {
+    t.Errorf("the user written before the keyring has the key %q, %v", keyId, err)
+  }
+}
@@ -0,0 +1,603 @@
+package user
+
+import (
+  log     "github.com/sirupsen/logrus"
+  sort    "sort"
+  strings "strings"
+  sync    "sync"
+  time    "time"
+)
+
+var memoryLog *log.Entry
+
+func init() {
+  memoryLog = log.WithFields(log.Fields{
+    "_file": "internal/user/memory.go",
+    "_type": "data",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. In-memory repository
+// -------------------------------------------------------------------------- //
+
+// MemoryRepository keeps users in a map guarded by a mutex. Nothing is
+// persisted: it is meant for local runs and handler tests without a database.
+type MemoryRepository struct {
+  mutex  sync.RWMutex
+  users  map[int]User
+  merges   map[int]MergedUser // by merged id
+  erasures map[int]Erasure
+  history  []Change
+  requests map[string]IdempotentRequest // by idempotency key
+  lastId   int
+  lastChangeId int // never reused, even once the history is forgotten
+  lastSequence int64 // position of the last change, see SyncToken
+}
+
+func NewMemoryRepository() *MemoryRepository {
+  return &MemoryRepository{users: map[int]User{}, merges: map[int]MergedUser{}, erasures: map[int]Erasure{}, requests: map[string]IdempotentRequest{}}
+}
+
+// Transaction runs fn on a copy of the users, which replaces the original
+// only when fn succeeds. Other calls wait until the transaction is over.
+func (m *MemoryRepository) Transaction(fn func(tx UserRepository) error) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  tx := &MemoryRepository{users: make(map[int]User, len(m.users)), merges: make(map[int]MergedUser, len(m.merges)), erasures: make(map[int]Erasure, len(m.erasures)), history: append([]Change{}, m.history...), requests: make(map[string]IdempotentRequest, len(m.requests)), lastId: m.lastId, lastChangeId: m.lastChangeId, lastSequence: m.lastSequence}
+  for id, stored := range m.users {
+    tx.users[id] = stored
+  }
+  for id, merged := range m.merges {
+    tx.merges[id] = merged
+  }
+  for id, receipt := range m.erasures {
+    tx.erasures[id] = receipt
+  }
+  for key, req := range m.requests {
+    tx.requests[key] = req
+  }
+
+  if err := fn(tx); err != nil {
+    return err
+  }
+
+  m.users    = tx.users
+  m.merges   = tx.merges
+  m.erasures = tx.erasures
+  m.history  = tx.history
+  m.requests = tx.requests
+  m.lastId   = tx.lastId
+  m.lastChangeId = tx.lastChangeId
+  m.lastSequence = tx.lastSequence
+
+  return nil
+}
+
+// nextSequence numbers a change, the mutex ordering the changes as they are
+// made
+func (m *MemoryRepository) nextSequence() int64 {
+  m.lastSequence++
+  return m.lastSequence
+}
+
+func (m *MemoryRepository) CreateUser(n *User) error {
+  if err := n.normalize(); err != nil {
+    return err
+  }
+
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  if err := m.checkEmail(n); err != nil {
+    return err
+  }
+
+  m.lastId++
+  n.Id, n.EmailVerified, n.DeletedAt, n.Version = m.lastId, false, nil, 1
+  n.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+  n.UpdatedAt = n.CreatedAt
+  n.PublicId  = NewULID(n.CreatedAt)
+  n.sequence  = m.nextSequence()
+  n.createdSequence = n.sequence
+  m.users[n.Id] = *n
+
+  memoryLog.WithFields(log.Fields{
+    "parameter_id": n.Id,
+  }).Debug("user created")
+
+  return nil
+}
+
+func (m *MemoryRepository) GetUser(n *User) error {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  stored, found := m.users[n.Id]
+  if !found || stored.DeletedAt != nil {
+    return ErrUserNotFound
+  }
+
+  *n = stored
+  return nil
+}
+
+func (m *MemoryRepository) GetDeletedUser(n *User) error {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  stored, found := m.users[n.Id]
+  if !found {
+    return ErrUserNotFound
+  }
+
+  if stored.DeletedAt == nil {
+    return ErrUserNotDeleted
+  }
+
+  *n = stored
+  return nil
+}
+
+func (m *MemoryRepository) UpdateUser(n *User) error {
+  if err := n.normalize(); err != nil {
+    return err
+  }
+
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  stored, found := m.users[n.Id]
+  if !found || stored.DeletedAt != nil {
+    return ErrUserNotFound
+  }
+
+  if n.Version != 0 && n.Version != stored.Version {
+    return ErrVersionMismatch
+  }
+
+  if err := m.checkEmail(n); err != nil {
+    return err
+  }
+
+  n.EmailVerified = stored.EmailVerified && strings.EqualFold(stored.Email, n.Email)
+  n.DeletedAt     = nil
+  n.Version       = stored.Version + 1
+  n.PublicId      = stored.PublicId
+  n.CreatedAt     = stored.CreatedAt
+  n.UpdatedAt     = time.Now().UTC().Truncate(time.Microsecond)
+  n.sequence      = m.nextSequence()
+  n.createdSequence = stored.createdSequence
+  m.users[n.Id]   = *n
+  return nil
+}
+
+// checkEmail enforces the uniqueness of emails, as the unique index of the SQL
+// backends does
+func (m *MemoryRepository) checkEmail(n *User) error {
+  if n.Email == "" {
+    return nil
+  }
+
+  for id, stored := range m.users {
+    if id != n.Id && strings.EqualFold(stored.Email, n.Email) {
+      return EmailTakenError(nil)
+    }
+  }
+
+  return nil
+}
+
+func (m *MemoryRepository) VerifyEmail(n *User) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  stored, found := m.users[n.Id]
+  if !found || stored.DeletedAt != nil {
+    return ErrUserNotFound
+  }
+
+  if stored.Email != n.Email {
+    return ErrEmailChanged
+  }
+
+  stored.EmailVerified = true
+  stored.Version++
+  stored.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+  stored.sequence  = m.nextSequence()
+  m.users[n.Id] = stored
+  n.EmailVerified, n.Version, n.UpdatedAt = true, stored.Version, stored.UpdatedAt
+
+  return nil
+}
+
+func (m *MemoryRepository) DeleteUser(n *User) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  stored, found := m.users[n.Id]
+  if !found || stored.DeletedAt != nil {
+    return ErrUserNotFound
+  }
+
+  if n.Version != 0 && n.Version != stored.Version {
+    return ErrVersionMismatch
+  }
+
+  deletedAt := time.Now().UTC().Truncate(time.Second)
+  stored.DeletedAt, n.DeletedAt = &deletedAt, &deletedAt
+  stored.Version++
+  stored.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+  stored.sequence  = m.nextSequence()
+  n.Version, n.UpdatedAt = stored.Version, stored.UpdatedAt
+  m.users[n.Id] = stored
+
+  return nil
+}
+
+func (m *MemoryRepository) RestoreUser(n *User) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  stored, found := m.users[n.Id]
+  if !found {
+    return ErrUserNotFound
+  }
+
+  if stored.DeletedAt == nil {
+    return ErrUserNotDeleted
+  }
+
+  stored.DeletedAt = nil
+  stored.Version++
+  stored.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+  stored.sequence  = m.nextSequence()
+  m.users[n.Id]    = stored
+  *n = stored
+
+  return nil
+}
+
+func (m *MemoryRepository) PurgeUsers(before time.Time) (int, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  purged := map[int]bool{}
+  for id, stored := range m.users {
+    if stored.DeletedAt != nil && stored.DeletedAt.Before(before) {
+      delete(m.users, id)
+      purged[id] = true
+    }
+  }
+
+  m.forget(purged)
+  return len(purged), nil
+}
+
+func (m *MemoryRepository) MergeUser(from *User, into *User) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  stored, found := m.users[from.Id]
+  if !found || stored.DeletedAt != nil {
+    return ErrUserNotFound
+  }
+
+  delete(m.users, from.Id)
+
+  for id, merged := range m.merges {
+    if merged.IntoId == from.Id {
+      merged.IntoId = into.Id
+      m.merges[id]  = merged
+    }
+  }
+
+  m.merges[from.Id] = MergedUser{Id: from.Id, PublicId: stored.PublicId, IntoId: into.Id, MergedAt: time.Now().UTC().Truncate(time.Second), sequence: m.nextSequence()}
+  return nil
+}
+
+func (m *MemoryRepository) MergedInto(id int) (int, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  merged, found := m.merges[id]
+  if !found {
+    return 0, ErrUserNotFound
+  }
+
+  return merged.IntoId, nil
+}
+
+func (m *MemoryRepository) MergedUsers(id int) ([]MergedUser, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  merged := []MergedUser{}
+  for _, candidate := range m.merges {
+    if candidate.IntoId == id {
+      candidate.IntoPublicId = m.publicIdOf(id)
+      merged = append(merged, candidate)
+    }
+  }
+
+  sort.Slice(merged, func(i, j int) bool { return merged[i].Id < merged[j].Id })
+  return merged, nil
+}
+
+func (m *MemoryRepository) EraseUser(n *User, receipt *Erasure) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  stored, found := m.users[n.Id]
+  if !found {
+    return ErrUserNotFound
+  }
+
+  delete(m.users, n.Id)
+
+  // the users merged into n were the same person
+  erased := map[int]bool{n.Id: true}
+  for id, merged := range m.merges {
+    if merged.IntoId == n.Id {
+      erased[id] = true
+    }
+  }
+
+  m.forget(erased)
+
+  receipt.UserId   = n.Id
+  receipt.PublicId = stored.PublicId
+  receipt.ErasedAt = time.Now().UTC().Truncate(time.Second)
+  receipt.sequence = m.nextSequence()
+
+  m.erasures[n.Id] = *receipt
+  return nil
+}
+
+func (m *MemoryRepository) ErasedUser(id int) (Erasure, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  receipt, found := m.erasures[id]
+  if !found {
+    return receipt, ErrUserNotFound
+  }
+
+  return receipt, nil
+}
+
+func (m *MemoryRepository) UserIdOf(publicId string) (int, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  for id, stored := range m.users {
+    if stored.PublicId == publicId {
+      return id, nil
+    }
+  }
+
+  for id, merged := range m.merges {
+    if merged.PublicId == publicId {
+      return id, nil
+    }
+  }
+
+  for id, receipt := range m.erasures {
+    if receipt.PublicId == publicId {
+      return id, nil
+    }
+  }
+
+  return 0, ErrUserNotFound
+}
+
+// publicIdOf returns the public id of the user id, which its merge or erasure
+// keeps once the user is gone. The caller holds the mutex.
+func (m *MemoryRepository) publicIdOf(id int) string {
+  if stored, found := m.users[id]; found {
+    return stored.PublicId
+  }
+
+  if merged, found := m.merges[id]; found {
+    return merged.PublicId
+  }
+
+  return m.erasures[id].PublicId
+}
+
+func (m *MemoryRepository) ListUsers(q PageQuery) (Page, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  users := []User{}
+  total := 0
+
+  for _, stored := range m.users {
+    if !q.Match(&stored) {
+      continue
+    }
+
+    total++
+
+    if q.afterCursor(&stored) {
+      users = append(users, stored)
+    }
+  }
+
+  // rows are expected in the cursor direction, like an SQL ORDER BY would
+  keys := orderKeys(q.Sort)
+  sort.Slice(users, func(i, j int) bool {
+    return (compareUsers(&users[i], &users[j], keys) < 0) != q.Cursor.Backward
+  })
+
+  if len(users) > q.Limit + 1 {
+    users = users[:q.Limit + 1]
+  }
+
+  page := newPage(q, users)
+
+  if q.WithTotal {
+    page.Total = &total
+  }
+
+  return page, nil
+}
+
+// ScanUsers works on a snapshot of the matching users, so that fn may take
+// its time without blocking the writers
+func (m *MemoryRepository) ScanUsers(q PageQuery, fn func(n *User) error) error {
+  m.mutex.RLock()
+
+  users := []User{}
+  for _, stored := range m.users {
+    if q.Match(&stored) {
+      users = append(users, stored)
+    }
+  }
+
+  m.mutex.RUnlock()
+
+  keys := orderKeys(q.Sort)
+  sort.Slice(users, func(i, j int) bool {
+    return compareUsers(&users[i], &users[j], keys) < 0
+  })
+
+  for i := range users {
+    if err := fn(&users[i]); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (m *MemoryRepository) RecordChange(c *Change) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  m.lastChangeId++
+  c.Id, c.ChangedAt = m.lastChangeId, time.Now().UTC().Truncate(time.Microsecond)
+
+  m.history = append(m.history, *c)
+  return nil
+}
+
+func (m *MemoryRepository) History(id int) ([]Change, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  history := []Change{}
+  for _, c := range m.history {
+    if c.UserId == id {
+      c.UserPublicId = m.publicIdOf(id)
+      history = append(history, c)
+    }
+  }
+
+  return history, nil
+}
+
+func (m *MemoryRepository) Deltas(token SyncToken, limit int) ([]Delta, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  deltas := []Delta{}
+  for _, stored := range m.users {
+    if stored.sequence > token.Position {
+      deltas = append(deltas, userDelta(stored, token.Since))
+    }
+  }
+
+  for _, merged := range m.merges {
+    if merged.sequence > token.Position {
+      merged.IntoPublicId = m.publicIdOf(merged.IntoId)
+      deltas = append(deltas, mergeDelta(merged))
+    }
+  }
+
+  for _, receipt := range m.erasures {
+    if receipt.sequence > token.Position {
+      deltas = append(deltas, erasureDelta(receipt))
+    }
+  }
+
+  return sortDeltas(deltas, limit), nil
+}
+
+func (m *MemoryRepository) RememberRequest(req *IdempotentRequest) error {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  if stored, found := m.requests[req.Key]; found && stored.ExpiresAt.After(time.Now()) {
+    return ErrIdempotencyKeyTaken
+  }
+
+  remembered := *req
+  remembered.User = snapshot(req.User)
+
+  m.requests[req.Key] = remembered
+  return nil
+}
+
+func (m *MemoryRepository) RememberedRequest(key string) (IdempotentRequest, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  req, found := m.requests[key]
+  if !found || !req.ExpiresAt.After(time.Now()) {
+    return IdempotentRequest{}, ErrIdempotencyKeyNotFound
+  }
+
+  req.User = snapshot(req.User)
+  return req, nil
+}
+
+func (m *MemoryRepository) RememberedRequestsOf(id int) ([]IdempotentRequest, error) {
+  m.mutex.RLock()
+  defer m.mutex.RUnlock()
+
+  requests := []IdempotentRequest{}
+  for _, req := range m.requests {
+    if merged, found := m.merges[req.User.Id]; req.User.Id == id || found && merged.IntoId == id {
+      req.User = snapshot(req.User)
+      requests = append(requests, req)
+    }
+  }
+
+  sort.Slice(requests, func(i, j int) bool { return requests[i].Key < requests[j].Key })
+  return requests, nil
+}
+
+func (m *MemoryRepository) ForgetRequests(before time.Time) (int, error) {
+  m.mutex.Lock()
+  defer m.mutex.Unlock()
+
+  forgotten := 0
+  for key, req := range m.requests {
+    if req.ExpiresAt.Before(before) {
+      delete(m.requests, key)
+      forgotten++
+    }
+  }
+
+  return forgotten, nil
+}
+
+// forget drops the history and the remembered requests of the given users
+func (m *MemoryRepository) forget(ids map[int]bool) {
+  kept := []Change{}
+  for _, c := range m.history {
+    if !ids[c.UserId] {
+      kept = append(kept, c)
+    }
+  }
+
+  m.history = kept
+
+  for key, req := range m.requests {
+    if ids[req.User.Id] {
+      delete(m.requests, key)
+    }
+  }
+}
@@ -0,0 +1,69 @@
+package user
+
+import (
+  errors  "errors"
+  testing "testing"
+)
+
+func TestMemoryRepositoryCRUD(t *testing.T) {
+  var users UserRepository = NewMemoryRepository()
+
+  n := User{Firstname: "Guillaume", Lastname: "Penaud"}
+  if err := users.CreateUser(&n); err != nil {
+    t.Fatal(err)
+  }
+  if n.Id != 1 || n.Version != 1 || n.PublicId == "" {
+    t.Fatalf("unexpected created user %+v", n)
+  }
+
+  n.Lastname = "Martin"
+  if err := users.UpdateUser(&n); err != nil {
+    t.Fatal(err)
+  }
+
+  found := User{Id: n.Id}
+  if err := users.GetUser(&found); err != nil {
+    t.Fatal(err)
+  }
+  if found.Lastname != "Martin" || found.Version != 2 {
+    t.Errorf("unexpected stored user %+v", found)
+  }
+
+  if err := users.DeleteUser(&found); err != nil {
+    t.Fatal(err)
+  }
+  if err := users.GetUser(&User{Id: n.Id}); !errors.Is(err, ErrUserNotFound) {
+    t.Errorf("GetUser of a deleted user = %v, want %v", err, ErrUserNotFound)
+  }
+}
+
+func TestMemoryRepositoryTransaction(t *testing.T) {
+  users := NewMemoryRepository()
+  failure := errors.New("failure")
+
+  err := users.Transaction(func(tx UserRepository) error {
+    if err := tx.CreateUser(&User{Firstname: "Guillaume", Lastname: "Penaud"}); err != nil {
+      return err
+    }
+
+    return failure
+  })
+  if err != failure {
+    t.Fatalf("Transaction = %v, want %v", err, failure)
+  }
+
+  if err := users.GetUser(&User{Id: 1}); !errors.Is(err, ErrUserNotFound) {
+    t.Errorf("the rolled back user is stored: %v", err)
+  }
+
+  err = users.Transaction(func(tx UserRepository) error {
+    return tx.CreateUser(&User{Firstname: "Guillaume", Lastname: "Penaud"})
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if err := users.GetUser(&User{Id: 1}); err != nil {
+    t.Errorf("the committed user is not stored: %v", err)
+  }
+}
@@ -0,0 +1,64 @@
+package user
+
+import (
+  strings "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Field by field merge
+// -------------------------------------------------------------------------- //
+
+// mergeField moves one field, or a group of fields, from a user to another
+type mergeField struct {
+  Name  string
+  Empty func(n *User) bool
+  Copy  func(to *User, from *User)
+}
+
+// mergeFields lists what a merge picks from one user or the other. The postal
+// address moves as a whole, a line of one user next to the city of the other
+// making no sense.
+var mergeFields = []mergeField{
+  {"firstname", func(n *User) bool { return n.Firstname == "" }, func(to *User, from *User) { to.Firstname = from.Firstname }},
+  {"lastname", func(n *User) bool { return n.Lastname == "" }, func(to *User, from *User) { to.Lastname = from.Lastname }},
+  {"address", func(n *User) bool { return n.Address == "" && n.PostalAddress.IsZero() }, func(to *User, from *User) { to.Address, to.PostalAddress = from.Address, from.PostalAddress }},
+  {"phone", func(n *User) bool { return n.Phone == "" }, func(to *User, from *User) { to.Phone, to.PhoneNational = from.Phone, from.PhoneNational }},
+  {"email", func(n *User) bool { return n.Email == "" }, func(to *User, from *User) { to.Email, to.EmailVerified = from.Email, from.EmailVerified }},
+}
+
+// MergeFieldNames are the fields a merge can take from the merged user
+func MergeFieldNames() []string {
+  names := make([]string, len(mergeFields))
+  for i, field := range mergeFields {
+    names[i] = field.Name
+  }
+
+  return names
+}
+
+// Merge completes the user with the fields of merged: each field keeps its
+// value, unless it is empty or listed in take, then comes from merged
+func (n *User) Merge(merged *User, take []string) error {
+  taken := map[string]bool{}
+
+  for _, name := range take {
+    found := false
+    for _, field := range mergeFields {
+      found = found || field.Name == strings.ToLower(name)
+    }
+
+    if !found {
+      return ValidationError("invalid_payload", "%s cannot be merged, expected one of %s", name, strings.Join(MergeFieldNames(), ", "))
+    }
+
+    taken[strings.ToLower(name)] = true
+  }
+
+  for _, field := range mergeFields {
+    if (taken[field.Name] || field.Empty(n)) && !field.Empty(merged) {
+      field.Copy(n, merged)
+    }
+  }
+
+  return nil
+}
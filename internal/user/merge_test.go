@@ -0,0 +1,74 @@
+package user
+
+import (
+  testing "testing"
+)
+
+func TestMerge(t *testing.T) {
+  merged := User{Firstname: "Guy", Lastname: "Penaud", Phone: "+33645124365", Email: "guy@example.com", EmailVerified: true, PostalAddress: PostalAddress{City: "Lyon"}}
+
+  tests := []struct {
+    kept  User
+    take  []string
+    check func(n User) bool
+    valid bool
+  }{
+    {User{Firstname: "Guillaume", Lastname: "Penaud"}, nil, func(n User) bool {
+      return n.Firstname == "Guillaume" && n.Phone == merged.Phone && n.Email == merged.Email && n.EmailVerified && n.PostalAddress.City == "Lyon"
+    }, true},
+    {User{Firstname: "Guillaume", Phone: "+33123456789", PostalAddress: PostalAddress{Line1: "10 route de Rhye", City: "Mouthier-En-Bresse"}}, []string{"Firstname", "address"}, func(n User) bool {
+      return n.Firstname == "Guy" && n.Lastname == "Penaud" && n.Phone == "+33123456789" && n.PostalAddress == merged.PostalAddress
+    }, true},
+    {User{Firstname: "Guillaume", Email: "guillaume@example.com"}, []string{"lastname"}, func(n User) bool {
+      return n.Email == "guillaume@example.com" && !n.EmailVerified
+    }, true},
+    {User{Firstname: "Guillaume"}, []string{"id"}, nil, false},
+  }
+
+  for _, test := range tests {
+    n := test.kept
+
+    err := n.Merge(&merged, test.take)
+    if (err == nil) != test.valid {
+      t.Errorf("Merge(%v) = %v, want valid %t", test.take, err, test.valid)
+      continue
+    }
+
+    if test.valid && !test.check(n) {
+      t.Errorf("Merge(%v) of %+v = %+v", test.take, test.kept, n)
+    }
+  }
+}
+
+// a merged user leads to the user which absorbed it, and to the users it
+// absorbed before
+func TestMergeUser(t *testing.T) {
+  for _, users := range []UserRepository{NewMemoryRepository(), newTestSQLiteRepository(t)} {
+    people := []User{{Firstname: "Guillaume", Lastname: "Penaud"}, {Firstname: "Guillaume", Lastname: "Penot"}, {Firstname: "Guy", Lastname: "Penaud"}}
+    for i := range people {
+      if err := users.CreateUser(&people[i]); err != nil {
+        t.Fatal(err)
+      }
+    }
+
+    if err := users.MergeUser(&people[2], &people[1]); err != nil {
+      t.Fatal(err)
+    }
+    if err := users.MergeUser(&people[1], &people[0]); err != nil {
+      t.Fatal(err)
+    }
+
+    for _, n := range people[1:] {
+      if into, err := users.MergedInto(n.Id); err != nil || into != people[0].Id {
+        t.Errorf("%T: MergedInto(%d) = %d, %v, want %d", users, n.Id, into, err, people[0].Id)
+      }
+      if err := users.GetUser(&User{Id: n.Id}); err != ErrUserNotFound {
+        t.Errorf("%T: the merged user %d is still found: %v", users, n.Id, err)
+      }
+    }
+
+    if _, err := users.MergedInto(people[0].Id); err != ErrUserNotFound {
+      t.Errorf("%T: MergedInto of a kept user = %v", users, err)
+    }
+  }
+}
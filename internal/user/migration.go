@@ -0,0 +1,417 @@
+package user
+
+import (
+  sql     "database/sql"
+  embed   "embed"
+  fmt     "fmt"
+  fs      "io/fs"
+  log     "github.com/sirupsen/logrus"
+  path    "path"
+  regexp  "regexp"
+  sort    "sort"
+  strconv "strconv"
+  strings "strings"
+  time    "time"
+)
+
+var migrationLog *log.Entry
+
+func init() {
+  migrationLog = log.WithFields(log.Fields{
+    "_file": "internal/user/migration.go",
+    "_type": "data",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Embedded migrations
+// -------------------------------------------------------------------------- //
+
+// Each SQL dialect has its own directory of numbered migrations, named
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFilename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const migrationTable = `
+  CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+  )`
+
+// dataMigrations complete the script of a migration with Go code, run in the
+// same transaction right after the script
+var dataMigrations = map[int]func(tx *sql.Tx, d dialect) error{
+  2: parseAddresses,
+  12: assignPublicIds,
+  13: storeTimestampsInUTC,
+  14: numberChanges,
+}
+
+// dataRollbacks undo the data migrations whose rollback script is not enough,
+// run in the same transaction right after the script
+var dataRollbacks = map[int]func(tx *sql.Tx, d dialect) error{
+  13: restoreTimestamps,
+}
+
+type Migration struct {
+  Version   int
+  Name      string
+  Applied   bool
+  AppliedAt time.Time
+  up        string
+  down      string
+}
+
+// Migrator is implemented by the storages owning a versioned schema. The
+// in-memory storage has no schema and does not implement it.
+type Migrator interface {
+  MigrateUp() (int, error)
+  MigrateDown(steps int) (int, error)
+  MigrationStatus() ([]Migration, error)
+}
+
+func loadMigrations(directory string) ([]Migration, error) {
+  entries, err := fs.ReadDir(migrationFiles, directory)
+  if err != nil {
+    return nil, err
+  }
+
+  byVersion := map[int]*Migration{}
+
+  for _, entry := range entries {
+    parts := migrationFilename.FindStringSubmatch(entry.Name())
+    if parts == nil {
+      return nil, fmt.Errorf("migration file %s is badly named", entry.Name())
+    }
+
+    content, err := fs.ReadFile(migrationFiles, path.Join(directory, entry.Name()))
+    if err != nil {
+      return nil, err
+    }
+
+    version, _ := strconv.Atoi(parts[1])
+
+    migration, found := byVersion[version]
+    if !found {
+      migration = &Migration{Version: version, Name: parts[2]}
+      byVersion[version] = migration
+    }
+
+    if parts[3] == "up" {
+      migration.up = string(content)
+    } else {
+      migration.down = string(content)
+    }
+  }
+
+  migrations := []Migration{}
+  for _, migration := range byVersion {
+    migrations = append(migrations, *migration)
+  }
+
+  sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+  return migrations, nil
+}
+
+// splitStatements cuts a migration file into statements, since not every
+// driver accepts several statements in a single Exec
+func splitStatements(content string) []string {
+  statements := []string{}
+
+  for _, statement := range strings.Split(content, ";\n") {
+    if statement = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(statement), ";")); !commentsOnly(statement) {
+      statements = append(statements, statement)
+    }
+  }
+
+  return statements
+}
+
+// commentsOnly tells whether a statement holds nothing but comments, which
+// some drivers refuse as an empty query. A migration may have nothing to run
+// on some dialect but its data migration.
+func commentsOnly(statement string) bool {
+  for _, line := range strings.Split(statement, "\n") {
+    if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+      return false
+    }
+  }
+
+  return true
+}
+
+// -------------------------------------------------------------------------- //
+// 2. SQL migrations
+// -------------------------------------------------------------------------- //
+
+func (r *SQLRepository) MigrationStatus() ([]Migration, error) {
+  if _, err := r.DB.Exec(migrationTable); err != nil {
+    return nil, err
+  }
+
+  migrations, err := loadMigrations(path.Join("migrations", r.dialect.Name))
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := r.DB.Query("SELECT version, applied_at FROM schema_migrations")
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+
+  applied := map[int]time.Time{}
+
+  for rows.Next() {
+    var version int
+    var appliedAt time.Time
+
+    if err = rows.Scan(&version, &appliedAt); err != nil {
+      return nil, err
+    }
+
+    applied[version] = appliedAt
+  }
+
+  if err = rows.Err(); err != nil {
+    return nil, err
+  }
+
+  for i := range migrations {
+    if appliedAt, found := applied[migrations[i].Version]; found {
+      migrations[i].Applied   = true
+      migrations[i].AppliedAt = appliedAt
+      delete(applied, migrations[i].Version)
+    }
+  }
+
+  for version := range applied {
+    migrationLog.WithFields(log.Fields{
+      "version": version,
+    }).Warn("database holds a migration unknown to this binary")
+  }
+
+  return migrations, nil
+}
+
+func (r *SQLRepository) MigrateUp() (int, error) {
+  migrations, err := r.MigrationStatus()
+  if err != nil {
+    return 0, err
+  }
+
+  count := 0
+
+  for _, migration := range migrations {
+    if migration.Applied {
+      continue
+    }
+
+    if err = r.applyMigration(migration, migration.up, dataMigrations[migration.Version], r.dialect.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), migration.Version, migration.Name, time.Now().UTC()); err != nil {
+      return count, fmt.Errorf("migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+    }
+
+    count++
+  }
+
+  return count, nil
+}
+
+func (r *SQLRepository) MigrateDown(steps int) (int, error) {
+  migrations, err := r.MigrationStatus()
+  if err != nil {
+    return 0, err
+  }
+
+  count := 0
+
+  for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+    migration := migrations[i]
+
+    if !migration.Applied {
+      continue
+    }
+
+    if err = r.applyMigration(migration, migration.down, dataRollbacks[migration.Version], r.dialect.rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version); err != nil {
+      return count, fmt.Errorf("rollback of migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+    }
+
+    count++
+  }
+
+  return count, nil
+}
+
+// applyMigration runs a migration script and its data migration, if any, then
+// records it with bookkeeping, inside one transaction where the database
+// supports transactional DDL
+func (r *SQLRepository) applyMigration(migration Migration, script string, data func(tx *sql.Tx, d dialect) error, bookkeeping string, args ...interface{}) error {
+  migrationLog.WithFields(log.Fields{
+    "driver": r.dialect.Name,
+    "version": migration.Version,
+    "name": migration.Name,
+  }).Info("running migration script")
+
+  tx, err := r.DB.Begin()
+  if err != nil {
+    return err
+  }
+
+  for _, statement := range splitStatements(script) {
+    if _, err = tx.Exec(r.dialect.rebind(statement)); err != nil {
+      tx.Rollback()
+      return err
+    }
+  }
+
+  if data != nil {
+    if err = data(tx, r.dialect); err != nil {
+      tx.Rollback()
+      return err
+    }
+  }
+
+  if _, err = tx.Exec(bookkeeping, args...); err != nil {
+    tx.Rollback()
+    return err
+  }
+
+  return tx.Commit()
+}
+
+// PendingMigrations counts the migrations not applied yet on the database
+func PendingMigrations(m Migrator) (int, error) {
+  migrations, err := m.MigrationStatus()
+  if err != nil {
+    return 0, err
+  }
+
+  pending := 0
+  for _, migration := range migrations {
+    if !migration.Applied {
+      pending++
+    }
+  }
+
+  return pending, nil
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Timestamps
+// -------------------------------------------------------------------------- //
+
+// timestampColumns lists the columns holding times, by table and key
+var timestampColumns = []struct {
+  table   string
+  key     string
+  columns []string
+}{
+  {"{table}", "id", []string{"created_at", "updated_at", "deleted_at"}},
+  {"user_merge", "merged_id", []string{"merged_at"}},
+  {"user_erasure", "user_id", []string{"erased_at"}},
+  {"user_history", "id", []string{"changed_at"}},
+  {"user_idempotency", "idempotency_key", []string{"expires_at"}},
+  {"schema_migrations", "version", []string{"applied_at"}},
+}
+
+// storeTimestampsInUTC rewrites the times written before the connections were
+// set to UTC. MySQL converted them from the time zone of the server, which the
+// session had by default, and SQLite held the text the Go driver gives times,
+// which SQLite itself does not understand.
+func storeTimestampsInUTC(tx *sql.Tx, d dialect) error {
+  switch d.Name {
+  case "mysql":
+    return rewriteTimestamps(tx, d, "@@GLOBAL.time_zone", "'+00:00'", func(t time.Time) interface{} { return t })
+  case "sqlite":
+    return rewriteTimestamps(tx, d, "", "", func(t time.Time) interface{} { return t })
+  }
+
+  return nil
+}
+
+// restoreTimestamps gives the times back the form storeTimestampsInUTC found
+func restoreTimestamps(tx *sql.Tx, d dialect) error {
+  switch d.Name {
+  case "mysql":
+    if err := rewriteTimestamps(tx, d, "'+00:00'", "@@GLOBAL.time_zone", func(t time.Time) interface{} { return t }); err != nil {
+      return err
+    }
+
+    // the connection goes back to the pool, in the time zone of the others
+    _, err := tx.Exec("SET time_zone = '+00:00'")
+    return err
+  case "sqlite":
+    return rewriteTimestamps(tx, d, "", "", func(t time.Time) interface{} { return t.UTC().String() })
+  }
+
+  return nil
+}
+
+// rewriteTimestamps reads every time in the session time zone readZone and
+// writes it back in writeZone, as given by value. Empty zones leave the
+// session as it is.
+func rewriteTimestamps(tx *sql.Tx, d dialect, readZone string, writeZone string, value func(t time.Time) interface{}) error {
+  count := 0
+
+  for _, source := range timestampColumns {
+    for _, column := range source.columns {
+      if readZone != "" {
+        if _, err := tx.Exec("SET time_zone = " + readZone); err != nil {
+          return err
+        }
+      }
+
+      rows, err := tx.Query(d.rebind(fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NOT NULL", source.key, column, source.table, column)))
+      if err != nil {
+        return err
+      }
+
+      times := map[string]time.Time{}
+
+      for rows.Next() {
+        var key string
+        var at sql.NullTime
+
+        if err = rows.Scan(&key, &at); err != nil {
+          rows.Close()
+          return err
+        }
+
+        times[key] = at.Time
+      }
+
+      rows.Close()
+
+      if err = rows.Err(); err != nil {
+        return err
+      }
+
+      if writeZone != "" {
+        if _, err = tx.Exec("SET time_zone = " + writeZone); err != nil {
+          return err
+        }
+      }
+
+      update := d.rebind(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", source.table, column, source.key))
+
+      for key, at := range times {
+        if _, err = tx.Exec(update, value(at), key); err != nil {
+          return err
+        }
+      }
+
+      count += len(times)
+    }
+  }
+
+  migrationLog.WithFields(log.Fields{
+    "timestamps": count,
+  }).Info("timestamps are rewritten")
+
+  return nil
+}
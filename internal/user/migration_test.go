@@ -0,0 +1,94 @@
+package user
+
+import (
+  reflect "reflect"
+  testing "testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+  var versions []int
+
+  for _, dialect := range []dialect{mysqlDialect, postgresDialect, sqliteDialect} {
+    migrations, err := loadMigrations("migrations/" + dialect.Name)
+    if err != nil {
+      t.Fatalf("%s: %s", dialect.Name, err)
+    }
+
+    numbers := []int{}
+    for i, migration := range migrations {
+      if migration.Version != i+1 {
+        t.Errorf("%s: migration %04d_%s is numbered after %d", dialect.Name, migration.Version, migration.Name, i)
+      }
+      if migration.up == "" || migration.down == "" {
+        t.Errorf("%s: migration %04d_%s lacks its up or down script", dialect.Name, migration.Version, migration.Name)
+      }
+
+      numbers = append(numbers, migration.Version)
+    }
+
+    if versions != nil && !reflect.DeepEqual(numbers, versions) {
+      t.Errorf("%s has the migrations %v, the other dialects %v", dialect.Name, numbers, versions)
+    }
+    versions = numbers
+  }
+}
+
+func TestSplitStatements(t *testing.T) {
+  tests := []struct {
+    content string
+    want    []string
+  }{
+    {"CREATE TABLE a (id INTEGER);\n", []string{"CREATE TABLE a (id INTEGER)"}},
+    {"CREATE TABLE a (id INTEGER);\nCREATE INDEX a_id ON a (id);\n", []string{"CREATE TABLE a (id INTEGER)", "CREATE INDEX a_id ON a (id)"}},
+    {"-- nothing to do on this dialect\n", []string{}},
+    {"-- the ids\nCREATE INDEX a_id ON a (id);\n\n-- done\n", []string{"-- the ids\nCREATE INDEX a_id ON a (id)"}},
+    {"UPDATE a SET b = 'x;y';\n", []string{"UPDATE a SET b = 'x;y'"}},
+  }
+
+  for _, test := range tests {
+    if got := splitStatements(test.content); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("splitStatements(%q) = %q, want %q", test.content, got, test.want)
+    }
+  }
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+  r := newTestSQLiteRepository(t)
+
+  migrations, err := r.MigrationStatus()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if pending, err := PendingMigrations(r); err != nil || pending != 0 {
+    t.Fatalf("PendingMigrations = %d, %v after MigrateUp", pending, err)
+  }
+
+  n := User{Firstname: "Guillaume", Lastname: "Penaud"}
+  if err = r.CreateUser(&n); err != nil {
+    t.Fatal(err)
+  }
+
+  // the last migrations keep the users
+  if count, err := r.MigrateDown(2); err != nil || count != 2 {
+    t.Fatalf("MigrateDown(2) = %d, %v", count, err)
+  }
+  if count, err := r.MigrateUp(); err != nil || count != 2 {
+    t.Fatalf("MigrateUp() = %d, %v", count, err)
+  }
+
+  found := User{Id: n.Id}
+  if err = r.GetUser(&found); err != nil || found.Lastname != "Penaud" || found.PublicId != n.PublicId {
+    t.Errorf("GetUser after the migrations = %+v, %v", found, err)
+  }
+
+  if count, err := r.MigrateDown(len(migrations)); err != nil || count != len(migrations) {
+    t.Fatalf("MigrateDown(%d) = %d, %v", len(migrations), count, err)
+  }
+  if pending, err := PendingMigrations(r); err != nil || pending != len(migrations) {
+    t.Errorf("PendingMigrations = %d, %v after every rollback", pending, err)
+  }
+  if count, err := r.MigrateUp(); err != nil || count != len(migrations) {
+    t.Errorf("MigrateUp() = %d, %v", count, err)
+  }
+}
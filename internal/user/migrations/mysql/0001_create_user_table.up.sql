@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS user (
+  id INTEGER PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  firstname VARCHAR(100),
+  lastname VARCHAR(100),
+  address VARCHAR(100),
+  phone VARCHAR(100)
+) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
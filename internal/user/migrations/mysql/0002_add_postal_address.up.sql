@@ -0,0 +1,9 @@
+ALTER TABLE user
+  ADD COLUMN address_line1 VARCHAR(100) NOT NULL DEFAULT '',
+  ADD COLUMN address_line2 VARCHAR(100) NOT NULL DEFAULT '',
+  ADD COLUMN postal_code VARCHAR(10) NOT NULL DEFAULT '',
+  ADD COLUMN city VARCHAR(100) NOT NULL DEFAULT '',
+  ADD COLUMN country_code CHAR(2) NOT NULL DEFAULT '',
+  MODIFY address VARCHAR(320);
+CREATE INDEX user_city ON user (city);
+UPDATE user SET firstname = COALESCE(firstname, ''), lastname = COALESCE(lastname, ''), address = COALESCE(address, ''), phone = COALESCE(phone, '');
@@ -0,0 +1,5 @@
+DROP INDEX user_email ON user;
+ALTER TABLE user
+  DROP COLUMN email_key,
+  DROP COLUMN email_verified,
+  DROP COLUMN email;
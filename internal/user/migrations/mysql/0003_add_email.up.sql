@@ -0,0 +1,6 @@
+-- email_key leaves out the empty emails, which may be shared, and ignores case
+ALTER TABLE user
+  ADD COLUMN email VARCHAR(254) NOT NULL DEFAULT '',
+  ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+  ADD COLUMN email_key VARCHAR(254) GENERATED ALWAYS AS (NULLIF(LOWER(email), '')) STORED;
+CREATE UNIQUE INDEX user_email ON user (email_key);
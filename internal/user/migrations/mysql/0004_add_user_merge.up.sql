@@ -0,0 +1,7 @@
+-- a merged user leads to the user which absorbed it
+CREATE TABLE IF NOT EXISTS user_merge (
+  merged_id INTEGER PRIMARY KEY,
+  into_id INTEGER NOT NULL,
+  merged_at TIMESTAMP NOT NULL
+);
+CREATE INDEX user_merge_into ON user_merge (into_id);
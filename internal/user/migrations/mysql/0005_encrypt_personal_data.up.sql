@@ -0,0 +1,11 @@
+-- the encrypted values are longer than the plain ones, key_id is empty for the
+-- rows "keys rotate" did not encrypt yet
+ALTER TABLE user
+  MODIFY address VARCHAR(2048),
+  MODIFY address_line1 VARCHAR(1024) NOT NULL DEFAULT '',
+  MODIFY address_line2 VARCHAR(1024) NOT NULL DEFAULT '',
+  MODIFY phone VARCHAR(255),
+  ADD COLUMN key_id VARCHAR(64) NOT NULL DEFAULT '',
+  ADD COLUMN phone_index VARCHAR(64) NOT NULL DEFAULT '';
+CREATE INDEX user_phone_index ON user (phone_index);
+CREATE INDEX user_key_id ON user (key_id);
@@ -0,0 +1,14 @@
+-- the states are JSON users, encrypted with the key key_id when it is set
+CREATE TABLE IF NOT EXISTS user_history (
+  id INTEGER PRIMARY KEY NOT NULL AUTO_INCREMENT,
+  user_id INTEGER NOT NULL,
+  action VARCHAR(20) NOT NULL,
+  actor VARCHAR(254) NOT NULL,
+  request_id VARCHAR(64) NOT NULL DEFAULT '',
+  changed_at TIMESTAMP(6) NOT NULL,
+  key_id VARCHAR(64) NOT NULL DEFAULT '',
+  before_state MEDIUMTEXT,
+  after_state MEDIUMTEXT
+) CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+CREATE INDEX user_history_user ON user_history (user_id, changed_at);
+CREATE INDEX user_history_key_id ON user_history (key_id);
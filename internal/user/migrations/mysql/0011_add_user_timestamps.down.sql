@@ -0,0 +1,5 @@
+DROP INDEX user_erasure_erased_at ON user_erasure;
+DROP INDEX user_merge_merged_at ON user_merge;
+DROP INDEX user_updated_at ON user;
+ALTER TABLE user DROP COLUMN updated_at;
+ALTER TABLE user DROP COLUMN created_at;
@@ -0,0 +1,8 @@
+-- set by the storage on every write, the users written before are dated from
+-- the migration
+ALTER TABLE user ADD COLUMN created_at TIMESTAMP(6) NULL DEFAULT NULL;
+ALTER TABLE user ADD COLUMN updated_at TIMESTAMP(6) NULL DEFAULT NULL;
+UPDATE user SET created_at = UTC_TIMESTAMP(), updated_at = UTC_TIMESTAMP();
+CREATE INDEX user_updated_at ON user (updated_at, id);
+CREATE INDEX user_merge_merged_at ON user_merge (merged_at, merged_id);
+CREATE INDEX user_erasure_erased_at ON user_erasure (erased_at, user_id);
@@ -0,0 +1,6 @@
+DROP INDEX user_erasure_public_id ON user_erasure;
+DROP INDEX user_merge_public_id ON user_merge;
+DROP INDEX user_public_id ON user;
+ALTER TABLE user_erasure DROP COLUMN public_id;
+ALTER TABLE user_merge DROP COLUMN public_id;
+ALTER TABLE user DROP COLUMN public_id;
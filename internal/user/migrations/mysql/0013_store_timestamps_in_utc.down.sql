@@ -0,0 +1,2 @@
+-- the times are converted back to the time zone of the server by a data
+-- migration
@@ -0,0 +1,2 @@
+-- the sessions are now in UTC, the times written in the time zone of the
+-- server are converted by a data migration
@@ -0,0 +1,17 @@
+-- the position of the last change of each row in the stream of the changes,
+-- taken from user_change_counter when the change commits; the rows written before
+-- are numbered by the migration code in the order of their times
+ALTER TABLE user ADD COLUMN sequence BIGINT NULL DEFAULT NULL;
+ALTER TABLE user ADD COLUMN created_sequence BIGINT NULL DEFAULT NULL;
+ALTER TABLE user_merge ADD COLUMN sequence BIGINT NULL DEFAULT NULL;
+ALTER TABLE user_erasure ADD COLUMN sequence BIGINT NULL DEFAULT NULL;
+CREATE TABLE IF NOT EXISTS user_change_counter (
+  value BIGINT NOT NULL
+);
+INSERT INTO user_change_counter (value) VALUES (0);
+DROP INDEX user_erasure_erased_at ON user_erasure;
+DROP INDEX user_merge_merged_at ON user_merge;
+DROP INDEX user_updated_at ON user;
+CREATE INDEX user_sequence ON user (sequence);
+CREATE INDEX user_merge_sequence ON user_merge (sequence);
+CREATE INDEX user_erasure_sequence ON user_erasure (sequence);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS "user" (
+  id SERIAL PRIMARY KEY,
+  firstname VARCHAR(100),
+  lastname VARCHAR(100),
+  address VARCHAR(100),
+  phone VARCHAR(100)
+);
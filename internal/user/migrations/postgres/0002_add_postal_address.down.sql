@@ -0,0 +1,8 @@
+-- address keeps its 320 characters, shrinking it back could truncate data
+DROP INDEX user_city;
+ALTER TABLE "user"
+  DROP COLUMN address_line1,
+  DROP COLUMN address_line2,
+  DROP COLUMN postal_code,
+  DROP COLUMN city,
+  DROP COLUMN country_code;
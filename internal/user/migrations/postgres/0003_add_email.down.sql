@@ -0,0 +1,4 @@
+DROP INDEX user_email;
+ALTER TABLE "user"
+  DROP COLUMN email_verified,
+  DROP COLUMN email;
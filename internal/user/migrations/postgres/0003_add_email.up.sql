@@ -0,0 +1,5 @@
+ALTER TABLE "user"
+  ADD COLUMN email VARCHAR(254) NOT NULL DEFAULT '',
+  ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+-- the empty emails may be shared, the others are unique regardless of case
+CREATE UNIQUE INDEX user_email ON "user" (LOWER(email)) WHERE email <> '';
@@ -0,0 +1,6 @@
+-- the columns keep their width, the encrypted values must be decrypted first
+DROP INDEX user_key_id;
+DROP INDEX user_phone_index;
+ALTER TABLE "user"
+  DROP COLUMN phone_index,
+  DROP COLUMN key_id;
@@ -0,0 +1,2 @@
+-- incremented by every write, the users written before start at 1
+ALTER TABLE "user" ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,11 @@
+-- the created user is kept as JSON, encrypted with the key key_id when it is set
+CREATE TABLE IF NOT EXISTS user_idempotency (
+  idempotency_key VARCHAR(255) PRIMARY KEY,
+  fingerprint CHAR(64) NOT NULL,
+  user_id INTEGER NOT NULL,
+  key_id VARCHAR(64) NOT NULL DEFAULT '',
+  user_state TEXT,
+  expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX user_idempotency_user ON user_idempotency (user_id);
+CREATE INDEX user_idempotency_expires_at ON user_idempotency (expires_at);
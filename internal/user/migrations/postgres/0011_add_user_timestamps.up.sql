@@ -0,0 +1,8 @@
+-- set by the storage on every write, the users written before are dated from
+-- the migration
+ALTER TABLE "user" ADD COLUMN created_at TIMESTAMP NULL;
+ALTER TABLE "user" ADD COLUMN updated_at TIMESTAMP NULL;
+UPDATE "user" SET created_at = NOW() AT TIME ZONE 'UTC', updated_at = NOW() AT TIME ZONE 'UTC';
+CREATE INDEX user_updated_at ON "user" (updated_at, id);
+CREATE INDEX user_merge_merged_at ON user_merge (merged_at, merged_id);
+CREATE INDEX user_erasure_erased_at ON user_erasure (erased_at, user_id);
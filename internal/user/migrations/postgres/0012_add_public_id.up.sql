@@ -0,0 +1,9 @@
+-- the ULID the clients know a user by, the users written before are given
+-- one by the migration code; merged and erased users keep theirs so that
+-- their public id still resolves
+ALTER TABLE "user" ADD COLUMN public_id CHAR(26) NULL;
+ALTER TABLE user_merge ADD COLUMN public_id CHAR(26) NULL;
+ALTER TABLE user_erasure ADD COLUMN public_id CHAR(26) NULL;
+CREATE UNIQUE INDEX user_public_id ON "user" (public_id);
+CREATE INDEX user_merge_public_id ON user_merge (public_id);
+CREATE INDEX user_erasure_public_id ON user_erasure (public_id);
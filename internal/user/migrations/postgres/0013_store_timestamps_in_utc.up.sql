@@ -0,0 +1 @@
+-- the times were always written in UTC, there is nothing to convert
@@ -0,0 +1,11 @@
+DROP INDEX user_erasure_sequence;
+DROP INDEX user_merge_sequence;
+DROP INDEX user_sequence;
+CREATE INDEX user_updated_at ON "user" (updated_at, id);
+CREATE INDEX user_merge_merged_at ON user_merge (merged_at, merged_id);
+CREATE INDEX user_erasure_erased_at ON user_erasure (erased_at, user_id);
+DROP TABLE user_change_counter;
+ALTER TABLE user_erasure DROP COLUMN sequence;
+ALTER TABLE user_merge DROP COLUMN sequence;
+ALTER TABLE "user" DROP COLUMN created_sequence;
+ALTER TABLE "user" DROP COLUMN sequence;
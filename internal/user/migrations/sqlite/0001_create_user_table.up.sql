@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS "user" (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  firstname TEXT,
+  lastname TEXT,
+  address TEXT,
+  phone TEXT
+);
@@ -0,0 +1,6 @@
+DROP INDEX user_city;
+ALTER TABLE "user" DROP COLUMN address_line1;
+ALTER TABLE "user" DROP COLUMN address_line2;
+ALTER TABLE "user" DROP COLUMN postal_code;
+ALTER TABLE "user" DROP COLUMN city;
+ALTER TABLE "user" DROP COLUMN country_code;
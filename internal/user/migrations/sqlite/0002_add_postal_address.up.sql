@@ -0,0 +1,7 @@
+ALTER TABLE "user" ADD COLUMN address_line1 TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD COLUMN address_line2 TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD COLUMN postal_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD COLUMN city TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD COLUMN country_code TEXT NOT NULL DEFAULT '';
+CREATE INDEX user_city ON "user" (city);
+UPDATE "user" SET firstname = COALESCE(firstname, ''), lastname = COALESCE(lastname, ''), address = COALESCE(address, ''), phone = COALESCE(phone, '');
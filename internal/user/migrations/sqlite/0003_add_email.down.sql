@@ -0,0 +1,3 @@
+DROP INDEX user_email;
+ALTER TABLE "user" DROP COLUMN email_verified;
+ALTER TABLE "user" DROP COLUMN email;
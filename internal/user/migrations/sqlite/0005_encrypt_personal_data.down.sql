@@ -0,0 +1,5 @@
+-- the encrypted values must be decrypted first
+DROP INDEX user_key_id;
+DROP INDEX user_phone_index;
+ALTER TABLE "user" DROP COLUMN phone_index;
+ALTER TABLE "user" DROP COLUMN key_id;
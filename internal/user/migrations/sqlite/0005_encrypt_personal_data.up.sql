@@ -0,0 +1,5 @@
+-- key_id is empty for the rows "keys rotate" did not encrypt yet
+ALTER TABLE "user" ADD COLUMN key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE "user" ADD COLUMN phone_index TEXT NOT NULL DEFAULT '';
+CREATE INDEX user_phone_index ON "user" (phone_index);
+CREATE INDEX user_key_id ON "user" (key_id);
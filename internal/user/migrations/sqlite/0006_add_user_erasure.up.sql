@@ -0,0 +1,7 @@
+-- an erased user leaves a receipt, which holds no personal data
+CREATE TABLE IF NOT EXISTS user_erasure (
+  user_id INTEGER PRIMARY KEY,
+  requester VARCHAR(254) NOT NULL,
+  reason VARCHAR(1000) NOT NULL DEFAULT '',
+  erased_at TIMESTAMP NOT NULL
+);
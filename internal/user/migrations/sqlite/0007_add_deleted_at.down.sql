@@ -0,0 +1,3 @@
+DELETE FROM "user" WHERE deleted_at IS NOT NULL;
+DROP INDEX user_deleted_at;
+ALTER TABLE "user" DROP COLUMN deleted_at;
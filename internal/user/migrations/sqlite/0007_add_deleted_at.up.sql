@@ -0,0 +1,3 @@
+-- a deleted user is kept until the purge, NULL when it is not deleted
+ALTER TABLE "user" ADD COLUMN deleted_at TIMESTAMP NULL;
+CREATE INDEX user_deleted_at ON "user" (deleted_at);
@@ -0,0 +1,14 @@
+-- the states are JSON users, encrypted with the key key_id when it is set
+CREATE TABLE IF NOT EXISTS user_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  action TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  request_id TEXT NOT NULL DEFAULT '',
+  changed_at TIMESTAMP NOT NULL,
+  key_id TEXT NOT NULL DEFAULT '',
+  before_state TEXT,
+  after_state TEXT
+);
+CREATE INDEX user_history_user ON user_history (user_id, changed_at);
+CREATE INDEX user_history_key_id ON user_history (key_id);
@@ -0,0 +1,9 @@
+-- set by the storage on every write, the users written before are dated from
+-- the migration, in the form the connections write times in so that they
+-- compare alike
+ALTER TABLE "user" ADD COLUMN created_at TIMESTAMP NULL;
+ALTER TABLE "user" ADD COLUMN updated_at TIMESTAMP NULL;
+UPDATE "user" SET created_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now'), updated_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');
+CREATE INDEX user_updated_at ON "user" (updated_at, id);
+CREATE INDEX user_merge_merged_at ON user_merge (merged_at, merged_id);
+CREATE INDEX user_erasure_erased_at ON user_erasure (erased_at, user_id);
@@ -0,0 +1,2 @@
+-- the times are converted back to the text form of the Go driver by a data
+-- migration
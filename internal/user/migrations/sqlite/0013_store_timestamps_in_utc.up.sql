@@ -0,0 +1,2 @@
+-- the times are now written as YYYY-MM-DD HH:MM:SS.SSS+00:00, the times
+-- written before are converted by a data migration
@@ -0,0 +1,46 @@
+package user
+
+import (
+  errors  "errors"
+  mysql   "github.com/go-sql-driver/mysql"
+  sql     "database/sql"
+  strings "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. MySQL / MariaDB dialect
+// -------------------------------------------------------------------------- //
+
+var mysqlDialect = dialect{
+  Name:      "mysql",
+  Table:     "user",
+  ForUpdate: true,
+  // the columns are utf8mb4_unicode_ci, which ignores case and accents
+  Collate:   " COLLATE utf8mb4_bin",
+  Classify:  func(err error) error {
+    var mysqlErr *mysql.MySQLError
+    if !errors.As(err, &mysqlErr) {
+      return nil
+    }
+
+    switch mysqlErr.Number {
+    case 1062: // ER_DUP_ENTRY
+      if strings.Contains(mysqlErr.Message, "user_email") {
+        return EmailTakenError(err)
+      }
+      return &Error{Kind: KindConflict, Code: "user_conflict", Message: "user already exists", Err: err}
+    case 1205, 1213: // ER_LOCK_WAIT_TIMEOUT, ER_LOCK_DEADLOCK
+      return TransactionConflictError(err)
+    case 1040: // ER_CON_COUNT_ERROR
+      return UnavailableError(err)
+    case 1406: // ER_DATA_TOO_LONG
+      return &Error{Kind: KindValidation, Code: "invalid_user", Message: "user field is too long", Err: err}
+    }
+
+    return nil
+  },
+}
+
+func NewMySQLRepository(db *sql.DB) *SQLRepository {
+  return &SQLRepository{DB: db, dialect: mysqlDialect}
+}
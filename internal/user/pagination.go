@@ -0,0 +1,170 @@
+package user
+
+import (
+  base64 "encoding/base64"
+  json   "encoding/json"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Page requests and results
+// -------------------------------------------------------------------------- //
+
+const DefaultPageSize = 50
+const MaxPageSize     = 500
+
+// PageQuery asks for at most Limit users matching every filter, ordered by
+// Sort then public id, from the Cursor position, the zero Cursor being the
+// first page
+type PageQuery struct {
+  Limit     int
+  Cursor    Cursor
+  Filters   []Filter
+  Sort      []SortKey
+  WithTotal bool
+  // IncludeDeleted lists the deleted users along with the others
+  IncludeDeleted bool
+}
+
+// Page is one slice of the user list. Next and Prev are nil when there is no
+// page in that direction, Total is only counted when asked for.
+type Page struct {
+  Users []User
+  Next  *Cursor
+  Prev  *Cursor
+  Total *int
+}
+
+// Validate makes sure the cursor was issued for the same sort order
+func (q PageQuery) Validate() error {
+  if len(q.Cursor.Values) == 0 {
+    return nil
+  }
+
+  keys := orderKeys(q.Sort)
+
+  if q.Cursor.Sort != sortSpecification(q.Sort) || len(q.Cursor.Values) != len(keys) {
+    return ValidationError("invalid_cursor", "the cursor does not belong to this sort order")
+  }
+
+  // the cursors issued before the public ids ended on the integer id
+  if _, ok := ParseULID(q.Cursor.Values[len(keys) - 1]); !ok {
+    return ValidationError("invalid_cursor", "the cursor is invalid")
+  }
+
+  return nil
+}
+
+// Match tells whether a user passes every filter of the query, the deleted
+// users passing only when IncludeDeleted is set
+func (q PageQuery) Match(n *User) bool {
+  if n.DeletedAt != nil && !q.IncludeDeleted {
+    return false
+  }
+
+  for _, filter := range q.Filters {
+    if !filter.Match(n) {
+      return false
+    }
+  }
+
+  return true
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Opaque cursors
+// -------------------------------------------------------------------------- //
+
+// Cursor is a keyset position: the page starts right after (or right before,
+// when Backward is set) the user whose sort keys are Values. Empty Values
+// stand for the start (or the end) of the list.
+type Cursor struct {
+  Values   []string `json:"v,omitempty"`
+  Sort     string   `json:"s,omitempty"`
+  Backward bool     `json:"b,omitempty"`
+}
+
+func (c Cursor) Encode() string {
+  document, _ := json.Marshal(c)
+  return base64.RawURLEncoding.EncodeToString(document)
+}
+
+func DecodeCursor(token string) (Cursor, error) {
+  cursor := Cursor{}
+
+  document, err := base64.RawURLEncoding.DecodeString(token)
+  if err != nil {
+    return cursor, ValidationError("invalid_cursor", "the cursor is invalid")
+  }
+
+  if err = json.Unmarshal(document, &cursor); err != nil {
+    return cursor, ValidationError("invalid_cursor", "the cursor is invalid")
+  }
+
+  return cursor, nil
+}
+
+func cursorAt(n *User, sort []SortKey, backward bool) *Cursor {
+  keys   := orderKeys(sort)
+  values := make([]string, len(keys))
+
+  for i, key := range keys {
+    values[i] = key.Field.Value(n)
+  }
+
+  return &Cursor{Values: values, Sort: sortSpecification(sort), Backward: backward}
+}
+
+// afterCursor tells whether a user lies past the cursor in its direction
+func (q PageQuery) afterCursor(n *User) bool {
+  if len(q.Cursor.Values) == 0 {
+    return true
+  }
+
+  result := compareToValues(n, orderKeys(q.Sort), q.Cursor.Values)
+
+  if q.Cursor.Backward {
+    return result < 0
+  }
+
+  return result > 0
+}
+
+// newPage builds the page and its cursors from the rows read in the cursor
+// direction, rows holding one extra user when more are available
+func newPage(query PageQuery, rows []User) Page {
+  hasMore := len(rows) > query.Limit
+  if hasMore {
+    rows = rows[:query.Limit]
+  }
+
+  if query.Cursor.Backward {
+    for i, j := 0, len(rows) - 1; i < j; i, j = i + 1, j - 1 {
+      rows[i], rows[j] = rows[j], rows[i]
+    }
+  }
+
+  page := Page{Users: rows}
+
+  if len(rows) == 0 {
+    return page
+  }
+
+  first := &rows[0]
+  last  := &rows[len(rows) - 1]
+
+  if query.Cursor.Backward {
+    page.Next = cursorAt(last, query.Sort, false)
+    if hasMore {
+      page.Prev = cursorAt(first, query.Sort, true)
+    }
+  } else {
+    if hasMore {
+      page.Next = cursorAt(last, query.Sort, false)
+    }
+    if len(query.Cursor.Values) > 0 {
+      page.Prev = cursorAt(first, query.Sort, true)
+    }
+  }
+
+  return page
+}
@@ -0,0 +1,140 @@
+package user
+
+import (
+  reflect "reflect"
+  testing "testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+  cursors := []Cursor{
+    {},
+    {Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE"}},
+    {Values: []string{"Penaud", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}, Sort: "lastname", Backward: true},
+    {Values: []string{"Müller-d'Arc", "01HV3KA2M8P0S3V6X9Z1C4F7HJ"}, Sort: "-lastname"},
+  }
+
+  for _, cursor := range cursors {
+    decoded, err := DecodeCursor(cursor.Encode())
+    if err != nil || !reflect.DeepEqual(decoded, cursor) {
+      t.Errorf("DecodeCursor(Encode(%+v)) = %+v, %v", cursor, decoded, err)
+    }
+  }
+
+  for _, token := range []string{"%%%", "bm90IGpzb24", "W10"} {
+    if _, err := DecodeCursor(token); err == nil {
+      t.Errorf("DecodeCursor(%q) accepts an invalid cursor", token)
+    }
+  }
+}
+
+func TestPageQueryValidate(t *testing.T) {
+  lastname, _ := ParseSort("lastname")
+
+  tests := []struct {
+    query PageQuery
+    valid bool
+  }{
+    {PageQuery{}, true},
+    {PageQuery{Cursor: Cursor{Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE"}}}, true},
+    {PageQuery{Cursor: Cursor{Values: []string{"7"}}}, false},
+    {PageQuery{Cursor: Cursor{Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE", "01HV3KA2M8P0S3V6X9Z1C4F7HJ"}}}, false},
+    {PageQuery{Cursor: Cursor{Values: []string{"Penaud", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}, Sort: "lastname"}, Sort: lastname}, true},
+    {PageQuery{Cursor: Cursor{Values: []string{"Penaud", "7"}, Sort: "lastname"}, Sort: lastname}, false},
+    {PageQuery{Cursor: Cursor{Values: []string{"Penaud", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}, Sort: "lastname"}}, false},
+    {PageQuery{Cursor: Cursor{Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE"}}, Sort: lastname}, false},
+  }
+
+  for _, test := range tests {
+    if err := test.query.Validate(); (err == nil) != test.valid {
+      t.Errorf("Validate(%+v) = %v, want valid %t", test.query, err, test.valid)
+    }
+  }
+}
+
+// walkPages lists every user matching q forward through the Next cursors,
+// then backward through the Prev cursors, both walks returning the ids in the
+// order of the listing
+func walkPages(t *testing.T, users UserRepository, q PageQuery) ([]int, []int) {
+  t.Helper()
+
+  forward, backward := []int{}, []int{}
+  var pages []Page
+
+  for page := 0; ; page++ {
+    result, err := users.ListUsers(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if page > 100 {
+      t.Fatal("the listing never ends")
+    }
+
+    pages = append(pages, result)
+    for _, n := range result.Users {
+      forward = append(forward, n.Id)
+    }
+
+    if result.Next == nil {
+      break
+    }
+    q.Cursor = *result.Next
+  }
+
+  // from the last page, the Prev cursors go back to the first one
+  last := pages[len(pages) - 1]
+  for _, n := range last.Users {
+    backward = append(backward, n.Id)
+  }
+
+  for cursor := last.Prev; cursor != nil; {
+    q.Cursor = *cursor
+
+    result, err := users.ListUsers(q)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    ids := []int{}
+    for _, n := range result.Users {
+      ids = append(ids, n.Id)
+    }
+
+    backward, cursor = append(ids, backward...), result.Prev
+  }
+
+  return forward, backward
+}
+
+func TestListUsersPages(t *testing.T) {
+  repositories := map[string]UserRepository{
+    "memory": NewMemoryRepository(),
+    "sqlite": newTestSQLiteRepository(t),
+  }
+
+  for name, users := range repositories {
+    for _, firstname := range []string{"Anna", "Bruno", "Carla", "David", "Emma", "Fabien", "Gaëlle"} {
+      if err := users.CreateUser(&User{Firstname: firstname, Lastname: "Roux"}); err != nil {
+        t.Fatal(err)
+      }
+    }
+
+    if err := users.DeleteUser(&User{Id: 4}); err != nil {
+      t.Fatal(err)
+    }
+
+    forward, backward := walkPages(t, users, PageQuery{Limit: 2, WithTotal: true})
+
+    want := []int{1, 2, 3, 5, 6, 7}
+    if !reflect.DeepEqual(forward, want) || !reflect.DeepEqual(backward, want) {
+      t.Errorf("%s: pages of 2 list %v forward and %v backward, want %v", name, forward, backward, want)
+    }
+
+    page, err := users.ListUsers(PageQuery{Limit: 10, WithTotal: true, IncludeDeleted: true})
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(page.Users) != 7 || page.Total == nil || *page.Total != 7 || page.Next != nil || page.Prev != nil {
+      t.Errorf("%s: a single page lists %d users, total %v", name, len(page.Users), page.Total)
+    }
+  }
+}
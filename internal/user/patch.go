@@ -0,0 +1,100 @@
+package user
+
+import (
+  json    "encoding/json"
+  strings "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. JSON Merge Patch (RFC 7396)
+// -------------------------------------------------------------------------- //
+
+const MergePatchContentType = "application/merge-patch+json"
+
+// MergePatch applies a JSON Merge Patch document onto the user. Member names
+// are matched case-insensitively, like encoding/json does when decoding a
+// User, and the id cannot be changed.
+func (n *User) MergePatch(patch []byte) error {
+  var changes map[string]interface{}
+  if err := json.Unmarshal(patch, &changes); err != nil {
+    return ValidationError("invalid_payload", "the merge patch must be a JSON object")
+  }
+
+  document, err := json.Marshal(n)
+  if err != nil {
+    return InternalError(err)
+  }
+
+  var current map[string]interface{}
+  if err = json.Unmarshal(document, &current); err != nil {
+    return InternalError(err)
+  }
+
+  for key := range changes {
+    if strings.EqualFold(key, "id") {
+      return ValidationError("invalid_payload", "the user id cannot be patched")
+    }
+
+    if findMember(current, key) == "" {
+      return InvalidUserError(UnknownFieldViolation(key))
+    }
+  }
+
+  merged, err := json.Marshal(mergePatch(current, changes))
+  if err != nil {
+    return InternalError(err)
+  }
+
+  patched := User{}
+  if err = json.Unmarshal(merged, &patched); err != nil {
+    return ValidationError("invalid_payload", "the merge patch does not fit a user: %s", err)
+  }
+
+  // a client patching the one-line address alone expects it to be parsed
+  // again, rather than overwritten by the former PostalAddress
+  if findMember(changes, "address") != "" && findMember(changes, "postaladdress") == "" {
+    patched.PostalAddress = PostalAddress{}
+  }
+
+  patched.Id = n.Id
+  *n = patched
+
+  return nil
+}
+
+// mergePatch implements the MergePatch pseudo code of RFC 7396 section 2
+func mergePatch(target interface{}, patch interface{}) interface{} {
+  changes, ok := patch.(map[string]interface{})
+  if !ok {
+    return patch
+  }
+
+  document, ok := target.(map[string]interface{})
+  if !ok {
+    document = map[string]interface{}{}
+  }
+
+  for key, value := range changes {
+    if member := findMember(document, key); member != "" {
+      key = member
+    }
+
+    if value == nil {
+      delete(document, key)
+    } else {
+      document[key] = mergePatch(document[key], value)
+    }
+  }
+
+  return document
+}
+
+func findMember(document map[string]interface{}, key string) string {
+  for member := range document {
+    if strings.EqualFold(member, key) {
+      return member
+    }
+  }
+
+  return ""
+}
@@ -0,0 +1,66 @@
+package user
+
+import (
+  errors  "errors"
+  testing "testing"
+)
+
+func TestMergePatch(t *testing.T) {
+  original := User{
+    Id: 7, PublicId: "01HV3K8Z4X6N7Q2R5T9W0YBCDE", Firstname: "Guillaume", Lastname: "Penaud",
+    Address: "10 route de Rhye 74210 Mouthier-En-Bresse", Phone: "+33645124365", Email: "guillaume@example.com",
+    PostalAddress: PostalAddress{Line1: "10 route de Rhye", PostalCode: "74210", City: "Mouthier-En-Bresse", CountryCode: "FR"},
+  }
+
+  tests := []struct {
+    patch string
+    check func(n User) bool
+  }{
+    {`{"lastname": "Martin"}`, func(n User) bool { return n.Lastname == "Martin" && n.Firstname == "Guillaume" && n.Phone == original.Phone }},
+    {`{"LASTNAME": "Martin"}`, func(n User) bool { return n.Lastname == "Martin" }},
+    {`{"email": null}`, func(n User) bool { return n.Email == "" && n.Lastname == "Penaud" }},
+    {`{"postaladdress": {"city": "Lyon"}}`, func(n User) bool { return n.PostalAddress.City == "Lyon" && n.PostalAddress.Line1 == "10 route de Rhye" }},
+    {`{"address": "3 rue Neuve 69001 Lyon"}`, func(n User) bool { return n.Address == "3 rue Neuve 69001 Lyon" && n.PostalAddress == PostalAddress{} }},
+    {`{}`, func(n User) bool { return n == original }},
+  }
+
+  for _, test := range tests {
+    n := original
+
+    if err := n.MergePatch([]byte(test.patch)); err != nil {
+      t.Errorf("MergePatch(%s) = %v", test.patch, err)
+      continue
+    }
+    if n.Id != original.Id || !test.check(n) {
+      t.Errorf("MergePatch(%s) = %+v", test.patch, n)
+    }
+  }
+}
+
+func TestMergePatchErrors(t *testing.T) {
+  tests := []struct {
+    patch string
+    code  string
+  }{
+    {`["lastname"]`, "invalid_payload"},
+    {`{"lastname": "Martin"`, "invalid_payload"},
+    {`{"id": 8}`, "invalid_payload"},
+    {`{"Id": 8}`, "invalid_payload"},
+    {`{"firstname": 42}`, "invalid_payload"},
+    {`{"age": 40}`, "invalid_user"},
+  }
+
+  for _, test := range tests {
+    n := User{Id: 7, Firstname: "Guillaume", Lastname: "Penaud"}
+
+    err := n.MergePatch([]byte(test.patch))
+
+    var userErr *Error
+    if !errors.As(err, &userErr) || userErr.Code != test.code || userErr.Kind != KindValidation {
+      t.Errorf("MergePatch(%s) = %v, want %s", test.patch, err, test.code)
+    }
+    if n.Firstname != "Guillaume" || n.Id != 7 {
+      t.Errorf("MergePatch(%s) changed the user: %+v", test.patch, n)
+    }
+  }
+}
@@ -0,0 +1,74 @@
+package user
+
+import (
+  fmt          "fmt"
+  phonenumbers "github.com/nyaruka/phonenumbers"
+  strings      "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Phone numbers
+// -------------------------------------------------------------------------- //
+
+// ParsePhone reads a phone number written in the national format of the
+// default region, or in the international format of any region, and returns
+// its E.164 form
+func ParsePhone(text string) (string, error) {
+  number, err := phonenumbers.Parse(text, DefaultRegion)
+  if err != nil || !phonenumbers.IsValidNumber(number) {
+    return "", fmt.Errorf("%q is not a valid phone number", text)
+  }
+
+  return phonenumbers.Format(number, phonenumbers.E164), nil
+}
+
+// NationalPhone formats an E.164 number the way it is dialled in its own
+// country, and returns "" for a number which cannot be parsed
+func NationalPhone(e164 string) string {
+  number, err := phonenumbers.Parse(e164, DefaultRegion)
+  if err != nil {
+    return ""
+  }
+
+  return phonenumbers.Format(number, phonenumbers.NATIONAL)
+}
+
+// IsSupportedRegion tells whether phone numbers of the region can be parsed
+func IsSupportedRegion(region string) bool {
+  return phonenumbers.GetSupportedRegions()[strings.ToUpper(region)]
+}
+
+// canonicalPhone turns a filter value into E.164 when it is a phone number
+func canonicalPhone(value string) string {
+  if e164, err := ParsePhone(value); err == nil {
+    return e164
+  }
+
+  return value
+}
+
+// normalizePhone stores the phone in E.164, rejecting the invalid numbers
+func (n *User) normalizePhone() *Violation {
+  n.Phone, n.PhoneNational = strings.TrimSpace(n.Phone), ""
+
+  if n.Phone == "" {
+    return nil
+  }
+
+  e164, err := ParsePhone(n.Phone)
+  if err != nil {
+    return &Violation{
+      Field:   "phone",
+      Code:    "invalid_phone",
+      Message: fmt.Sprintf("phone is not a valid phone number, national numbers being read as %s ones", DefaultRegion),
+    }
+  }
+
+  n.Phone, n.PhoneNational = e164, NationalPhone(e164)
+  return nil
+}
+
+// derive fills the read-only fields of a user read from a storage
+func (n *User) derive() {
+  n.PhoneNational = NationalPhone(n.Phone)
+}
@@ -0,0 +1,78 @@
+package user
+
+import (
+  testing "testing"
+)
+
+func TestParsePhone(t *testing.T) {
+  tests := map[string]string{
+    "06 45 12 43 65":     "+33645124365",
+    "06.45.12.43.65":     "+33645124365",
+    "+33 6 45 12 43 65":  "+33645124365",
+    "0033645124365":      "+33645124365",
+    "+1 650-253-0000":    "+16502530000",
+    "+44 20 7946 0958":   "+442079460958",
+    "06 45 12":           "",
+    "+33 1":              "",
+    "not a phone":        "",
+    "":                   "",
+  }
+
+  for text, want := range tests {
+    e164, err := ParsePhone(text)
+    if e164 != want || (err == nil) != (want != "") {
+      t.Errorf("ParsePhone(%q) = %q, %v, want %q", text, e164, err, want)
+    }
+  }
+}
+
+func TestParsePhoneRegion(t *testing.T) {
+  defer func(region string) { DefaultRegion = region }(DefaultRegion)
+  DefaultRegion = "GB"
+
+  if e164, err := ParsePhone("020 7946 0958"); err != nil || e164 != "+442079460958" {
+    t.Errorf("ParsePhone in GB = %q, %v", e164, err)
+  }
+  if _, err := ParsePhone("06 45 12 43 65"); err == nil {
+    t.Error("ParsePhone in GB accepts a French national number")
+  }
+}
+
+func TestNationalPhone(t *testing.T) {
+  tests := map[string]string{
+    "+33645124365":  "06 45 12 43 65",
+    "+16502530000":  "(650) 253-0000",
+    "":              "",
+  }
+
+  for e164, want := range tests {
+    if national := NationalPhone(e164); national != want {
+      t.Errorf("NationalPhone(%q) = %q, want %q", e164, national, want)
+    }
+  }
+}
+
+func TestIsSupportedRegion(t *testing.T) {
+  for region, want := range map[string]bool{"FR": true, "ch": true, "XX": false, "": false} {
+    if supported := IsSupportedRegion(region); supported != want {
+      t.Errorf("IsSupportedRegion(%q) = %t, want %t", region, supported, want)
+    }
+  }
+}
+
+func TestNormalizePhone(t *testing.T) {
+  n := User{Phone: " 06 45 12 43 65 ", PhoneNational: "stale"}
+  if violation := n.normalizePhone(); violation != nil || n.Phone != "+33645124365" || n.PhoneNational != "06 45 12 43 65" {
+    t.Errorf("normalizePhone = %v, %q %q", violation, n.Phone, n.PhoneNational)
+  }
+
+  n = User{Phone: "0645"}
+  if violation := n.normalizePhone(); violation == nil || violation.Code != "invalid_phone" || n.Phone != "0645" {
+    t.Errorf("normalizePhone(0645) = %v, %q", violation, n.Phone)
+  }
+
+  n = User{Phone: "  "}
+  if violation := n.normalizePhone(); violation != nil || n.Phone != "" {
+    t.Errorf("normalizePhone(blank) = %v, %q", violation, n.Phone)
+  }
+}
@@ -0,0 +1,47 @@
+package user
+
+import (
+  errors "errors"
+  pq     "github.com/lib/pq"
+  sql    "database/sql"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. PostgreSQL dialect
+// -------------------------------------------------------------------------- //
+
+// "user" is a reserved word in PostgreSQL, so the table name is always quoted
+var postgresDialect = dialect{
+  Name:      "postgres",
+  Table:     `"user"`,
+  Numbered:  true,
+  Returning: true,
+  ForUpdate: true,
+  // the default collation follows the locale of the database
+  Collate:   ` COLLATE "C"`,
+  Classify: func(err error) error {
+    var pqErr *pq.Error
+    if !errors.As(err, &pqErr) {
+      return nil
+    }
+
+    switch {
+    case pqErr.Code == "23505" && pqErr.Constraint == "user_email":
+      return EmailTakenError(err)
+    case pqErr.Code == "23505": // unique_violation
+      return &Error{Kind: KindConflict, Code: "user_conflict", Message: "user already exists", Err: err}
+    case pqErr.Code == "22001": // string_data_right_truncation
+      return &Error{Kind: KindValidation, Code: "invalid_user", Message: "user field is too long", Err: err}
+    case pqErr.Code == "40001", pqErr.Code == "40P01": // serialization_failure, deadlock_detected
+      return TransactionConflictError(err)
+    case pqErr.Code.Class() == "08", pqErr.Code.Class() == "53", pqErr.Code.Class() == "57": // connection, resources, operator intervention
+      return UnavailableError(err)
+    }
+
+    return nil
+  },
+}
+
+func NewPostgresRepository(db *sql.DB) *SQLRepository {
+  return &SQLRepository{DB: db, dialect: postgresDialect}
+}
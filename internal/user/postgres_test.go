@@ -0,0 +1,57 @@
+package user
+
+import (
+  errors  "errors"
+  pq      "github.com/lib/pq"
+  strings "strings"
+  testing "testing"
+)
+
+func TestPostgresRebind(t *testing.T) {
+  tests := []struct {
+    query string
+    want  string
+  }{
+    {"SELECT id FROM {table}", `SELECT id FROM "user"`},
+    {"SELECT id FROM {table} WHERE id = ?", `SELECT id FROM "user" WHERE id = $1`},
+    {"UPDATE {table} SET firstname = ?, lastname = ? WHERE id = ? AND version = ?", `UPDATE "user" SET firstname = $1, lastname = $2 WHERE id = $3 AND version = $4`},
+  }
+
+  for _, test := range tests {
+    if got := postgresDialect.rebind(test.query); got != test.want {
+      t.Errorf("rebind(%q) = %q, want %q", test.query, got, test.want)
+    }
+    if got := sqliteDialect.rebind(test.query); strings.Count(got, "?") != strings.Count(test.query, "?") {
+      t.Errorf("the placeholders of %q are rewritten for SQLite: %q", test.query, got)
+    }
+  }
+}
+
+func TestPostgresClassify(t *testing.T) {
+  tests := []struct {
+    err  *pq.Error
+    code string
+    kind Kind
+  }{
+    {&pq.Error{Code: "23505", Constraint: "user_email"}, "email_taken", KindConflict},
+    {&pq.Error{Code: "23505", Constraint: "user_pkey"}, "user_conflict", KindConflict},
+    {&pq.Error{Code: "22001"}, "invalid_user", KindValidation},
+    {&pq.Error{Code: "40001"}, "transaction_conflict", KindUnavailable},
+    {&pq.Error{Code: "40P01"}, "transaction_conflict", KindUnavailable},
+    {&pq.Error{Code: "08006"}, "storage_unavailable", KindUnavailable},
+    {&pq.Error{Code: "57P01"}, "storage_unavailable", KindUnavailable},
+    {&pq.Error{Code: "42P01"}, "storage_error", KindInternal},
+  }
+
+  for _, test := range tests {
+    err := postgresDialect.classify(test.err)
+
+    var userErr *Error
+    if !errors.As(err, &userErr) || userErr.Code != test.code || userErr.Kind != test.kind {
+      t.Errorf("classify(%s) = %v, want %s", test.err.Code, err, test.code)
+    }
+    if !errors.Is(err, test.err) {
+      t.Errorf("classify(%s) lost the driver error", test.err.Code)
+    }
+  }
+}
@@ -0,0 +1,345 @@
+package user
+
+import (
+  fmt     "fmt"
+  strconv "strconv"
+  strings "strings"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Queryable fields
+// -------------------------------------------------------------------------- //
+
+// Field maps a public user field to its column and to its value in memory.
+// Only the fields listed in UserFields can be filtered or sorted on, and only
+// those with a Set function can be written by imports. Canonical, when set,
+// rewrites exact filter values the way the field is stored. Internal fields
+// are never given to the clients nor taken from them, see User.Id.
+type Field struct {
+  Name      string
+  Column    string
+  Numeric   bool
+  Internal  bool
+  Value     func(n *User) string
+  Set       func(n *User, value string)
+  Canonical func(value string) string
+}
+
+var UserFields = []Field{
+  {Name: "id", Column: "id", Numeric: true, Internal: true, Value: func(n *User) string { return strconv.Itoa(n.Id) }},
+  {Name: "publicid", Column: "public_id", Value: func(n *User) string { return n.PublicId }},
+  {Name: "firstname", Column: "firstname", Value: func(n *User) string { return n.Firstname }, Set: func(n *User, value string) { n.Firstname = value }},
+  {Name: "lastname", Column: "lastname", Value: func(n *User) string { return n.Lastname }, Set: func(n *User, value string) { n.Lastname = value }},
+  {Name: "address", Column: "address", Value: func(n *User) string { return n.Address }, Set: func(n *User, value string) { n.Address = value }},
+  {Name: "addressline1", Column: "address_line1", Value: func(n *User) string { return n.PostalAddress.Line1 }, Set: func(n *User, value string) { n.PostalAddress.Line1 = value }},
+  {Name: "addressline2", Column: "address_line2", Value: func(n *User) string { return n.PostalAddress.Line2 }, Set: func(n *User, value string) { n.PostalAddress.Line2 = value }},
+  {Name: "postalcode", Column: "postal_code", Value: func(n *User) string { return n.PostalAddress.PostalCode }, Set: func(n *User, value string) { n.PostalAddress.PostalCode = value }},
+  {Name: "city", Column: "city", Value: func(n *User) string { return n.PostalAddress.City }, Set: func(n *User, value string) { n.PostalAddress.City = value }},
+  {Name: "countrycode", Column: "country_code", Value: func(n *User) string { return n.PostalAddress.CountryCode }, Set: func(n *User, value string) { n.PostalAddress.CountryCode = value }},
+  {Name: "phone", Column: "phone", Value: func(n *User) string { return n.Phone }, Set: func(n *User, value string) { n.Phone = value }, Canonical: canonicalPhone},
+  {Name: "email", Column: "email", Value: func(n *User) string { return n.Email }, Set: func(n *User, value string) { n.Email = value }, Canonical: canonicalEmail},
+}
+
+func LookupField(name string) (Field, bool) {
+  for _, field := range UserFields {
+    if field.Name == name {
+      return field, true
+    }
+  }
+
+  return Field{}, false
+}
+
+// PublicFields lists the fields given to the clients, e.g. the columns of the
+// exports
+func PublicFields() []Field {
+  fields := []Field{}
+  for _, field := range UserFields {
+    if !field.Internal {
+      fields = append(fields, field)
+    }
+  }
+
+  return fields
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Filters
+// -------------------------------------------------------------------------- //
+
+const (
+  OperatorEqual    = "eq"
+  OperatorIn       = "in"
+  OperatorPrefix   = "prefix"
+  OperatorContains = "contains"
+)
+
+// Filter keeps the users whose Field matches one of Values with Operator.
+// Prefix and contains matches ignore case, the others compare the values as
+// they are, like the sorts (see Field.compare).
+type Filter struct {
+  Field    Field
+  Operator string
+  Values   []string
+}
+
+func NewFilter(name string, operator string, value string) (Filter, error) {
+  field, found := LookupField(name)
+  if !found || field.Internal {
+    return Filter{}, ValidationError("invalid_parameter", "%s is not a user field", name)
+  }
+
+  values := []string{value}
+
+  // only [in] lists values, a bare value may hold commas, as addresses do
+  switch operator {
+  case "":
+    operator = OperatorEqual
+  case OperatorIn:
+    values = strings.Split(value, ",")
+  case OperatorEqual, OperatorPrefix, OperatorContains:
+  default:
+    return Filter{}, ValidationError("invalid_parameter", "%s is not a filter operator (eq, in, prefix, contains)", operator)
+  }
+
+  if field.Canonical != nil && (operator == OperatorEqual || operator == OperatorIn) {
+    for i := range values {
+      values[i] = field.Canonical(values[i])
+    }
+  }
+
+  if field.Numeric {
+    if operator != OperatorEqual && operator != OperatorIn {
+      return Filter{}, ValidationError("invalid_parameter", "%s only accepts eq and in filters", name)
+    }
+
+    for _, value := range values {
+      if _, err := strconv.Atoi(value); err != nil {
+        return Filter{}, ValidationError("invalid_parameter", "%s filter expects numbers, got %q", name, value)
+      }
+    }
+  }
+
+  return Filter{Field: field, Operator: operator, Values: values}, nil
+}
+
+func (f Filter) Match(n *User) bool {
+  value := f.Field.Value(n)
+
+  for _, expected := range f.Values {
+    switch f.Operator {
+    case OperatorEqual, OperatorIn:
+      if value == expected {
+        return true
+      }
+    case OperatorPrefix:
+      if strings.HasPrefix(strings.ToLower(value), strings.ToLower(expected)) {
+        return true
+      }
+    case OperatorContains:
+      if strings.Contains(strings.ToLower(value), strings.ToLower(expected)) {
+        return true
+      }
+    }
+  }
+
+  return false
+}
+
+// escapeLike protects the LIKE wildcards of a user value, "!" being declared
+// as the escape character since it needs no quoting in any SQL dialect
+func escapeLike(value string) string {
+  return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+// sql renders the filter as a parameterised condition. Values never reach
+// the query text, only column names from UserFields do.
+func (f Filter) sql(d dialect) (string, []interface{}) {
+  args := []interface{}{}
+
+  switch f.Operator {
+  case OperatorPrefix, OperatorContains:
+    pattern := escapeLike(strings.ToLower(f.Values[0])) + "%"
+    if f.Operator == OperatorContains {
+      pattern = "%" + pattern
+    }
+
+    return fmt.Sprintf("LOWER(%s)%s LIKE ? ESCAPE '!'", f.Field.Column, d.Collate), append(args, pattern)
+  case OperatorIn:
+    placeholders := make([]string, len(f.Values))
+    for i, value := range f.Values {
+      placeholders[i] = "?"
+      args = append(args, f.Field.typed(value))
+    }
+
+    return fmt.Sprintf("%s IN (%s)", f.Field.collated(d), strings.Join(placeholders, ", ")), args
+  default:
+    return fmt.Sprintf("%s = ?", f.Field.collated(d)), append(args, f.Field.typed(f.Values[0]))
+  }
+}
+
+// collated renders the column compared the way Field.compare does, the
+// backends defaulting to their own collation otherwise
+func (f Field) collated(d dialect) string {
+  if f.Numeric {
+    return f.Column
+  }
+
+  return f.Column + d.Collate
+}
+
+func (f Field) typed(value string) interface{} {
+  if f.Numeric {
+    number, _ := strconv.Atoi(value)
+    return number
+  }
+
+  return value
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Sorting
+// -------------------------------------------------------------------------- //
+
+type SortKey struct {
+  Field      Field
+  Descending bool
+}
+
+// ParseSort reads a sort specification like "-lastname,firstname"
+func ParseSort(specification string) ([]SortKey, error) {
+  keys := []SortKey{}
+
+  for _, name := range strings.Split(specification, ",") {
+    descending := strings.HasPrefix(name, "-")
+    name = strings.TrimPrefix(name, "-")
+
+    field, found := LookupField(name)
+    if !found || field.Internal {
+      return nil, ValidationError("invalid_parameter", "cannot sort on %q, it is not a user field", name)
+    }
+
+    keys = append(keys, SortKey{Field: field, Descending: descending})
+  }
+
+  return keys, nil
+}
+
+func sortSpecification(keys []SortKey) string {
+  names := make([]string, len(keys))
+
+  for i, key := range keys {
+    names[i] = key.Field.Name
+    if key.Descending {
+      names[i] = "-" + names[i]
+    }
+  }
+
+  return strings.Join(names, ",")
+}
+
+// orderKeys completes the requested sort with the public id, so that the
+// order is total and usable as a keyset without the cursors holding the
+// integer id. Keys after the public id are useless and dropped.
+func orderKeys(sort []SortKey) []SortKey {
+  keys := []SortKey{}
+
+  for _, key := range sort {
+    keys = append(keys, key)
+    if key.Field.Name == "publicid" {
+      return keys
+    }
+  }
+
+  return append(keys, SortKey{Field: UserFields[1]})
+}
+
+// compare orders two values of the field. Text is compared byte by byte, that
+// is by code point, which every backend is made to do as well: "Dupont" and
+// "dupont" are different values, and "Z" sorts before "a".
+func (f Field) compare(x string, y string) int {
+  if !f.Numeric {
+    return strings.Compare(x, y)
+  }
+
+  a, _ := strconv.Atoi(x)
+  b, _ := strconv.Atoi(y)
+
+  switch {
+  case a < b:
+    return -1
+  case a > b:
+    return 1
+  }
+
+  return 0
+}
+
+// compareToValues orders a user against the sort key values of another one,
+// like the SQL ORDER BY does
+func compareToValues(n *User, keys []SortKey, values []string) int {
+  for i, key := range keys {
+    result := key.Field.compare(key.Field.Value(n), values[i])
+
+    if key.Descending {
+      result = -result
+    }
+
+    if result != 0 {
+      return result
+    }
+  }
+
+  return 0
+}
+
+func compareUsers(a *User, b *User, keys []SortKey) int {
+  values := make([]string, len(keys))
+  for i, key := range keys {
+    values[i] = key.Field.Value(b)
+  }
+
+  return compareToValues(a, keys, values)
+}
+
+// keysetSQL renders the condition selecting the rows past the cursor, e.g.
+// for "-lastname,id": lastname < ? OR (lastname = ? AND id > ?)
+func keysetSQL(d dialect, keys []SortKey, cursor Cursor) (string, []interface{}) {
+  conditions := []string{}
+  args       := []interface{}{}
+
+  for i, key := range keys {
+    terms := []string{}
+
+    for j := 0; j < i; j++ {
+      terms = append(terms, keys[j].Field.collated(d) + " = ?")
+      args  = append(args, keys[j].Field.typed(cursor.Values[j]))
+    }
+
+    operator := ">"
+    if key.Descending != cursor.Backward {
+      operator = "<"
+    }
+
+    terms = append(terms, key.Field.collated(d) + " " + operator + " ?")
+    args  = append(args, key.Field.typed(cursor.Values[i]))
+
+    conditions = append(conditions, "(" + strings.Join(terms, " AND ") + ")")
+  }
+
+  return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+// orderSQL renders the ORDER BY clause, reversed when reading backward
+func orderSQL(d dialect, keys []SortKey, backward bool) string {
+  terms := make([]string, len(keys))
+
+  for i, key := range keys {
+    terms[i] = key.Field.collated(d) + " ASC"
+    if key.Descending != backward {
+      terms[i] = key.Field.collated(d) + " DESC"
+    }
+  }
+
+  return strings.Join(terms, ", ")
+}
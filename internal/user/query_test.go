@@ -0,0 +1,188 @@
+package user
+
+import (
+  reflect "reflect"
+  testing "testing"
+)
+
+func TestNewFilter(t *testing.T) {
+  tests := []struct {
+    name     string
+    operator string
+    value    string
+    want     Filter // Field is only compared by name
+    valid    bool
+  }{
+    {"lastname", "", "Penaud", Filter{Operator: OperatorEqual, Values: []string{"Penaud"}}, true},
+    {"lastname", "", "Penaud,Martin", Filter{Operator: OperatorEqual, Values: []string{"Penaud,Martin"}}, true},
+    {"address", "", "1 rue X, Paris", Filter{Operator: OperatorEqual, Values: []string{"1 rue X, Paris"}}, true},
+    {"lastname", "in", "Penaud", Filter{Operator: OperatorIn, Values: []string{"Penaud"}}, true},
+    {"lastname", "in", "Penaud,Martin", Filter{Operator: OperatorIn, Values: []string{"Penaud", "Martin"}}, true},
+    {"lastname", "prefix", "Pen", Filter{Operator: OperatorPrefix, Values: []string{"Pen"}}, true},
+    {"city", "contains", "en-b", Filter{Operator: OperatorContains, Values: []string{"en-b"}}, true},
+    {"email", "eq", "Guillaume@Example.COM", Filter{Operator: OperatorEqual, Values: []string{"Guillaume@example.com"}}, true},
+    {"phone", "", "06 45 12 43 65", Filter{Operator: OperatorEqual, Values: []string{"+33645124365"}}, true},
+    {"publicid", "in", "01HV3K8Z4X6N7Q2R5T9W0YBCDE", Filter{Operator: OperatorIn, Values: []string{"01HV3K8Z4X6N7Q2R5T9W0YBCDE"}}, true},
+    {"id", "in", "1,2", Filter{}, false},
+    {"id", "", "1", Filter{}, false},
+    {"age", "", "40", Filter{}, false},
+    {"lastname", "like", "Pen%", Filter{}, false},
+  }
+
+  for _, test := range tests {
+    filter, err := NewFilter(test.name, test.operator, test.value)
+    if (err == nil) != test.valid {
+      t.Errorf("NewFilter(%s, %s, %s) = %v, want valid %t", test.name, test.operator, test.value, err, test.valid)
+      continue
+    }
+    if !test.valid {
+      continue
+    }
+
+    if filter.Field.Name != test.name || filter.Operator != test.want.Operator || !reflect.DeepEqual(filter.Values, test.want.Values) {
+      t.Errorf("NewFilter(%s, %s, %s) = %s %s %v", test.name, test.operator, test.value, filter.Field.Name, filter.Operator, filter.Values)
+    }
+  }
+}
+
+func TestFilterMatch(t *testing.T) {
+  n := User{Firstname: "Guillaume", Lastname: "Penaud", PostalAddress: PostalAddress{City: "Mouthier-En-Bresse"}}
+
+  tests := []struct {
+    name     string
+    operator string
+    value    string
+    match    bool
+  }{
+    {"lastname", "", "Penaud", true},
+    {"lastname", "", "penaud", false},
+    {"lastname", "", "Martin,Penaud", false},
+    {"lastname", "in", "Martin,Penaud", true},
+    {"lastname", "prefix", "pen", true},
+    {"lastname", "prefix", "aud", false},
+    {"city", "contains", "EN-B", true},
+    {"city", "contains", "%", false},
+    {"firstname", "in", "Anna,Bruno", false},
+  }
+
+  for _, test := range tests {
+    filter, err := NewFilter(test.name, test.operator, test.value)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if match := filter.Match(&n); match != test.match {
+      t.Errorf("%s[%s]=%s matches %t, want %t", test.name, test.operator, test.value, match, test.match)
+    }
+  }
+}
+
+func TestParseSort(t *testing.T) {
+  tests := []struct {
+    specification string
+    order         string // specification of orderKeys
+    valid         bool
+  }{
+    {"lastname", "lastname,publicid", true},
+    {"-lastname,firstname", "-lastname,firstname,publicid", true},
+    {"-publicid,lastname", "-publicid", true},
+    {"-id", "", false},
+    {"id,lastname", "", false},
+    {"age", "", false},
+    {"lastname,", "", false},
+  }
+
+  for _, test := range tests {
+    keys, err := ParseSort(test.specification)
+    if (err == nil) != test.valid {
+      t.Errorf("ParseSort(%q) = %v, want valid %t", test.specification, err, test.valid)
+      continue
+    }
+    if !test.valid {
+      continue
+    }
+
+    if specification := sortSpecification(keys); specification != test.specification {
+      t.Errorf("sortSpecification(ParseSort(%q)) = %q", test.specification, specification)
+    }
+    if order := sortSpecification(orderKeys(keys)); order != test.order {
+      t.Errorf("orderKeys(%q) = %q, want %q", test.specification, order, test.order)
+    }
+  }
+}
+
+func TestKeysetSQL(t *testing.T) {
+  keys, _ := ParseSort("-lastname")
+  keys = orderKeys(keys)
+
+  condition, args := keysetSQL(sqliteDialect, keys, Cursor{Values: []string{"Penaud", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}})
+  if want := "((lastname < ?) OR (lastname = ? AND public_id > ?))"; condition != want || !reflect.DeepEqual(args, []interface{}{"Penaud", "Penaud", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}) {
+    t.Errorf("keysetSQL = %s %v, want %s", condition, args, want)
+  }
+
+  condition, _ = keysetSQL(postgresDialect, keys, Cursor{Values: []string{"Penaud", "01HV3K8Z4X6N7Q2R5T9W0YBCDE"}, Backward: true})
+  if want := `((lastname COLLATE "C" > ?) OR (lastname COLLATE "C" = ? AND public_id COLLATE "C" < ?))`; condition != want {
+    t.Errorf("keysetSQL backward = %s, want %s", condition, want)
+  }
+
+  if order := orderSQL(mysqlDialect, keys, true); order != "lastname COLLATE utf8mb4_bin ASC, public_id COLLATE utf8mb4_bin DESC" {
+    t.Errorf("orderSQL backward = %s", order)
+  }
+}
+
+// the storages filter and sort alike, the memory one standing for the others
+// in the handler tests
+func TestListUsersFiltersAndSorts(t *testing.T) {
+  memory := NewMemoryRepository()
+  sqlite := newTestSQLiteRepository(t)
+
+  people := [][2]string{
+    {"Anna", "Roux"}, {"bruno", "Roux"}, {"Carla", "roux"}, {"Zoé", "Martin"}, {"Émile", "Martin"},
+    {"david", "Müller"}, {"Emma", "100%_Roux"}, {"Fabien", "Rouxel"}, {"Gaëlle", "Martin"},
+  }
+
+  for _, users := range []UserRepository{memory, sqlite} {
+    for _, person := range people {
+      if err := users.CreateUser(&User{Firstname: person[0], Lastname: person[1]}); err != nil {
+        t.Fatal(err)
+      }
+    }
+  }
+
+  queries := []struct {
+    sort    string
+    filters [][3]string
+  }{
+    {"firstname", nil},
+    {"-firstname", nil},
+    {"lastname,-firstname", nil},
+    {"-lastname,firstname", [][3]string{{"lastname", "prefix", "rou"}}},
+    {"firstname", [][3]string{{"lastname", "contains", "%_"}}},
+    {"firstname", [][3]string{{"lastname", "in", "Roux,Martin"}}},
+    {"-lastname", [][3]string{{"firstname", "contains", "E"}, {"lastname", "prefix", "m"}}},
+  }
+
+  for _, query := range queries {
+    q := PageQuery{Limit: 2}
+    q.Sort, _ = ParseSort(query.sort)
+
+    for _, f := range query.filters {
+      filter, err := NewFilter(f[0], f[1], f[2])
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      q.Filters = append(q.Filters, filter)
+    }
+
+    forward, backward := walkPages(t, memory, q)
+    sqliteForward, sqliteBackward := walkPages(t, sqlite, q)
+
+    if len(forward) == 0 || !reflect.DeepEqual(forward, backward) {
+      t.Errorf("sort %s, filters %v: memory lists %v forward and %v backward", query.sort, query.filters, forward, backward)
+    }
+    if !reflect.DeepEqual(sqliteForward, forward) || !reflect.DeepEqual(sqliteBackward, forward) {
+      t.Errorf("sort %s, filters %v: sqlite lists %v forward and %v backward, memory %v", query.sort, query.filters, sqliteForward, sqliteBackward, forward)
+    }
+  }
+}
@@ -0,0 +1,1332 @@
+package user
+
+import (
+  errors  "errors"
+  fmt     "fmt"
+  json    "encoding/json"
+  log     "github.com/sirupsen/logrus"
+  sql     "database/sql"
+  strconv "strconv"
+  strings "strings"
+  time    "time"
+)
+
+var sqlLog *log.Entry
+
+func init() {
+  sqlLog = log.WithFields(log.Fields{
+    "_file": "internal/user/sql.go",
+    "_type": "data",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. SQL dialects
+// -------------------------------------------------------------------------- //
+
+// dialect holds what differs between the SQL backends. Queries are written
+// once with a {table} token and "?" placeholders, then rewritten per dialect.
+// The schema itself lives in migrations/<name>.
+type dialect struct {
+  Name      string
+  Table     string
+  Numbered  bool // placeholders are $1, $2... instead of ?
+  Returning bool // inserted id is read with RETURNING instead of LastInsertId
+  ForUpdate bool // rows read before being updated are locked with FOR UPDATE
+  Collate   string // appended to the text columns compared or sorted, see Field.compare
+  Classify  func(err error) error // maps driver specific errors, nil when unknown
+}
+
+func (d dialect) rebind(query string) string {
+  query = strings.ReplaceAll(query, "{table}", d.Table)
+
+  if !d.Numbered {
+    return query
+  }
+
+  var builder strings.Builder
+  n := 0
+
+  for _, c := range query {
+    if c == '?' {
+      n++
+      builder.WriteString(fmt.Sprintf("$%d", n))
+    } else {
+      builder.WriteRune(c)
+    }
+  }
+
+  return builder.String()
+}
+
+// -------------------------------------------------------------------------- //
+// 2. SQL repository
+// -------------------------------------------------------------------------- //
+
+// executor is what *sql.DB and *sql.Tx have in common
+type executor interface {
+  Exec(query string, args ...interface{}) (sql.Result, error)
+  Query(query string, args ...interface{}) (*sql.Rows, error)
+  QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// SQLRepository implements UserRepository on top of database/sql for every
+// SQL backend (see mysql.go, postgres.go, sqlite.go). Inside Transaction, tx
+// is set and every query goes through it, the rows changed being listed in
+// changed. When Keyring is set, the personal data columns are encrypted at
+// rest (see keyring.go).
+type SQLRepository struct {
+  DB      *sql.DB
+  Keyring *Keyring
+  dialect dialect
+  tx      *sql.Tx
+  changed []changedRow
+}
+
+func (r *SQLRepository) conn() executor {
+  if r.tx != nil {
+    return r.tx
+  }
+
+  return r.DB
+}
+
+func (r *SQLRepository) Transaction(fn func(tx UserRepository) error) error {
+  if r.tx != nil {
+    return fn(r)
+  }
+
+  tx, err := r.DB.Begin()
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  t := &SQLRepository{DB: r.DB, Keyring: r.Keyring, dialect: r.dialect, tx: tx}
+
+  if err = fn(t); err == nil {
+    err = t.stamp()
+  }
+
+  if err != nil {
+    tx.Rollback()
+    return err
+  }
+
+  return r.dialect.classify(tx.Commit())
+}
+
+func (r *SQLRepository) logQuery(query string, fields log.Fields) {
+  fields["type"]   = "database query"
+  fields["driver"] = r.dialect.Name
+
+  sqlLog.WithFields(fields).Debug(query)
+}
+
+// userColumns are the columns written from a user, in the order of userValues.
+// email_verified is only written by VerifyEmail and reset by UpdateUser,
+// version is incremented and updated_at set by every write.
+// key_id names the key the row is encrypted with, "" when it is not.
+var userColumns = []string{"firstname", "lastname", "address", "address_line1", "address_line2", "postal_code", "city", "country_code", "phone", "email", "key_id", "phone_index"}
+
+// selectColumns reads a user in the order of scanUser
+var selectColumns = "id, " + strings.Join(userColumns, ", ") + ", email_verified, deleted_at, version, created_at, updated_at, public_id"
+
+// encryptedColumns hold the personal data encrypted at rest, in the order of
+// encryptedFields. Postal codes and cities stay in clear for mailings.
+var encryptedColumns = []string{"address", "address_line1", "address_line2", "phone"}
+
+func encryptedFields(n *User) []*string {
+  return []*string{&n.Address, &n.PostalAddress.Line1, &n.PostalAddress.Line2, &n.Phone}
+}
+
+func isEncrypted(column string) bool {
+  for _, encrypted := range encryptedColumns {
+    if column == encrypted {
+      return true
+    }
+  }
+
+  return false
+}
+
+// userValues returns the values of userColumns, encrypted when a keyring is
+// set, along with the blind index of the phone. The encrypted values are bound
+// to the public id of n, which must be the stored one.
+func (r *SQLRepository) userValues(n *User) ([]interface{}, error) {
+  stored, keyId, phoneIndex := *n, "", ""
+
+  if r.Keyring != nil {
+    keyId, phoneIndex = r.Keyring.Primary, r.Keyring.BlindIndex(n.Phone)
+
+    fields := encryptedFields(&stored)
+    for i, column := range encryptedColumns {
+      ciphertext, err := r.Keyring.Encrypt(column, n.PublicId, *fields[i])
+      if err != nil {
+        return nil, InternalError(err)
+      }
+
+      *fields[i] = ciphertext
+    }
+  }
+
+  return []interface{}{
+    stored.Firstname, stored.Lastname, stored.Address,
+    stored.PostalAddress.Line1, stored.PostalAddress.Line2, stored.PostalAddress.PostalCode, stored.PostalAddress.City, stored.PostalAddress.CountryCode,
+    stored.Phone, stored.Email, keyId, phoneIndex,
+  }, nil
+}
+
+// scanner is what *sql.Row and *sql.Rows have in common
+type scanner interface {
+  Scan(dest ...interface{}) error
+}
+
+// scanUser reads a row of selectColumns into n, decrypting its personal data
+func (r *SQLRepository) scanUser(row scanner, n *User) error {
+  keyId, phoneIndex, deletedAt := "", "", sql.NullTime{}
+
+  err := row.Scan(
+    &n.Id, &n.Firstname, &n.Lastname, &n.Address,
+    &n.PostalAddress.Line1, &n.PostalAddress.Line2, &n.PostalAddress.PostalCode, &n.PostalAddress.City, &n.PostalAddress.CountryCode,
+    &n.Phone, &n.Email, &keyId, &phoneIndex, &n.EmailVerified, &deletedAt, &n.Version, &n.CreatedAt, &n.UpdatedAt,
+    &n.PublicId,
+  )
+  if err != nil {
+    return err
+  }
+
+  n.CreatedAt, n.UpdatedAt = n.CreatedAt.UTC(), n.UpdatedAt.UTC()
+
+  n.DeletedAt = nil
+  if deletedAt.Valid {
+    deletedAt.Time = deletedAt.Time.UTC()
+    n.DeletedAt    = &deletedAt.Time
+  }
+
+  if keyId != "" {
+    if r.Keyring == nil {
+      return InternalError(fmt.Errorf("user %d is encrypted with key %s but no keyring is configured", n.Id, keyId))
+    }
+
+    fields := encryptedFields(n)
+    for i, column := range encryptedColumns {
+      if *fields[i], err = r.Keyring.Decrypt(keyId, column, n.PublicId, *fields[i]); err != nil {
+        return InternalError(fmt.Errorf("user %d: %w", n.Id, err))
+      }
+    }
+  }
+
+  n.derive()
+  return nil
+}
+
+func parameterFields(values []interface{}) log.Fields {
+  fields := log.Fields{}
+  for i, column := range userColumns {
+    fields["parameter_" + column] = values[i]
+  }
+
+  return fields
+}
+
+func (r *SQLRepository) CreateUser(n *User) error {
+  if r.tx == nil {
+    return r.Transaction(func(tx UserRepository) error { return tx.CreateUser(n) })
+  }
+
+  if err := n.normalize(); err != nil {
+    return err
+  }
+
+  n.EmailVerified, n.DeletedAt, n.Version = false, nil, 1
+  n.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+  n.UpdatedAt = n.CreatedAt
+  n.PublicId  = NewULID(n.CreatedAt)
+
+  values, err := r.userValues(n)
+  if err != nil {
+    return err
+  }
+
+  values        = append(values, n.CreatedAt, n.UpdatedAt, n.PublicId)
+  placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+  query        := r.dialect.rebind(fmt.Sprintf("INSERT INTO {table} (%s, created_at, updated_at, public_id) VALUES (%s)", strings.Join(userColumns, ", "), placeholders))
+
+  r.logQuery(query, parameterFields(values))
+
+  if r.dialect.Returning {
+    if err = r.conn().QueryRow(query + " RETURNING id", values...).Scan(&n.Id); err != nil {
+      return r.dialect.classify(err)
+    }
+  } else {
+    result, err := r.conn().Exec(query, values...)
+    if err != nil {
+      return r.dialect.classify(err)
+    }
+
+    id, err := result.LastInsertId()
+    if err != nil {
+      return r.dialect.classify(err)
+    }
+
+    n.Id = int(id)
+  }
+
+  r.touch("{table}", "id", n.Id, true)
+  return nil
+}
+
+func (r *SQLRepository) GetUser(n *User) error {
+  return r.getUser(n, "deleted_at IS NULL")
+}
+
+func (r *SQLRepository) GetDeletedUser(n *User) error {
+  if err := r.getUser(n, "deleted_at IS NOT NULL"); !errors.Is(err, ErrUserNotFound) {
+    return err
+  }
+
+  if err := r.getUser(&User{Id: n.Id}, "deleted_at IS NULL"); err != nil {
+    return err
+  }
+
+  return ErrUserNotDeleted
+}
+
+// getUser reads the user n.Id when it matches the condition on deleted_at
+func (r *SQLRepository) getUser(n *User, deleted string) error {
+  query := r.dialect.rebind("SELECT " + selectColumns + " FROM {table} WHERE id = ? AND " + deleted)
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": n.Id,
+  })
+
+  err := r.scanUser(r.conn().QueryRow(query, n.Id), n)
+  if err == sql.ErrNoRows {
+    return ErrUserNotFound
+  }
+
+  return r.dialect.classify(err)
+}
+
+func (r *SQLRepository) UpdateUser(n *User) error {
+  if r.tx == nil {
+    return r.Transaction(func(tx UserRepository) error { return tx.UpdateUser(n) })
+  }
+
+  if err := n.normalize(); err != nil {
+    return err
+  }
+
+  // the client never decides the public id, which binds the encrypted values
+  if r.Keyring != nil {
+    if err := r.readPublicId(n); err != nil {
+      return err
+    }
+  }
+
+  // email_verified comes first, MySQL assigning the columns from left to right
+  // and the comparison needing the former email
+  values, err := r.userValues(n)
+  if err != nil {
+    return err
+  }
+
+  condition, versionParameters := versionCondition(n)
+  query := r.dialect.rebind(fmt.Sprintf("UPDATE {table} SET email_verified = CASE WHEN LOWER(email) = LOWER(?) THEN email_verified ELSE FALSE END, version = version + 1, updated_at = ?, %s = ? WHERE id = ? AND deleted_at IS NULL%s", strings.Join(userColumns, " = ?, "), condition))
+
+  fields := parameterFields(values)
+  fields["parameter_id"]      = n.Id
+  fields["parameter_version"] = n.Version
+  r.logQuery(query, fields)
+
+  updatedAt := time.Now().UTC().Truncate(time.Microsecond)
+
+  result, err := r.conn().Exec(query, append(append(append([]interface{}{n.Email, updatedAt}, values...), n.Id), versionParameters...)...)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  if err = r.expectOneRow(result); errors.Is(err, ErrUserNotFound) {
+    return r.missedVersion(n)
+  } else if err != nil {
+    return err
+  }
+
+  r.touch("{table}", "id", n.Id, false)
+
+  // the client never decides whether the email is verified
+  return r.refresh(n)
+}
+
+// versionCondition restricts a write to the version of n expected by the
+// caller, if any
+func versionCondition(n *User) (string, []interface{}) {
+  if n.Version == 0 {
+    return "", nil
+  }
+
+  return " AND version = ?", []interface{}{n.Version}
+}
+
+// missedVersion tells why a write restricted by versionCondition changed no
+// row: the user is missing, deleted, or at another version
+func (r *SQLRepository) missedVersion(n *User) error {
+  if n.Version == 0 {
+    return ErrUserNotFound
+  }
+
+  if err := r.GetUser(&User{Id: n.Id}); err != nil {
+    return err
+  }
+
+  return ErrVersionMismatch
+}
+
+// readPublicId sets the stored public id of the user n.Id
+func (r *SQLRepository) readPublicId(n *User) error {
+  query := r.dialect.rebind("SELECT public_id FROM {table} WHERE id = ?")
+
+  err := r.conn().QueryRow(query, n.Id).Scan(&n.PublicId)
+  if err == sql.ErrNoRows {
+    return ErrUserNotFound
+  }
+
+  return r.dialect.classify(err)
+}
+
+// refresh reads back the columns a write leaves to the storage
+func (r *SQLRepository) refresh(n *User) error {
+  query := r.dialect.rebind("SELECT email_verified, version, created_at, updated_at, public_id FROM {table} WHERE id = ?")
+
+  if err := r.conn().QueryRow(query, n.Id).Scan(&n.EmailVerified, &n.Version, &n.CreatedAt, &n.UpdatedAt, &n.PublicId); err != nil {
+    return r.dialect.classify(err)
+  }
+
+  n.CreatedAt, n.UpdatedAt = n.CreatedAt.UTC(), n.UpdatedAt.UTC()
+  return nil
+}
+
+func (r *SQLRepository) VerifyEmail(n *User) error {
+  if r.tx == nil {
+    return r.Transaction(func(tx UserRepository) error { return tx.VerifyEmail(n) })
+  }
+
+  query := r.dialect.rebind("UPDATE {table} SET email_verified = TRUE, version = version + 1, updated_at = ? WHERE id = ? AND email = ? AND deleted_at IS NULL")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id":    n.Id,
+    "parameter_email": n.Email,
+  })
+
+  result, err := r.conn().Exec(query, time.Now().UTC().Truncate(time.Microsecond), n.Id, n.Email)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  if err = r.expectOneRow(result); err == nil {
+    r.touch("{table}", "id", n.Id, false)
+    return r.refresh(n)
+  } else if !errors.Is(err, ErrUserNotFound) {
+    return err
+  }
+
+  // tell a deleted user from a changed email
+  if err = r.GetUser(&User{Id: n.Id}); err != nil {
+    return err
+  }
+
+  return ErrEmailChanged
+}
+
+func (r *SQLRepository) DeleteUser(n *User) error {
+  if r.tx == nil {
+    return r.Transaction(func(tx UserRepository) error { return tx.DeleteUser(n) })
+  }
+
+  condition, versionParameters := versionCondition(n)
+  query     := r.dialect.rebind("UPDATE {table} SET deleted_at = ?, version = version + 1, updated_at = ? WHERE id = ? AND deleted_at IS NULL" + condition)
+  deletedAt := time.Now().UTC().Truncate(time.Second)
+
+  r.logQuery(query, log.Fields{
+    "parameter_id":      n.Id,
+    "parameter_version": n.Version,
+  })
+
+  result, err := r.conn().Exec(query, append([]interface{}{deletedAt, time.Now().UTC().Truncate(time.Microsecond), n.Id}, versionParameters...)...)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  if err = r.expectOneRow(result); errors.Is(err, ErrUserNotFound) {
+    return r.missedVersion(n)
+  } else if err != nil {
+    return err
+  }
+
+  r.touch("{table}", "id", n.Id, false)
+
+  n.DeletedAt = &deletedAt
+  return r.refresh(n)
+}
+
+func (r *SQLRepository) RestoreUser(n *User) error {
+  if r.tx == nil {
+    return r.Transaction(func(tx UserRepository) error { return tx.RestoreUser(n) })
+  }
+
+  query := r.dialect.rebind("UPDATE {table} SET deleted_at = NULL, version = version + 1, updated_at = ? WHERE id = ? AND deleted_at IS NOT NULL")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": n.Id,
+  })
+
+  result, err := r.conn().Exec(query, time.Now().UTC().Truncate(time.Microsecond), n.Id)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  if err = r.expectOneRow(result); errors.Is(err, ErrUserNotFound) {
+    // tell a missing user from a user which is not deleted
+    return r.GetDeletedUser(n)
+  } else if err != nil {
+    return err
+  }
+
+  r.touch("{table}", "id", n.Id, false)
+  return r.GetUser(n)
+}
+
+// removeUser deletes the row of the user for good, whether it is deleted or
+// not
+func (r *SQLRepository) removeUser(n *User) error {
+  query := r.dialect.rebind("DELETE FROM {table} WHERE id = ?")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": n.Id,
+  })
+
+  result, err := r.conn().Exec(query, n.Id)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  return r.expectOneRow(result)
+}
+
+func (r *SQLRepository) PurgeUsers(before time.Time) (int, error) {
+  purged := int64(0)
+
+  err := r.Transaction(func(tx UserRepository) error {
+    t := tx.(*SQLRepository)
+
+    // the history and the remembered requests go first, while the purged
+    // users can still be told apart
+    for _, table := range []string{"user_history", "user_idempotency"} {
+      query := t.dialect.rebind("DELETE FROM " + table + " WHERE user_id IN (SELECT id FROM {table} WHERE deleted_at IS NOT NULL AND deleted_at < ?)")
+
+      t.logQuery(query, log.Fields{
+        "parameter_before": before,
+      })
+
+      if _, err := t.conn().Exec(query, before.UTC()); err != nil {
+        return t.dialect.classify(err)
+      }
+    }
+
+    query := t.dialect.rebind("DELETE FROM {table} WHERE deleted_at IS NOT NULL AND deleted_at < ?")
+    t.logQuery(query, log.Fields{})
+
+    result, err := t.conn().Exec(query, before.UTC())
+    if err != nil {
+      return t.dialect.classify(err)
+    }
+
+    purged, err = result.RowsAffected()
+    return t.dialect.classify(err)
+  })
+
+  return int(purged), err
+}
+
+func (r *SQLRepository) MergeUser(from *User, into *User) error {
+  return r.Transaction(func(tx UserRepository) error {
+    t := tx.(*SQLRepository)
+
+    // the merged user keeps its public id, for the clients which knew it
+    merged := User{Id: from.Id}
+    if err := t.GetUser(&merged); err != nil {
+      return err
+    }
+
+    if err := t.removeUser(from); err != nil {
+      return err
+    }
+
+    query := t.dialect.rebind("UPDATE user_merge SET into_id = ? WHERE into_id = ?")
+
+    t.logQuery(query, log.Fields{
+      "parameter_from": from.Id,
+      "parameter_into": into.Id,
+    })
+
+    if _, err := t.conn().Exec(query, into.Id, from.Id); err != nil {
+      return t.dialect.classify(err)
+    }
+
+    query = t.dialect.rebind("INSERT INTO user_merge (merged_id, into_id, merged_at, public_id) VALUES (?, ?, ?, ?)")
+    t.logQuery(query, log.Fields{})
+
+    if _, err := t.conn().Exec(query, from.Id, into.Id, time.Now().UTC().Truncate(time.Second), merged.PublicId); err != nil {
+      return t.dialect.classify(err)
+    }
+
+    t.touch("user_merge", "merged_id", from.Id, false)
+    return nil
+  })
+}
+
+func (r *SQLRepository) MergedInto(id int) (int, error) {
+  query := r.dialect.rebind("SELECT into_id FROM user_merge WHERE merged_id = ?")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": id,
+  })
+
+  into := 0
+
+  err := r.conn().QueryRow(query, id).Scan(&into)
+  if err == sql.ErrNoRows {
+    return 0, ErrUserNotFound
+  }
+
+  return into, r.dialect.classify(err)
+}
+
+func (r *SQLRepository) MergedUsers(id int) ([]MergedUser, error) {
+  query := r.dialect.rebind("SELECT m.merged_id, COALESCE(m.public_id, ''), m.into_id, " + publicIdExpression("m.into_id") + ", m.merged_at FROM user_merge m WHERE m.into_id = ? ORDER BY m.merged_id")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": id,
+  })
+
+  rows, err := r.conn().Query(query, id)
+  if err != nil {
+    return nil, r.dialect.classify(err)
+  }
+
+  defer rows.Close()
+
+  merged := []MergedUser{}
+  for rows.Next() {
+    m := MergedUser{}
+    if err = rows.Scan(&m.Id, &m.PublicId, &m.IntoId, &m.IntoPublicId, &m.MergedAt); err != nil {
+      return nil, r.dialect.classify(err)
+    }
+
+    merged = append(merged, m)
+  }
+
+  return merged, r.dialect.classify(rows.Err())
+}
+
+func (r *SQLRepository) EraseUser(n *User, receipt *Erasure) error {
+  return r.Transaction(func(tx UserRepository) error {
+    t := tx.(*SQLRepository)
+
+    // the public id is not personal data, it is kept so that it still
+    // resolves to the erasure
+    publicId := sql.NullString{}
+
+    query := t.dialect.rebind("SELECT public_id FROM {table} WHERE id = ?")
+    if err := t.conn().QueryRow(query, n.Id).Scan(&publicId); err != nil && err != sql.ErrNoRows {
+      return t.dialect.classify(err)
+    }
+
+    // deleted users are erased too, their data being still held
+    if err := t.removeUser(n); err != nil {
+      return err
+    }
+
+    // the users merged into n were the same person
+    for _, table := range []string{"user_history", "user_idempotency"} {
+      query := t.dialect.rebind("DELETE FROM " + table + " WHERE user_id = ? OR user_id IN (SELECT merged_id FROM user_merge WHERE into_id = ?)")
+
+      t.logQuery(query, log.Fields{
+        "parameter_id": n.Id,
+      })
+
+      if _, err := t.conn().Exec(query, n.Id, n.Id); err != nil {
+        return t.dialect.classify(err)
+      }
+    }
+
+    receipt.UserId   = n.Id
+    receipt.PublicId = publicId.String
+    receipt.ErasedAt = time.Now().UTC().Truncate(time.Second)
+
+    query = t.dialect.rebind("INSERT INTO user_erasure (user_id, requester, reason, erased_at, public_id) VALUES (?, ?, ?, ?, ?)")
+
+    t.logQuery(query, log.Fields{
+      "parameter_id": n.Id,
+      "parameter_requester": receipt.Requester,
+    })
+
+    if _, err := t.conn().Exec(query, receipt.UserId, receipt.Requester, receipt.Reason, receipt.ErasedAt, publicId); err != nil {
+      return t.dialect.classify(err)
+    }
+
+    t.touch("user_erasure", "user_id", n.Id, false)
+    return nil
+  })
+}
+
+func (r *SQLRepository) ErasedUser(id int) (Erasure, error) {
+  query := r.dialect.rebind("SELECT user_id, COALESCE(public_id, ''), requester, reason, erased_at FROM user_erasure WHERE user_id = ?")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": id,
+  })
+
+  receipt := Erasure{}
+
+  err := r.conn().QueryRow(query, id).Scan(&receipt.UserId, &receipt.PublicId, &receipt.Requester, &receipt.Reason, &receipt.ErasedAt)
+  if err == sql.ErrNoRows {
+    return receipt, ErrUserNotFound
+  }
+
+  return receipt, r.dialect.classify(err)
+}
+
+func (r *SQLRepository) UserIdOf(publicId string) (int, error) {
+  query := r.dialect.rebind("SELECT id FROM {table} WHERE public_id = ? UNION ALL SELECT merged_id FROM user_merge WHERE public_id = ? UNION ALL SELECT user_id FROM user_erasure WHERE public_id = ?")
+
+  r.logQuery(query, log.Fields{
+    "parameter_public_id": publicId,
+  })
+
+  id := 0
+
+  err := r.conn().QueryRow(query, publicId, publicId, publicId).Scan(&id)
+  if err == sql.ErrNoRows {
+    return 0, ErrUserNotFound
+  }
+
+  return id, r.dialect.classify(err)
+}
+
+// publicIdExpression is the SQL expression of the public id of the user whose
+// id is given by the expression id, which its merge or erasure keeps once the
+// user is gone, '' when it has none
+func publicIdExpression(id string) string {
+  return fmt.Sprintf("COALESCE((SELECT public_id FROM {table} WHERE id = %[1]s), (SELECT public_id FROM user_merge WHERE merged_id = %[1]s), (SELECT public_id FROM user_erasure WHERE user_id = %[1]s), '')", id)
+}
+
+// publicIdOf returns the public id of the user id, see publicIdExpression
+func (r *SQLRepository) publicIdOf(id int) (string, error) {
+  query := r.dialect.rebind("SELECT " + publicIdExpression("?"))
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": id,
+  })
+
+  publicId := ""
+  err := r.conn().QueryRow(query, id, id, id).Scan(&publicId)
+
+  return publicId, r.dialect.classify(err)
+}
+
+// historyColumns are the columns of a change, in the order of scanChange
+var historyColumns = "id, user_id, action, actor, request_id, changed_at, key_id, before_state, after_state"
+
+// encodeState stores a state of a change as JSON, encrypted when a keyring is
+// set, NULL standing for no user
+func (r *SQLRepository) encodeState(column string, row string, n *User) (sql.NullString, error) {
+  if n == nil {
+    return sql.NullString{}, nil
+  }
+
+  state, err := json.Marshal(n)
+  if err != nil {
+    return sql.NullString{}, InternalError(err)
+  }
+
+  if r.Keyring == nil {
+    return sql.NullString{String: string(state), Valid: true}, nil
+  }
+
+  ciphertext, err := r.Keyring.Encrypt(column, row, string(state))
+  if err != nil {
+    return sql.NullString{}, InternalError(err)
+  }
+
+  return sql.NullString{String: ciphertext, Valid: true}, nil
+}
+
+// decodeState reads a state stored by encodeState, which leaves out the id of
+// the user as its JSON form does
+func (r *SQLRepository) decodeState(keyId string, column string, row string, id int, state sql.NullString) (*User, error) {
+  if !state.Valid {
+    return nil, nil
+  }
+
+  if keyId != "" {
+    if r.Keyring == nil {
+      return nil, InternalError(fmt.Errorf("%s is encrypted with key %s but no keyring is configured", column, keyId))
+    }
+
+    plaintext, err := r.Keyring.Decrypt(keyId, column, row, state.String)
+    if err != nil {
+      return nil, InternalError(err)
+    }
+
+    state.String = plaintext
+  }
+
+  n := &User{}
+  if err := json.Unmarshal([]byte(state.String), n); err != nil {
+    return nil, InternalError(err)
+  }
+
+  n.Id = id
+  return n, nil
+}
+
+// historyRow binds the encrypted states of a change to its user, the id of the
+// change being unknown until it is inserted
+func historyRow(userId int) string {
+  return strconv.Itoa(userId)
+}
+
+// scanChange reads a row of historyColumns into c, decrypting its states
+func (r *SQLRepository) scanChange(row scanner, c *Change) error {
+  keyId, before, after := "", sql.NullString{}, sql.NullString{}
+
+  err := row.Scan(&c.Id, &c.UserId, &c.Action, &c.Actor, &c.RequestId, &c.ChangedAt, &keyId, &before, &after)
+  if err != nil {
+    return err
+  }
+
+  c.ChangedAt = c.ChangedAt.UTC()
+
+  if c.Before, err = r.decodeState(keyId, "before_state", historyRow(c.UserId), c.UserId, before); err != nil {
+    return err
+  }
+
+  c.After, err = r.decodeState(keyId, "after_state", historyRow(c.UserId), c.UserId, after)
+  return err
+}
+
+func (r *SQLRepository) RecordChange(c *Change) error {
+  c.ChangedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+  before, err := r.encodeState("before_state", historyRow(c.UserId), c.Before)
+  if err != nil {
+    return err
+  }
+
+  after, err := r.encodeState("after_state", historyRow(c.UserId), c.After)
+  if err != nil {
+    return err
+  }
+
+  keyId := ""
+  if r.Keyring != nil {
+    keyId = r.Keyring.Primary
+  }
+
+  query  := r.dialect.rebind("INSERT INTO user_history (user_id, action, actor, request_id, changed_at, key_id, before_state, after_state) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+  values := []interface{}{c.UserId, c.Action, c.Actor, c.RequestId, c.ChangedAt, keyId, before, after}
+
+  r.logQuery(query, log.Fields{
+    "parameter_user_id": c.UserId,
+    "parameter_action": c.Action,
+    "parameter_actor": c.Actor,
+  })
+
+  if r.dialect.Returning {
+    return r.dialect.classify(r.conn().QueryRow(query + " RETURNING id", values...).Scan(&c.Id))
+  }
+
+  result, err := r.conn().Exec(query, values...)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  id, err := result.LastInsertId()
+  c.Id = int(id)
+
+  return r.dialect.classify(err)
+}
+
+func (r *SQLRepository) History(id int) ([]Change, error) {
+  publicId, err := r.publicIdOf(id)
+  if err != nil {
+    return nil, err
+  }
+
+  query := r.dialect.rebind("SELECT " + historyColumns + " FROM user_history WHERE user_id = ? ORDER BY id")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": id,
+  })
+
+  rows, err := r.conn().Query(query, id)
+  if err != nil {
+    return nil, r.dialect.classify(err)
+  }
+
+  defer rows.Close()
+
+  history := []Change{}
+  for rows.Next() {
+    c := Change{UserPublicId: publicId}
+    if err = r.scanChange(rows, &c); err != nil {
+      return nil, r.dialect.classify(err)
+    }
+
+    history = append(history, c)
+  }
+
+  return history, r.dialect.classify(rows.Err())
+}
+
+func (r *SQLRepository) Deltas(token SyncToken, limit int) ([]Delta, error) {
+  // each source is read up to limit, sortDeltas keeping the first of them all
+  users, err := r.readDeltas(fmt.Sprintf("SELECT %s, sequence, COALESCE(created_sequence, 0) FROM {table} WHERE sequence > ? ORDER BY sequence LIMIT %d", selectColumns, limit), token.Position, func(rows *sql.Rows) (Delta, error) {
+    n := User{}
+    err := r.scanUser(sequenceScanner{rows, []interface{}{&n.sequence, &n.createdSequence}}, &n)
+    return userDelta(n, token.Since), err
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  merges, err := r.readDeltas(fmt.Sprintf("SELECT m.merged_id, COALESCE(m.public_id, ''), m.into_id, %s, m.merged_at, m.sequence FROM user_merge m WHERE m.sequence > ? ORDER BY m.sequence LIMIT %d", publicIdExpression("m.into_id"), limit), token.Position, func(rows *sql.Rows) (Delta, error) {
+    m := MergedUser{}
+    err := rows.Scan(&m.Id, &m.PublicId, &m.IntoId, &m.IntoPublicId, &m.MergedAt, &m.sequence)
+    return mergeDelta(m), err
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  erasures, err := r.readDeltas(fmt.Sprintf("SELECT user_id, COALESCE(public_id, ''), erased_at, sequence FROM user_erasure WHERE sequence > ? ORDER BY sequence LIMIT %d", limit), token.Position, func(rows *sql.Rows) (Delta, error) {
+    e := Erasure{}
+    err := rows.Scan(&e.UserId, &e.PublicId, &e.ErasedAt, &e.sequence)
+    return erasureDelta(e), err
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  return sortDeltas(append(append(users, merges...), erasures...), limit), nil
+}
+
+// sequenceScanner scans the columns of a row after the ones of a user into
+// extra
+type sequenceScanner struct {
+  row   scanner
+  extra []interface{}
+}
+
+func (s sequenceScanner) Scan(dest ...interface{}) error {
+  return s.row.Scan(append(dest, s.extra...)...)
+}
+
+// readDeltas runs a query of Deltas, scanning each row into a delta
+func (r *SQLRepository) readDeltas(query string, after int64, scan func(rows *sql.Rows) (Delta, error)) ([]Delta, error) {
+  query = r.dialect.rebind(query)
+
+  r.logQuery(query, log.Fields{
+    "parameter_after": after,
+  })
+
+  rows, err := r.conn().Query(query, after)
+  if err != nil {
+    return nil, r.dialect.classify(err)
+  }
+
+  defer rows.Close()
+
+  deltas := []Delta{}
+  for rows.Next() {
+    delta, err := scan(rows)
+    if err != nil {
+      return nil, r.dialect.classify(err)
+    }
+
+    delta.ChangedAt = delta.ChangedAt.UTC()
+    deltas = append(deltas, delta)
+  }
+
+  return deltas, r.dialect.classify(rows.Err())
+}
+
+func (r *SQLRepository) RememberRequest(req *IdempotentRequest) error {
+  return r.Transaction(func(tx UserRepository) error {
+    t := tx.(*SQLRepository)
+
+    // an expired request gives way to the new one
+    query := t.dialect.rebind("DELETE FROM user_idempotency WHERE idempotency_key = ? AND expires_at <= ?")
+
+    t.logQuery(query, log.Fields{
+      "parameter_key": req.Key,
+    })
+
+    if _, err := t.conn().Exec(query, req.Key, time.Now().UTC()); err != nil {
+      return t.dialect.classify(err)
+    }
+
+    state, err := t.encodeState("user_state", req.Key, req.User)
+    if err != nil {
+      return err
+    }
+
+    keyId := ""
+    if t.Keyring != nil {
+      keyId = t.Keyring.Primary
+    }
+
+    query = t.dialect.rebind("INSERT INTO user_idempotency (idempotency_key, fingerprint, user_id, key_id, user_state, expires_at) VALUES (?, ?, ?, ?, ?, ?)")
+
+    t.logQuery(query, log.Fields{
+      "parameter_key": req.Key,
+      "parameter_user_id": req.User.Id,
+    })
+
+    _, err = t.conn().Exec(query, req.Key, req.Fingerprint, req.User.Id, keyId, state, req.ExpiresAt.UTC())
+    if err = t.dialect.classify(err); err != nil && KindOf(err) == KindConflict {
+      return ErrIdempotencyKeyTaken
+    }
+
+    return err
+  })
+}
+
+func (r *SQLRepository) RememberedRequest(key string) (IdempotentRequest, error) {
+  query := r.dialect.rebind("SELECT idempotency_key, fingerprint, user_id, key_id, user_state, expires_at FROM user_idempotency WHERE idempotency_key = ? AND expires_at > ?")
+
+  r.logQuery(query, log.Fields{
+    "parameter_key": key,
+  })
+
+  req, userId, keyId, state := IdempotentRequest{}, 0, "", sql.NullString{}
+
+  err := r.conn().QueryRow(query, key, time.Now().UTC()).Scan(&req.Key, &req.Fingerprint, &userId, &keyId, &state, &req.ExpiresAt)
+  if err == sql.ErrNoRows {
+    return req, ErrIdempotencyKeyNotFound
+  }
+  if err != nil {
+    return req, r.dialect.classify(err)
+  }
+
+  req.User, err = r.decodeState(keyId, "user_state", req.Key, userId, state)
+  return req, err
+}
+
+func (r *SQLRepository) RememberedRequestsOf(id int) ([]IdempotentRequest, error) {
+  query := r.dialect.rebind("SELECT idempotency_key, fingerprint, user_id, key_id, user_state, expires_at FROM user_idempotency WHERE user_id = ? OR user_id IN (SELECT merged_id FROM user_merge WHERE into_id = ?) ORDER BY idempotency_key")
+
+  r.logQuery(query, log.Fields{
+    "parameter_id": id,
+  })
+
+  rows, err := r.conn().Query(query, id, id)
+  if err != nil {
+    return nil, r.dialect.classify(err)
+  }
+
+  defer rows.Close()
+
+  requests := []IdempotentRequest{}
+  for rows.Next() {
+    req, userId, keyId, state := IdempotentRequest{}, 0, "", sql.NullString{}
+    if err = rows.Scan(&req.Key, &req.Fingerprint, &userId, &keyId, &state, &req.ExpiresAt); err != nil {
+      return nil, r.dialect.classify(err)
+    }
+
+    if req.User, err = r.decodeState(keyId, "user_state", req.Key, userId, state); err != nil {
+      return nil, err
+    }
+
+    req.ExpiresAt = req.ExpiresAt.UTC()
+    requests = append(requests, req)
+  }
+
+  return requests, r.dialect.classify(rows.Err())
+}
+
+func (r *SQLRepository) ForgetRequests(before time.Time) (int, error) {
+  query := r.dialect.rebind("DELETE FROM user_idempotency WHERE expires_at < ?")
+
+  r.logQuery(query, log.Fields{
+    "parameter_before": before,
+  })
+
+  result, err := r.conn().Exec(query, before.UTC())
+  if err != nil {
+    return 0, r.dialect.classify(err)
+  }
+
+  forgotten, err := result.RowsAffected()
+  return int(forgotten), r.dialect.classify(err)
+}
+
+// expectOneRow reports a missing user when a statement targeting a single id
+// matched nothing
+func (r *SQLRepository) expectOneRow(result sql.Result) error {
+  affected, err := result.RowsAffected()
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+
+  if affected == 0 {
+    return ErrUserNotFound
+  }
+
+  return nil
+}
+
+// filterSQL renders a filter. Encrypted columns can neither be compared nor
+// sorted, but phones are matched on their blind index.
+func (r *SQLRepository) filterSQL(f Filter) (string, []interface{}, error) {
+  if r.Keyring == nil || !isEncrypted(f.Field.Column) {
+    condition, values := f.sql(r.dialect)
+    return condition, values, nil
+  }
+
+  if f.Field.Column != "phone" {
+    return "", nil, ValidationError("invalid_parameter", "%s is encrypted at rest, it cannot be filtered on", f.Field.Name)
+  }
+
+  if f.Operator != OperatorEqual && f.Operator != OperatorIn {
+    return "", nil, ValidationError("invalid_parameter", "%s is encrypted at rest, it only accepts eq and in filters", f.Field.Name)
+  }
+
+  placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(f.Values)), ", ")
+  indexes      := []interface{}{}
+  phones       := []interface{}{}
+
+  for _, value := range f.Values {
+    indexes = append(indexes, r.Keyring.BlindIndex(value))
+    phones  = append(phones, value)
+  }
+
+  // rows written before the keyring was set hold their phone in clear
+  return fmt.Sprintf("(phone_index IN (%s) OR (key_id = '' AND phone IN (%s)))", placeholders, placeholders), append(indexes, phones...), nil
+}
+
+// whereSQL renders the filters of the query, and the keyset condition when
+// withCursor is set, as a WHERE clause
+func (r *SQLRepository) whereSQL(q PageQuery, withCursor bool) (string, []interface{}, error) {
+  conditions := []string{}
+  args       := []interface{}{}
+
+  if !q.IncludeDeleted {
+    conditions = append(conditions, "deleted_at IS NULL")
+  }
+
+  for _, filter := range q.Filters {
+    condition, values, err := r.filterSQL(filter)
+    if err != nil {
+      return "", nil, err
+    }
+
+    conditions = append(conditions, condition)
+    args       = append(args, values...)
+  }
+
+  if withCursor && len(q.Cursor.Values) > 0 {
+    condition, values := keysetSQL(r.dialect, orderKeys(q.Sort), q.Cursor)
+    conditions = append(conditions, condition)
+    args       = append(args, values...)
+  }
+
+  if len(conditions) == 0 {
+    return "", args, nil
+  }
+
+  return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// orderSQL renders the ORDER BY clause of the query
+func (r *SQLRepository) orderSQL(q PageQuery, backward bool) (string, error) {
+  for _, key := range q.Sort {
+    if r.Keyring != nil && isEncrypted(key.Field.Column) {
+      return "", ValidationError("invalid_parameter", "cannot sort on %s, it is encrypted at rest", key.Field.Name)
+    }
+  }
+
+  return orderSQL(r.dialect, orderKeys(q.Sort), backward), nil
+}
+
+func (r *SQLRepository) ListUsers(q PageQuery) (Page, error) {
+  where, args, err := r.whereSQL(q, true)
+  if err != nil {
+    return Page{}, err
+  }
+
+  order, err := r.orderSQL(q, q.Cursor.Backward)
+  if err != nil {
+    return Page{}, err
+  }
+
+  query := r.dialect.rebind(fmt.Sprintf("SELECT %s FROM {table} %s ORDER BY %s LIMIT %d", selectColumns, where, order, q.Limit + 1))
+
+  r.logQuery(query, log.Fields{
+    "parameters": args,
+    "parameter_limit": q.Limit,
+  })
+
+  selDB, err := r.conn().Query(query, args...)
+  if err != nil {
+    return Page{}, r.dialect.classify(err)
+  }
+  defer selDB.Close()
+
+  users := []User{}
+
+  for selDB.Next() {
+    user := User{}
+
+    err = r.scanUser(selDB, &user)
+    if err != nil {
+      return Page{}, r.dialect.classify(err)
+    }
+
+    users = append(users, user)
+  }
+
+  if err = selDB.Err(); err != nil {
+    return Page{}, r.dialect.classify(err)
+  }
+
+  page := newPage(q, users)
+
+  if q.WithTotal {
+    total := 0
+    where, args, _ := r.whereSQL(q, false)
+
+    if err = r.conn().QueryRow(r.dialect.rebind("SELECT COUNT(*) FROM {table} " + where), args...).Scan(&total); err != nil {
+      return Page{}, r.dialect.classify(err)
+    }
+
+    page.Total = &total
+  }
+
+  return page, nil
+}
+
+// ScanUsers streams the rows straight from the database cursor, which holds a
+// connection until the last row is read
+func (r *SQLRepository) ScanUsers(q PageQuery, fn func(n *User) error) error {
+  where, args, err := r.whereSQL(q, false)
+  if err != nil {
+    return err
+  }
+
+  order, err := r.orderSQL(q, false)
+  if err != nil {
+    return err
+  }
+
+  query := r.dialect.rebind(fmt.Sprintf("SELECT %s FROM {table} %s ORDER BY %s", selectColumns, where, order))
+
+  r.logQuery(query, log.Fields{
+    "parameters": args,
+  })
+
+  selDB, err := r.conn().Query(query, args...)
+  if err != nil {
+    return r.dialect.classify(err)
+  }
+  defer selDB.Close()
+
+  for selDB.Next() {
+    user := User{}
+
+    if err = r.scanUser(selDB, &user); err != nil {
+      return r.dialect.classify(err)
+    }
+
+    if err = fn(&user); err != nil {
+      return err
+    }
+  }
+
+  if err = selDB.Err(); err != nil {
+    return r.dialect.classify(err)
+  }
+
+  return nil
+}
+
+// -------------------------------------------------------------------------- //
+// 3. Change sequence
+// -------------------------------------------------------------------------- //
+
+// changedRow is a row whose sequence is set when its transaction commits,
+// along with its created_sequence when it was created
+type changedRow struct {
+  table   string
+  key     string
+  id      int
+  created bool
+}
+
+// touch lists a row changed by the transaction. Every write of a user, merge
+// or erasure runs in a transaction for it.
+func (r *SQLRepository) touch(table string, key string, id int, created bool) {
+  r.changed = append(r.changed, changedRow{table: table, key: key, id: id, created: created})
+}
+
+// stamp gives the rows changed by the transaction the next positions in the
+// stream of the changes, right before it commits. The row of
+// user_change_counter stays locked until then, so that the positions follow
+// the order of the commits, and it is the last lock taken, so that no
+// transaction holding it waits for another one.
+func (r *SQLRepository) stamp() error {
+  if len(r.changed) == 0 {
+    return nil
+  }
+
+  query := "UPDATE user_change_counter SET value = value + " + strconv.Itoa(len(r.changed))
+  r.logQuery(query, log.Fields{})
+
+  if _, err := r.tx.Exec(query); err != nil {
+    return r.dialect.classify(err)
+  }
+
+  last := int64(0)
+  if err := r.tx.QueryRow("SELECT value FROM user_change_counter").Scan(&last); err != nil {
+    return r.dialect.classify(err)
+  }
+
+  sequence := last - int64(len(r.changed))
+
+  for _, row := range r.changed {
+    sequence++
+
+    query := "UPDATE " + row.table + " SET sequence = ? WHERE " + row.key + " = ?"
+    parameters := []interface{}{sequence, row.id}
+
+    if row.created {
+      query      = "UPDATE " + row.table + " SET sequence = ?, created_sequence = ? WHERE " + row.key + " = ?"
+      parameters = []interface{}{sequence, sequence, row.id}
+    }
+
+    query = r.dialect.rebind(query)
+
+    r.logQuery(query, log.Fields{
+      "parameter_id": row.id,
+      "parameter_sequence": sequence,
+    })
+
+    if _, err := r.tx.Exec(query, parameters...); err != nil {
+      return r.dialect.classify(err)
+    }
+  }
+
+  r.changed = nil
+  return nil
+}
@@ -0,0 +1,55 @@
+package user
+
+import (
+  driver  "database/sql/driver"
+  errors  "errors"
+  sql     "database/sql"
+  sqlite  "modernc.org/sqlite"
+  lib     "modernc.org/sqlite/lib"
+  strings "strings"
+)
+
+// the lower() of SQLite only folds ASCII letters, the case-insensitive filters
+// fold every letter as the other backends do
+func init() {
+  sqlite.MustRegisterDeterministicScalarFunction("lower", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+    if text, ok := args[0].(string); ok {
+      return strings.ToLower(text), nil
+    }
+
+    return args[0], nil
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. SQLite dialect
+// -------------------------------------------------------------------------- //
+
+var sqliteDialect = dialect{
+  Name:     "sqlite",
+  Table:    `"user"`,
+  Classify: func(err error) error {
+    var sqliteErr *sqlite.Error
+    if !errors.As(err, &sqliteErr) {
+      return nil
+    }
+
+    switch sqliteErr.Code() {
+    case lib.SQLITE_CONSTRAINT_UNIQUE, lib.SQLITE_CONSTRAINT_PRIMARYKEY:
+      if strings.Contains(sqliteErr.Error(), "user_email") {
+        return EmailTakenError(err)
+      }
+      return &Error{Kind: KindConflict, Code: "user_conflict", Message: "user already exists", Err: err}
+    case lib.SQLITE_BUSY, lib.SQLITE_LOCKED:
+      return TransactionConflictError(err)
+    case lib.SQLITE_CANTOPEN:
+      return UnavailableError(err)
+    }
+
+    return nil
+  },
+}
+
+func NewSQLiteRepository(db *sql.DB) *SQLRepository {
+  return &SQLRepository{DB: db, dialect: sqliteDialect}
+}
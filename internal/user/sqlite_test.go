@@ -0,0 +1,100 @@
+package user
+
+import (
+  errors  "errors"
+  fmt     "fmt"
+  path    "path/filepath"
+  sql     "database/sql"
+  testing "testing"
+)
+
+// newTestSQLiteRepository migrates a SQLite database in a temporary directory,
+// opened as the server opens it
+func newTestSQLiteRepository(t *testing.T) *SQLRepository {
+  t.Helper()
+
+  db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_time_format=sqlite&_timezone=UTC", path.Join(t.TempDir(), "needys.db")))
+  if err != nil {
+    t.Fatal(err)
+  }
+  db.SetMaxOpenConns(1)
+  t.Cleanup(func() { db.Close() })
+
+  r := NewSQLiteRepository(db)
+  if _, err = r.MigrateUp(); err != nil {
+    t.Fatal(err)
+  }
+
+  return r
+}
+
+func TestSQLiteRepositoryCRUD(t *testing.T) {
+  var users UserRepository = newTestSQLiteRepository(t)
+
+  n := User{Firstname: "Guillaume", Lastname: "Penaud"}
+  if err := users.CreateUser(&n); err != nil {
+    t.Fatal(err)
+  }
+  if n.Id != 1 || n.Version != 1 || n.PublicId == "" {
+    t.Fatalf("unexpected created user %+v", n)
+  }
+
+  n.Lastname = "Martin"
+  if err := users.UpdateUser(&n); err != nil {
+    t.Fatal(err)
+  }
+
+  found := User{Id: n.Id}
+  if err := users.GetUser(&found); err != nil {
+    t.Fatal(err)
+  }
+  if found.Lastname != "Martin" || found.Version != 2 || !found.CreatedAt.Equal(n.CreatedAt) {
+    t.Errorf("GetUser = %+v, want %+v", found, n)
+  }
+
+  if err := users.DeleteUser(&found); err != nil {
+    t.Fatal(err)
+  }
+  if err := users.GetUser(&User{Id: n.Id}); !errors.Is(err, ErrUserNotFound) {
+    t.Errorf("GetUser of a deleted user = %v, want %v", err, ErrUserNotFound)
+  }
+  if err := users.UpdateUser(&User{Id: 42, Firstname: "Guillaume", Lastname: "Penaud"}); !errors.Is(err, ErrUserNotFound) {
+    t.Errorf("UpdateUser of an unknown user = %v, want %v", err, ErrUserNotFound)
+  }
+}
+
+func TestSQLiteRepositoryTransaction(t *testing.T) {
+  users := newTestSQLiteRepository(t)
+  failure := errors.New("failure")
+
+  err := users.Transaction(func(tx UserRepository) error {
+    if err := tx.CreateUser(&User{Firstname: "Guillaume", Lastname: "Penaud"}); err != nil {
+      return err
+    }
+
+    return failure
+  })
+  if err != failure {
+    t.Fatalf("Transaction = %v, want %v", err, failure)
+  }
+
+  page, err := users.ListUsers(PageQuery{Limit: 10})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(page.Users) != 0 {
+    t.Errorf("the rolled back users are stored: %+v", page.Users)
+  }
+}
+
+func TestSQLiteLower(t *testing.T) {
+  users := newTestSQLiteRepository(t)
+
+  var lower string
+  if err := users.DB.QueryRow("SELECT lower('ÉLODIE Ørsted')").Scan(&lower); err != nil {
+    t.Fatal(err)
+  }
+  if lower != "élodie ørsted" {
+    t.Errorf("lower('ÉLODIE Ørsted') = %q, want %q", lower, "élodie ørsted")
+  }
+}
@@ -0,0 +1,47 @@
+package user
+
+import (
+  errors "errors"
+  log    "github.com/sirupsen/logrus"
+  time   "time"
+)
+
+var transactionLog *log.Entry
+
+func init() {
+  transactionLog = log.WithFields(log.Fields{
+    "_file": "internal/user/transaction.go",
+    "_type": "data",
+  })
+}
+
+// -------------------------------------------------------------------------- //
+// 1. Retried transactions
+// -------------------------------------------------------------------------- //
+
+const TransactionAttempts = 3
+
+var transactionConflict = &Error{Code: "transaction_conflict"}
+
+// RunTransaction runs fn in a transaction, starting it over with a growing
+// delay when it fails on a deadlock or a serialization conflict
+func RunTransaction(users UserRepository, fn func(tx UserRepository) error) error {
+  var err error
+
+  for attempt := 1; attempt <= TransactionAttempts; attempt++ {
+    if err = users.Transaction(fn); !errors.Is(err, transactionConflict) {
+      return err
+    }
+
+    transactionLog.WithFields(log.Fields{
+      "attempt": attempt,
+      "error": err,
+    }).Warn("transaction conflict")
+
+    if attempt < TransactionAttempts {
+      time.Sleep(time.Duration(attempt * 50) * time.Millisecond)
+    }
+  }
+
+  return err
+}
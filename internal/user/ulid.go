@@ -0,0 +1,149 @@
+package user
+
+import (
+  rand    "crypto/rand"
+  binary  "encoding/binary"
+  bytes   "bytes"
+  log     "github.com/sirupsen/logrus"
+  sql     "database/sql"
+  strings "strings"
+  sync    "sync"
+  time    "time"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Public ids
+// -------------------------------------------------------------------------- //
+
+// The public id of a user is a ULID: 48 bits of milliseconds since the epoch,
+// so that public ids sort by creation, then 80 random bits, so that they
+// cannot be guessed from one another. It is written in Crockford's base32.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const ULIDLength = 26
+
+// lastULID is the last ULID issued. The next one of the same millisecond is
+// a random step above it rather than random, so that the users created in a
+// burst still sort in their order of creation, the public id being the last
+// key of every listing order.
+var lastULID struct {
+  sync.Mutex
+  id [16]byte
+}
+
+// NewULID returns a new ULID dated at the given time
+func NewULID(at time.Time) string {
+  var id [16]byte
+
+  var milliseconds [8]byte
+  binary.BigEndian.PutUint64(milliseconds[:], uint64(at.UnixMilli()))
+  copy(id[:6], milliseconds[2:])
+
+  rand.Read(id[6:])
+
+  lastULID.Lock()
+  if bytes.Equal(id[:6], lastULID.id[:6]) {
+    // a step of at most 2^32, which leaves room for billions of ULIDs in the
+    // millisecond: past the last one, the ULID is random again
+    step := uint64(binary.BigEndian.Uint32(id[12:])) + 1
+    next := lastULID.id
+
+    for i := len(next) - 1; i >= 6 && step > 0; i-- {
+      sum    := uint64(next[i]) + step & 0xff
+      next[i] = byte(sum)
+      step    = step >> 8 + sum >> 8
+    }
+
+    if step == 0 {
+      id = next
+    }
+  }
+  lastULID.id = id
+  lastULID.Unlock()
+
+  // the 128 bits are read 5 at a time, after 2 leading zero bits
+  encoded := make([]byte, ULIDLength)
+  for i := range encoded {
+    value := 0
+    for bit := 5 * i - 2; bit < 5 * i + 3; bit++ {
+      value <<= 1
+      if bit >= 0 && id[bit / 8] & (0x80 >> (bit % 8)) != 0 {
+        value |= 1
+      }
+    }
+
+    encoded[i] = crockford[value]
+  }
+
+  return string(encoded)
+}
+
+// ParseULID returns the canonical, upper case form of a ULID, and false when
+// the value is not one
+func ParseULID(value string) (string, bool) {
+  value = strings.ToUpper(value)
+
+  // the first character only holds 3 bits
+  if len(value) != ULIDLength || value[0] > '7' {
+    return "", false
+  }
+
+  for _, c := range value {
+    if !strings.ContainsRune(crockford, c) {
+      return "", false
+    }
+  }
+
+  return value, true
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Migration
+// -------------------------------------------------------------------------- //
+
+// assignPublicIds gives a public id to the users created before public ids,
+// dated from their creation. Merged and erased users are left without one,
+// the clients never knew them by it.
+func assignPublicIds(tx *sql.Tx, d dialect) error {
+  rows, err := tx.Query(d.rebind("SELECT id, created_at FROM {table} WHERE public_id IS NULL"))
+  if err != nil {
+    return err
+  }
+
+  createdAt := map[int]time.Time{}
+
+  for rows.Next() {
+    var id int
+    var created sql.NullTime
+
+    if err = rows.Scan(&id, &created); err != nil {
+      rows.Close()
+      return err
+    }
+
+    createdAt[id] = created.Time
+    if !created.Valid {
+      createdAt[id] = time.Now()
+    }
+  }
+
+  rows.Close()
+
+  if err = rows.Err(); err != nil {
+    return err
+  }
+
+  update := d.rebind("UPDATE {table} SET public_id = ? WHERE id = ?")
+
+  for id, at := range createdAt {
+    if _, err = tx.Exec(update, NewULID(at), id); err != nil {
+      return err
+    }
+  }
+
+  migrationLog.WithFields(log.Fields{
+    "users": len(createdAt),
+  }).Info("public ids are assigned")
+
+  return nil
+}
@@ -0,0 +1,103 @@
+package user
+
+import (
+  strings "strings"
+  testing "testing"
+  time    "time"
+)
+
+// ulidTime decodes the milliseconds of a ULID, held by its first 10
+// characters
+func ulidTime(id string) time.Time {
+  milliseconds := int64(0)
+  for _, c := range id[:10] {
+    milliseconds = milliseconds << 5 | int64(strings.IndexRune(crockford, c))
+  }
+
+  return time.UnixMilli(milliseconds)
+}
+
+func TestNewULID(t *testing.T) {
+  at := time.Date(2024, 4, 2, 10, 0, 0, 123000000, time.UTC)
+
+  id := NewULID(at)
+  if parsed, ok := ParseULID(id); !ok || parsed != id {
+    t.Fatalf("NewULID = %q, which ParseULID reads as %q, %t", id, parsed, ok)
+  }
+  if !ulidTime(id).Equal(at) {
+    t.Errorf("NewULID(%s) is dated %s", at, ulidTime(id))
+  }
+
+  if other := NewULID(at); other == id || other[:10] != id[:10] {
+    t.Errorf("two ULIDs of the same time are %s and %s", id, other)
+  }
+  if later := NewULID(at.Add(time.Millisecond)); later <= id {
+    t.Errorf("a later ULID %s sorts before %s", later, id)
+  }
+
+  // the ULIDs of a same millisecond sort in the order they are issued
+  previous := NewULID(at)
+  for i := 0; i < 1000; i++ {
+    next := NewULID(at)
+    if next <= previous || next[:10] != previous[:10] {
+      t.Fatalf("the ULID %s is issued after %s", next, previous)
+    }
+
+    previous = next
+  }
+}
+
+func TestParseULID(t *testing.T) {
+  tests := map[string]string{
+    "01HV3K8Z4X6N7Q2R5T9W0YBCDE":  "01HV3K8Z4X6N7Q2R5T9W0YBCDE",
+    "01hv3k8z4x6n7q2r5t9w0ybcde":  "01HV3K8Z4X6N7Q2R5T9W0YBCDE",
+    "7ZZZZZZZZZZZZZZZZZZZZZZZZZ":  "7ZZZZZZZZZZZZZZZZZZZZZZZZZ",
+    "8ZZZZZZZZZZZZZZZZZZZZZZZZZ":  "",
+    "01HV3K8Z4X6N7Q2R5T9W0YBCDU":  "",
+    "01HV3K8Z4X6N7Q2R5T9W0YBCD":   "",
+    "01HV3K8Z4X6N7Q2R5T9W0YBCDEF": "",
+    "42":                          "",
+  }
+
+  for value, want := range tests {
+    parsed, ok := ParseULID(value)
+    if parsed != want || ok != (want != "") {
+      t.Errorf("ParseULID(%q) = %q, %t, want %q", value, parsed, ok, want)
+    }
+  }
+}
+
+// the migration 0012 gives the users created before it a public id dated from
+// their creation
+func TestAssignPublicIds(t *testing.T) {
+  r := newTestSQLiteRepository(t)
+
+  migrations, err := r.MigrationStatus()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err = r.MigrateDown(len(migrations) - 11); err != nil {
+    t.Fatal(err)
+  }
+
+  createdAt := time.Date(2024, 4, 2, 10, 0, 0, 0, time.UTC)
+  if _, err = r.DB.Exec(`INSERT INTO "user" (firstname, lastname, address, phone, created_at, updated_at) VALUES ('Guillaume', 'Penaud', '', '', ?, ?)`, createdAt, createdAt); err != nil {
+    t.Fatal(err)
+  }
+
+  if _, err = r.MigrateUp(); err != nil {
+    t.Fatal(err)
+  }
+
+  n := User{Id: 1}
+  if err = r.GetUser(&n); err != nil {
+    t.Fatal(err)
+  }
+
+  if _, ok := ParseULID(n.PublicId); !ok || !ulidTime(n.PublicId).Equal(createdAt) {
+    t.Errorf("the migrated user has the public id %q", n.PublicId)
+  }
+  if id, err := r.UserIdOf(n.PublicId); err != nil || id != 1 {
+    t.Errorf("UserIdOf(%s) = %d, %v", n.PublicId, id, err)
+  }
+}
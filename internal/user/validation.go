@@ -0,0 +1,147 @@
+package user
+
+import (
+  errors  "errors"
+  fmt     "fmt"
+  regexp  "regexp"
+  strings "strings"
+  utf8    "unicode/utf8"
+)
+
+// -------------------------------------------------------------------------- //
+// 1. Validation rules
+// -------------------------------------------------------------------------- //
+
+// Violation describes why one field of a payload was rejected
+type Violation struct {
+  Field   string `json:"field"`
+  Code    string `json:"code"`
+  Message string `json:"message"`
+}
+
+// Rule declares the constraints of one User field. MaxLength follows the
+// VARCHAR columns of the schema and is counted in characters.
+type Rule struct {
+  Field     string
+  Value     func(n *User) string
+  Required  bool
+  MaxLength int
+  Pattern   *regexp.Regexp
+  Allowed   string // describes Pattern in violation messages
+}
+
+var namePattern    = regexp.MustCompile(`^[\p{L}\p{M}' .-]*$`)
+var phonePattern   = regexp.MustCompile(`^\+?[0-9 ().-]*$`)
+var textPattern    = regexp.MustCompile(`^[^\p{C}]*$`)
+var postalPattern  = regexp.MustCompile(`^[0-9A-Za-z -]*$`)
+var countryPattern = regexp.MustCompile(`^([A-Za-z]{2})?$`)
+
+var UserRules = []Rule{
+  {
+    Field: "firstname", Value: func(n *User) string { return n.Firstname },
+    Required: true, MaxLength: 100, Pattern: namePattern, Allowed: "letters, spaces, apostrophes, dots and hyphens",
+  },
+  {
+    Field: "lastname", Value: func(n *User) string { return n.Lastname },
+    Required: true, MaxLength: 100, Pattern: namePattern, Allowed: "letters, spaces, apostrophes, dots and hyphens",
+  },
+  {
+    Field: "address", Value: func(n *User) string { return n.Address },
+    MaxLength: 320, Pattern: textPattern, Allowed: "printable characters",
+  },
+  {
+    Field: "addressline1", Value: func(n *User) string { return n.PostalAddress.Line1 },
+    MaxLength: 100, Pattern: textPattern, Allowed: "printable characters",
+  },
+  {
+    Field: "addressline2", Value: func(n *User) string { return n.PostalAddress.Line2 },
+    MaxLength: 100, Pattern: textPattern, Allowed: "printable characters",
+  },
+  {
+    Field: "postalcode", Value: func(n *User) string { return n.PostalAddress.PostalCode },
+    MaxLength: 10, Pattern: postalPattern, Allowed: "letters, digits, spaces and hyphens",
+  },
+  {
+    Field: "city", Value: func(n *User) string { return n.PostalAddress.City },
+    MaxLength: 100, Pattern: textPattern, Allowed: "printable characters",
+  },
+  {
+    Field: "countrycode", Value: func(n *User) string { return n.PostalAddress.CountryCode },
+    Pattern: countryPattern, Allowed: "a two letters ISO 3166 country code",
+  },
+  {
+    Field: "phone", Value: func(n *User) string { return n.Phone },
+    MaxLength: 100, Pattern: phonePattern, Allowed: "digits, spaces, dots, hyphens, parentheses and a leading +",
+  },
+  {
+    Field: "email", Value: func(n *User) string { return n.Email },
+    MaxLength: 254, Pattern: textPattern, Allowed: "printable characters",
+  },
+}
+
+// -------------------------------------------------------------------------- //
+// 2. Validation
+// -------------------------------------------------------------------------- //
+
+func (r Rule) check(n *User) *Violation {
+  value := r.Value(n)
+
+  if r.Required && strings.TrimSpace(value) == "" {
+    return &Violation{Field: r.Field, Code: "required", Message: fmt.Sprintf("%s is required", r.Field)}
+  }
+
+  if r.MaxLength > 0 && utf8.RuneCountInString(value) > r.MaxLength {
+    return &Violation{Field: r.Field, Code: "too_long", Message: fmt.Sprintf("%s must not exceed %d characters", r.Field, r.MaxLength)}
+  }
+
+  if r.Pattern != nil && !r.Pattern.MatchString(value) {
+    return &Violation{Field: r.Field, Code: "invalid_characters", Message: fmt.Sprintf("%s may only contain %s", r.Field, r.Allowed)}
+  }
+
+  return nil
+}
+
+// Validate checks the user, as it would be stored, against UserRules and
+// returns a validation *Error listing every violation, or nil when the user
+// is valid
+func (n *User) Validate() error {
+  violations := []Violation{}
+  rejected   := map[string]bool{}
+
+  stored := *n
+  if err := stored.normalize(); err != nil {
+    var userErr *Error
+    if !errors.As(err, &userErr) || userErr.Kind != KindValidation {
+      return err
+    }
+
+    for _, violation := range userErr.Violations {
+      violations = append(violations, violation)
+      rejected[violation.Field] = true
+    }
+  }
+
+  for _, rule := range UserRules {
+    if rejected[rule.Field] {
+      continue
+    }
+
+    if violation := rule.check(&stored); violation != nil {
+      violations = append(violations, *violation)
+    }
+  }
+
+  if len(violations) > 0 {
+    return InvalidUserError(violations...)
+  }
+
+  return nil
+}
+
+func InvalidUserError(violations ...Violation) *Error {
+  return &Error{Kind: KindValidation, Code: "invalid_user", Message: "the user is invalid", Violations: violations}
+}
+
+func UnknownFieldViolation(field string) Violation {
+  return Violation{Field: field, Code: "unknown_field", Message: fmt.Sprintf("%s is not a user field", field)}
+}
@@ -0,0 +1,60 @@
+package user
+
+import (
+  reflect "reflect"
+  strings "strings"
+  testing "testing"
+)
+
+func TestValidate(t *testing.T) {
+  tests := []struct {
+    user User
+    want []string // field:code of the violations
+  }{
+    {User{Firstname: "Guillaume", Lastname: "Penaud"}, nil},
+    {User{Firstname: "Jean-Loïc", Lastname: "d'Arc-Müller Jr."}, nil},
+    {User{Firstname: " ", Lastname: ""}, []string{"firstname:required", "lastname:required"}},
+    {User{Firstname: strings.Repeat("é", 101), Lastname: "Penaud"}, []string{"firstname:too_long"}},
+    {User{Firstname: strings.Repeat("é", 100), Lastname: "Penaud"}, nil},
+    {User{Firstname: "Guillaume<script>", Lastname: "Penaud2"}, []string{"firstname:invalid_characters", "lastname:invalid_characters"}},
+    {User{Firstname: "Guillaume", Lastname: "Penaud", Address: "10 route\x00de Rhye"}, []string{"address:invalid_characters", "addressline1:invalid_characters"}},
+    {User{Firstname: "Guillaume", Lastname: "Penaud", PostalAddress: PostalAddress{CountryCode: "FRA"}}, []string{"countrycode:invalid_characters"}},
+    {User{Firstname: "Guillaume", Lastname: "Penaud", Phone: "call me"}, []string{"phone:invalid_phone"}},
+    {User{Firstname: "Guillaume", Lastname: "Penaud", Email: "guillaume"}, []string{"email:invalid_email"}},
+    {User{Firstname: "", Lastname: "Penaud", Email: "guillaume"}, []string{"email:invalid_email", "firstname:required"}},
+  }
+
+  for _, test := range tests {
+    err := test.user.Validate()
+
+    var got []string
+    if err != nil {
+      userErr, ok := err.(*Error)
+      if !ok || userErr.Code != "invalid_user" {
+        t.Errorf("Validate(%+v) = %v, want an invalid_user error", test.user, err)
+        continue
+      }
+
+      for _, violation := range userErr.Violations {
+        got = append(got, violation.Field+":"+violation.Code)
+      }
+    }
+
+    if !reflect.DeepEqual(got, test.want) {
+      t.Errorf("Validate(%+v) = %v, want %v", test.user, got, test.want)
+    }
+  }
+}
+
+// Validate checks a copy of the user, the payload being normalized on write
+func TestValidateKeepsTheUser(t *testing.T) {
+  n := User{Firstname: "Guillaume", Lastname: "Penaud", Phone: "06 45 12 43 65", Email: "Guillaume@Example.com"}
+  original := n
+
+  if err := n.Validate(); err != nil {
+    t.Fatal(err)
+  }
+  if n != original {
+    t.Errorf("Validate changed the user into %+v", n)
+  }
+}
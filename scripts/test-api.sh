@@ -1,6 +1,6 @@
 #! /usr/bin/env sh
 
-options=$(getopt -o qlfcud -l query,list,fetch,create,update,delete -- "$@")
+options=$(getopt -o qlfcupd -l query,list,fetch,create,update,patch,delete -- "$@")
 
 [ $? -eq 0 ] || {
   echo "Incorrect options provided"
@@ -23,6 +23,7 @@ while true; do
     -f|--fetch)  action="fetch"  ;;
     -c|--create) action="create" ;;
     -u|--update) action="update" ;;
+    -p|--patch)  action="patch"  ;;
     -d|--delete) action="delete" ;;
     # *)           action="all"    ;;
     --) shift; break ;;
@@ -57,17 +58,25 @@ create () {
 update () {
   printf "${COLOR_TEST}\nUPDATE TEST\n-----------${COLOR_RESET}\n"
   if [ "${log_query}" = "true" ]; then
-    echo "DEBUG: curl -i -X POST -d '{\"firstname\":\"Oceane\", \"lastname\":\"Cyclette\", \"address\":\"10 allée de la gadoue 78340 Torpes\", \"phone\":\"0745908978\"}' http://localhost:8010/user"
+    echo "DEBUG: curl -i -H \"Content-Type: application/json\" -X PUT -d '{\"firstname\":\"Oceane\", \"lastname\":\"Cyclette\", \"address\":\"12 allée de la gadoue 78340 Torpes\", \"phone\":\"0745908978\"}' http://localhost:8010/user/3"
   fi
-  curl -i -X POST -d '{"firstname":"Oceane", "lastname":"Cyclette", "address":"10 allée de la gadoue 78340 Torpes", "phone":"0745908978"}' http://localhost:8010/user && printf "\n"
+  curl -i -H "Content-Type: application/json" -X PUT -d '{"firstname":"Oceane", "lastname":"Cyclette", "address":"12 allée de la gadoue 78340 Torpes", "phone":"0745908978"}' http://localhost:8010/user/3 && printf "\n"
+}
+
+patch () {
+  printf "${COLOR_TEST}\nPATCH TEST\n----------${COLOR_RESET}\n"
+  if [ "${log_query}" = "true" ]; then
+    echo "DEBUG: curl -i -H \"Content-Type: application/merge-patch+json\" -X PATCH -d '{\"phone\":\"0745908979\"}' http://localhost:8010/user/3"
+  fi
+  curl -i -H "Content-Type: application/merge-patch+json" -X PATCH -d '{"phone":"0745908979"}' http://localhost:8010/user/3 && printf "\n"
 }
 
 delete () {
   printf "${COLOR_TEST}\nDELETE TEST\n-----------${COLOR_RESET}\n"
   if [ "${log_query}" = "true" ]; then
-    echo "DEBUG: curl -i -X DELETE http://localhost:8010/user/Oceane/Cyclette"
+    echo "DEBUG: curl -i -X DELETE http://localhost:8010/user/3"
   fi
-  curl -i -X DELETE http://localhost:8010/user/Oceane/Cyclette && printf "\n"
+  curl -i -X DELETE http://localhost:8010/user/3 && printf "\n"
 }
 
 if [ "${action}" = "list" ]; then
@@ -78,6 +87,8 @@ elif [ "${action}" = "create" ]; then
   create
 elif [ "${action}" = "update" ]; then
   update
+elif [ "${action}" = "patch" ]; then
+  patch
 elif [ "${action}" = "delete" ]; then
   delete
 else
@@ -85,6 +96,7 @@ else
   fetch
   create
   update
+  patch
   delete
 fi
 